@@ -0,0 +1,131 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	VerificationPassed = "Passed"
+	VerificationFailed = "Failed"
+)
+
+type BackupVerificationSpec struct {
+	// ClusterName is the PostgresCluster whose latest completed backup is
+	// verified.
+	// +kubebuilder:validation:MinLength=1
+	ClusterName string `json:"clusterName"`
+
+	// Interval between two restore drills, at least an hour: each drill
+	// restores a whole cluster.
+	// +kubebuilder:default="24h"
+	// +kubebuilder:validation:XValidation:rule="duration(self) >= duration('1h')",message="interval must be at least 1h"
+	// +optional
+	Interval metav1.Duration `json:"interval,omitempty"`
+
+	// Timeout fails a drill that has not finished restoring and checking
+	// the backup in time.
+	// +kubebuilder:default="2h"
+	// +optional
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+
+	// +optional
+	Checks VerificationChecks `json:"checks,omitempty"`
+}
+
+type VerificationChecks struct {
+	// Amcheck runs pg_amcheck against every database of the restored
+	// cluster to detect corrupted tables and indexes.
+	// +kubebuilder:default=true
+	// +optional
+	Amcheck *bool `json:"amcheck,omitempty"`
+
+	// SQL queries run against the restored cluster.
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	SQL []SQLCheck `json:"sql,omitempty"`
+}
+
+type SQLCheck struct {
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+	// Database defaults to postgres.
+	// +optional
+	Database string `json:"database,omitempty"`
+	// +kubebuilder:validation:MinLength=1
+	Query string `json:"query"`
+	// Expected is compared to the first column of the first row returned
+	// by the query. The check only requires the query to succeed when unset.
+	// +optional
+	Expected *string `json:"expected,omitempty"`
+}
+
+type BackupVerificationStatus struct {
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// ActiveDrill is the drill in progress, if any.
+	// +optional
+	ActiveDrill *RestoreDrill `json:"activeDrill,omitempty"`
+
+	LastDrillTime *metav1.Time `json:"lastDrillTime,omitempty"`
+	// LastBackup is the PostgresBackup verified by the last drill.
+	LastBackup    string       `json:"lastBackup,omitempty"`
+	LastResult    string       `json:"lastResult,omitempty"`
+	NextDrillTime *metav1.Time `json:"nextDrillTime,omitempty"`
+}
+
+type RestoreDrill struct {
+	// ClusterName is the ephemeral PostgresCluster the backup is restored
+	// into.
+	ClusterName string      `json:"clusterName"`
+	BackupName  string      `json:"backupName"`
+	StartedAt   metav1.Time `json:"startedAt"`
+	// RestoredAt is when the ephemeral cluster finished recovery.
+	RestoredAt *metav1.Time `json:"restoredAt,omitempty"`
+}
+
+// BackupVerificationResult is the outcome of the last restore drill of a
+// backup.
+type BackupVerificationResult struct {
+	Result string      `json:"result"`
+	Time   metav1.Time `json:"time"`
+	// RestoreDuration is how long restoring the backup took, from the
+	// creation of the ephemeral cluster to the end of recovery.
+	RestoreDuration *metav1.Duration `json:"restoreDuration,omitempty"`
+	Message         string           `json:"message,omitempty"`
+	// +optional
+	Checks []CheckResult `json:"checks,omitempty"`
+}
+
+type CheckResult struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.clusterName`
+// +kubebuilder:printcolumn:name="Last Backup",type=string,JSONPath=`.status.lastBackup`
+// +kubebuilder:printcolumn:name="Result",type=string,JSONPath=`.status.lastResult`
+// +kubebuilder:printcolumn:name="Next Drill",type=date,JSONPath=`.status.nextDrillTime`
+type BackupVerification struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BackupVerificationSpec   `json:"spec,omitempty"`
+	Status BackupVerificationStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+type BackupVerificationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitzero"`
+	Items           []BackupVerification `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&BackupVerification{}, &BackupVerificationList{})
+}
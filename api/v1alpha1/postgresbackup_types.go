@@ -0,0 +1,99 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	BackupPhasePending   = "Pending"
+	BackupPhaseRunning   = "Running"
+	BackupPhaseCompleted = "Completed"
+	BackupPhaseFailed    = "Failed"
+	// BackupPhaseExpired is set once the retention policy of the cluster
+	// removed the backup from the object store.
+	BackupPhaseExpired = "Expired"
+)
+
+const (
+	// BackupMethodBaseBackup streams the data with pg_basebackup to the
+	// object store of the cluster.
+	BackupMethodBaseBackup = "basebackup"
+	// BackupMethodVolumeSnapshot takes CSI VolumeSnapshots of the volumes
+	// of the primary between pg_backup_start and pg_backup_stop.
+	BackupMethodVolumeSnapshot = "volumeSnapshot"
+)
+
+type PostgresBackupSpec struct {
+	// ClusterName is the PostgresCluster to back up. It must have
+	// spec.backup.objectStore configured.
+	// +kubebuilder:validation:MinLength=1
+	ClusterName string `json:"clusterName"`
+
+	// +kubebuilder:validation:Enum=basebackup;volumeSnapshot
+	// +kubebuilder:default=basebackup
+	// +optional
+	Method string `json:"method,omitempty"`
+
+	// VolumeSnapshotClassName is used for the snapshots of the volumeSnapshot
+	// method. The default class of the CSI driver is used when unset.
+	// +optional
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
+}
+
+type PostgresBackupStatus struct {
+	Phase string `json:"phase,omitempty"`
+
+	// BackupID identifies the backup in the object store.
+	BackupID string `json:"backupID,omitempty"`
+	// DestinationPath is the object store prefix of the cluster archive.
+	DestinationPath string `json:"destinationPath,omitempty"`
+
+	Timeline int    `json:"timeline,omitempty"`
+	BeginLSN string `json:"beginLSN,omitempty"`
+	EndLSN   string `json:"endLSN,omitempty"`
+	BeginWAL string `json:"beginWAL,omitempty"`
+	EndWAL   string `json:"endWAL,omitempty"`
+
+	StartedAt *metav1.Time `json:"startedAt,omitempty"`
+	StoppedAt *metav1.Time `json:"stoppedAt,omitempty"`
+
+	// Snapshots are the VolumeSnapshots of a volumeSnapshot backup, one per
+	// volume of the primary.
+	Snapshots []string `json:"snapshots,omitempty"`
+	// BackupLabel is returned by pg_backup_stop and written back into
+	// PGDATA when a volume is restored from the snapshots.
+	BackupLabel string `json:"backupLabel,omitempty"`
+
+	Error string `json:"error,omitempty"`
+
+	// Verification is the result of the last restore drill of the backup,
+	// see BackupVerification.
+	// +optional
+	Verification *BackupVerificationResult `json:"verification,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.clusterName`
+// +kubebuilder:printcolumn:name="Method",type=string,JSONPath=`.spec.method`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Verified",type=string,JSONPath=`.status.verification.result`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type PostgresBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PostgresBackupSpec   `json:"spec,omitempty"`
+	Status PostgresBackupStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+type PostgresBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitzero"`
+	Items           []PostgresBackup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PostgresBackup{}, &PostgresBackupList{})
+}
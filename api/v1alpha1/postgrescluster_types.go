@@ -1,35 +1,524 @@
 package v1alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// Fields left empty default to one instance, 1Gi of storage and PostgreSQL
+// 15 in the CRD, and to a <name>-superuser Secret generated by the operator
+// in the mutating webhook.
+//
+// The rules below only compare with the old object, the API server skips
+// them on create. A missing superuserSecretName may still be filled in for
+// clusters created before it was defaulted.
+// +kubebuilder:validation:XValidation:rule="!has(oldSelf.version) || !has(self.version) || int(self.version.find('^[0-9]+')) >= int(oldSelf.version.find('^[0-9]+'))",message="the major version of PostgreSQL can not be decreased"
+// +kubebuilder:validation:XValidation:rule="!has(oldSelf.superuserSecretName) || has(self.superuserSecretName) && self.superuserSecretName == oldSelf.superuserSecretName",message="superuserSecretName is immutable"
+// +kubebuilder:validation:XValidation:rule="has(self.databaseName) == has(oldSelf.databaseName) && (!has(self.databaseName) || self.databaseName == oldSelf.databaseName)",message="databaseName is immutable"
 type PostgresClusterSpec struct {
-	Instances int32       `json:"instances"`
-	Version   string      `json:"version"`
-	Storage   StorageSpec `json:"storage"`
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=16
+	// +kubebuilder:default=1
+	// +optional
+	Instances int32 `json:"instances,omitempty"`
+	// Version is the tag of the postgres image, e.g. 16, 16.4 or 16-alpine.
+	// Its major version can not be decreased.
+	// +kubebuilder:validation:Pattern=`^[0-9]+(\.[0-9]+)?(-[a-z0-9.]+)?$`
+	// +kubebuilder:validation:MaxLength=32
+	// +kubebuilder:default="15"
+	// +optional
+	Version string `json:"version,omitempty"`
+	// +kubebuilder:default={}
+	// +optional
+	Storage StorageSpec `json:"storage,omitempty"`
+	// SuperuserSecretName is a Secret with the password of the postgres
+	// user. It must exist unless it is the default <name>-superuser, which
+	// the operator generates. It can not be changed.
 	// +kubebuilder:validation:MinLength=1
-	SuperuserSecretName string `json:"superuserSecretName"`
-	DatabaseName        string `json:"databaseName,omitempty"`
-	AppUser             string `json:"appUser,omitempty"`
+	// +kubebuilder:validation:MaxLength=253
+	// +optional
+	SuperuserSecretName string `json:"superuserSecretName,omitempty"`
+	// DatabaseName is the database created for the application. It can not
+	// be changed.
+	// +kubebuilder:validation:MaxLength=63
+	// +optional
+	DatabaseName string `json:"databaseName,omitempty"`
+	AppUser      string `json:"appUser,omitempty"`
+
+	// Backup configures continuous WAL archiving.
+	// +optional
+	Backup *BackupSpec `json:"backup,omitempty"`
+
+	// Bootstrap configures how the data of a new cluster is initialized.
+	// It is only honoured when the cluster is created.
+	// +optional
+	Bootstrap *BootstrapSpec `json:"bootstrap,omitempty"`
+
+	// ReplicaBootstrap configures how the volumes of new replicas are
+	// provisioned.
+	// +optional
+	ReplicaBootstrap *ReplicaBootstrapSpec `json:"replicaBootstrap,omitempty"`
+
+	// DeletionPolicy decides what happens to the data volumes when the
+	// cluster is deleted: Retain leaves them, Delete removes them and
+	// Snapshot takes a VolumeSnapshot of each before removing it.
+	// +kubebuilder:validation:Enum=Delete;Retain;Snapshot
+	// +kubebuilder:default=Retain
+	// +optional
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+
+	// FinalBackup takes a base backup before the cluster is torn down on
+	// deletion. It requires spec.backup.objectStore.
+	// +optional
+	FinalBackup bool `json:"finalBackup,omitempty"`
+
+	// DeletionProtection makes the validating webhook reject the deletion
+	// of the cluster. Changing it requires the
+	// databases.atlasdb.io/confirm-deletion-protection-change annotation.
+	// +optional
+	DeletionProtection bool `json:"deletionProtection,omitempty"`
+
+	// Probes tunes the health checks of the instances.
+	// +optional
+	Probes *ProbesSpec `json:"probes,omitempty"`
+
+	// MajorUpgrade configures how the data moves to a new major version
+	// of spec.version.
+	// +optional
+	MajorUpgrade *MajorUpgradeSpec `json:"majorUpgrade,omitempty"`
+
+	// MaintenanceWindow restricts the disruptive operations, restarts,
+	// switchovers, upgrades and volume resizes, to the times it opens.
+	// Unset, they run as soon as they are reconciled.
+	// +optional
+	MaintenanceWindow *MaintenanceWindowSpec `json:"maintenanceWindow,omitempty"`
+
+	// Hibernation "on" shuts the instances down and keeps their data
+	// volumes, "off" keeps them running even while hibernationSchedule is
+	// open. Unset, hibernationSchedule decides. YAML reads on and off
+	// unquoted as booleans.
+	// +kubebuilder:validation:Enum=on;off
+	// +optional
+	Hibernation string `json:"hibernation,omitempty"`
+
+	// HibernationSchedule hibernates the cluster while one of its windows
+	// is open, e.g. at night and over the weekend. Its windows are written
+	// like those of maintenanceWindow.
+	// +optional
+	HibernationSchedule *MaintenanceWindowSpec `json:"hibernationSchedule,omitempty"`
+}
+
+// ConfirmDeletionProtectionChangeAnnotation has to be set to "true" in the
+// same update that changes spec.deletionProtection. The operator removes it
+// afterwards so that every change needs a new confirmation.
+const ConfirmDeletionProtectionChangeAnnotation = "databases.atlasdb.io/confirm-deletion-protection-change"
+
+// RestartAnnotation restarts every instance, the primary last, whenever its
+// value changes, e.g. to the current time.
+const RestartAnnotation = "databases.atlasdb.io/restart"
+
+// RollbackUpgradeAnnotation sends the clients of a cluster switched over to
+// the target of a blue/green major upgrade back to the cluster, and makes
+// it writable again. The operator removes it once done.
+const RollbackUpgradeAnnotation = "databases.atlasdb.io/rollback-upgrade"
+
+// MaintenanceOverrideAnnotation runs the disruptive operations queued for
+// the maintenance window, and those of changes made while it is set, right
+// away. The operator removes it once the cluster is ready with no operation
+// pending.
+const MaintenanceOverrideAnnotation = "databases.atlasdb.io/maintenance-override"
+
+// ReconciliationPausedAnnotation set to "true" stops the operator from
+// changing anything about the cluster, except for fencing, and from
+// starting the Jobs of its backups, dumps, restores and operations. The
+// status is still updated.
+const ReconciliationPausedAnnotation = "databases.atlasdb.io/reconciliation-paused"
+
+// FencedInstancesAnnotation lists the instances, by the names of their
+// pods separated by commas, or * for all of them, PostgreSQL is stopped on.
+// Their pods and data volumes are kept.
+const FencedInstancesAnnotation = "databases.atlasdb.io/fenced-instances"
+
+// RecloneInstanceAnnotation names the instance, by the name of its pod,
+// whose data volume is deleted and recreated from the primary or from the
+// latest snapshot backup, e.g. when it is corrupt. The primary is not
+// re-cloned. The operator removes the annotation once done, see
+// status.reclone.
+const RecloneInstanceAnnotation = "databases.atlasdb.io/reclone-instance"
+
+const (
+	RecloneDeletingVolume = "DeletingVolume"
+	RecloneCloning        = "Cloning"
+	RecloneSucceeded      = "Succeeded"
+	RecloneFailed         = "Failed"
+)
+
+const (
+	HibernationOn  = "on"
+	HibernationOff = "off"
+)
+
+const (
+	DeletionPolicyDelete   = "Delete"
+	DeletionPolicyRetain   = "Retain"
+	DeletionPolicySnapshot = "Snapshot"
+)
+
+type ProbesSpec struct {
+	// StartupTimeoutSeconds is how long an instance may take to accept
+	// connections after its container starts, which includes cloning a
+	// new replica and crash recovery. Defaults to 3600.
+	// +kubebuilder:validation:Minimum=10
+	// +optional
+	StartupTimeoutSeconds *int32 `json:"startupTimeoutSeconds,omitempty"`
+
+	// MaxReplicationLag is how far a replica may fall behind the primary,
+	// in bytes of WAL such as 64Mi, and still be ready. A replica that does
+	// not stream from the primary is not ready either. Unset, replicas are
+	// ready as soon as they accept connections.
+	// +optional
+	MaxReplicationLag *resource.Quantity `json:"maxReplicationLag,omitempty"`
+}
+
+const (
+	MajorUpgradeInPlace   = "InPlace"
+	MajorUpgradeBlueGreen = "BlueGreen"
+)
+
+type MajorUpgradeSpec struct {
+	// Method is InPlace, pg_upgrade on the data volumes while the
+	// instances are down, or BlueGreen, a new cluster on the new version
+	// fed by logical replication, which the clients are switched over to.
+	// +kubebuilder:validation:Enum=InPlace;BlueGreen
+	// +kubebuilder:default=InPlace
+	// +optional
+	Method string `json:"method,omitempty"`
+
+	// MaxSwitchoverLag is how far, in bytes of WAL, the logical
+	// replication into the new cluster of a blue/green upgrade may be
+	// behind for the clients to be switched over. Defaults to 16Mi.
+	// +optional
+	MaxSwitchoverLag *resource.Quantity `json:"maxSwitchoverLag,omitempty"`
+}
+
+type MaintenanceWindowSpec struct {
+	// TimeZone the windows are in, an IANA name such as Europe/Berlin.
+	// Defaults to UTC.
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// Windows the disruptive operations may run in. They may overlap.
+	// +kubebuilder:validation:MinItems=1
+	Windows []MaintenanceWindow `json:"windows"`
+}
+
+// MaintenanceWindow opens on some days of the week at the same time.
+type MaintenanceWindow struct {
+	// Days the window opens on, in the syntax of the day of week field of
+	// cron: days or ranges of days such as Mon-Fri or Sat,Sun, 0 and 7
+	// being Sunday, or * for every day.
+	// +kubebuilder:default="*"
+	// +optional
+	Days string `json:"days,omitempty"`
+
+	// Start is the time of day the window opens, HH:MM.
+	// +kubebuilder:validation:Pattern=`^([01][0-9]|2[0-3]):[0-5][0-9]$`
+	Start string `json:"start"`
+
+	// Duration the window stays open, such as 2h or 90m.
+	Duration metav1.Duration `json:"duration"`
 }
 
 type StorageSpec struct {
-	Size string `json:"size"`
+	// Size of the data volume of every instance, a quantity such as 10Gi.
+	// It can not be decreased.
+	// +kubebuilder:validation:Pattern=`^([0-9]+(\.[0-9]*)?|\.[0-9]+)([KMGTPE]i|[kMGTPE]|[eE][0-9]+)?$`
+	// +kubebuilder:default="1Gi"
+	// +optional
+	Size string `json:"size,omitempty"`
+	// StorageClassName of the data volumes. The default class of the
+	// Kubernetes cluster is used when empty. It can not be changed.
+	// +optional
+	StorageClassName string `json:"storageClassName,omitempty"`
+}
+
+type BackupSpec struct {
+	// ObjectStore is the S3-compatible bucket WAL segments are archived to.
+	// +optional
+	ObjectStore *ObjectStoreSpec `json:"objectStore,omitempty"`
+
+	// RetentionPolicy prunes base backups and WAL from the object store.
+	// Either a recovery window (30d, 4w) or keep-last-N. Backups are kept
+	// forever when unset.
+	// +kubebuilder:validation:Pattern=`^([1-9][0-9]*[dw]|keep-last-[1-9][0-9]*)$`
+	// +optional
+	RetentionPolicy string `json:"retentionPolicy,omitempty"`
+}
+
+type ObjectStoreSpec struct {
+	// Endpoint is the URL of the S3 API, e.g. https://s3.amazonaws.com
+	// or http://minio.minio.svc:9000.
+	// +kubebuilder:validation:MinLength=1
+	Endpoint string `json:"endpoint"`
+	// +kubebuilder:validation:MinLength=1
+	Bucket string `json:"bucket"`
+	// Path is the key prefix inside the bucket. Defaults to
+	// <namespace>/<cluster name>.
+	// +optional
+	Path string `json:"path,omitempty"`
+	// +optional
+	Region string `json:"region,omitempty"`
+	// CredentialsSecretName is a Secret with the accessKeyId and
+	// secretAccessKey keys.
+	// +kubebuilder:validation:MinLength=1
+	CredentialsSecretName string `json:"credentialsSecretName"`
+}
+
+type BootstrapSpec struct {
+	// Recovery restores a base backup and replays archived WAL up to the
+	// target before the cluster is promoted.
+	// +optional
+	Recovery *RecoverySpec `json:"recovery,omitempty"`
+}
+
+// +kubebuilder:validation:XValidation:rule="has(self.source.path)",message="source.path is required, the archive of the source cluster is not found from the name of the new one"
+type RecoverySpec struct {
+	// Source is the archive of the cluster to recover from. It may belong
+	// to a cluster in another namespace, the credentials Secret has to
+	// exist in the namespace of the new cluster. Its path is required: it
+	// is the archive path of the source cluster, <namespace>/<cluster
+	// name> unless that one sets another.
+	Source ObjectStoreSpec `json:"source"`
+	// BackupID selects the base backup to start from. By default the latest
+	// backup completed before the target is used.
+	// +optional
+	BackupID string `json:"backupID,omitempty"`
+	// VolumeSnapshots restores the volumes from the snapshots of a
+	// volumeSnapshot PostgresBackup in the same namespace instead of
+	// downloading a base backup. WAL is still replayed from source.
+	// +optional
+	VolumeSnapshots *VolumeSnapshotsSource `json:"volumeSnapshots,omitempty"`
+	// Target stops recovery at a given point. Without it all archived WAL
+	// is replayed.
+	// +optional
+	Target *RecoveryTarget `json:"target,omitempty"`
+}
+
+type VolumeSnapshotsSource struct {
+	// BackupName is a completed PostgresBackup with method volumeSnapshot.
+	// +kubebuilder:validation:MinLength=1
+	BackupName string `json:"backupName"`
+}
+
+type ReplicaBootstrapSpec struct {
+	// VolumeSnapshot provisions the volume of a new replica from the latest
+	// completed volumeSnapshot backup of the cluster. The replica then
+	// only has to replay the WAL written since the backup, from the
+	// archive and from the primary.
+	// +optional
+	VolumeSnapshot bool `json:"volumeSnapshot,omitempty"`
+}
+
+// RecoveryTarget mirrors the recovery_target_* settings of PostgreSQL.
+// At most one of time, lsn, xid and name may be set.
+type RecoveryTarget struct {
+	// +kubebuilder:validation:Format=date-time
+	// +optional
+	Time string `json:"time,omitempty"`
+	// +optional
+	LSN string `json:"lsn,omitempty"`
+	// +optional
+	XID string `json:"xid,omitempty"`
+	// Name is a restore point created with pg_create_restore_point().
+	// +optional
+	Name string `json:"name,omitempty"`
+	// Exclusive stops just before the target instead of just after it.
+	// +optional
+	Exclusive bool `json:"exclusive,omitempty"`
 }
 
 type PostgresClusterStatus struct {
+	// ObservedGeneration is the generation of the spec the status, and
+	// the Ready condition in particular, was computed for.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
 	Phase string `json:"phase,omitempty"`
 
+	// ReadyInstances is the number of instances passing their readiness
+	// probe.
+	// +optional
+	ReadyInstances int32 `json:"readyInstances,omitempty"`
+	// CurrentPrimary is the pod running the primary instance.
+	// +optional
+	CurrentPrimary string `json:"currentPrimary,omitempty"`
+	// TargetPrimary is the instance being promoted by a switchover, empty
+	// when none is in progress.
+	// +optional
+	TargetPrimary string `json:"targetPrimary,omitempty"`
+	// Image is the PostgreSQL image the instances are rolled out with.
+	// +optional
+	Image string `json:"image,omitempty"`
+	// MajorVersion is the PostgreSQL major version the data of the
+	// instances was written by. It only changes once a major upgrade of
+	// the data succeeded.
+	// +optional
+	MajorVersion int32 `json:"majorVersion,omitempty"`
+	// Selector matches the pods of the instances. It backs the scale
+	// subresource together with instances and readyInstances.
+	// +optional
+	Selector string `json:"selector,omitempty"`
+
+	// BlueGreen is the state of a blue/green major upgrade.
+	// +optional
+	BlueGreen *BlueGreenStatus `json:"blueGreen,omitempty"`
+
+	// Reclone is the progress of the last re-clone of an instance, see
+	// RecloneInstanceAnnotation.
+	// +optional
+	Reclone *RecloneStatus `json:"reclone,omitempty"`
+
+	// PendingOperations are the disruptive operations waiting for the
+	// maintenance window to open.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	PendingOperations []PendingOperation `json:"pendingOperations,omitempty"`
+	// NextMaintenanceWindow is when the maintenance window opens next,
+	// set while operations are pending.
+	// +optional
+	NextMaintenanceWindow *metav1.Time `json:"nextMaintenanceWindow,omitempty"`
+
+	// Instances is the state of every instance, as reported by the
+	// instances themselves.
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	Instances []InstanceStatus `json:"instances,omitempty"`
+
 	// +listType=map
 	// +listMapKey=type
 	Conditions       []metav1.Condition `json:"conditions,omitempty"`
 	Endpoint         string             `json:"endpoint,omitempty"`
 	ConnectionSecret string             `json:"connectionSecret,omitempty"`
+
+	LastArchivedWAL     string       `json:"lastArchivedWAL,omitempty"`
+	LastArchivedWALTime *metav1.Time `json:"lastArchivedWALTime,omitempty"`
+	LastFailedWAL       string       `json:"lastFailedWAL,omitempty"`
+	LastFailedWALTime   *metav1.Time `json:"lastFailedWALTime,omitempty"`
+
+	// FirstRecoverabilityPoint is the earliest point in time the cluster
+	// can be recovered to with the backups kept in the object store.
+	FirstRecoverabilityPoint *metav1.Time `json:"firstRecoverabilityPoint,omitempty"`
+	// LastRecoverabilityPoint is the latest point in time covered by the
+	// backups and the archived WAL.
+	LastRecoverabilityPoint *metav1.Time `json:"lastRecoverabilityPoint,omitempty"`
+	LastSuccessfulBackup    string       `json:"lastSuccessfulBackup,omitempty"`
+}
+
+// BlueGreenStatus describes a blue/green major upgrade from the cluster to
+// a new one.
+type BlueGreenStatus struct {
+	// Target is the cluster on the new major version.
+	Target string `json:"target"`
+	// ReplicationLagBytes is how far the logical replication into target
+	// is behind the cluster.
+	// +optional
+	ReplicationLagBytes *int64 `json:"replicationLagBytes,omitempty"`
+	// SwitchedOver is set while the clients of the cluster are sent to
+	// target and the cluster is read-only.
+	// +optional
+	SwitchedOver bool `json:"switchedOver,omitempty"`
+}
+
+// RecloneStatus describes the re-clone of an instance on a new data
+// volume.
+type RecloneStatus struct {
+	// Instance is the name of the pod of the instance.
+	Instance string `json:"instance"`
+	// Phase is DeletingVolume, Cloning, Succeeded or Failed.
+	Phase string `json:"phase"`
+	// Source is the primary the instance is cloned from, or the snapshot
+	// backup its volume is restored from.
+	// +optional
+	Source string `json:"source,omitempty"`
+	// Message describes the phase.
+	// +optional
+	Message string `json:"message,omitempty"`
+	// StartTime is when the re-clone was requested.
+	StartTime metav1.Time `json:"startTime"`
+	// CompletionTime is when the re-clone succeeded or failed.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// PendingOperation is a disruptive operation deferred to the maintenance
+// window.
+type PendingOperation struct {
+	// Type is Restart, MinorUpgrade, Switchover, MajorUpgrade or
+	// VolumeResize.
+	Type string `json:"type"`
+	// Message describes the operation.
+	// +optional
+	Message string `json:"message,omitempty"`
+	// Since is when the operation was first deferred.
+	Since metav1.Time `json:"since"`
+}
+
+// InstanceStatus describes one instance of a cluster.
+type InstanceStatus struct {
+	// Name of the pod of the instance.
+	Name string `json:"name"`
+	// Role is primary or replica.
+	// +optional
+	Role string `json:"role,omitempty"`
+	// Ready reports whether the pod passes its readiness probe.
+	Ready bool `json:"ready"`
+	// Version is the version of the running PostgreSQL server.
+	// +optional
+	Version string `json:"version,omitempty"`
+	// +optional
+	Timeline int64 `json:"timeline,omitempty"`
+	// LSN is the current WAL position of the primary and the last replayed
+	// position of a replica.
+	// +optional
+	LSN string `json:"lsn,omitempty"`
+	// ReplicationLagBytes is the amount of WAL a replica has yet to replay
+	// to catch up with the primary.
+	// +optional
+	ReplicationLagBytes *int64 `json:"replicationLagBytes,omitempty"`
+	// PVC is the data volume of the instance.
+	// +optional
+	PVC string `json:"pvc,omitempty"`
+	// PVCSize is the capacity of the data volume.
+	// +optional
+	PVCSize *resource.Quantity `json:"pvcSize,omitempty"`
+	// +optional
+	RestartCount int32 `json:"restartCount,omitempty"`
+	// LastRestartTime is when PostgreSQL was last started in the pod.
+	// +optional
+	LastRestartTime *metav1.Time `json:"lastRestartTime,omitempty"`
+	// Fenced is set while PostgreSQL is stopped on the instance, see the
+	// databases.atlasdb.io/fenced-instances annotation.
+	// +optional
+	Fenced bool `json:"fenced,omitempty"`
+	// Error tells why the status of the instance could not be collected.
+	// +optional
+	Error string `json:"error,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:subresource:scale:specpath=.spec.instances,statuspath=.status.readyInstances,selectorpath=.status.selector
+// +kubebuilder:resource:shortName=pg;pgc
+// +kubebuilder:printcolumn:name="Instances",type=integer,JSONPath=`.spec.instances`
+// +kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.readyInstances`
+// +kubebuilder:printcolumn:name="Primary",type=string,JSONPath=`.status.currentPrimary`
+// +kubebuilder:printcolumn:name="Version",type=string,JSONPath=`.spec.version`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Image",type=string,JSONPath=`.status.image`,priority=1
+// +kubebuilder:printcolumn:name="Endpoint",type=string,JSONPath=`.status.endpoint`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 type PostgresCluster struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
@@ -0,0 +1,108 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Phases of PostgresDump and PostgresRestore, and of each of their
+// databases.
+const (
+	DumpPhasePending   = "Pending"
+	DumpPhaseRunning   = "Running"
+	DumpPhaseCompleted = "Completed"
+	DumpPhaseFailed    = "Failed"
+)
+
+type PostgresDumpSpec struct {
+	// ClusterName is the PostgresCluster to dump.
+	// +kubebuilder:validation:MinLength=1
+	ClusterName string `json:"clusterName"`
+
+	// Format of pg_dump: a single custom format archive per database, or
+	// a directory per database.
+	// +kubebuilder:validation:Enum=custom;directory
+	// +kubebuilder:default=custom
+	// +optional
+	Format string `json:"format,omitempty"`
+
+	// Databases to dump, one after the other. Defaults to the database of
+	// the cluster.
+	// +optional
+	Databases []string `json:"databases,omitempty"`
+
+	// Schemas restricts the dump to these schemas in every database.
+	// +optional
+	Schemas []string `json:"schemas,omitempty"`
+
+	Destination DumpDestination `json:"destination"`
+}
+
+// DumpDestination is where dumps are stored. Exactly one of its fields
+// must be set.
+type DumpDestination struct {
+	// PersistentVolumeClaim in the namespace of the dump.
+	// +optional
+	PersistentVolumeClaim *DumpVolume `json:"persistentVolumeClaim,omitempty"`
+	// ObjectStore stores the dumps under <path>/dumps/<dump name>/.
+	// +optional
+	ObjectStore *ObjectStoreSpec `json:"objectStore,omitempty"`
+}
+
+type DumpVolume struct {
+	// +kubebuilder:validation:MinLength=1
+	ClaimName string `json:"claimName"`
+	// SubPath is the directory of the volume the dumps are written to.
+	// +optional
+	SubPath string `json:"subPath,omitempty"`
+}
+
+type PostgresDumpStatus struct {
+	Phase string `json:"phase,omitempty"`
+	// Progress is the number of databases done out of the total, e.g. 1/3.
+	Progress string `json:"progress,omitempty"`
+
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	Databases []DatabaseDump `json:"databases,omitempty"`
+
+	StartedAt   *metav1.Time `json:"startedAt,omitempty"`
+	CompletedAt *metav1.Time `json:"completedAt,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+type DatabaseDump struct {
+	Name  string `json:"name"`
+	Phase string `json:"phase"`
+	// Location is the path of the dump on the volume, or its key in the
+	// object store.
+	Location string `json:"location,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.clusterName`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Progress",type=string,JSONPath=`.status.progress`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type PostgresDump struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PostgresDumpSpec   `json:"spec,omitempty"`
+	Status PostgresDumpStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+type PostgresDumpList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitzero"`
+	Items           []PostgresDump `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PostgresDump{}, &PostgresDumpList{})
+}
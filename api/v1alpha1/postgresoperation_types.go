@@ -0,0 +1,127 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	OperationPhasePending   = "Pending"
+	OperationPhaseRunning   = "Running"
+	OperationPhaseSucceeded = "Succeeded"
+	OperationPhaseFailed    = "Failed"
+)
+
+const (
+	// OperationTypeRestart restarts an instance, or every instance the
+	// way the RestartAnnotation does.
+	OperationTypeRestart = "restart"
+	// OperationTypeSwitchover makes a caught up replica the primary.
+	OperationTypeSwitchover = "switchover"
+	// OperationTypeReload reloads the configuration of the instances.
+	OperationTypeReload = "reload"
+	// OperationTypeCheckpoint runs a CHECKPOINT.
+	OperationTypeCheckpoint = "checkpoint"
+	// OperationTypeVacuum runs vacuumdb against the primary.
+	OperationTypeVacuum = "vacuum"
+	// OperationTypeReindex runs reindexdb against the primary.
+	OperationTypeReindex = "reindex"
+	// OperationTypePromote promotes a replica while the primary is down.
+	OperationTypePromote = "promote"
+)
+
+// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="spec is immutable, create another operation"
+// +kubebuilder:validation:XValidation:rule="self.type != 'promote' || has(self.instance)",message="promote needs the instance to promote"
+// +kubebuilder:validation:XValidation:rule="!has(self.instance) || !(self.type in ['vacuum', 'reindex'])",message="vacuum and reindex run against the primary, instance can not be set"
+// +kubebuilder:validation:XValidation:rule="!has(self.vacuum) || self.type == 'vacuum'",message="vacuum is only set for the vacuum type"
+// +kubebuilder:validation:XValidation:rule="!has(self.reindex) || self.type == 'reindex'",message="reindex is only set for the reindex type"
+// +kubebuilder:validation:XValidation:rule="!has(self.databases) || self.type in ['vacuum', 'reindex']",message="databases are only set for vacuum and reindex"
+type PostgresOperationSpec struct {
+	// ClusterName is the PostgresCluster the operation is run against.
+	// +kubebuilder:validation:MinLength=1
+	ClusterName string `json:"clusterName"`
+
+	// +kubebuilder:validation:Enum=restart;switchover;reload;checkpoint;vacuum;reindex;promote
+	Type string `json:"type"`
+
+	// Instance is the name of the pod of the instance to act on: the one
+	// to restart, reload or checkpoint, instead of every instance or the
+	// primary, and the one to switch over to or to promote. The most
+	// caught up replica is switched over to when unset.
+	// +optional
+	Instance string `json:"instance,omitempty"`
+
+	// Databases to vacuum or reindex, one after the other. Defaults to
+	// every database.
+	// +optional
+	Databases []string `json:"databases,omitempty"`
+
+	// +optional
+	Vacuum *VacuumOptions `json:"vacuum,omitempty"`
+	// +optional
+	Reindex *ReindexOptions `json:"reindex,omitempty"`
+
+	// RequestedBy is the user who created the operation, recorded by the
+	// admission webhook, which refuses an operation naming another user.
+	// +optional
+	RequestedBy string `json:"requestedBy,omitempty"`
+}
+
+type VacuumOptions struct {
+	// Full rewrites the tables to give their space back, it locks each of
+	// them exclusively while doing so.
+	// +optional
+	Full bool `json:"full,omitempty"`
+	// Analyze updates the statistics of the planner too.
+	// +optional
+	Analyze bool `json:"analyze,omitempty"`
+}
+
+type ReindexOptions struct {
+	// Concurrently rebuilds the indexes without locking out writes.
+	// +optional
+	Concurrently bool `json:"concurrently,omitempty"`
+}
+
+type PostgresOperationStatus struct {
+	Phase string `json:"phase,omitempty"`
+
+	// Instances are the instances the operation acted on.
+	// +optional
+	Instances []string `json:"instances,omitempty"`
+	// Message describes the progress or the result of the operation.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	StartedAt   *metav1.Time `json:"startedAt,omitempty"`
+	CompletedAt *metav1.Time `json:"completedAt,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=pgop
+// +kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.clusterName`
+// +kubebuilder:printcolumn:name="Type",type=string,JSONPath=`.spec.type`
+// +kubebuilder:printcolumn:name="Instance",type=string,JSONPath=`.spec.instance`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Requested By",type=string,JSONPath=`.spec.requestedBy`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type PostgresOperation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PostgresOperationSpec   `json:"spec,omitempty"`
+	Status PostgresOperationStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+type PostgresOperationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitzero"`
+	Items           []PostgresOperation `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PostgresOperation{}, &PostgresOperationList{})
+}
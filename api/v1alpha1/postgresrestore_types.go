@@ -0,0 +1,80 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type PostgresRestoreSpec struct {
+	// ClusterName is the PostgresCluster the dump is loaded into.
+	// +kubebuilder:validation:MinLength=1
+	ClusterName string `json:"clusterName"`
+
+	// DumpName is a completed PostgresDump in the same namespace.
+	// +kubebuilder:validation:MinLength=1
+	DumpName string `json:"dumpName"`
+
+	// Databases restores only these databases of the dump. Each database
+	// is restored into a database of the same name, created if missing.
+	// +optional
+	Databases []string `json:"databases,omitempty"`
+
+	// Schemas restricts the restore to these schemas.
+	// +optional
+	Schemas []string `json:"schemas,omitempty"`
+
+	// Clean drops the objects of the dump before recreating them.
+	// +optional
+	Clean bool `json:"clean,omitempty"`
+
+	// NoOwner skips restoring ownership and privileges, for targets that do
+	// not have the roles of the source cluster.
+	// +optional
+	NoOwner bool `json:"noOwner,omitempty"`
+
+	// Jobs is the number of parallel pg_restore workers.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=1
+	// +optional
+	Jobs int32 `json:"jobs,omitempty"`
+}
+
+type PostgresRestoreStatus struct {
+	Phase    string `json:"phase,omitempty"`
+	Progress string `json:"progress,omitempty"`
+
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	Databases []DatabaseDump `json:"databases,omitempty"`
+
+	StartedAt   *metav1.Time `json:"startedAt,omitempty"`
+	CompletedAt *metav1.Time `json:"completedAt,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.clusterName`
+// +kubebuilder:printcolumn:name="Dump",type=string,JSONPath=`.spec.dumpName`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Progress",type=string,JSONPath=`.status.progress`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type PostgresRestore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PostgresRestoreSpec   `json:"spec,omitempty"`
+	Status PostgresRestoreStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+type PostgresRestoreList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitzero"`
+	Items           []PostgresRestore `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PostgresRestore{}, &PostgresRestoreList{})
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+// ConversionDataAnnotation keeps the v1beta1 fields that v1alpha1 can not
+// represent on a v1alpha1 object, so that converting it back is lossless.
+// It never appears on a v1beta1 object.
+const ConversionDataAnnotation = "databases.atlasdb.io/conversion-data"
+
+// conversionData is the value of ConversionDataAnnotation.
+type conversionData struct {
+	Monitoring *MonitoringSpec `json:"monitoring,omitempty"`
+}
+
+// ConvertTo converts this PostgresCluster to the hub version (v1alpha1).
+func (src *PostgresCluster) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1alpha1.PostgresCluster)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+
+	dst.Spec = v1alpha1.PostgresClusterSpec{
+		Instances:           src.Spec.Instances,
+		Version:             src.Spec.PostgreSQL.Version,
+		SuperuserSecretName: src.Spec.PostgreSQL.SuperuserSecretName,
+		DatabaseName:        src.Spec.PostgreSQL.DatabaseName,
+		AppUser:             src.Spec.PostgreSQL.AppUser,
+		MajorUpgrade:        (*v1alpha1.MajorUpgradeSpec)(src.Spec.PostgreSQL.MajorUpgrade.DeepCopy()),
+		Storage:             v1alpha1.StorageSpec(src.Spec.Storage),
+		DeletionPolicy:      src.Spec.Deletion.Policy,
+		FinalBackup:         src.Spec.Deletion.FinalBackup,
+		DeletionProtection:  src.Spec.Deletion.Protection,
+		Probes:              (*v1alpha1.ProbesSpec)(src.Spec.Probes.DeepCopy()),
+	}
+	if in := src.Spec.Backup; in != nil {
+		dst.Spec.Backup = &v1alpha1.BackupSpec{
+			ObjectStore:     (*v1alpha1.ObjectStoreSpec)(in.ObjectStore.DeepCopy()),
+			RetentionPolicy: in.RetentionPolicy,
+		}
+	}
+	if in := src.Spec.Bootstrap; in != nil {
+		if in.Recovery != nil {
+			dst.Spec.Bootstrap = &v1alpha1.BootstrapSpec{
+				Recovery: &v1alpha1.RecoverySpec{
+					Source:          v1alpha1.ObjectStoreSpec(in.Recovery.Source),
+					BackupID:        in.Recovery.BackupID,
+					VolumeSnapshots: (*v1alpha1.VolumeSnapshotsSource)(in.Recovery.VolumeSnapshots.DeepCopy()),
+					Target:          (*v1alpha1.RecoveryTarget)(in.Recovery.Target.DeepCopy()),
+				},
+			}
+		}
+		dst.Spec.ReplicaBootstrap = (*v1alpha1.ReplicaBootstrapSpec)(in.Replicas.DeepCopy())
+	}
+
+	if err := convertJSON(src.Spec.MaintenanceWindow, &dst.Spec.MaintenanceWindow); err != nil {
+		return err
+	}
+	dst.Spec.Hibernation = src.Spec.Hibernation
+	if err := convertJSON(src.Spec.HibernationSchedule, &dst.Spec.HibernationSchedule); err != nil {
+		return err
+	}
+
+	// the status is the same in both versions
+	if err := convertJSON(&src.Status, &dst.Status); err != nil {
+		return err
+	}
+
+	delete(dst.Annotations, ConversionDataAnnotation)
+	if src.Spec.Monitoring != nil {
+		data, err := json.Marshal(conversionData{Monitoring: src.Spec.Monitoring})
+		if err != nil {
+			return err
+		}
+		if dst.Annotations == nil {
+			dst.Annotations = map[string]string{}
+		}
+		dst.Annotations[ConversionDataAnnotation] = string(data)
+	}
+
+	return nil
+}
+
+// ConvertFrom converts the hub version (v1alpha1) to this version.
+func (dst *PostgresCluster) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1alpha1.PostgresCluster)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+
+	dst.Spec = PostgresClusterSpec{
+		Instances: src.Spec.Instances,
+		PostgreSQL: PostgreSQLSpec{
+			Version:             src.Spec.Version,
+			SuperuserSecretName: src.Spec.SuperuserSecretName,
+			DatabaseName:        src.Spec.DatabaseName,
+			AppUser:             src.Spec.AppUser,
+			MajorUpgrade:        (*MajorUpgradeSpec)(src.Spec.MajorUpgrade.DeepCopy()),
+		},
+		Storage: StorageSpec(src.Spec.Storage),
+		Deletion: DeletionSpec{
+			Policy:      src.Spec.DeletionPolicy,
+			FinalBackup: src.Spec.FinalBackup,
+			Protection:  src.Spec.DeletionProtection,
+		},
+		Probes: (*ProbesSpec)(src.Spec.Probes.DeepCopy()),
+	}
+	if in := src.Spec.Backup; in != nil {
+		dst.Spec.Backup = &BackupSpec{
+			ObjectStore:     (*ObjectStoreSpec)(in.ObjectStore.DeepCopy()),
+			RetentionPolicy: in.RetentionPolicy,
+		}
+	}
+	if src.Spec.Bootstrap != nil && src.Spec.Bootstrap.Recovery != nil {
+		in := src.Spec.Bootstrap.Recovery
+		dst.Spec.Bootstrap = &BootstrapSpec{
+			Recovery: &RecoverySpec{
+				Source:          ObjectStoreSpec(in.Source),
+				BackupID:        in.BackupID,
+				VolumeSnapshots: (*VolumeSnapshotsSource)(in.VolumeSnapshots.DeepCopy()),
+				Target:          (*RecoveryTarget)(in.Target.DeepCopy()),
+			},
+		}
+	}
+	if src.Spec.ReplicaBootstrap != nil {
+		if dst.Spec.Bootstrap == nil {
+			dst.Spec.Bootstrap = &BootstrapSpec{}
+		}
+		dst.Spec.Bootstrap.Replicas = (*ReplicaBootstrapSpec)(src.Spec.ReplicaBootstrap.DeepCopy())
+	}
+
+	if err := convertJSON(src.Spec.MaintenanceWindow, &dst.Spec.MaintenanceWindow); err != nil {
+		return err
+	}
+	dst.Spec.Hibernation = src.Spec.Hibernation
+	if err := convertJSON(src.Spec.HibernationSchedule, &dst.Spec.HibernationSchedule); err != nil {
+		return err
+	}
+
+	if err := convertJSON(&src.Status, &dst.Status); err != nil {
+		return err
+	}
+
+	if raw, ok := dst.Annotations[ConversionDataAnnotation]; ok {
+		var data conversionData
+		if err := json.Unmarshal([]byte(raw), &data); err != nil {
+			return fmt.Errorf("decode %s annotation: %w", ConversionDataAnnotation, err)
+		}
+		dst.Spec.Monitoring = data.Monitoring
+		delete(dst.Annotations, ConversionDataAnnotation)
+		if len(dst.Annotations) == 0 {
+			dst.Annotations = nil
+		}
+	}
+
+	return nil
+}
+
+// convertJSON converts between types with the same JSON representation.
+func convertJSON(in, out any) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
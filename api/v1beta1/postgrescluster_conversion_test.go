@@ -0,0 +1,95 @@
+package v1beta1
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+
+	"github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+func TestPostgresClusterRoundTrip(t *testing.T) {
+	store := &ObjectStoreSpec{Endpoint: "http://minio:9000", Bucket: "pg", CredentialsSecretName: "s3"}
+	beta := &PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pg",
+			Namespace:   "default",
+			Annotations: map[string]string{"team": "db"},
+		},
+		Spec: PostgresClusterSpec{
+			Instances: 3,
+			PostgreSQL: PostgreSQLSpec{
+				Version:             "16.4",
+				SuperuserSecretName: "pg-superuser",
+				DatabaseName:        "app",
+				AppUser:             "app",
+				MajorUpgrade: &MajorUpgradeSpec{
+					Method:           MajorUpgradeBlueGreen,
+					MaxSwitchoverLag: ptr.To(resource.MustParse("1Mi")),
+				},
+			},
+			Storage: StorageSpec{Size: "10Gi", StorageClassName: "fast"},
+			Backup:  &BackupSpec{ObjectStore: store, RetentionPolicy: "30d"},
+			Bootstrap: &BootstrapSpec{
+				Recovery: &RecoverySpec{
+					Source: *store,
+					Target: &RecoveryTarget{LSN: "0/3000000"},
+				},
+				Replicas: &ReplicaBootstrapSpec{VolumeSnapshot: true},
+			},
+			Probes: &ProbesSpec{
+				StartupTimeoutSeconds: ptr.To[int32](7200),
+				MaxReplicationLag:     ptr.To(resource.MustParse("64Mi")),
+			},
+			Monitoring: &MonitoringSpec{EnablePodMonitor: true},
+			Deletion:   DeletionSpec{Policy: "Snapshot", FinalBackup: true, Protection: true},
+			MaintenanceWindow: &MaintenanceWindowSpec{
+				TimeZone: "Europe/Berlin",
+				Windows:  []MaintenanceWindow{{Days: "Sat,Sun", Start: "02:00", Duration: metav1.Duration{Duration: 3 * time.Hour}}},
+			},
+			Hibernation: "on",
+			HibernationSchedule: &MaintenanceWindowSpec{
+				Windows: []MaintenanceWindow{{Days: "Mon-Fri", Start: "20:00", Duration: metav1.Duration{Duration: 12 * time.Hour}}},
+			},
+		},
+		Status: PostgresClusterStatus{Phase: "Ready", Endpoint: "pg-rw"},
+	}
+
+	hub := &v1alpha1.PostgresCluster{}
+	if err := beta.ConvertTo(hub); err != nil {
+		t.Fatal(err)
+	}
+	if hub.Spec.Version != "16.4" || hub.Spec.ReplicaBootstrap == nil || !hub.Spec.DeletionProtection {
+		t.Errorf("unexpected hub spec %+v", hub.Spec)
+	}
+	if w := hub.Spec.MaintenanceWindow; w == nil || len(w.Windows) != 1 || w.Windows[0].Duration.Duration != 3*time.Hour {
+		t.Errorf("maintenance window not converted: %+v", w)
+	}
+	if hub.Spec.Hibernation != "on" || hub.Spec.HibernationSchedule == nil {
+		t.Errorf("hibernation not converted: %q %+v", hub.Spec.Hibernation, hub.Spec.HibernationSchedule)
+	}
+	if hub.Annotations[ConversionDataAnnotation] == "" {
+		t.Errorf("monitoring is not kept on the hub")
+	}
+
+	back := &PostgresCluster{}
+	if err := back.ConvertFrom(hub); err != nil {
+		t.Fatal(err)
+	}
+	if !equality.Semantic.DeepEqual(beta, back) {
+		t.Errorf("round trip changed the object:\n%+v\n%+v", beta, back)
+	}
+
+	// converting the hub back and forth must not change it either
+	again := &v1alpha1.PostgresCluster{}
+	if err := back.ConvertTo(again); err != nil {
+		t.Fatal(err)
+	}
+	if !equality.Semantic.DeepEqual(hub, again) {
+		t.Errorf("hub round trip changed the object:\n%+v\n%+v", hub, again)
+	}
+}
@@ -0,0 +1,95 @@
+// instance-manager runs inside PostgreSQL pods. The operator copies it into
+// the pod with an init container. It is the entrypoint of the postgres
+// container, and PostgreSQL invokes it as a helper, e.g. from
+// archive_command.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+const usage = `usage: instance-manager <command> [args]
+
+commands:
+  bootstrap <dest>            copy this binary to dest
+  run <pgdata> [args]         initialize pgdata, run postgres with args and serve the instance API
+  wal-archive <path>          archive a WAL segment to the object store
+  wal-restore <name> <dest>   fetch an archived WAL file from the recovery object store
+  backup <workdir>            take a base backup and upload it to the object store
+  restore <pgdata>            restore a base backup into pgdata for point-in-time recovery
+  snapshot-backup             take an online backup of the primary volumes with VolumeSnapshots
+  prepare-snapshot <pgdata> <recovery|standby>
+                              configure a volume restored from a snapshot backup
+  verify                      run the checks of a restore drill against PGHOST
+  dump                        pg_dump one database to a volume or an object store
+  restore-dump                pg_restore a dump into PGHOST
+  upgrade <pgdata> <old-bindir>
+                              upgrade pgdata to the major version of the PostgreSQL binaries on the PATH
+  logical-setup               replicate a cluster to a cluster on a new major version
+  logical-cutover             switch the writes over to the cluster replicated to
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; {
+	case cmd == "bootstrap" && len(args) == 1:
+		err = instance.Bootstrap(args[0])
+	case cmd == "run" && len(args) >= 1:
+		err = instance.Run(ctx, args[0], args[1:])
+	case cmd == "wal-archive" && len(args) == 1:
+		err = instance.ArchiveWAL(ctx, args[0])
+	case cmd == "wal-restore" && len(args) == 2:
+		err = instance.RestoreWAL(ctx, args[0], args[1])
+	case cmd == "backup" && len(args) == 1:
+		err = instance.TakeBackup(ctx, args[0])
+	case cmd == "restore" && len(args) == 1:
+		err = instance.RestoreBackup(ctx, args[0], self())
+	case cmd == "snapshot-backup" && len(args) == 0:
+		err = instance.TakeSnapshotBackup(ctx, "/dev/termination-log")
+	case cmd == "prepare-snapshot" && len(args) == 2:
+		err = instance.PrepareSnapshot(args[0], args[1], self())
+	case cmd == "verify" && len(args) == 0:
+		err = instance.VerifyBackup(ctx, "/dev/termination-log")
+	case cmd == "dump" && len(args) == 0:
+		err = instance.Dump(ctx, "/dev/termination-log")
+	case cmd == "restore-dump" && len(args) == 0:
+		err = instance.RestoreDump(ctx)
+	case cmd == "upgrade" && len(args) == 2:
+		err = instance.Upgrade(ctx, args[0], args[1])
+	case cmd == "logical-setup" && len(args) == 0:
+		err = instance.SetupLogicalReplication(ctx)
+	case cmd == "logical-cutover" && len(args) == 0:
+		err = instance.CutOverLogicalReplication(ctx)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "instance-manager %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// self is the path PostgreSQL should use to call back into this binary.
+func self() string {
+	path, err := os.Executable()
+	if err != nil {
+		return os.Args[0]
+	}
+	return path
+}
@@ -9,6 +9,7 @@ import (
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -20,7 +21,9 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	databasesv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	databasesv1beta1 "github.com/nikitadada/atlasdb/api/v1beta1"
 	"github.com/nikitadada/atlasdb/internal/controller"
+	webhookv1alpha1 "github.com/nikitadada/atlasdb/internal/webhook/v1alpha1"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -31,8 +34,10 @@ var (
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(apiextensionsv1.AddToScheme(scheme))
 
 	utilruntime.Must(databasesv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(databasesv1beta1.AddToScheme(scheme))
 	// +kubebuilder:scaffold:scheme
 }
 
@@ -45,6 +50,8 @@ func main() {
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var operatorImage string
+	var operatorNamespace string
 	var tlsOpts []func(*tls.Config)
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
 		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
@@ -63,6 +70,11 @@ func main() {
 	flag.StringVar(&metricsCertKey, "metrics-cert-key", "tls.key", "The name of the metrics server key file.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&operatorImage, "operator-image", os.Getenv("OPERATOR_IMAGE_NAME"),
+		"The image the instance manager is copied from into PostgreSQL pods. Defaults to $OPERATOR_IMAGE_NAME.")
+	flag.StringVar(&operatorNamespace, "operator-namespace", os.Getenv("POD_NAMESPACE"),
+		"The namespace the operator runs in, the only one allowed to call the instance managers. "+
+			"Defaults to $POD_NAMESPACE, empty when the operator runs outside of the cluster.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -162,13 +174,80 @@ func main() {
 		os.Exit(1)
 	}
 
+	if operatorImage == "" {
+		setupLog.Error(nil, "operator image is not set, use --operator-image or OPERATOR_IMAGE_NAME")
+		os.Exit(1)
+	}
+
 	if err := (&controller.PostgresClusterReconciler{
+		Client:            mgr.GetClient(),
+		Scheme:            mgr.GetScheme(),
+		OperatorImage:     operatorImage,
+		OperatorNamespace: operatorNamespace,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PostgresCluster")
+		os.Exit(1)
+	}
+	if err := (&controller.PostgresBackupReconciler{
+		Client:        mgr.GetClient(),
+		Scheme:        mgr.GetScheme(),
+		OperatorImage: operatorImage,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PostgresBackup")
+		os.Exit(1)
+	}
+	if err := (&controller.BackupVerificationReconciler{
+		Client:        mgr.GetClient(),
+		Scheme:        mgr.GetScheme(),
+		OperatorImage: operatorImage,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "BackupVerification")
+		os.Exit(1)
+	}
+	if err := (&controller.PostgresDumpReconciler{
+		Client:        mgr.GetClient(),
+		Scheme:        mgr.GetScheme(),
+		OperatorImage: operatorImage,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PostgresDump")
+		os.Exit(1)
+	}
+	if err := (&controller.PostgresRestoreReconciler{
+		Client:        mgr.GetClient(),
+		Scheme:        mgr.GetScheme(),
+		OperatorImage: operatorImage,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PostgresRestore")
+		os.Exit(1)
+	}
+	if err := (&controller.PostgresOperationReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "PostgresCluster")
+		setupLog.Error(err, "unable to create controller", "controller", "PostgresOperation")
 		os.Exit(1)
 	}
+	// nolint:goconst
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err := webhookv1alpha1.SetupPostgresClusterWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "PostgresCluster")
+			os.Exit(1)
+		}
+		if err := webhookv1alpha1.SetupPostgresOperationWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "PostgresOperation")
+			os.Exit(1)
+		}
+
+		// objects written before v1beta1 became the storage version are
+		// converted by the webhook registered above
+		if err := mgr.Add(&controller.StorageVersionMigrator{
+			Client:  mgr.GetClient(),
+			CRDName: "postgresclusters." + databasesv1alpha1.GroupVersion.Group,
+		}); err != nil {
+			setupLog.Error(err, "unable to add storage version migration", "crd", "PostgresCluster")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
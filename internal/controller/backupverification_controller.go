@@ -0,0 +1,330 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	databasesv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/controller/postgres"
+	"github.com/nikitadada/atlasdb/internal/instance"
+	batchv1 "k8s.io/api/batch/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// BackupVerificationReconciler periodically restores the latest backup of a
+// cluster into an ephemeral cluster, runs checks against it and records the
+// outcome on the PostgresBackup.
+type BackupVerificationReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	OperatorImage string
+}
+
+const ConditionVerified = "Verified"
+
+// +kubebuilder:rbac:groups=databases.atlasdb.io,resources=backupverifications,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=databases.atlasdb.io,resources=backupverifications/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch;delete
+
+func (r *BackupVerificationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	v := &databasesv1alpha1.BackupVerification{}
+	if err := r.Get(ctx, req.NamespacedName, v); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if v.Status.ActiveDrill == nil {
+		return r.startDrill(ctx, v)
+	}
+
+	drill := &databasesv1alpha1.PostgresCluster{}
+	err := r.Get(ctx, client.ObjectKey{Name: v.Status.ActiveDrill.ClusterName, Namespace: v.Namespace}, drill)
+	if apierrors.IsNotFound(err) {
+		return r.finishDrill(ctx, v, databasesv1alpha1.VerificationFailed, "the ephemeral cluster was deleted", nil)
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if time.Since(v.Status.ActiveDrill.StartedAt.Time) > v.Spec.Timeout.Duration {
+		return r.finishDrill(ctx, v, databasesv1alpha1.VerificationFailed,
+			fmt.Sprintf("the drill did not finish within %s", v.Spec.Timeout.Duration), nil)
+	}
+
+	// ---------------- RESTORE ----------------
+
+	recovered := meta.FindStatusCondition(drill.Status.Conditions, postgres.ConditionRecovered)
+	if recovered != nil && recovered.Status == metav1.ConditionFalse &&
+		(recovered.Reason == "RecoveryFailed" || recovered.Reason == "InvalidRecovery") {
+		return r.finishDrill(ctx, v, databasesv1alpha1.VerificationFailed, "restore failed: "+recovered.Message, nil)
+	}
+
+	if drill.Status.Phase != "Ready" || recovered == nil || recovered.Status != metav1.ConditionTrue {
+		logger.Info("Waiting for the backup to be restored", "cluster", drill.Name)
+		return ctrl.Result{RequeueAfter: 15 * time.Second}, nil
+	}
+
+	if v.Status.ActiveDrill.RestoredAt == nil {
+		v.Status.ActiveDrill.RestoredAt = &recovered.LastTransitionTime
+		if err := r.Status().Update(ctx, v); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// ---------------- CHECKS ----------------
+
+	job := &batchv1.Job{}
+	err = r.Get(ctx, client.ObjectKey{Name: postgres.DrillCheckJobName(v), Namespace: v.Namespace}, job)
+
+	if apierrors.IsNotFound(err) {
+		desired, err := postgres.BuildDrillCheckJob(v, drill, r.OperatorImage)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := ctrl.SetControllerReference(v, desired, r.Scheme); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		logger.Info("Running restore drill checks", "job", desired.Name)
+		return ctrl.Result{}, r.Create(ctx, desired)
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	switch {
+	case jobFinished(job, batchv1.JobFailed):
+		return r.finishDrill(ctx, v, databasesv1alpha1.VerificationFailed,
+			"the check Job failed, see its pod logs for details", nil)
+
+	case jobFinished(job, batchv1.JobComplete):
+		checks, err := r.checkResults(ctx, v)
+		if err != nil {
+			return r.finishDrill(ctx, v, databasesv1alpha1.VerificationFailed, err.Error(), nil)
+		}
+
+		var failed []string
+		for _, check := range checks {
+			if !check.Passed {
+				failed = append(failed, check.Name)
+			}
+		}
+		if len(failed) > 0 {
+			return r.finishDrill(ctx, v, databasesv1alpha1.VerificationFailed,
+				"failed checks: "+strings.Join(failed, ", "), checks)
+		}
+		return r.finishDrill(ctx, v, databasesv1alpha1.VerificationPassed, "", checks)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// startDrill creates the ephemeral cluster once the next drill is due.
+func (r *BackupVerificationReconciler) startDrill(
+	ctx context.Context,
+	v *databasesv1alpha1.BackupVerification,
+) (ctrl.Result, error) {
+	next := postgres.NextDrillTime(v)
+	if wait := time.Until(next); wait > 0 {
+		if v.Status.NextDrillTime == nil || !v.Status.NextDrillTime.Time.Equal(next) {
+			v.Status.NextDrillTime = &metav1.Time{Time: next}
+			if err := r.Status().Update(ctx, v); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{RequeueAfter: wait}, nil
+	}
+
+	// the cluster of the previous drill may still be terminating
+	drillKey := client.ObjectKey{Name: postgres.DrillClusterName(v), Namespace: v.Namespace}
+	if err := r.Get(ctx, drillKey, &databasesv1alpha1.PostgresCluster{}); err == nil {
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	} else if !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+
+	source := &databasesv1alpha1.PostgresCluster{}
+	err := r.Get(ctx, client.ObjectKey{Name: v.Spec.ClusterName, Namespace: v.Namespace}, source)
+	if apierrors.IsNotFound(err) {
+		return r.notVerified(ctx, v, "ClusterNotFound", fmt.Sprintf("PostgresCluster %s not found", v.Spec.ClusterName))
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+	if clusterPaused(ctx, source) {
+		return ctrl.Result{RequeueAfter: pausedRequeue}, nil
+	}
+
+	backup, err := postgres.LatestBackup(ctx, r.Client, source)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if backup == nil || !postgres.ArchivingEnabled(source) {
+		return r.notVerified(ctx, v, "NoBackup", "The cluster has no completed backup to verify")
+	}
+
+	drill := postgres.BuildDrillCluster(v, source, backup)
+	if err := ctrl.SetControllerReference(v, drill, r.Scheme); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	log.FromContext(ctx).Info("Starting restore drill", "backup", backup.Name, "cluster", drill.Name)
+	if err := r.Create(ctx, drill); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	v.Status.ActiveDrill = &databasesv1alpha1.RestoreDrill{
+		ClusterName: drill.Name,
+		BackupName:  backup.Name,
+		StartedAt:   metav1.Now(),
+	}
+	v.Status.NextDrillTime = nil
+
+	return ctrl.Result{RequeueAfter: 15 * time.Second}, r.Status().Update(ctx, v)
+}
+
+func (r *BackupVerificationReconciler) notVerified(
+	ctx context.Context,
+	v *databasesv1alpha1.BackupVerification,
+	reason, message string,
+) (ctrl.Result, error) {
+	meta.SetStatusCondition(&v.Status.Conditions, metav1.Condition{
+		Type:               ConditionVerified,
+		Status:             metav1.ConditionFalse,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: v.Generation,
+	})
+
+	// try again later, a backup may have been taken meanwhile
+	return ctrl.Result{RequeueAfter: 10 * time.Minute}, r.Status().Update(ctx, v)
+}
+
+// checkResults reads the results the check Job reported in its termination
+// message.
+func (r *BackupVerificationReconciler) checkResults(
+	ctx context.Context,
+	v *databasesv1alpha1.BackupVerification,
+) ([]databasesv1alpha1.CheckResult, error) {
+	job := &batchv1.Job{}
+	if err := r.Get(ctx, client.ObjectKey{Name: postgres.DrillCheckJobName(v), Namespace: v.Namespace}, job); err != nil {
+		return nil, err
+	}
+
+	message, err := jobTerminationMessage(ctx, r.Client, job, true)
+	if err != nil {
+		return nil, err
+	}
+	if message == "" {
+		return nil, fmt.Errorf("the check Job completed without reporting its results")
+	}
+
+	var results []instance.CheckResult
+	if err := json.Unmarshal([]byte(message), &results); err != nil {
+		return nil, fmt.Errorf("invalid check Job result: %w", err)
+	}
+
+	checks := make([]databasesv1alpha1.CheckResult, 0, len(results))
+	for _, res := range results {
+		checks = append(checks, databasesv1alpha1.CheckResult(res))
+	}
+	return checks, nil
+}
+
+// finishDrill records the outcome of the active drill on the backup and the
+// verification, and tears the ephemeral cluster down.
+func (r *BackupVerificationReconciler) finishDrill(
+	ctx context.Context,
+	v *databasesv1alpha1.BackupVerification,
+	result, message string,
+	checks []databasesv1alpha1.CheckResult,
+) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	active := v.Status.ActiveDrill
+	now := metav1.Now()
+
+	logger.Info("Restore drill finished", "backup", active.BackupName, "result", result, "message", message)
+
+	// ---------------- RECORD ON BACKUP ----------------
+
+	backup := &databasesv1alpha1.PostgresBackup{}
+	err := r.Get(ctx, client.ObjectKey{Name: active.BackupName, Namespace: v.Namespace}, backup)
+	if err == nil {
+		backup.Status.Verification = &databasesv1alpha1.BackupVerificationResult{
+			Result:  result,
+			Time:    now,
+			Message: message,
+			Checks:  checks,
+		}
+		if active.RestoredAt != nil {
+			backup.Status.Verification.RestoreDuration = &metav1.Duration{
+				Duration: active.RestoredAt.Sub(active.StartedAt.Time).Round(time.Second),
+			}
+		}
+		if err := r.Status().Update(ctx, backup); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else if !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+
+	// ---------------- TEARDOWN ----------------
+
+	background := client.PropagationPolicy(metav1.DeletePropagationBackground)
+
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: postgres.DrillCheckJobName(v), Namespace: v.Namespace}}
+	if err := r.Delete(ctx, job, background); client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, err
+	}
+
+	drill := &databasesv1alpha1.PostgresCluster{ObjectMeta: metav1.ObjectMeta{Name: active.ClusterName, Namespace: v.Namespace}}
+	if err := r.Delete(ctx, drill, background); client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, err
+	}
+	if err := postgres.DeleteDrillVolumes(ctx, r.Client, client.ObjectKeyFromObject(drill)); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// ---------------- STATUS ----------------
+
+	status := metav1.ConditionTrue
+	if result != databasesv1alpha1.VerificationPassed {
+		status = metav1.ConditionFalse
+	}
+	meta.SetStatusCondition(&v.Status.Conditions, metav1.Condition{
+		Type:               ConditionVerified,
+		Status:             status,
+		Reason:             result,
+		Message:            fmt.Sprintf("Backup %s: %s", active.BackupName, strings.TrimSpace(result+" "+message)),
+		ObservedGeneration: v.Generation,
+	})
+
+	v.Status.ActiveDrill = nil
+	v.Status.LastDrillTime = &now
+	v.Status.LastBackup = active.BackupName
+	v.Status.LastResult = result
+	v.Status.NextDrillTime = &metav1.Time{Time: postgres.NextDrillTime(v)}
+
+	if err := r.Status().Update(ctx, v); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: v.Spec.Interval.Duration}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BackupVerificationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&databasesv1alpha1.BackupVerification{}).
+		Owns(&databasesv1alpha1.PostgresCluster{}).
+		Owns(&batchv1.Job{}).
+		Named("backupverification").
+		Complete(r)
+}
@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"context"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func jobFinished(job *batchv1.Job, condition batchv1.JobConditionType) bool {
+	for _, c := range job.Status.Conditions {
+		if c.Type == condition && c.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// jobTerminationMessage returns the termination message of the last
+// container of job that exited successfully, or unsuccessfully when
+// succeeded is false. Helpers running in Jobs report their results this way.
+func jobTerminationMessage(
+	ctx context.Context,
+	c client.Client,
+	job *batchv1.Job,
+	succeeded bool,
+) (string, error) {
+	var pods corev1.PodList
+	if err := c.List(ctx, &pods,
+		client.InNamespace(job.Namespace),
+		client.MatchingLabels{batchv1.JobNameLabel: job.Name},
+	); err != nil {
+		return "", err
+	}
+
+	var (
+		message  string
+		finished metav1.Time
+	)
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			terminated := status.State.Terminated
+			if terminated == nil || (terminated.ExitCode == 0) != succeeded {
+				continue
+			}
+			if message == "" || finished.Before(&terminated.FinishedAt) {
+				message, finished = terminated.Message, terminated.FinishedAt
+			}
+		}
+	}
+	return message, nil
+}
+
+func ptrNow() *metav1.Time {
+	now := metav1.Now()
+	return &now
+}
@@ -0,0 +1,26 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	databasesv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/controller/postgres"
+)
+
+// pausedRequeue is how often what waits for a paused cluster checks
+// whether its reconciliation was resumed.
+const pausedRequeue = 30 * time.Second
+
+// clusterPaused reports whether the reconciliation of pg is paused. The
+// backups, dumps, restores and restore drills of pg then wait instead of
+// starting Jobs against it.
+func clusterPaused(ctx context.Context, pg *databasesv1alpha1.PostgresCluster) bool {
+	if !postgres.ReconciliationPaused(pg) {
+		return false
+	}
+	log.FromContext(ctx).Info("Waiting for the reconciliation of the cluster to be resumed", "cluster", pg.Name)
+	return true
+}
@@ -0,0 +1,77 @@
+package postgres
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+// APITokenSecretName is the Secret with the token the instance managers of
+// the cluster require for the actions of their API.
+func APITokenSecretName(clusterName string) string {
+	return clusterName + "-instance-api"
+}
+
+// ReconcileAPIToken generates the token of the API of the instance
+// managers of pg. It is not rotated: the instances read it when they start.
+func ReconcileAPIToken(ctx context.Context, c client.Client, scheme *runtime.Scheme, pg *dbv1alpha1.PostgresCluster) error {
+	secret := &corev1.Secret{}
+	err := c.Get(ctx, client.ObjectKey{Name: APITokenSecretName(pg.Name), Namespace: pg.Namespace}, secret)
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      APITokenSecretName(pg.Name),
+			Namespace: pg.Namespace,
+			Labels:    Labels(pg.Name),
+		},
+		Data: map[string][]byte{
+			instance.APITokenKey: []byte(hex.EncodeToString(token)),
+		},
+	}
+	if err := controllerutil.SetControllerReference(pg, secret, scheme); err != nil {
+		return err
+	}
+	return c.Create(ctx, secret)
+}
+
+// apiToken is the token of the instance managers of pg, empty until it is
+// generated.
+func apiToken(ctx context.Context, c client.Client, pg *dbv1alpha1.PostgresCluster) (string, error) {
+	secret := &corev1.Secret{}
+	err := c.Get(ctx, client.ObjectKey{Name: APITokenSecretName(pg.Name), Namespace: pg.Namespace}, secret)
+	if err != nil {
+		return "", client.IgnoreNotFound(err)
+	}
+	return string(secret.Data[instance.APITokenKey]), nil
+}
+
+func apiTokenEnv(cluster *dbv1alpha1.PostgresCluster) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: instance.EnvAPIToken,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: APITokenSecretName(cluster.Name),
+				},
+				Key: instance.APITokenKey,
+			},
+		},
+	}
+}
@@ -0,0 +1,169 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/objectstore"
+)
+
+const ConditionContinuousArchiving = "ContinuousArchiving"
+
+// ArchivingEnabled reports whether WAL archiving is configured for pg.
+func ArchivingEnabled(pg *dbv1alpha1.PostgresCluster) bool {
+	return pg.Spec.Backup != nil && pg.Spec.Backup.ObjectStore != nil
+}
+
+// ObjectStorePrefix is the key prefix a cluster archives to. The default
+// holds the namespace: clusters of the same name in other namespaces may
+// share the bucket.
+func ObjectStorePrefix(pg *dbv1alpha1.PostgresCluster, store *dbv1alpha1.ObjectStoreSpec) string {
+	if store.Path != "" {
+		return store.Path
+	}
+	return pg.Namespace + "/" + pg.Name
+}
+
+// ObjectStoreEnv is the environment the instance manager needs to talk to
+// the object store. envPrefix is one of objectstore.ArchiveEnvPrefix and
+// objectstore.RecoveryEnvPrefix.
+func ObjectStoreEnv(envPrefix string, store *dbv1alpha1.ObjectStoreSpec, prefix string) []corev1.EnvVar {
+	secretKey := func(key string) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: store.CredentialsSecretName,
+				},
+				Key: key,
+			},
+		}
+	}
+
+	return []corev1.EnvVar{
+		{Name: envPrefix + objectstore.EnvEndpoint, Value: store.Endpoint},
+		{Name: envPrefix + objectstore.EnvBucket, Value: store.Bucket},
+		{Name: envPrefix + objectstore.EnvPath, Value: prefix},
+		{Name: envPrefix + objectstore.EnvRegion, Value: store.Region},
+		{Name: envPrefix + objectstore.EnvAccessKeyID, ValueFrom: secretKey(objectstore.AccessKeyIDKey)},
+		{Name: envPrefix + objectstore.EnvSecretAccessKey, ValueFrom: secretKey(objectstore.SecretAccessKeyKey)},
+	}
+}
+
+// ArchivingArgs are the postgres command line options enabling
+// archive_command through the instance manager.
+func ArchivingArgs() []string {
+	return []string{
+		"-c", "wal_level=replica",
+		"-c", "archive_mode=on",
+		"-c", "archive_command=" + InstanceManagerPath + " wal-archive %p",
+		"-c", "archive_timeout=5min",
+	}
+}
+
+// NewObjectStoreClient builds a client using the credentials Secret
+// referenced by store.
+func NewObjectStoreClient(
+	ctx context.Context,
+	c client.Client,
+	namespace string,
+	store *dbv1alpha1.ObjectStoreSpec,
+) (*objectstore.Client, error) {
+	secret := &corev1.Secret{}
+	err := c.Get(ctx, client.ObjectKey{
+		Name:      store.CredentialsSecretName,
+		Namespace: namespace,
+	}, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	accessKeyID, ok := secret.Data[objectstore.AccessKeyIDKey]
+	if !ok {
+		return nil, fmt.Errorf("%s key not found in secret %s", objectstore.AccessKeyIDKey, secret.Name)
+	}
+	secretAccessKey, ok := secret.Data[objectstore.SecretAccessKeyKey]
+	if !ok {
+		return nil, fmt.Errorf("%s key not found in secret %s", objectstore.SecretAccessKeyKey, secret.Name)
+	}
+
+	return objectstore.New(objectstore.Config{
+		Endpoint:        store.Endpoint,
+		Bucket:          store.Bucket,
+		Region:          store.Region,
+		AccessKeyID:     string(accessKeyID),
+		SecretAccessKey: string(secretAccessKey),
+	})
+}
+
+// UpdateArchivingStatus copies the archiver status written by the instance
+// manager into pg.Status. Problems reaching the object store are reported
+// through the ContinuousArchiving condition rather than returned.
+func UpdateArchivingStatus(
+	ctx context.Context,
+	c client.Client,
+	pg *dbv1alpha1.PostgresCluster,
+) {
+	if !ArchivingEnabled(pg) {
+		meta.RemoveStatusCondition(&pg.Status.Conditions, ConditionContinuousArchiving)
+		pg.Status.LastArchivedWAL = ""
+		pg.Status.LastArchivedWALTime = nil
+		pg.Status.LastFailedWAL = ""
+		pg.Status.LastFailedWALTime = nil
+		return
+	}
+
+	setCondition := func(status metav1.ConditionStatus, reason, message string) {
+		meta.SetStatusCondition(&pg.Status.Conditions, metav1.Condition{
+			Type:               ConditionContinuousArchiving,
+			Status:             status,
+			Reason:             reason,
+			Message:            message,
+			ObservedGeneration: pg.Generation,
+		})
+	}
+
+	store := pg.Spec.Backup.ObjectStore
+	storeClient, err := NewObjectStoreClient(ctx, c, pg.Namespace, store)
+	if err != nil {
+		setCondition(metav1.ConditionFalse, "InvalidObjectStore", err.Error())
+		return
+	}
+
+	archiver, err := storeClient.GetArchiverStatus(ctx, ObjectStorePrefix(pg, store))
+	if err != nil {
+		setCondition(metav1.ConditionFalse, "ObjectStoreUnreachable", err.Error())
+		return
+	}
+	if archiver == nil {
+		setCondition(metav1.ConditionFalse, "WaitingForWAL", "No WAL segment has been archived yet")
+		return
+	}
+
+	pg.Status.LastArchivedWAL = archiver.LastArchivedWAL
+	pg.Status.LastArchivedWALTime = optionalTime(archiver.LastArchivedTime)
+	pg.Status.LastFailedWAL = archiver.LastFailedWAL
+	pg.Status.LastFailedWALTime = optionalTime(archiver.LastFailedTime)
+
+	if archiver.Failing() {
+		setCondition(metav1.ConditionFalse, "ArchivingFailed",
+			fmt.Sprintf("Failed to archive %s: %s", archiver.LastFailedWAL, archiver.LastError))
+		return
+	}
+
+	setCondition(metav1.ConditionTrue, "WALArchived",
+		fmt.Sprintf("Last archived WAL is %s", archiver.LastArchivedWAL))
+}
+
+func optionalTime(t time.Time) *metav1.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &metav1.Time{Time: t}
+}
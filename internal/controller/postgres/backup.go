@@ -0,0 +1,83 @@
+package postgres
+
+import (
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+	"github.com/nikitadada/atlasdb/internal/objectstore"
+)
+
+const backupWorkDir = "/backup"
+
+func BackupJobName(backup *dbv1alpha1.PostgresBackup) string {
+	return backup.Name + "-backup"
+}
+
+// BuildBackupJob runs pg_basebackup against the read-write service of
+// cluster and uploads the result next to the WAL archive.
+func BuildBackupJob(
+	backup *dbv1alpha1.PostgresBackup,
+	cluster *dbv1alpha1.PostgresCluster,
+	operatorImage string,
+) *batchv1.Job {
+	store := cluster.Spec.Backup.ObjectStore
+
+	env := []corev1.EnvVar{
+		{Name: "PGHOST", Value: cluster.Name + "-rw"},
+		{Name: "PGUSER", Value: PostgresCaption},
+		superuserPasswordEnv(cluster, "PGPASSWORD"),
+		{Name: instance.EnvBackupID, Value: backup.Name},
+	}
+	env = append(env, ObjectStoreEnv(objectstore.ArchiveEnvPrefix, store, ObjectStorePrefix(cluster, store))...)
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      BackupJobName(backup),
+			Namespace: backup.Namespace,
+			Labels:    Labels(cluster.Name),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: ptr.To[int32](2),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						"postgresbackup": backup.Name,
+					},
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy:  corev1.RestartPolicyNever,
+					InitContainers: []corev1.Container{BootstrapControllerContainer(operatorImage)},
+					Containers: []corev1.Container{
+						{
+							Name:                     "backup",
+							Image:                    PostgresImage(cluster),
+							Command:                  []string{InstanceManagerPath, "backup", backupWorkDir},
+							Env:                      env,
+							TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+							VolumeMounts: []corev1.VolumeMount{
+								controllerVolumeMount(),
+								{
+									Name:      "work",
+									MountPath: backupWorkDir,
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						controllerVolume(),
+						{
+							Name: "work",
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
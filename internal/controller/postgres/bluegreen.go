@@ -0,0 +1,566 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+// BlueGreenSourceLabel is set on the target cluster of a blue/green major
+// upgrade to the name of the cluster it replicates.
+const BlueGreenSourceLabel = "databases.atlasdb.io/blue-green-source"
+
+// Steps of a blue/green major upgrade, in order, and how it can end besides
+// failing.
+const (
+	upgradeCreatingTarget = "CreatingTarget"
+	upgradeReplicating    = "Replicating"
+	upgradeCuttingOver    = "CuttingOver"
+	upgradeSwitchedOver   = "SwitchedOver"
+	upgradeRolledBack     = "RolledBack"
+)
+
+// defaultMaxSwitchoverLag is the MaxSwitchoverLag of clusters that set none.
+const defaultMaxSwitchoverLag = 16 << 20
+
+// BlueGreenUpgrade reports whether pg is upgraded to a new major version
+// with a new cluster rather than in place.
+func BlueGreenUpgrade(pg *dbv1alpha1.PostgresCluster) bool {
+	return pg.Spec.MajorUpgrade != nil && pg.Spec.MajorUpgrade.Method == dbv1alpha1.MajorUpgradeBlueGreen
+}
+
+// SwitchedOver reports whether the clients of pg are sent to the target of
+// its blue/green upgrade.
+func SwitchedOver(pg *dbv1alpha1.PostgresCluster) bool {
+	return pg.Status.BlueGreen != nil && pg.Status.BlueGreen.SwitchedOver
+}
+
+// LogicalReplicationSource reports whether pg has to run with wal_level =
+// logical to be replicated into the target of a blue/green upgrade.
+func LogicalReplicationSource(pg *dbv1alpha1.PostgresCluster) bool {
+	return BlueGreenUpgrade(pg) && MajorUpgradePending(pg)
+}
+
+// BlueGreenTargetName is the name of the cluster a blue/green upgrade of pg
+// creates on the major version of its spec, e.g. orders-v17.
+func BlueGreenTargetName(pg *dbv1alpha1.PostgresCluster) string {
+	major, _ := MajorVersion(specVersion(pg))
+	return fmt.Sprintf("%s-v%d", pg.Name, major)
+}
+
+func LogicalSetupJobName(cluster string) string {
+	return cluster + "-logical-setup"
+}
+
+func LogicalCutoverJobName(cluster string) string {
+	return cluster + "-logical-cutover"
+}
+
+func RollbackUpgradeJobName(cluster string) string {
+	return cluster + "-rollback-upgrade"
+}
+
+// blueGreenStep reports whether reason is a step of a blue/green upgrade
+// that has to be seen through even if spec.majorUpgrade changed since.
+func blueGreenStep(reason string) bool {
+	switch reason {
+	case upgradeCreatingTarget, upgradeReplicating, upgradeCuttingOver, upgradeSwitchedOver:
+		return true
+	}
+	return false
+}
+
+// reconcileBlueGreen upgrades pg to a new major version without stopping
+// it:
+//
+//   - a new cluster, the target, is created on the new major version with
+//     the spec and the superuser password of pg. It is not owned by pg;
+//   - pg is restarted with wal_level = logical and a Job copies the roles
+//     and the schema into the target and subscribes it to every database,
+//     see instance.SetupLogicalReplication;
+//   - once the target is less than spec.majorUpgrade.maxSwitchoverLag
+//     behind, a Job makes pg read-only, waits for the target to catch up
+//     and copies the sequences, see instance.CutOverLogicalReplication;
+//   - the -rw Service and the connection Secret of pg are switched over to
+//     the target. pg keeps running, read-only, for a rollback with
+//     RollbackUpgradeAnnotation.
+//
+// A failed upgrade leaves pg serving the clients and is not retried until
+// the spec changes and the target is deleted.
+func reconcileBlueGreen(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+	instances []Instance,
+	operatorImage string,
+) error {
+	cond := meta.FindStatusCondition(pg.Status.Conditions, ConditionMajorUpgrade)
+	reason := ""
+	if cond != nil {
+		reason = cond.Reason
+	}
+
+	switch reason {
+	case upgradeCreatingTarget:
+		return reconcileBlueGreenTarget(ctx, c, scheme, pg, operatorImage)
+	case upgradeReplicating:
+		return reconcileLogicalReplication(ctx, c, scheme, pg, instances, operatorImage)
+	case upgradeCuttingOver:
+		return reconcileCutover(ctx, c, scheme, pg, operatorImage)
+	case upgradeSwitchedOver:
+		return reconcileUpgradeRollback(ctx, c, scheme, pg)
+	case upgradeFailed, upgradePreflightFailed, upgradeRolledBack:
+		if cond.ObservedGeneration == pg.Generation {
+			return nil
+		}
+	}
+	return startBlueGreen(ctx, c, scheme, pg, operatorImage)
+}
+
+func startBlueGreen(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+	operatorImage string,
+) error {
+	target := BlueGreenTargetName(pg)
+
+	existing := &dbv1alpha1.PostgresCluster{}
+	err := c.Get(ctx, client.ObjectKey{Name: target, Namespace: pg.Namespace}, existing)
+	if err == nil {
+		setUpgradeCondition(pg, metav1.ConditionFalse, upgradePreflightFailed,
+			fmt.Sprintf("PostgresCluster %s already exists, delete it to upgrade into a new one", target))
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	// jobs of a previous upgrade
+	for _, name := range []string{
+		LogicalSetupJobName(pg.Name), LogicalCutoverJobName(pg.Name), RollbackUpgradeJobName(pg.Name),
+	} {
+		job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: pg.Namespace}}
+		if err := c.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+
+	log.FromContext(ctx).Info("Starting a blue/green major upgrade", "target", target)
+	pg.Status.BlueGreen = &dbv1alpha1.BlueGreenStatus{Target: target}
+	setUpgradeCondition(pg, metav1.ConditionFalse, upgradeCreatingTarget,
+		fmt.Sprintf("Creating %s on PostgreSQL %s", target, specVersion(pg)))
+	return reconcileBlueGreenTarget(ctx, c, scheme, pg, operatorImage)
+}
+
+// reconcileBlueGreenTarget creates the target cluster and starts the
+// replication into it once it is ready.
+func reconcileBlueGreenTarget(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+	operatorImage string,
+) error {
+	target := &dbv1alpha1.PostgresCluster{}
+	err := c.Get(ctx, client.ObjectKey{Name: pg.Status.BlueGreen.Target, Namespace: pg.Namespace}, target)
+	if apierrors.IsNotFound(err) {
+		return createBlueGreenTarget(ctx, c, pg)
+	}
+	if err != nil {
+		return err
+	}
+	if err := adoptTargetSecret(ctx, c, scheme, pg, target); err != nil {
+		return err
+	}
+
+	if !meta.IsStatusConditionTrue(target.Status.Conditions, ConditionReady) {
+		setUpgradeCondition(pg, metav1.ConditionFalse, upgradeCreatingTarget,
+			fmt.Sprintf("Waiting for %s to be ready", target.Name))
+		return nil
+	}
+
+	created, err := createJob(ctx, c, scheme, pg, BuildLogicalSetupJob(pg, operatorImage))
+	if !created {
+		return err
+	}
+	setUpgradeCondition(pg, metav1.ConditionFalse, upgradeReplicating,
+		fmt.Sprintf("Copying the schema and the data into %s", target.Name))
+	return nil
+}
+
+// createBlueGreenTarget creates the target cluster. A generated superuser
+// Secret is owned by pg, the target gets a copy with the same password:
+// the subscriptions of the target connect to pg with it.
+func createBlueGreenTarget(ctx context.Context, c client.Client, pg *dbv1alpha1.PostgresCluster) error {
+	target := BuildBlueGreenTarget(pg)
+
+	if target.Spec.SuperuserSecretName != pg.Spec.SuperuserSecretName {
+		var creds corev1.Secret
+		if err := c.Get(ctx, client.ObjectKey{Name: pg.Spec.SuperuserSecretName, Namespace: pg.Namespace}, &creds); err != nil {
+			return err
+		}
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: target.Spec.SuperuserSecretName, Namespace: pg.Namespace},
+			Data: map[string][]byte{
+				"username": creds.Data["username"],
+				"password": creds.Data["password"],
+			},
+		}
+		err := c.Create(ctx, secret)
+		if apierrors.IsAlreadyExists(err) {
+			err = c.Get(ctx, client.ObjectKeyFromObject(secret), secret)
+			if err == nil && metav1.GetControllerOf(secret) != nil {
+				// left behind by a deleted target, about to be collected
+				return nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	log.FromContext(ctx).Info("Creating the target of the blue/green upgrade", "target", target.Name)
+	return c.Create(ctx, target)
+}
+
+// adoptTargetSecret makes the target the owner of the superuser Secret
+// created for it, which could not be owned before the target existed.
+func adoptTargetSecret(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg, target *dbv1alpha1.PostgresCluster,
+) error {
+	if target.Spec.SuperuserSecretName == pg.Spec.SuperuserSecretName {
+		return nil
+	}
+	secret := &corev1.Secret{}
+	err := c.Get(ctx, client.ObjectKey{Name: target.Spec.SuperuserSecretName, Namespace: target.Namespace}, secret)
+	if err != nil || metav1.GetControllerOf(secret) != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if err := ctrl.SetControllerReference(target, secret, scheme); err != nil {
+		return err
+	}
+	return c.Update(ctx, secret)
+}
+
+// reconcileLogicalReplication waits for the setup Job and then for the
+// target to be close enough behind pg to cut over.
+func reconcileLogicalReplication(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+	instances []Instance,
+	operatorImage string,
+) error {
+	target := pg.Status.BlueGreen.Target
+
+	job := &batchv1.Job{}
+	err := c.Get(ctx, client.ObjectKey{Name: LogicalSetupJobName(pg.Name), Namespace: pg.Namespace}, job)
+	if apierrors.IsNotFound(err) {
+		_, err := createJob(ctx, c, scheme, pg, BuildLogicalSetupJob(pg, operatorImage))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	switch jobOutcome(job) {
+	case batchv1.JobFailed:
+		message, err := jobFailureMessage(ctx, c, job)
+		if err != nil {
+			return err
+		}
+		setUpgradeCondition(pg, metav1.ConditionFalse, upgradeFailed, fmt.Sprintf(
+			"Setting up the replication into %s failed, the clients keep using PostgreSQL %d: %s",
+			target, pg.Status.MajorVersion, message))
+		return nil
+	case batchv1.JobComplete:
+	default:
+		return nil
+	}
+
+	lag, ok := logicalReplicationLag(pg, instances)
+	if !ok {
+		return nil
+	}
+	pg.Status.BlueGreen.ReplicationLagBytes = &lag
+	if lag > maxSwitchoverLag(pg) {
+		setUpgradeCondition(pg, metav1.ConditionFalse, upgradeReplicating,
+			fmt.Sprintf("Replicating into %s, waiting for it to catch up to switch over", target))
+		return nil
+	}
+
+	if !allowDisruption(pg, OperationMajorUpgrade,
+		fmt.Sprintf("Switchover of the clients to %s, the cluster is read-only meanwhile", target), time.Now()) {
+		return nil
+	}
+	created, err := createJob(ctx, c, scheme, pg, BuildLogicalCutoverJob(pg, operatorImage))
+	if !created {
+		return err
+	}
+	log.FromContext(ctx).Info("Cutting over to the target of the blue/green upgrade", "target", target, "lag", lag)
+	setUpgradeCondition(pg, metav1.ConditionFalse, upgradeCuttingOver,
+		fmt.Sprintf("Making the cluster read-only until %s caught up", target))
+	return nil
+}
+
+// logicalReplicationLag is how far, in bytes of WAL, the slowest
+// subscription of the target is behind the primary of pg. It is not known
+// until the primary reports the slots.
+func logicalReplicationLag(pg *dbv1alpha1.PostgresCluster, instances []Instance) (int64, bool) {
+	for _, inst := range instances {
+		if inst.Pod.Name != CurrentPrimary(pg) || inst.Reported == nil {
+			continue
+		}
+		var lag int64
+		found := false
+		for slot, slotLag := range inst.Reported.LogicalSlotLag {
+			if strings.HasPrefix(slot, instance.LogicalSlotPrefix) {
+				lag = max(lag, slotLag)
+				found = true
+			}
+		}
+		return lag, found
+	}
+	return 0, false
+}
+
+func maxSwitchoverLag(pg *dbv1alpha1.PostgresCluster) int64 {
+	if pg.Spec.MajorUpgrade == nil || pg.Spec.MajorUpgrade.MaxSwitchoverLag == nil {
+		return defaultMaxSwitchoverLag
+	}
+	return pg.Spec.MajorUpgrade.MaxSwitchoverLag.Value()
+}
+
+// reconcileCutover switches the clients over once the cutover Job
+// completed. A failed Job made pg writable again.
+func reconcileCutover(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+	operatorImage string,
+) error {
+	target := pg.Status.BlueGreen.Target
+
+	job := &batchv1.Job{}
+	err := c.Get(ctx, client.ObjectKey{Name: LogicalCutoverJobName(pg.Name), Namespace: pg.Namespace}, job)
+	if apierrors.IsNotFound(err) {
+		_, err := createJob(ctx, c, scheme, pg, BuildLogicalCutoverJob(pg, operatorImage))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	switch jobOutcome(job) {
+	case batchv1.JobFailed:
+		message, err := jobFailureMessage(ctx, c, job)
+		if err != nil {
+			return err
+		}
+		setUpgradeCondition(pg, metav1.ConditionFalse, upgradeFailed, fmt.Sprintf(
+			"Cutting over to %s failed, the cluster is writable again and the clients keep using it: %s",
+			target, message))
+	case batchv1.JobComplete:
+		log.FromContext(ctx).Info("Switching the clients over to the target of the blue/green upgrade", "target", target)
+		pg.Status.BlueGreen.SwitchedOver = true
+		setUpgradeCondition(pg, metav1.ConditionTrue, upgradeSwitchedOver, fmt.Sprintf(
+			"The clients use %s on PostgreSQL %s, the cluster stays read-only, annotate it with %s to roll back",
+			target, specVersion(pg), dbv1alpha1.RollbackUpgradeAnnotation))
+	}
+	return nil
+}
+
+// reconcileUpgradeRollback switches the clients back to pg when it is
+// annotated with RollbackUpgradeAnnotation. What they wrote to the target
+// in the meantime is not carried back.
+func reconcileUpgradeRollback(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+) error {
+	if _, ok := pg.Annotations[dbv1alpha1.RollbackUpgradeAnnotation]; !ok {
+		return nil
+	}
+
+	job := BuildRollbackUpgradeJob(pg)
+	created, err := createJob(ctx, c, scheme, pg, job)
+	if !created {
+		return err
+	}
+	log.FromContext(ctx).Info("Rolling back the blue/green upgrade", "target", pg.Status.BlueGreen.Target)
+	pg.Status.BlueGreen.SwitchedOver = false
+	setUpgradeCondition(pg, metav1.ConditionFalse, upgradeRolledBack, fmt.Sprintf(
+		"The clients use the cluster again, Job %s makes it writable, %s is left running", job.Name,
+		pg.Status.BlueGreen.Target))
+	return nil
+}
+
+// BuildBlueGreenTarget is the cluster a blue/green upgrade of pg replicates
+// into: the spec of pg on the new major version, archiving under its own
+// name.
+func BuildBlueGreenTarget(pg *dbv1alpha1.PostgresCluster) *dbv1alpha1.PostgresCluster {
+	target := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      BlueGreenTargetName(pg),
+			Namespace: pg.Namespace,
+			Labels:    map[string]string{BlueGreenSourceLabel: pg.Name},
+		},
+		Spec: *pg.Spec.DeepCopy(),
+	}
+	target.Spec.Version = specVersion(pg)
+	target.Spec.Bootstrap = nil
+	target.Spec.MajorUpgrade = nil
+	if pg.Spec.SuperuserSecretName == DefaultSuperuserSecretName(pg) {
+		target.Spec.SuperuserSecretName = DefaultSuperuserSecretName(target)
+	}
+	if target.Spec.Backup != nil && target.Spec.Backup.ObjectStore != nil {
+		target.Spec.Backup.ObjectStore.Path = ""
+	}
+	return target
+}
+
+// BuildLogicalSetupJob runs instance.SetupLogicalReplication from pg into
+// the target of its blue/green upgrade.
+func BuildLogicalSetupJob(pg *dbv1alpha1.PostgresCluster, operatorImage string) *batchv1.Job {
+	return buildLogicalJob(pg, LogicalSetupJobName(pg.Name), "logical-setup", operatorImage)
+}
+
+// BuildLogicalCutoverJob runs instance.CutOverLogicalReplication from pg
+// into the target of its blue/green upgrade.
+func BuildLogicalCutoverJob(pg *dbv1alpha1.PostgresCluster, operatorImage string) *batchv1.Job {
+	return buildLogicalJob(pg, LogicalCutoverJobName(pg.Name), "logical-cutover", operatorImage)
+}
+
+// buildLogicalJob runs an instance manager command against both clusters
+// with the client programs of the new major version: pg_dump has to be at
+// least as new as the server it dumps.
+func buildLogicalJob(pg *dbv1alpha1.PostgresCluster, name, command, operatorImage string) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: pg.Namespace,
+			Labels:    Labels(pg.Name),
+		},
+		Spec: batchv1.JobSpec{
+			// the steps are not idempotent, a failed upgrade is started over
+			BackoffLimit: ptr.To[int32](0),
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy:  corev1.RestartPolicyNever,
+					InitContainers: []corev1.Container{BootstrapControllerContainer(operatorImage)},
+					Containers: []corev1.Container{
+						{
+							Name:                     command,
+							Image:                    specImage(pg),
+							Command:                  []string{InstanceManagerPath, command},
+							TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+							Env: []corev1.EnvVar{
+								{Name: instance.EnvLogicalSource, Value: PrimaryHost(pg)},
+								{Name: instance.EnvLogicalTarget, Value: pg.Status.BlueGreen.Target + "-rw"},
+								{Name: "PGUSER", Value: "postgres"},
+								superuserPasswordEnv(pg, "PGPASSWORD"),
+							},
+							VolumeMounts: []corev1.VolumeMount{controllerVolumeMount()},
+						},
+					},
+					Volumes: []corev1.Volume{controllerVolume()},
+				},
+			},
+		},
+	}
+}
+
+// BuildRollbackUpgradeJob makes the primary of pg writable again after its
+// clients were switched over. It connects to the pod, the -rw Service may
+// still send to the target.
+func BuildRollbackUpgradeJob(pg *dbv1alpha1.PostgresCluster) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      RollbackUpgradeJobName(pg.Name),
+			Namespace: pg.Namespace,
+			Labels:    Labels(pg.Name),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: ptr.To[int32](5),
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:  "rollback",
+							Image: PostgresImage(pg),
+							Command: []string{"psql", "-X", "-v", "ON_ERROR_STOP=1",
+								"-c", "ALTER SYSTEM RESET default_transaction_read_only",
+								"-c", "SELECT pg_reload_conf()"},
+							TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+							Env: []corev1.EnvVar{
+								{Name: "PGHOST", Value: CurrentPrimary(pg) + "." + pg.Name},
+								{Name: "PGUSER", Value: "postgres"},
+								superuserPasswordEnv(pg, "PGPASSWORD"),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// createJob creates job owned by pg. It reports false while a Job of the
+// same name is still being deleted.
+func createJob(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+	job *batchv1.Job,
+) (bool, error) {
+	if err := ctrl.SetControllerReference(pg, job, scheme); err != nil {
+		return false, err
+	}
+	err := c.Create(ctx, job)
+	if apierrors.IsAlreadyExists(err) {
+		existing := &batchv1.Job{}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(job), existing); err != nil {
+			return false, err
+		}
+		return existing.DeletionTimestamp.IsZero(), nil
+	}
+	return err == nil, err
+}
+
+// jobOutcome is batchv1.JobComplete or batchv1.JobFailed once job finished,
+// empty before.
+func jobOutcome(job *batchv1.Job) batchv1.JobConditionType {
+	for _, cond := range job.Status.Conditions {
+		if cond.Status == corev1.ConditionTrue &&
+			(cond.Type == batchv1.JobComplete || cond.Type == batchv1.JobFailed) {
+			return cond.Type
+		}
+	}
+	return ""
+}
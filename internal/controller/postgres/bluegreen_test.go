@@ -0,0 +1,96 @@
+package postgres
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+func TestBuildBlueGreenTarget(t *testing.T) {
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg", Namespace: "db"},
+		Spec: dbv1alpha1.PostgresClusterSpec{
+			Instances:           3,
+			Version:             "17.2",
+			SuperuserSecretName: "pg-superuser",
+			Backup: &dbv1alpha1.BackupSpec{
+				ObjectStore: &dbv1alpha1.ObjectStoreSpec{Bucket: "backups", Path: "pg"},
+			},
+			Bootstrap:    &dbv1alpha1.BootstrapSpec{},
+			MajorUpgrade: &dbv1alpha1.MajorUpgradeSpec{Method: dbv1alpha1.MajorUpgradeBlueGreen},
+		},
+	}
+
+	target := BuildBlueGreenTarget(pg)
+	if target.Name != "pg-v17" || target.Labels[BlueGreenSourceLabel] != "pg" {
+		t.Errorf("target = %s %v, want pg-v17 labeled with its source", target.Name, target.Labels)
+	}
+	if target.Spec.Instances != 3 || target.Spec.Version != "17.2" {
+		t.Errorf("spec = %d instances of %s, want the one of the source", target.Spec.Instances, target.Spec.Version)
+	}
+	if target.Spec.Bootstrap != nil || target.Spec.MajorUpgrade != nil {
+		t.Error("target is bootstrapped or upgraded like the source")
+	}
+	if target.Spec.SuperuserSecretName != "pg-v17-superuser" {
+		t.Errorf("superuser secret = %s, want a generated one of its own", target.Spec.SuperuserSecretName)
+	}
+	if target.Spec.Backup.ObjectStore.Path != "" || pg.Spec.Backup.ObjectStore.Path != "pg" {
+		t.Error("target archives into the path of the source, or the source was modified")
+	}
+
+	pg.Spec.SuperuserSecretName = "shared"
+	if got := BuildBlueGreenTarget(pg).Spec.SuperuserSecretName; got != "shared" {
+		t.Errorf("superuser secret = %s, want the one referenced by the source", got)
+	}
+}
+
+func TestLogicalReplicationLag(t *testing.T) {
+	pg := &dbv1alpha1.PostgresCluster{ObjectMeta: metav1.ObjectMeta{Name: "pg"}}
+	pod := func(name string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+
+	instances := []Instance{
+		{Pod: pod("pg-0"), Reported: &instance.Status{LogicalSlotLag: map[string]int64{
+			instance.LogicalSlotPrefix + "5":     100,
+			instance.LogicalSlotPrefix + "16384": 4096,
+			"other":                              1 << 30,
+		}}},
+		{Pod: pod("pg-1"), Reported: &instance.Status{}},
+	}
+	if lag, ok := logicalReplicationLag(pg, instances); !ok || lag != 4096 {
+		t.Errorf("lag = %d, %v, want the slowest subscription 4096", lag, ok)
+	}
+
+	instances[0].Reported = &instance.Status{}
+	if _, ok := logicalReplicationLag(pg, instances); ok {
+		t.Error("lag known before the primary reports the slots")
+	}
+}
+
+func TestSwitchedOverClients(t *testing.T) {
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg"},
+		Status: dbv1alpha1.PostgresClusterStatus{
+			CurrentPrimary: "pg-1",
+			BlueGreen:      &dbv1alpha1.BlueGreenStatus{Target: "pg-v17"},
+		},
+	}
+	if got := BuildClientService(pg).Spec.Selector["postgrescluster"]; got != "pg" {
+		t.Errorf("selector before the switchover = %s, want pg", got)
+	}
+
+	pg.Status.BlueGreen.SwitchedOver = true
+	selector := BuildClientService(pg).Spec.Selector
+	if selector["postgrescluster"] != "pg-v17" || selector[RoleLabel] != instance.RolePrimary {
+		t.Errorf("selector = %v, want the primary of pg-v17", selector)
+	}
+	// the replicas must not follow the -rw Service to the target
+	if got := PrimaryHost(pg); got != "pg-1.pg" {
+		t.Errorf("primary host = %s, want the pod of the primary", got)
+	}
+}
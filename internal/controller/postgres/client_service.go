@@ -5,11 +5,19 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	databasesv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
 )
 
 func BuildClientService(pg *databasesv1alpha1.PostgresCluster) *corev1.Service {
 	labels := Labels(pg.Name)
 
+	// only the primary accepts writes
+	selector := Labels(pg.Name)
+	if SwitchedOver(pg) {
+		selector = Labels(pg.Status.BlueGreen.Target)
+	}
+	selector[RoleLabel] = instance.RolePrimary
+
 	return &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      pg.Name + "-rw", // rw = read-write endpoint
@@ -18,7 +26,7 @@ func BuildClientService(pg *databasesv1alpha1.PostgresCluster) *corev1.Service {
 		},
 		Spec: corev1.ServiceSpec{
 			Type:     corev1.ServiceTypeClusterIP,
-			Selector: labels,
+			Selector: selector,
 			Ports: []corev1.ServicePort{
 				{
 					Name: "postgres",
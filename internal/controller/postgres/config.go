@@ -0,0 +1,109 @@
+package postgres
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+const (
+	ConfigVolumePath = instance.ConfigDir
+	hbaFileName      = "pg_hba.conf"
+)
+
+// pgHBA trusts local connections and requires a password for everything
+// else, including replication connections used by pg_basebackup.
+const pgHBA = `local   all          all                 trust
+host    all          all   127.0.0.1/32  trust
+host    all          all   ::1/128       trust
+local   replication  all                 trust
+host    replication  all   all           scram-sha-256
+host    all          all   all           scram-sha-256
+`
+
+func ConfigMapName(clusterName string) string {
+	return clusterName + "-config"
+}
+
+// BuildConfigMap renders the configuration of the instances of pg. It
+// carries instance.BootstrapKey until pg is Initialized: the key is read
+// when an instance starts, so that it is dropped without a restart.
+func BuildConfigMap(pg *dbv1alpha1.PostgresCluster) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ConfigMapName(pg.Name),
+			Namespace: pg.Namespace,
+			Labels:    Labels(pg.Name),
+		},
+		Data: map[string]string{
+			hbaFileName: pgHBA,
+		},
+	}
+	if !Initialized(pg) {
+		cm.Data[instance.BootstrapKey] = "true"
+	}
+	return cm
+}
+
+func bootstrapEnv(cluster *dbv1alpha1.PostgresCluster) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: instance.EnvBootstrap,
+		ValueFrom: &corev1.EnvVarSource{
+			ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: ConfigMapName(cluster.Name),
+				},
+				Key:      instance.BootstrapKey,
+				Optional: ptr.To(true),
+			},
+		},
+	}
+}
+
+// ConfigArgs point postgres at the configuration files rendered by the
+// operator.
+func ConfigArgs() []string {
+	return []string{
+		"-c", "hba_file=" + ConfigVolumePath + "/" + hbaFileName,
+	}
+}
+
+func ReconcileConfigMap(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+) error {
+	desired := BuildConfigMap(pg)
+	if err := ctrl.SetControllerReference(pg, desired, scheme); err != nil {
+		return err
+	}
+
+	var existing corev1.ConfigMap
+	err := c.Get(ctx, client.ObjectKeyFromObject(desired), &existing)
+
+	// --- create ---
+	if apierrors.IsNotFound(err) {
+		return c.Create(ctx, desired)
+	}
+
+	// --- real error ---
+	if err != nil {
+		return err
+	}
+
+	// --- update ---
+	existing.Data = desired.Data
+	existing.Labels = desired.Labels
+
+	return c.Update(ctx, &existing)
+}
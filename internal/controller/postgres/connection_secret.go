@@ -92,6 +92,9 @@ func ReconcileConnectionSecret(
 	username := PostgresCaption
 	db := PostgresCaption
 	host := pg.Name + "-rw"
+	if SwitchedOver(pg) {
+		host = pg.Status.BlueGreen.Target + "-rw"
+	}
 	port := "5432"
 
 	uri := fmt.Sprintf(
@@ -13,6 +13,22 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
+// DefaultSuperuserSecretName is the Secret generated for clusters that do
+// not reference one.
+func DefaultSuperuserSecretName(pg *databasesv1alpha1.PostgresCluster) string {
+	return pg.Name + "-superuser"
+}
+
+// SuperuserSecretName is the Secret with the password of the postgres user
+// of pg. Clusters created while the webhooks were down have none set and
+// use the generated one.
+func SuperuserSecretName(pg *databasesv1alpha1.PostgresCluster) string {
+	if pg.Spec.SuperuserSecretName != "" {
+		return pg.Spec.SuperuserSecretName
+	}
+	return DefaultSuperuserSecretName(pg)
+}
+
 func ReconcileCredentials(
 	ctx context.Context,
 	c client.Client,
@@ -20,10 +36,7 @@ func ReconcileCredentials(
 	pg *databasesv1alpha1.PostgresCluster,
 ) (*corev1.Secret, error) {
 
-	name := pg.Spec.SuperuserSecretName
-	if name == "" {
-		name = pg.Name + "-superuser"
-	}
+	name := SuperuserSecretName(pg)
 
 	var secret corev1.Secret
 	err := c.Get(ctx, types.NamespacedName{
@@ -0,0 +1,90 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+// ConditionDrainBlocked is True while the node of the primary is cordoned
+// and there is no replica to switch over to, so that its drain waits.
+const ConditionDrainBlocked = "DrainBlocked"
+
+// ReconcileDrainedPrimary starts a switchover away from the primary when its
+// node is cordoned, which is the first step of a drain: the budget of the
+// primary keeps it from being evicted until it is a replica. The target is
+// the ready replica with the least lag on a node that is not cordoned, the
+// switchover is then carried on by ReconcileSwitchover. A drain is not
+// deferred to the maintenance window.
+func ReconcileDrainedPrimary(ctx context.Context, c client.Client, pg *dbv1alpha1.PostgresCluster, instances []Instance) error {
+	if pg.Status.TargetPrimary != "" || MajorUpgradeInProgress(pg) {
+		return nil
+	}
+
+	primary := CurrentPrimary(pg)
+	nodes := map[string]string{}
+	for _, inst := range instances {
+		nodes[inst.Pod.Name] = inst.Pod.Spec.NodeName
+	}
+	cordoned, err := nodeCordoned(ctx, c, nodes[primary])
+	if err != nil || !cordoned {
+		meta.RemoveStatusCondition(&pg.Status.Conditions, ConditionDrainBlocked)
+		return err
+	}
+
+	target := ""
+	var targetLag int64
+	for _, s := range pg.Status.Instances {
+		if s.Name == primary || !s.Ready || s.Role != instance.RoleReplica ||
+			s.ReplicationLagBytes == nil || *s.ReplicationLagBytes > rolloutMaxLag {
+			continue
+		}
+		if target != "" && *s.ReplicationLagBytes >= targetLag {
+			continue
+		}
+		if cordoned, err := nodeCordoned(ctx, c, nodes[s.Name]); err != nil {
+			return err
+		} else if !cordoned {
+			target, targetLag = s.Name, *s.ReplicationLagBytes
+		}
+	}
+	if target == "" {
+		log.FromContext(ctx).Info("The node of the primary is cordoned, no replica to switch over to",
+			"primary", primary, "node", nodes[primary])
+		SetCondition(pg, ConditionDrainBlocked, metav1.ConditionTrue, "NoSwitchoverTarget", fmt.Sprintf(
+			"The node %s of the primary %s is cordoned and no ready replica on a schedulable node is caught up, "+
+				"the primary is not evicted until one is", nodes[primary], primary))
+		return nil
+	}
+	meta.RemoveStatusCondition(&pg.Status.Conditions, ConditionDrainBlocked)
+
+	log.FromContext(ctx).Info("Switching over away from a cordoned node",
+		"primary", primary, "node", nodes[primary], "target", target)
+	pg.Status.TargetPrimary = target
+	return nil
+}
+
+// nodeCordoned reports whether no new pods may be scheduled on the node,
+// false for a pod that is not scheduled.
+func nodeCordoned(ctx context.Context, c client.Client, name string) (bool, error) {
+	if name == "" {
+		return false, nil
+	}
+	node := &corev1.Node{}
+	if err := c.Get(ctx, client.ObjectKey{Name: name}, node); err != nil {
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return node.Spec.Unschedulable, nil
+}
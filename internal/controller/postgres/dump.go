@@ -0,0 +1,168 @@
+package postgres
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+	"github.com/nikitadada/atlasdb/internal/objectstore"
+)
+
+// dumpMountPath is where the destination volume of dumps, or a scratch
+// volume for object store destinations, is mounted in dump and restore Jobs.
+const dumpMountPath = "/dump"
+
+// DumpDatabases are the databases dump covers.
+func DumpDatabases(dump *dbv1alpha1.PostgresDump, cluster *dbv1alpha1.PostgresCluster) []string {
+	if len(dump.Spec.Databases) > 0 {
+		return dump.Spec.Databases
+	}
+	if cluster.Spec.DatabaseName != "" {
+		return []string{cluster.Spec.DatabaseName}
+	}
+	return []string{PostgresCaption}
+}
+
+// ValidateDumpDestination requires exactly one destination.
+func ValidateDumpDestination(dest dbv1alpha1.DumpDestination) error {
+	if (dest.PersistentVolumeClaim == nil) == (dest.ObjectStore == nil) {
+		return fmt.Errorf("exactly one of persistentVolumeClaim and objectStore must be set as destination")
+	}
+	return nil
+}
+
+func DumpJobName(dump *dbv1alpha1.PostgresDump, index int) string {
+	return fmt.Sprintf("%s-dump-%d", dump.Name, index)
+}
+
+func RestoreJobName(restore *dbv1alpha1.PostgresRestore, index int) string {
+	return fmt.Sprintf("%s-restore-%d", restore.Name, index)
+}
+
+// BuildDumpJob runs pg_dump for database db of cluster.
+func BuildDumpJob(
+	dump *dbv1alpha1.PostgresDump,
+	cluster *dbv1alpha1.PostgresCluster,
+	index int,
+	db string,
+	operatorImage string,
+) *batchv1.Job {
+	env := []corev1.EnvVar{
+		{Name: instance.EnvDumpName, Value: dump.Name},
+		{Name: instance.EnvDumpDatabase, Value: db},
+		{Name: instance.EnvDumpFormat, Value: dump.Spec.Format},
+		{Name: instance.EnvDumpDir, Value: dumpDir(dump.Spec.Destination)},
+	}
+	if len(dump.Spec.Schemas) > 0 {
+		env = append(env, corev1.EnvVar{Name: instance.EnvDumpSchemas, Value: strings.Join(dump.Spec.Schemas, ",")})
+	}
+	if store := dump.Spec.Destination.ObjectStore; store != nil {
+		env = append(env, ObjectStoreEnv(objectstore.DumpEnvPrefix, store, ObjectStorePrefix(cluster, store))...)
+	}
+
+	return buildDumpJob(DumpJobName(dump, index), dump.Namespace, cluster, dump.Spec.Destination,
+		[]string{InstanceManagerPath, "dump"}, env, operatorImage)
+}
+
+// BuildRestoreJob loads the dump of database db into the target cluster.
+func BuildRestoreJob(
+	restore *dbv1alpha1.PostgresRestore,
+	target *dbv1alpha1.PostgresCluster,
+	dump *dbv1alpha1.PostgresDump,
+	index int,
+	db dbv1alpha1.DatabaseDump,
+	operatorImage string,
+) *batchv1.Job {
+	env := []corev1.EnvVar{
+		{Name: instance.EnvDumpLocation, Value: db.Location},
+		{Name: instance.EnvDumpDatabase, Value: db.Name},
+		{Name: instance.EnvDumpFormat, Value: dump.Spec.Format},
+		{Name: instance.EnvDumpDir, Value: dumpDir(dump.Spec.Destination)},
+		{Name: instance.EnvRestoreClean, Value: strconv.FormatBool(restore.Spec.Clean)},
+		{Name: instance.EnvRestoreNoOwner, Value: strconv.FormatBool(restore.Spec.NoOwner)},
+		{Name: instance.EnvRestoreJobs, Value: strconv.Itoa(int(restore.Spec.Jobs))},
+	}
+	if len(restore.Spec.Schemas) > 0 {
+		env = append(env, corev1.EnvVar{Name: instance.EnvDumpSchemas, Value: strings.Join(restore.Spec.Schemas, ",")})
+	}
+	if store := dump.Spec.Destination.ObjectStore; store != nil {
+		// the location already is the full key
+		env = append(env, ObjectStoreEnv(objectstore.DumpEnvPrefix, store, "")...)
+	}
+
+	return buildDumpJob(RestoreJobName(restore, index), restore.Namespace, target, dump.Spec.Destination,
+		[]string{InstanceManagerPath, "restore-dump"}, env, operatorImage)
+}
+
+func dumpDir(dest dbv1alpha1.DumpDestination) string {
+	if pvc := dest.PersistentVolumeClaim; pvc != nil {
+		return path.Join(dumpMountPath, pvc.SubPath)
+	}
+	return dumpMountPath
+}
+
+func buildDumpJob(
+	name, namespace string,
+	cluster *dbv1alpha1.PostgresCluster,
+	dest dbv1alpha1.DumpDestination,
+	command []string,
+	env []corev1.EnvVar,
+	operatorImage string,
+) *batchv1.Job {
+	env = append([]corev1.EnvVar{
+		{Name: "PGHOST", Value: PrimaryHost(cluster)},
+		{Name: "PGUSER", Value: PostgresCaption},
+		superuserPasswordEnv(cluster, "PGPASSWORD"),
+	}, env...)
+
+	volume := corev1.Volume{
+		Name: "dump",
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	}
+	if pvc := dest.PersistentVolumeClaim; pvc != nil {
+		volume.VolumeSource = corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: pvc.ClaimName},
+		}
+	}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    Labels(cluster.Name),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: ptr.To[int32](2),
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy:  corev1.RestartPolicyNever,
+					InitContainers: []corev1.Container{BootstrapControllerContainer(operatorImage)},
+					Containers: []corev1.Container{
+						{
+							Name:                     "dump",
+							Image:                    PostgresImage(cluster),
+							Command:                  command,
+							Env:                      env,
+							TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+							VolumeMounts: []corev1.VolumeMount{
+								controllerVolumeMount(),
+								{Name: "dump", MountPath: dumpMountPath},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{controllerVolume(), volume},
+				},
+			},
+		},
+	}
+}
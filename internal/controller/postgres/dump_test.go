@@ -0,0 +1,82 @@
+package postgres
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+	"github.com/nikitadada/atlasdb/internal/objectstore"
+)
+
+func TestBuildDumpJob(t *testing.T) {
+	cluster := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg", Namespace: "db"},
+		Spec:       dbv1alpha1.PostgresClusterSpec{SuperuserSecretName: "pg-superuser"},
+	}
+	dump := &dbv1alpha1.PostgresDump{
+		ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: "db"},
+		Spec: dbv1alpha1.PostgresDumpSpec{
+			ClusterName: "pg",
+			Format:      instance.DumpFormatDirectory,
+			Schemas:     []string{"public", "billing"},
+			Destination: dbv1alpha1.DumpDestination{
+				PersistentVolumeClaim: &dbv1alpha1.DumpVolume{ClaimName: "dumps", SubPath: "pg"},
+			},
+		},
+	}
+
+	if got := DumpDatabases(dump, cluster); len(got) != 1 || got[0] != "postgres" {
+		t.Errorf("DumpDatabases = %v, want the postgres database", got)
+	}
+
+	job := BuildDumpJob(dump, cluster, 1, "app", "controller:latest")
+	if job.Name != "nightly-dump-1" {
+		t.Errorf("job name = %s", job.Name)
+	}
+
+	env := map[string]string{}
+	for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	for name, want := range map[string]string{
+		instance.EnvDumpDatabase: "app",
+		instance.EnvDumpDir:      "/dump/pg",
+		instance.EnvDumpSchemas:  "public,billing",
+		"PGHOST":                 "pg-rw",
+	} {
+		if env[name] != want {
+			t.Errorf("%s = %q, want %q", name, env[name], want)
+		}
+	}
+	if _, ok := env[objectstore.DumpEnvPrefix+objectstore.EnvEndpoint]; ok {
+		t.Error("no object store is configured")
+	}
+
+	var volume *corev1.Volume
+	for i, v := range job.Spec.Template.Spec.Volumes {
+		if v.Name == "dump" {
+			volume = &job.Spec.Template.Spec.Volumes[i]
+		}
+	}
+	if volume == nil || volume.PersistentVolumeClaim == nil || volume.PersistentVolumeClaim.ClaimName != "dumps" {
+		t.Errorf("dump volume = %+v, want the dumps claim", volume)
+	}
+
+	// the -rw Service follows the target of a blue/green upgrade once
+	// switched over, the dump stays on the primary of the cluster
+	cluster.Status.CurrentPrimary = "pg-0"
+	cluster.Status.BlueGreen = &dbv1alpha1.BlueGreenStatus{SwitchedOver: true}
+	for _, e := range BuildDumpJob(dump, cluster, 1, "app", "controller:latest").Spec.Template.Spec.Containers[0].Env {
+		if e.Name == "PGHOST" && e.Value != PrimaryHost(cluster) {
+			t.Errorf("PGHOST = %q after the switchover, want %q", e.Value, PrimaryHost(cluster))
+		}
+	}
+
+	dump.Spec.Destination.ObjectStore = &dbv1alpha1.ObjectStoreSpec{Endpoint: "http://minio:9000", Bucket: "b"}
+	if err := ValidateDumpDestination(dump.Spec.Destination); err == nil {
+		t.Error("two destinations should be rejected")
+	}
+}
@@ -0,0 +1,51 @@
+package postgres
+
+import (
+	"context"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+// Fenced reports whether the instance name of pg is listed in
+// dbv1alpha1.FencedInstancesAnnotation.
+func Fenced(pg *dbv1alpha1.PostgresCluster, name string) bool {
+	for _, fenced := range strings.Split(pg.Annotations[dbv1alpha1.FencedInstancesAnnotation], ",") {
+		if fenced = strings.TrimSpace(fenced); fenced == "*" || fenced == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ReconcileFencing stops PostgreSQL on the instances of pg listed in
+// dbv1alpha1.FencedInstancesAnnotation and starts it again on the others
+// that are fenced. The instance manager keeps an instance fenced when its
+// container restarts, so an instance that keeps crashing can be fenced
+// too.
+func ReconcileFencing(ctx context.Context, pg *dbv1alpha1.PostgresCluster, instances []Instance) {
+	logger := log.FromContext(ctx)
+
+	fenced := map[string]bool{}
+	for _, s := range pg.Status.Instances {
+		fenced[s.Name] = s.Fenced
+	}
+	for _, inst := range instances {
+		name := inst.Pod.Name
+		switch want := Fenced(pg, name); {
+		case want && !fenced[name]:
+			logger.Info("Fencing instance", "instance", name)
+			if err := callInstance(ctx, instanceClient, inst, instance.FencePath); err != nil {
+				logger.Error(err, "Failed to fence instance", "instance", name)
+			}
+		case !want && fenced[name]:
+			logger.Info("Unfencing instance", "instance", name)
+			if err := callInstance(ctx, instanceClient, inst, instance.UnfencePath); err != nil {
+				logger.Error(err, "Failed to unfence instance", "instance", name)
+			}
+		}
+	}
+}
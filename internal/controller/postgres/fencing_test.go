@@ -0,0 +1,52 @@
+package postgres
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+func TestFenced(t *testing.T) {
+	pg := &dbv1alpha1.PostgresCluster{}
+	if Fenced(pg, "pg-0") {
+		t.Error("fenced without the annotation")
+	}
+
+	pg.Annotations = map[string]string{dbv1alpha1.FencedInstancesAnnotation: "pg-0, pg-2"}
+	for name, want := range map[string]bool{"pg-0": true, "pg-1": false, "pg-2": true} {
+		if got := Fenced(pg, name); got != want {
+			t.Errorf("Fenced(%s) = %v, want %v", name, got, want)
+		}
+	}
+
+	pg.Annotations[dbv1alpha1.FencedInstancesAnnotation] = "*"
+	if !Fenced(pg, "pg-1") {
+		t.Error("* does not fence every instance")
+	}
+}
+
+func TestReconciliationPaused(t *testing.T) {
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{dbv1alpha1.ReconciliationPausedAnnotation: "true"},
+		},
+	}
+	if !ReconciliationPaused(pg) || !meta.IsStatusConditionTrue(pg.Status.Conditions, ConditionReconciliationPaused) {
+		t.Fatal("not paused with the annotation")
+	}
+
+	pg.Annotations[dbv1alpha1.ReconciliationPausedAnnotation] = "false"
+	if ReconciliationPaused(pg) || meta.FindStatusCondition(pg.Status.Conditions, ConditionReconciliationPaused) != nil {
+		t.Error("paused with the annotation set to false")
+	}
+
+	pg.Annotations[dbv1alpha1.ReconciliationPausedAnnotation] = "true"
+	ReconciliationPaused(pg)
+	delete(pg.Annotations, dbv1alpha1.ReconciliationPausedAnnotation)
+	if ReconciliationPaused(pg) || meta.FindStatusCondition(pg.Status.Conditions, ConditionReconciliationPaused) != nil {
+		t.Error("still paused without the annotation")
+	}
+}
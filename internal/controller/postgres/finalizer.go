@@ -2,34 +2,223 @@ package postgres
 
 import (
 	"context"
+	"fmt"
 
-	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
 )
 
 const PostgresFinalizer = "databases.atlasdb.io/finalizer"
 
+// ConditionDeletionPolicyApplied tracks the teardown of a deleted cluster.
+const ConditionDeletionPolicyApplied = "DeletionPolicyApplied"
+
+// EnsureFinalizer adds the finalizer to a cluster that is not being deleted.
 func EnsureFinalizer(
 	ctx context.Context,
 	c client.Client,
 	pg *dbv1alpha1.PostgresCluster,
 ) error {
-	if pg.DeletionTimestamp.IsZero() {
-		// объект НЕ удаляется
-		if !controllerutil.ContainsFinalizer(pg, PostgresFinalizer) {
-			controllerutil.AddFinalizer(pg, PostgresFinalizer)
-			return c.Update(ctx, pg)
+	if pg.DeletionTimestamp.IsZero() && !controllerutil.ContainsFinalizer(pg, PostgresFinalizer) {
+		controllerutil.AddFinalizer(pg, PostgresFinalizer)
+		return c.Update(ctx, pg)
+	}
+	return nil
+}
+
+func FinalBackupName(pg *dbv1alpha1.PostgresCluster) string {
+	return pg.Name + "-final"
+}
+
+// FinalSnapshotName is the VolumeSnapshot taken of pvc by the Snapshot
+// deletion policy.
+func FinalSnapshotName(pvc string) string {
+	return pvc + "-final"
+}
+
+// Finalize runs one step of the teardown of a deleted cluster: the final
+// backup, then the deletion policy of the volumes. It reports progress in the
+// DeletionPolicyApplied condition and returns true once the finalizer can be
+// removed.
+func Finalize(
+	ctx context.Context,
+	c client.Client,
+	pg *dbv1alpha1.PostgresCluster,
+) (bool, error) {
+	setCondition := func(status metav1.ConditionStatus, reason, message string) {
+		meta.SetStatusCondition(&pg.Status.Conditions, metav1.Condition{
+			Type:               ConditionDeletionPolicyApplied,
+			Status:             status,
+			Reason:             reason,
+			Message:            message,
+			ObservedGeneration: pg.Generation,
+		})
+	}
+
+	// ---------------- FINAL BACKUP ----------------
+
+	if pg.Spec.FinalBackup {
+		if !ArchivingEnabled(pg) {
+			setCondition(metav1.ConditionFalse, "FinalBackupUnavailable",
+				"finalBackup requires spec.backup.objectStore, configure it or disable finalBackup")
+			return false, nil
+		}
+
+		backup := &dbv1alpha1.PostgresBackup{}
+		err := c.Get(ctx, client.ObjectKey{Name: FinalBackupName(pg), Namespace: pg.Namespace}, backup)
+		if apierrors.IsNotFound(err) {
+			backup = &dbv1alpha1.PostgresBackup{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      FinalBackupName(pg),
+					Namespace: pg.Namespace,
+					Labels:    Labels(pg.Name),
+				},
+				Spec: dbv1alpha1.PostgresBackupSpec{
+					ClusterName: pg.Name,
+					Method:      dbv1alpha1.BackupMethodBaseBackup,
+				},
+			}
+			setCondition(metav1.ConditionFalse, "FinalBackupRunning", "Taking the final backup "+backup.Name)
+			return false, c.Create(ctx, backup)
+		}
+		if err != nil {
+			return false, err
+		}
+
+		switch backup.Status.Phase {
+		case dbv1alpha1.BackupPhaseCompleted, dbv1alpha1.BackupPhaseExpired:
+		case dbv1alpha1.BackupPhaseFailed:
+			setCondition(metav1.ConditionFalse, "FinalBackupFailed",
+				fmt.Sprintf("Final backup %s failed: %s. Delete it to retry, or disable finalBackup", backup.Name, backup.Status.Error))
+			return false, nil
+		default:
+			setCondition(metav1.ConditionFalse, "FinalBackupRunning", "Taking the final backup "+backup.Name)
+			return false, nil
 		}
-		return nil
 	}
 
-	// объект УДАЛЯЕТСЯ
-	if controllerutil.ContainsFinalizer(pg, PostgresFinalizer) {
-		// TODO: здесь позже будет backup / cleanup
-		controllerutil.RemoveFinalizer(pg, PostgresFinalizer)
-		return c.Update(ctx, pg)
+	policy := pg.Spec.DeletionPolicy
+	if policy == "" || policy == dbv1alpha1.DeletionPolicyRetain {
+		setCondition(metav1.ConditionTrue, "VolumesRetained", "The data volumes were left in place")
+		return true, nil
 	}
 
-	return nil
+	// ---------------- STOP INSTANCES ----------------
+
+	// volumes are only snapshotted or deleted once no instance uses them,
+	// which also makes the snapshots consistent
+	sts := &appsv1.StatefulSet{}
+	err := c.Get(ctx, client.ObjectKey{Name: pg.Name, Namespace: pg.Namespace}, sts)
+	if err == nil && ptr.Deref(sts.Spec.Replicas, 1) != 0 {
+		sts.Spec.Replicas = ptr.To[int32](0)
+		setCondition(metav1.ConditionFalse, "StoppingInstances", "Stopping the instances")
+		return false, c.Update(ctx, sts)
+	} else if err != nil && !apierrors.IsNotFound(err) {
+		return false, err
+	}
+
+	var pods corev1.PodList
+	if err := c.List(ctx, &pods, client.InNamespace(pg.Namespace), client.MatchingLabels(Labels(pg.Name))); err != nil {
+		return false, err
+	}
+	if len(pods.Items) > 0 {
+		setCondition(metav1.ConditionFalse, "StoppingInstances",
+			fmt.Sprintf("Waiting for %d instances to stop", len(pods.Items)))
+		return false, nil
+	}
+
+	var pvcs corev1.PersistentVolumeClaimList
+	if err := c.List(ctx, &pvcs,
+		client.InNamespace(pg.Namespace),
+		client.MatchingLabels{"postgrescluster": pg.Name},
+	); err != nil {
+		return false, err
+	}
+
+	// ---------------- SNAPSHOT VOLUMES ----------------
+
+	if policy == dbv1alpha1.DeletionPolicySnapshot {
+		pending := 0
+		for _, pvc := range pvcs.Items {
+			if pvc.DeletionTimestamp != nil {
+				continue
+			}
+			ready, err := ensureFinalSnapshot(ctx, c, pg, pvc.Name)
+			if err != nil {
+				setCondition(metav1.ConditionFalse, "SnapshotFailed", err.Error())
+				return false, nil
+			}
+			if !ready {
+				pending++
+			}
+		}
+		if pending > 0 {
+			setCondition(metav1.ConditionFalse, "SnapshottingVolumes",
+				fmt.Sprintf("Waiting for %d VolumeSnapshots to be ready", pending))
+			return false, nil
+		}
+	}
+
+	// ---------------- DELETE VOLUMES ----------------
+
+	if len(pvcs.Items) > 0 {
+		for i := range pvcs.Items {
+			if err := c.Delete(ctx, &pvcs.Items[i]); client.IgnoreNotFound(err) != nil {
+				return false, err
+			}
+		}
+		setCondition(metav1.ConditionFalse, "DeletingVolumes",
+			fmt.Sprintf("Deleting %d data volumes", len(pvcs.Items)))
+		return false, nil
+	}
+
+	if policy == dbv1alpha1.DeletionPolicySnapshot {
+		setCondition(metav1.ConditionTrue, "VolumesSnapshotted", "The data volumes were snapshotted and deleted")
+	} else {
+		setCondition(metav1.ConditionTrue, "VolumesDeleted", "The data volumes were deleted")
+	}
+	return true, nil
+}
+
+// ensureFinalSnapshot creates the final VolumeSnapshot of pvc and reports
+// whether it is ready. The snapshot is not owned by the cluster so that it
+// outlives it.
+func ensureFinalSnapshot(
+	ctx context.Context,
+	c client.Client,
+	pg *dbv1alpha1.PostgresCluster,
+	pvc string,
+) (bool, error) {
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetGroupVersionKind(instance.VolumeSnapshotGVK)
+	err := c.Get(ctx, client.ObjectKey{Name: FinalSnapshotName(pvc), Namespace: pg.Namespace}, snapshot)
+
+	if apierrors.IsNotFound(err) {
+		snapshot.SetName(FinalSnapshotName(pvc))
+		snapshot.SetNamespace(pg.Namespace)
+		snapshot.SetLabels(Labels(pg.Name))
+		snapshot.Object["spec"] = map[string]any{
+			"source": map[string]any{"persistentVolumeClaimName": pvc},
+		}
+		return false, c.Create(ctx, snapshot)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if msg, found, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message"); found {
+		return false, fmt.Errorf("VolumeSnapshot %s failed: %s", snapshot.GetName(), msg)
+	}
+	ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+	return ready, nil
 }
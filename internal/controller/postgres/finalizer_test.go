@@ -0,0 +1,61 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+func TestFinalizeDeletesVolumes(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = dbv1alpha1.AddToScheme(scheme)
+
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg", Namespace: "db"},
+		Spec:       dbv1alpha1.PostgresClusterSpec{DeletionPolicy: dbv1alpha1.DeletionPolicyDelete},
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data-pg-0", Namespace: "db", Labels: Labels("pg")},
+	}
+	other := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data-other-0", Namespace: "db", Labels: Labels("other")},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pvc, other).Build()
+	ctx := context.Background()
+
+	done, err := Finalize(ctx, c, pg)
+	if err != nil || done {
+		t.Fatalf("first step: done=%v err=%v, want the volumes to be deleted first", done, err)
+	}
+	if cond := meta.FindStatusCondition(pg.Status.Conditions, ConditionDeletionPolicyApplied); cond.Reason != "DeletingVolumes" {
+		t.Errorf("reason = %s, want DeletingVolumes", cond.Reason)
+	}
+
+	done, err = Finalize(ctx, c, pg)
+	if err != nil || !done {
+		t.Fatalf("second step: done=%v err=%v, want done", done, err)
+	}
+
+	var left corev1.PersistentVolumeClaimList
+	if err := c.List(ctx, &left); err != nil {
+		t.Fatal(err)
+	}
+	if len(left.Items) != 1 || left.Items[0].Name != "data-other-0" {
+		t.Errorf("remaining volumes = %v, want only the one of the other cluster", left.Items)
+	}
+
+	pg.Spec.DeletionPolicy = dbv1alpha1.DeletionPolicyRetain
+	pg.Spec.FinalBackup = true
+	if done, _ := Finalize(ctx, c, pg); done {
+		t.Error("a final backup without an object store must block the deletion")
+	}
+}
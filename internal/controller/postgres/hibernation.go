@@ -0,0 +1,113 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+// ConditionHibernated is True once the instances of a cluster are shut
+// down for hibernation, see spec.hibernation.
+const ConditionHibernated = "Hibernated"
+
+// HibernationRequested reports whether the spec of pg asks for it to be
+// hibernated at now and, for spec.hibernationSchedule, how long until that
+// changes. It is zero otherwise.
+func HibernationRequested(pg *dbv1alpha1.PostgresCluster, now time.Time) (bool, time.Duration) {
+	switch pg.Spec.Hibernation {
+	case dbv1alpha1.HibernationOn:
+		return true, 0
+	case dbv1alpha1.HibernationOff:
+		return false, 0
+	}
+	if pg.Spec.HibernationSchedule == nil {
+		return false, 0
+	}
+	// the webhook rejects invalid schedules
+	open, change, err := nextWindowChange(pg.Spec.HibernationSchedule, now)
+	if err != nil || change.IsZero() {
+		return open, 0
+	}
+	return open, change.Sub(now)
+}
+
+// ReadyToHibernate reports whether the instances of pg can be shut down
+// for hibernation. An upgrade or a switchover in progress is seen through
+// first. On resume the StatefulSet starts the pods in order and a replica
+// may not be ready until its primary runs, so the first instance is
+// switched over to beforehand when it is a caught up replica.
+func ReadyToHibernate(ctx context.Context, pg *dbv1alpha1.PostgresCluster) bool {
+	if MajorUpgradeInProgress(pg) || pg.Status.TargetPrimary != "" {
+		return false
+	}
+
+	first := pg.Name + "-0"
+	if CurrentPrimary(pg) == first {
+		return true
+	}
+	for _, s := range pg.Status.Instances {
+		if s.Name != first || !s.Ready || s.Role != instance.RoleReplica ||
+			s.ReplicationLagBytes == nil || *s.ReplicationLagBytes > rolloutMaxLag {
+			continue
+		}
+		log.FromContext(ctx).Info("Switching over to the first instance before hibernation",
+			"primary", CurrentPrimary(pg), "target", first)
+		pg.Status.TargetPrimary = first
+		return false
+	}
+	return true
+}
+
+// Hibernate records the shutdown of the instances of pg for hibernation,
+// which the caller does by scaling sts to zero. The primary is
+// checkpointed first so that its shutdown is short. The data volumes, the
+// Services and the connection Secret are kept, and so are spec.instances
+// and status.currentPrimary, which the instances come back with.
+func Hibernate(ctx context.Context, pg *dbv1alpha1.PostgresCluster, instances []Instance, sts *appsv1.StatefulSet) {
+	if ptr.Deref(sts.Spec.Replicas, 0) > 0 {
+		for _, inst := range instances {
+			if inst.Pod.Name != CurrentPrimary(pg) || inst.Reported == nil || inst.Reported.Role != instance.RolePrimary {
+				continue
+			}
+			if err := checkpointInstance(ctx, inst); err != nil {
+				log.FromContext(ctx).Error(err, "Failed to checkpoint before hibernation", "instance", inst.Pod.Name)
+			}
+		}
+	}
+
+	pg.Status.ReadyInstances = sts.Status.ReadyReplicas
+	SetCondition(pg, ConditionAvailable, metav1.ConditionFalse, "Hibernated", "The cluster is hibernated")
+	if len(instances) > 0 {
+		message := fmt.Sprintf("Shutting down %d instances for hibernation", len(instances))
+		SetProgressing(pg, "Hibernating", message)
+		SetCondition(pg, ConditionHibernated, metav1.ConditionFalse, "ShuttingDown", message)
+		return
+	}
+
+	message := "The instances are shut down, their data volumes are kept"
+	pg.Status.Phase = "Hibernated"
+	pg.Status.ObservedGeneration = pg.Generation
+	SetCondition(pg, ConditionReady, metav1.ConditionFalse, "Hibernated", message)
+	SetCondition(pg, ConditionProgressing, metav1.ConditionFalse, "ReconcileComplete", "The spec is rolled out")
+	SetCondition(pg, ConditionHibernated, metav1.ConditionTrue, "Hibernated", message)
+	updateDegradedCondition(pg)
+}
+
+// Resume records that pg is no longer hibernated once it is asked to run
+// again. The StatefulSet is scaled back to spec.instances by the caller.
+func Resume(pg *dbv1alpha1.PostgresCluster) {
+	cond := meta.FindStatusCondition(pg.Status.Conditions, ConditionHibernated)
+	if cond == nil || cond.Reason == "Resumed" {
+		return
+	}
+	SetCondition(pg, ConditionHibernated, metav1.ConditionFalse, "Resumed", "The instances are started again")
+}
@@ -0,0 +1,97 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+func TestHibernationRequested(t *testing.T) {
+	// Monday 2026-10-19 21:00 UTC
+	now := time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC)
+	pg := &dbv1alpha1.PostgresCluster{
+		Spec: dbv1alpha1.PostgresClusterSpec{
+			HibernationSchedule: &dbv1alpha1.MaintenanceWindowSpec{
+				Windows: []dbv1alpha1.MaintenanceWindow{
+					{Days: "Mon-Fri", Start: "20:00", Duration: metav1.Duration{Duration: 12 * time.Hour}},
+				},
+			},
+		},
+	}
+
+	if hibernate, until := HibernationRequested(pg, now); !hibernate || until != 11*time.Hour {
+		t.Errorf("scheduled = %v for %s, want hibernated until 08:00", hibernate, until)
+	}
+	if hibernate, until := HibernationRequested(pg, now.Add(12*time.Hour)); hibernate || until != 11*time.Hour {
+		t.Errorf("scheduled = %v for %s, want running until 20:00", hibernate, until)
+	}
+
+	pg.Spec.Hibernation = dbv1alpha1.HibernationOff
+	if hibernate, until := HibernationRequested(pg, now); hibernate || until != 0 {
+		t.Errorf("off = %v for %s, want running regardless of the schedule", hibernate, until)
+	}
+	pg.Spec.Hibernation = dbv1alpha1.HibernationOn
+	pg.Spec.HibernationSchedule = nil
+	if hibernate, _ := HibernationRequested(pg, now); !hibernate {
+		t.Error("on does not hibernate")
+	}
+}
+
+func TestReadyToHibernate(t *testing.T) {
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg"},
+		Status: dbv1alpha1.PostgresClusterStatus{
+			CurrentPrimary: "pg-1",
+			Instances: []dbv1alpha1.InstanceStatus{
+				{Name: "pg-0", Role: instance.RoleReplica, Ready: true, ReplicationLagBytes: ptr.To[int64](0)},
+				{Name: "pg-1", Role: instance.RolePrimary, Ready: true},
+			},
+		},
+	}
+	ctx := context.Background()
+
+	if ReadyToHibernate(ctx, pg) || pg.Status.TargetPrimary != "pg-0" {
+		t.Fatalf("target = %q, want a switchover to the first instance first", pg.Status.TargetPrimary)
+	}
+	if ReadyToHibernate(ctx, pg) {
+		t.Error("hibernating during the switchover")
+	}
+
+	pg.Status.TargetPrimary = ""
+	pg.Status.Instances[0].Ready = false
+	if !ReadyToHibernate(ctx, pg) {
+		t.Error("not hibernating with the first instance down")
+	}
+}
+
+func TestHibernate(t *testing.T) {
+	pg := &dbv1alpha1.PostgresCluster{ObjectMeta: metav1.ObjectMeta{Name: "pg", Generation: 2}}
+	sts := &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Replicas: ptr.To[int32](0)}}
+
+	Hibernate(context.Background(), pg, []Instance{{Pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pg-0"}}}}, sts)
+	if pg.Status.Phase != "Hibernating" || meta.IsStatusConditionTrue(pg.Status.Conditions, ConditionHibernated) {
+		t.Errorf("phase = %s, want Hibernating until the pods are gone", pg.Status.Phase)
+	}
+
+	Hibernate(context.Background(), pg, nil, sts)
+	if pg.Status.Phase != "Hibernated" || !meta.IsStatusConditionTrue(pg.Status.Conditions, ConditionHibernated) {
+		t.Errorf("phase = %s, want Hibernated", pg.Status.Phase)
+	}
+	if meta.IsStatusConditionTrue(pg.Status.Conditions, ConditionProgressing) {
+		t.Error("a hibernated cluster is progressing")
+	}
+
+	Resume(pg)
+	if cond := meta.FindStatusCondition(pg.Status.Conditions, ConditionHibernated); cond.Reason != "Resumed" {
+		t.Errorf("reason = %s after resume, want Resumed", cond.Reason)
+	}
+}
@@ -0,0 +1,311 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var instanceClient = &http.Client{Timeout: 5 * time.Second}
+
+// checkpointTimeout bounds a CHECKPOINT, which flushes every dirty buffer.
+const checkpointTimeout = time.Minute
+
+// Instance is what the operator observed about an instance.
+type Instance struct {
+	Pod *corev1.Pod
+	// Reported is the status the instance manager reported, nil when it
+	// could not be reached.
+	Reported *instance.Status
+	// APIToken authorizes the calls to the instance manager.
+	APIToken string
+}
+
+// UpdateInstanceStatuses fills pg.Status.Instances from the pods and data
+// volumes of pg and from the API of the instance manager of every instance.
+// An instance that can not be reached gets an error instead of its
+// PostgreSQL details. The current primary is the instance reporting the
+// primary role, see electPrimary.
+func UpdateInstanceStatuses(ctx context.Context, c client.Client, pg *dbv1alpha1.PostgresCluster) ([]Instance, error) {
+	var pods corev1.PodList
+	if err := c.List(ctx, &pods, client.InNamespace(pg.Namespace), client.MatchingLabels(Labels(pg.Name))); err != nil {
+		return nil, err
+	}
+	sort.Slice(pods.Items, func(i, j int) bool { return pods.Items[i].Name < pods.Items[j].Name })
+	token, err := apiToken(ctx, c, pg)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]Instance, 0, len(pods.Items))
+	statuses := make([]dbv1alpha1.InstanceStatus, 0, len(pods.Items))
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+
+		status := dbv1alpha1.InstanceStatus{
+			Name:  pod.Name,
+			Ready: podReady(pod),
+			PVC:   dataVolumeName + "-" + pod.Name,
+		}
+
+		for _, cs := range pod.Status.ContainerStatuses {
+			if cs.Name != "postgres" {
+				continue
+			}
+			status.RestartCount = cs.RestartCount
+			if cs.State.Running != nil {
+				status.LastRestartTime = cs.State.Running.StartedAt.DeepCopy()
+			}
+		}
+
+		pvc := &corev1.PersistentVolumeClaim{}
+		err := c.Get(ctx, types.NamespacedName{Namespace: pg.Namespace, Name: status.PVC}, pvc)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		if capacity, ok := pvc.Status.Capacity[corev1.ResourceStorage]; err == nil && ok {
+			status.PVCSize = &capacity
+		}
+
+		reported, err := fetchInstanceStatus(ctx, pod, token)
+		if err != nil {
+			status.Error = err.Error()
+		} else if reported.Fenced {
+			// there is nothing to act upon, the instance is unreachable
+			// to the rest of the reconciliation
+			status.Fenced = true
+			reported = nil
+		} else {
+			status.Role = reported.Role
+			status.Version = reported.Version
+			status.Timeline = reported.Timeline
+			status.LSN = reported.LSN
+		}
+
+		instances = append(instances, Instance{Pod: pod, Reported: reported, APIToken: token})
+		statuses = append(statuses, status)
+	}
+
+	pg.Status.CurrentPrimary = electPrimary(CurrentPrimary(pg), statuses)
+	setReplicationLag(pg.Status.CurrentPrimary, statuses)
+	pg.Status.Instances = statuses
+	if Initialized(pg) {
+		SetCondition(pg, ConditionInitialized, metav1.ConditionTrue, "PrimaryRan",
+			"A primary ran, empty volumes are cloned from the primary")
+	}
+	return instances, nil
+}
+
+// ConditionInitialized is true once a primary of the cluster ran. From
+// then on an empty data volume, of a re-cloned instance in particular, is
+// cloned from the primary and never initialized nor recovered again, which
+// would start a second primary.
+const ConditionInitialized = "Initialized"
+
+// Initialized reports whether a primary of pg ran.
+func Initialized(pg *dbv1alpha1.PostgresCluster) bool {
+	return meta.IsStatusConditionTrue(pg.Status.Conditions, ConditionInitialized) ||
+		slices.ContainsFunc(pg.Status.Instances, func(s dbv1alpha1.InstanceStatus) bool {
+			return s.Role == instance.RolePrimary
+		})
+}
+
+// electPrimary picks the primary among the instances reporting the primary
+// role: the one on the latest timeline, which was promoted last, and the
+// current one on a tie. current stays the primary while no instance
+// reports the role.
+func electPrimary(current string, statuses []dbv1alpha1.InstanceStatus) string {
+	primary := current
+	var timeline int64 = -1
+	for _, s := range statuses {
+		if s.Role != instance.RolePrimary {
+			continue
+		}
+		if s.Timeline > timeline || (s.Timeline == timeline && s.Name == current) {
+			primary, timeline = s.Name, s.Timeline
+		}
+	}
+	return primary
+}
+
+// ReconcileInstances labels the pod of every instance with its role, so
+// that the -rw Service only selects the current primary, reloads instances
+// running an outdated configuration and demotes former primaries. It
+// reports whether the instances are settled, i.e. none of this is pending.
+func ReconcileInstances(
+	ctx context.Context,
+	c client.Client,
+	pg *dbv1alpha1.PostgresCluster,
+	instances []Instance,
+) (bool, error) {
+	logger := log.FromContext(ctx)
+	settled := true
+
+	primary := CurrentPrimary(pg)
+	var primaryTimeline int64
+	for _, s := range pg.Status.Instances {
+		if s.Name == primary {
+			primaryTimeline = s.Timeline
+		}
+	}
+	configHash := instance.ConfigHash(BuildConfigMap(pg).Data)
+
+	for i, inst := range instances {
+		role := instance.RoleReplica
+		if inst.Pod.Name == primary {
+			role = instance.RolePrimary
+		}
+		if inst.Pod.Labels[RoleLabel] != role {
+			patch := client.MergeFrom(inst.Pod.DeepCopy())
+			if inst.Pod.Labels == nil {
+				inst.Pod.Labels = map[string]string{}
+			}
+			inst.Pod.Labels[RoleLabel] = role
+			if err := c.Patch(ctx, inst.Pod, patch); err != nil {
+				return false, err
+			}
+		}
+
+		reported := inst.Reported
+		if reported == nil {
+			continue
+		}
+
+		if reported.ConfigHash != configHash {
+			settled = false
+			if err := callInstance(ctx, instanceClient, inst, instance.ReloadPath); err != nil {
+				logger.Error(err, "Failed to reload the configuration", "instance", inst.Pod.Name)
+			}
+		}
+
+		if reported.Role != instance.RolePrimary || inst.Pod.Name == primary {
+			continue
+		}
+		settled = false
+
+		// a primary on the same timeline was not promoted from the
+		// current one, rewinding it could lose data nobody replicated
+		if reported.Timeline >= primaryTimeline {
+			pg.Status.Instances[i].Error = fmt.Sprintf(
+				"also runs as a primary on timeline %d, not demoted", reported.Timeline)
+			continue
+		}
+
+		logger.Info("Demoting former primary", "instance", inst.Pod.Name, "primary", primary)
+		if err := callInstance(ctx, instanceClient, inst, instance.DemotePath); err != nil {
+			logger.Error(err, "Failed to demote former primary", "instance", inst.Pod.Name)
+		}
+	}
+
+	return settled, nil
+}
+
+// checkpointInstance runs a CHECKPOINT on inst, which shortens its shutdown
+// before a restart.
+func checkpointInstance(ctx context.Context, inst Instance) error {
+	return callInstance(ctx, &http.Client{Timeout: checkpointTimeout}, inst, instance.CheckpointPath)
+}
+
+// setReplicationLag computes how far every replica is behind the primary
+// when the primary has reported its position.
+func setReplicationLag(primaryName string, statuses []dbv1alpha1.InstanceStatus) {
+	var primary *uint64
+	for _, s := range statuses {
+		if s.Name == primaryName && s.Role == instance.RolePrimary {
+			if lsn, err := instance.ParseLSN(s.LSN); err == nil {
+				primary = &lsn
+			}
+		}
+	}
+	if primary == nil {
+		return
+	}
+
+	for i := range statuses {
+		s := &statuses[i]
+		if s.Role != instance.RoleReplica {
+			continue
+		}
+		lsn, err := instance.ParseLSN(s.LSN)
+		if err != nil {
+			continue
+		}
+		lag := int64(0)
+		if *primary > lsn {
+			lag = int64(*primary - lsn)
+		}
+		s.ReplicationLagBytes = &lag
+	}
+}
+
+func fetchInstanceStatus(ctx context.Context, pod *corev1.Pod, token string) (*instance.Status, error) {
+	resp, err := requestInstance(ctx, instanceClient, pod, token, http.MethodGet, instance.StatusPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	status := &instance.Status{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, fmt.Errorf("decode instance status: %w", err)
+	}
+	return status, nil
+}
+
+// callInstance calls an action of the API of the instance manager of inst.
+func callInstance(ctx context.Context, httpClient *http.Client, inst Instance, path string) error {
+	resp, err := requestInstance(ctx, httpClient, inst.Pod, inst.APIToken, http.MethodPost, path)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func requestInstance(
+	ctx context.Context,
+	httpClient *http.Client,
+	pod *corev1.Pod,
+	token, method, path string,
+) (*http.Response, error) {
+	if pod.Status.PodIP == "" {
+		return nil, fmt.Errorf("pod has no IP yet")
+	}
+
+	url := "http://" + net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(instance.APIPort)) + path
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer func() { _ = resp.Body.Close() }()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
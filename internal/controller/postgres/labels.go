@@ -1,5 +1,9 @@
 package postgres
 
+// RoleLabel is set on the pod of every instance to the role it reports,
+// instance.RolePrimary or instance.RoleReplica.
+const RoleLabel = "databases.atlasdb.io/role"
+
 func Labels(clusterName string) map[string]string {
 	return map[string]string{
 		"app":             "pg-test",
@@ -0,0 +1,191 @@
+package postgres
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+// Disruptive operations, the types of status.pendingOperations.
+const (
+	OperationRestart      = "Restart"
+	OperationMinorUpgrade = "MinorUpgrade"
+	OperationSwitchover   = "Switchover"
+	OperationMajorUpgrade = "MajorUpgrade"
+	OperationVolumeResize = "VolumeResize"
+)
+
+var weekdays = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+// ParseWeekdays parses the days of a maintenance window, indexed by
+// time.Weekday. Ranges may wrap around the week, e.g. Sat-Mon.
+func ParseWeekdays(days string) ([7]bool, error) {
+	var set [7]bool
+	if days == "" || days == "*" {
+		for i := range set {
+			set[i] = true
+		}
+		return set, nil
+	}
+
+	for _, item := range strings.Split(days, ",") {
+		from, to, isRange := strings.Cut(item, "-")
+		first, err := parseWeekday(from)
+		if err != nil {
+			return set, err
+		}
+		last := first
+		if isRange {
+			if last, err = parseWeekday(to); err != nil {
+				return set, err
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			set[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return set, nil
+}
+
+func parseWeekday(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if d, ok := weekdays[strings.ToLower(s)]; ok {
+		return d, nil
+	}
+	if d, err := strconv.Atoi(s); err == nil && d >= 0 && d <= 7 {
+		return d % 7, nil
+	}
+	return 0, fmt.Errorf("invalid day %q, must be Sun to Sat or 0 to 7", s)
+}
+
+// MaintenanceWindowOpen reports whether now is in one of the windows of
+// spec. Otherwise it returns when the next one opens.
+func MaintenanceWindowOpen(spec *dbv1alpha1.MaintenanceWindowSpec, now time.Time) (bool, time.Time, error) {
+	open, change, err := nextWindowChange(spec, now)
+	if open {
+		return true, time.Time{}, nil
+	}
+	return false, change, err
+}
+
+// nextWindowChange reports whether now is in one of the windows of spec
+// and when that window closes. Otherwise it returns when the next one
+// opens.
+func nextWindowChange(spec *dbv1alpha1.MaintenanceWindowSpec, now time.Time) (bool, time.Time, error) {
+	loc := time.UTC
+	if spec.TimeZone != "" {
+		var err error
+		if loc, err = time.LoadLocation(spec.TimeZone); err != nil {
+			return false, time.Time{}, err
+		}
+	}
+	now = now.In(loc)
+
+	var next time.Time
+	for _, window := range spec.Windows {
+		days, err := ParseWeekdays(window.Days)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+		start, err := time.Parse("15:04", window.Start)
+		if err != nil {
+			return false, time.Time{}, fmt.Errorf("invalid start %q: %w", window.Start, err)
+		}
+
+		// a window that opened on one of the previous days may still be
+		// open, time.Date keeps the time of day across DST changes
+		for offset := -7; offset <= 7; offset++ {
+			opens := time.Date(now.Year(), now.Month(), now.Day()+offset, start.Hour(), start.Minute(), 0, 0, loc)
+			if !days[opens.Weekday()] {
+				continue
+			}
+			if !now.Before(opens) && now.Before(opens.Add(window.Duration.Duration)) {
+				return true, opens.Add(window.Duration.Duration), nil
+			}
+			if opens.After(now) && (next.IsZero() || opens.Before(next)) {
+				next = opens
+			}
+		}
+	}
+	return false, next, nil
+}
+
+// allowDisruption reports whether the disruptive operation op of pg may run
+// now: pg has no maintenance window, it is open or overridden with
+// MaintenanceOverrideAnnotation. Otherwise op is queued in
+// status.pendingOperations, which it is removed from once it runs.
+func allowDisruption(pg *dbv1alpha1.PostgresCluster, op, message string, now time.Time) bool {
+	allowed := pg.Spec.MaintenanceWindow == nil
+	if _, ok := pg.Annotations[dbv1alpha1.MaintenanceOverrideAnnotation]; ok {
+		allowed = true
+	}
+	if !allowed {
+		open, _, err := MaintenanceWindowOpen(pg.Spec.MaintenanceWindow, now)
+		if err != nil {
+			message = fmt.Sprintf("%s, the maintenance window is invalid: %v", message, err)
+		}
+		allowed = open
+	}
+
+	if allowed {
+		clearPendingOperation(pg, op)
+		return true
+	}
+	for i := range pg.Status.PendingOperations {
+		if pending := &pg.Status.PendingOperations[i]; pending.Type == op {
+			pending.Message = message
+			return false
+		}
+	}
+	pg.Status.PendingOperations = append(pg.Status.PendingOperations, dbv1alpha1.PendingOperation{
+		Type:    op,
+		Message: message,
+		Since:   metav1.NewTime(now),
+	})
+	return false
+}
+
+// clearPendingOperation removes op from status.pendingOperations once there
+// is nothing left to do.
+func clearPendingOperation(pg *dbv1alpha1.PostgresCluster, op string) {
+	for i, pending := range pg.Status.PendingOperations {
+		if pending.Type == op {
+			pg.Status.PendingOperations = append(pg.Status.PendingOperations[:i], pg.Status.PendingOperations[i+1:]...)
+			return
+		}
+	}
+}
+
+// UpdateNextMaintenanceWindow sets status.nextMaintenanceWindow while
+// operations are pending and returns how long until it opens, zero when
+// none are pending or it is open already.
+func UpdateNextMaintenanceWindow(pg *dbv1alpha1.PostgresCluster, now time.Time) time.Duration {
+	pg.Status.NextMaintenanceWindow = nil
+	if len(pg.Status.PendingOperations) == 0 || pg.Spec.MaintenanceWindow == nil {
+		return 0
+	}
+	open, next, err := MaintenanceWindowOpen(pg.Spec.MaintenanceWindow, now)
+	if err != nil || open || next.IsZero() {
+		return 0
+	}
+	pg.Status.NextMaintenanceWindow = ptr.To(metav1.NewTime(next))
+	return next.Sub(now)
+}
+
+// MaintenanceOverrideDone reports whether MaintenanceOverrideAnnotation can
+// be removed from pg: it is ready and nothing is left pending.
+func MaintenanceOverrideDone(pg *dbv1alpha1.PostgresCluster) bool {
+	_, ok := pg.Annotations[dbv1alpha1.MaintenanceOverrideAnnotation]
+	return ok && len(pg.Status.PendingOperations) == 0 &&
+		meta.IsStatusConditionTrue(pg.Status.Conditions, ConditionReady)
+}
@@ -0,0 +1,126 @@
+package postgres
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+func TestParseWeekdays(t *testing.T) {
+	for days, want := range map[string][7]bool{
+		"*":       {true, true, true, true, true, true, true},
+		"Mon-Fri": {false, true, true, true, true, true, false},
+		"sat-MON": {true, true, false, false, false, false, true},
+		"0,3":     {true, false, false, true, false, false, false},
+		"7":       {true, false, false, false, false, false, false},
+		"Tue, 5":  {false, false, true, false, false, true, false},
+	} {
+		got, err := ParseWeekdays(days)
+		if err != nil || got != want {
+			t.Errorf("ParseWeekdays(%q) = %v, %v, want %v", days, got, err, want)
+		}
+	}
+	for _, days := range []string{"Funday", "8", "Mon-", ","} {
+		if _, err := ParseWeekdays(days); err == nil {
+			t.Errorf("ParseWeekdays(%q) succeeded", days)
+		}
+	}
+}
+
+func TestMaintenanceWindowOpen(t *testing.T) {
+	spec := &dbv1alpha1.MaintenanceWindowSpec{
+		TimeZone: "Europe/Berlin",
+		Windows: []dbv1alpha1.MaintenanceWindow{
+			{Days: "Sat,Sun", Start: "02:00", Duration: metav1.Duration{Duration: 3 * time.Hour}},
+			{Days: "Wed", Start: "23:00", Duration: metav1.Duration{Duration: 2 * time.Hour}},
+		},
+	}
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		now  time.Time
+		open bool
+		next time.Time
+	}{
+		// Saturday 2026-10-17 03:00 in Berlin is 01:00 UTC
+		{now: time.Date(2026, 10, 17, 1, 0, 0, 0, time.UTC), open: true},
+		{now: time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC), next: time.Date(2026, 10, 18, 2, 0, 0, 0, berlin)},
+		// the window of Wednesday 23:00 is still open on Thursday
+		{now: time.Date(2026, 10, 22, 0, 30, 0, 0, berlin), open: true},
+		{now: time.Date(2026, 10, 19, 12, 0, 0, 0, berlin), next: time.Date(2026, 10, 21, 23, 0, 0, 0, berlin)},
+	} {
+		open, next, err := MaintenanceWindowOpen(spec, tc.now)
+		if err != nil || open != tc.open || !next.Equal(tc.next) {
+			t.Errorf("MaintenanceWindowOpen(%s) = %v, %s, %v, want %v, %s", tc.now, open, next, err, tc.open, tc.next)
+		}
+	}
+
+	spec.TimeZone = "Mars/Olympus"
+	if _, _, err := MaintenanceWindowOpen(spec, time.Now()); err == nil {
+		t.Error("unknown time zone accepted")
+	}
+}
+
+func TestNextWindowChange(t *testing.T) {
+	spec := &dbv1alpha1.MaintenanceWindowSpec{
+		Windows: []dbv1alpha1.MaintenanceWindow{
+			{Days: "Mon-Fri", Start: "20:00", Duration: metav1.Duration{Duration: 12 * time.Hour}},
+		},
+	}
+	// Friday 2026-10-16 at night, the window closes on Saturday morning
+	open, change, err := nextWindowChange(spec, time.Date(2026, 10, 16, 23, 0, 0, 0, time.UTC))
+	if err != nil || !open || !change.Equal(time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("nextWindowChange = %v, %s, %v, want open until Saturday 08:00", open, change, err)
+	}
+	open, change, err = nextWindowChange(spec, time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC))
+	if err != nil || open || !change.Equal(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)) {
+		t.Errorf("nextWindowChange = %v, %s, %v, want closed until Monday 20:00", open, change, err)
+	}
+}
+
+func TestAllowDisruption(t *testing.T) {
+	closed := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	open := time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC)
+	pg := &dbv1alpha1.PostgresCluster{
+		Spec: dbv1alpha1.PostgresClusterSpec{
+			MaintenanceWindow: &dbv1alpha1.MaintenanceWindowSpec{
+				Windows: []dbv1alpha1.MaintenanceWindow{
+					{Days: "Sun", Start: "02:00", Duration: metav1.Duration{Duration: 2 * time.Hour}},
+				},
+			},
+		},
+	}
+
+	if allowDisruption(pg, OperationRestart, "first", closed) {
+		t.Fatal("restart allowed outside of the window")
+	}
+	if allowDisruption(pg, OperationRestart, "second", closed.Add(time.Hour)) {
+		t.Fatal("restart allowed outside of the window")
+	}
+	pending := pg.Status.PendingOperations
+	if len(pending) != 1 || pending[0].Message != "second" || !pending[0].Since.Time.Equal(closed) {
+		t.Errorf("pending operations = %v, want the restart queued since it was first deferred", pending)
+	}
+	if wait := UpdateNextMaintenanceWindow(pg, closed); wait != 5*24*time.Hour+14*time.Hour {
+		t.Errorf("next window in %s, want the next Sunday 02:00", wait)
+	}
+
+	if !allowDisruption(pg, OperationRestart, "", open) || len(pg.Status.PendingOperations) != 0 {
+		t.Error("restart not allowed or still pending in the window")
+	}
+
+	allowDisruption(pg, OperationVolumeResize, "", closed)
+	pg.Annotations = map[string]string{dbv1alpha1.MaintenanceOverrideAnnotation: ""}
+	if !allowDisruption(pg, OperationVolumeResize, "", closed) || len(pg.Status.PendingOperations) != 0 {
+		t.Error("override did not allow the volume resize")
+	}
+	if UpdateNextMaintenanceWindow(pg, closed) != 0 || pg.Status.NextMaintenanceWindow != nil {
+		t.Error("next window set with nothing pending")
+	}
+}
@@ -0,0 +1,103 @@
+package postgres
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+// operatorPodLabels select the pods of the operator, see
+// config/manager/manager.yaml.
+var operatorPodLabels = map[string]string{
+	"control-plane":          "controller-manager",
+	"app.kubernetes.io/name": "atlasdb",
+}
+
+func NetworkPolicyName(clusterName string) string {
+	return clusterName + "-instance-api"
+}
+
+// BuildNetworkPolicy lets any pod connect to PostgreSQL on the instances of
+// pg, and only the operator running in operatorNamespace call the API of
+// their instance managers. The kubelet probing the instances is let
+// through by the network plugins.
+func BuildNetworkPolicy(pg *dbv1alpha1.PostgresCluster, operatorNamespace string) *networkingv1.NetworkPolicy {
+	port := func(p int32) []networkingv1.NetworkPolicyPort {
+		return []networkingv1.NetworkPolicyPort{{Protocol: ptr.To(corev1.ProtocolTCP), Port: ptr.To(intstr.FromInt32(p))}}
+	}
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      NetworkPolicyName(pg.Name),
+			Namespace: pg.Namespace,
+			Labels:    Labels(pg.Name),
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: Labels(pg.Name)},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{Ports: port(5432)},
+				{
+					Ports: port(instance.APIPort),
+					From: []networkingv1.NetworkPolicyPeer{{
+						NamespaceSelector: &metav1.LabelSelector{
+							MatchLabels: map[string]string{corev1.LabelMetadataName: operatorNamespace},
+						},
+						PodSelector: &metav1.LabelSelector{MatchLabels: operatorPodLabels},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// ReconcileNetworkPolicy keeps the NetworkPolicy of pg in line with the
+// namespace of the operator, and removes it when that is unknown.
+func ReconcileNetworkPolicy(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+	operatorNamespace string,
+) error {
+	desired := BuildNetworkPolicy(pg, operatorNamespace)
+
+	var existing networkingv1.NetworkPolicy
+	err := c.Get(ctx, client.ObjectKeyFromObject(desired), &existing)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	found := err == nil
+
+	if operatorNamespace == "" {
+		if !found {
+			return nil
+		}
+		return client.IgnoreNotFound(c.Delete(ctx, &existing))
+	}
+
+	if err := ctrl.SetControllerReference(pg, desired, scheme); err != nil {
+		return err
+	}
+	if !found {
+		return c.Create(ctx, desired)
+	}
+	if equality.Semantic.DeepEqual(existing.Spec, desired.Spec) {
+		return nil
+	}
+	existing.Spec = desired.Spec
+	existing.Labels = desired.Labels
+	return c.Update(ctx, &existing)
+}
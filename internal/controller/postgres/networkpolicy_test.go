@@ -0,0 +1,87 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+func TestBuildNetworkPolicy(t *testing.T) {
+	pg := &dbv1alpha1.PostgresCluster{ObjectMeta: metav1.ObjectMeta{Name: "pg", Namespace: "db"}}
+	policy := BuildNetworkPolicy(pg, "atlasdb-system")
+
+	for _, rule := range policy.Spec.Ingress {
+		switch port := rule.Ports[0].Port.IntValue(); port {
+		case 5432:
+			if len(rule.From) != 0 {
+				t.Error("PostgreSQL is not reachable from every pod")
+			}
+		case instance.APIPort:
+			if len(rule.From) != 1 || rule.From[0].NamespaceSelector.MatchLabels[corev1.LabelMetadataName] != "atlasdb-system" ||
+				rule.From[0].PodSelector.MatchLabels["control-plane"] != "controller-manager" {
+				t.Errorf("the instance API is reachable from %+v, want the operator pods only", rule.From)
+			}
+		default:
+			t.Errorf("unexpected port %d", port)
+		}
+	}
+}
+
+func TestReconcileAPIToken(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = dbv1alpha1.AddToScheme(scheme)
+	ctx := context.Background()
+	pg := &dbv1alpha1.PostgresCluster{ObjectMeta: metav1.ObjectMeta{Name: "pg", Namespace: "db", UID: "uid"}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pg).Build()
+
+	if token, err := apiToken(ctx, c, pg); err != nil || token != "" {
+		t.Fatalf("token before it is generated: %q, %v", token, err)
+	}
+	if err := ReconcileAPIToken(ctx, c, scheme, pg); err != nil {
+		t.Fatal(err)
+	}
+	token, err := apiToken(ctx, c, pg)
+	if err != nil || len(token) != 64 {
+		t.Fatalf("generated token %q, %v", token, err)
+	}
+	if err := ReconcileAPIToken(ctx, c, scheme, pg); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := apiToken(ctx, c, pg); again != token {
+		t.Error("the token was regenerated")
+	}
+}
+
+func TestReconcileNetworkPolicy(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = dbv1alpha1.AddToScheme(scheme)
+	ctx := context.Background()
+	pg := &dbv1alpha1.PostgresCluster{ObjectMeta: metav1.ObjectMeta{Name: "pg", Namespace: "db", UID: "uid"}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pg).Build()
+
+	if err := ReconcileNetworkPolicy(ctx, c, scheme, pg, ""); err != nil {
+		t.Fatal(err)
+	}
+	var policy networkingv1.NetworkPolicy
+	if err := c.Get(ctx, client.ObjectKey{Name: NetworkPolicyName("pg"), Namespace: "db"}, &policy); err == nil {
+		t.Error("NetworkPolicy created without the namespace of the operator")
+	}
+	if err := ReconcileNetworkPolicy(ctx, c, scheme, pg, "atlasdb-system"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, client.ObjectKey{Name: NetworkPolicyName("pg"), Namespace: "db"}, &policy); err != nil {
+		t.Errorf("NetworkPolicy: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/utils/ptr"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+// OperationJobName is the Job running the vacuum or the reindex of op. The
+// Job name is a label value of its pods: past 63 characters it is cut
+// short and ends with a hash of the whole name instead.
+func OperationJobName(op *dbv1alpha1.PostgresOperation) string {
+	name := op.Name + "-" + op.Spec.Type
+	if len(name) <= validation.DNS1123LabelMaxLength {
+		return name
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	suffix := fmt.Sprintf("-%08x", h.Sum32())
+	return strings.TrimRight(name[:validation.DNS1123LabelMaxLength-len(suffix)], "-.") + suffix
+}
+
+// BuildOperationJob runs vacuumdb or reindexdb for op against the primary
+// of cluster, on every database or on those of spec.databases one after
+// the other.
+func BuildOperationJob(op *dbv1alpha1.PostgresOperation, cluster *dbv1alpha1.PostgresCluster) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      OperationJobName(op),
+			Namespace: op.Namespace,
+			Labels:    Labels(cluster.Name),
+		},
+		Spec: batchv1.JobSpec{
+			// a vacuum or a reindex cut short is simply done again
+			BackoffLimit: ptr.To[int32](2),
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:    op.Spec.Type,
+							Image:   PostgresImage(cluster),
+							Command: operationCommand(op),
+							Env: []corev1.EnvVar{
+								{Name: "PGHOST", Value: PrimaryHost(cluster)},
+								{Name: "PGUSER", Value: PostgresCaption},
+								superuserPasswordEnv(cluster, "PGPASSWORD"),
+							},
+							TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func operationCommand(op *dbv1alpha1.PostgresOperation) []string {
+	var command []string
+	switch op.Spec.Type {
+	case dbv1alpha1.OperationTypeVacuum:
+		command = []string{"vacuumdb"}
+		if v := op.Spec.Vacuum; v != nil && v.Full {
+			command = append(command, "--full")
+		}
+		if v := op.Spec.Vacuum; v != nil && v.Analyze {
+			command = append(command, "--analyze")
+		}
+	case dbv1alpha1.OperationTypeReindex:
+		command = []string{"reindexdb"}
+		if r := op.Spec.Reindex; r != nil && r.Concurrently {
+			command = append(command, "--concurrently")
+		}
+	}
+
+	if len(op.Spec.Databases) == 0 {
+		return append(command, "--all")
+	}
+	// the databases are passed as arguments of the script, never quoted
+	// into it
+	script := fmt.Sprintf(`for db in "$@"; do %s --dbname "$db" || exit 1; done`, strings.Join(command, " "))
+	return append([]string{"sh", "-c", script, "sh"}, op.Spec.Databases...)
+}
+
+// OperationPath is the action of the instance manager a reload,
+// checkpoint or promote operation calls.
+func OperationPath(opType string) string {
+	switch opType {
+	case dbv1alpha1.OperationTypeReload:
+		return instance.ReloadPath
+	case dbv1alpha1.OperationTypeCheckpoint:
+		return instance.CheckpointPath
+	case dbv1alpha1.OperationTypePromote:
+		return instance.PromotePath
+	}
+	return ""
+}
+
+// CallInstanceOperation calls path on the instance manager of the instance
+// name.
+func CallInstanceOperation(ctx context.Context, instances []Instance, name, path string) error {
+	for _, inst := range instances {
+		if inst.Pod.Name != name {
+			continue
+		}
+		if path == instance.CheckpointPath {
+			return checkpointInstance(ctx, inst)
+		}
+		return callInstance(ctx, instanceClient, inst, path)
+	}
+	return fmt.Errorf("instance %s is not running", name)
+}
+
+// CaughtUpReplica reports whether the instance name of pg is a ready
+// replica close enough to the primary to be switched over to.
+func CaughtUpReplica(pg *dbv1alpha1.PostgresCluster, name string) bool {
+	for _, s := range pg.Status.Instances {
+		if s.Name == name {
+			return s.Ready && s.Role == instance.RoleReplica &&
+				s.ReplicationLagBytes != nil && *s.ReplicationLagBytes <= rolloutMaxLag
+		}
+	}
+	return false
+}
+
+// MostCaughtUpReplica is the caught up replica of pg with the least
+// replication lag, empty when there is none.
+func MostCaughtUpReplica(pg *dbv1alpha1.PostgresCluster) string {
+	target := ""
+	var targetLag int64
+	for _, s := range pg.Status.Instances {
+		if !CaughtUpReplica(pg, s.Name) {
+			continue
+		}
+		if target == "" || *s.ReplicationLagBytes < targetLag {
+			target, targetLag = s.Name, *s.ReplicationLagBytes
+		}
+	}
+	return target
+}
+
+// PrimaryDown reports whether no instance of pg runs as a ready primary,
+// the only case a replica is promoted without demoting the primary first.
+func PrimaryDown(pg *dbv1alpha1.PostgresCluster) bool {
+	for _, s := range pg.Status.Instances {
+		if s.Role == instance.RolePrimary && s.Ready {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package postgres
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+func TestBuildOperationJob(t *testing.T) {
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg"},
+		Spec:       dbv1alpha1.PostgresClusterSpec{Version: "16", SuperuserSecretName: "pg-superuser"},
+	}
+	op := &dbv1alpha1.PostgresOperation{
+		ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: "db"},
+		Spec: dbv1alpha1.PostgresOperationSpec{
+			ClusterName: "pg",
+			Type:        dbv1alpha1.OperationTypeVacuum,
+			Vacuum:      &dbv1alpha1.VacuumOptions{Analyze: true},
+		},
+	}
+
+	job := BuildOperationJob(op, pg)
+	if job.Name != "nightly-vacuum" || job.Namespace != "db" {
+		t.Errorf("job %s/%s, want db/nightly-vacuum", job.Namespace, job.Name)
+	}
+	command := job.Spec.Template.Spec.Containers[0].Command
+	if want := []string{"vacuumdb", "--analyze", "--all"}; !slices.Equal(command, want) {
+		t.Errorf("command = %q, want %q", command, want)
+	}
+
+	op.Spec.Type = dbv1alpha1.OperationTypeReindex
+	op.Spec.Vacuum = nil
+	op.Spec.Reindex = &dbv1alpha1.ReindexOptions{Concurrently: true}
+	op.Spec.Databases = []string{"app", "a'; DROP"}
+	command = BuildOperationJob(op, pg).Spec.Template.Spec.Containers[0].Command
+	want := []string{"sh", "-c", `for db in "$@"; do reindexdb --concurrently --dbname "$db" || exit 1; done`, "sh", "app", "a'; DROP"}
+	if !slices.Equal(command, want) {
+		t.Errorf("command = %q, want the databases passed as arguments %q", command, want)
+	}
+}
+
+func TestOperationJobName(t *testing.T) {
+	op := &dbv1alpha1.PostgresOperation{
+		ObjectMeta: metav1.ObjectMeta{Name: strings.Repeat("nightly-", 7) + "x"},
+		Spec:       dbv1alpha1.PostgresOperationSpec{Type: dbv1alpha1.OperationTypeReindex},
+	}
+	name := OperationJobName(op)
+	if len(name) > 63 || !strings.HasPrefix(name, "nightly-nightly-") {
+		t.Errorf("job name %q (%d characters), want it cut to 63", name, len(name))
+	}
+
+	other := op.DeepCopy()
+	other.Name += "y"
+	if OperationJobName(other) == name {
+		t.Errorf("operations %s and %s share the job %s", op.Name, other.Name, name)
+	}
+}
+
+func TestMostCaughtUpReplica(t *testing.T) {
+	replica := func(name string, ready bool, lag int64) dbv1alpha1.InstanceStatus {
+		return dbv1alpha1.InstanceStatus{Name: name, Role: instance.RoleReplica, Ready: ready, ReplicationLagBytes: ptr.To(lag)}
+	}
+	pg := &dbv1alpha1.PostgresCluster{
+		Status: dbv1alpha1.PostgresClusterStatus{
+			CurrentPrimary: "pg-0",
+			Instances: []dbv1alpha1.InstanceStatus{
+				{Name: "pg-0", Role: instance.RolePrimary, Ready: true},
+				replica("pg-1", true, 2048),
+				replica("pg-2", false, 0),
+				replica("pg-3", true, 1024),
+				replica("pg-4", true, rolloutMaxLag+1),
+			},
+		},
+	}
+
+	if got := MostCaughtUpReplica(pg); got != "pg-3" {
+		t.Errorf("MostCaughtUpReplica = %q, want the ready replica with the least lag", got)
+	}
+	if CaughtUpReplica(pg, "pg-4") || CaughtUpReplica(pg, "pg-0") {
+		t.Error("a lagging replica or the primary counted as caught up")
+	}
+	if PrimaryDown(pg) {
+		t.Error("primary reported down while it is ready")
+	}
+	pg.Status.Instances[0].Ready = false
+	if !PrimaryDown(pg) {
+		t.Error("primary not reported down while it is not ready")
+	}
+}
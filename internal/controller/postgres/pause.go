@@ -0,0 +1,25 @@
+package postgres
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+// ConditionReconciliationPaused is True while the operator keeps its
+// hands off a cluster.
+const ConditionReconciliationPaused = "ReconciliationPaused"
+
+// ReconciliationPaused reports whether the operator must keep its hands
+// off pg, see dbv1alpha1.ReconciliationPausedAnnotation, and records it in
+// the conditions of pg.
+func ReconciliationPaused(pg *dbv1alpha1.PostgresCluster) bool {
+	if pg.Annotations[dbv1alpha1.ReconciliationPausedAnnotation] != "true" {
+		meta.RemoveStatusCondition(&pg.Status.Conditions, ConditionReconciliationPaused)
+		return false
+	}
+	SetCondition(pg, ConditionReconciliationPaused, metav1.ConditionTrue, "Paused",
+		"Only the status is updated until the "+dbv1alpha1.ReconciliationPausedAnnotation+" annotation is removed")
+	return true
+}
@@ -0,0 +1,114 @@
+package postgres
+
+import (
+	"context"
+
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+func PrimaryPDBName(clusterName string) string {
+	return clusterName + "-primary"
+}
+
+func ReplicasPDBName(clusterName string) string {
+	return clusterName + "-replicas"
+}
+
+// BuildPrimaryPDB forbids evicting the primary: a drain waits for the
+// operator to switch over to an instance on another node, see
+// ReconcileDrainedPrimary.
+func BuildPrimaryPDB(pg *dbv1alpha1.PostgresCluster) *policyv1.PodDisruptionBudget {
+	return buildPDB(pg, PrimaryPDBName(pg.Name), instance.RolePrimary, 1)
+}
+
+// BuildReplicasPDB keeps a majority of the instances, the primary
+// included, available while replicas are evicted. One replica may always be
+// evicted, so that the node of either instance of a pair can be drained.
+func BuildReplicasPDB(pg *dbv1alpha1.PostgresCluster) *policyv1.PodDisruptionBudget {
+	minAvailable := min(pg.Spec.Instances/2, pg.Spec.Instances-2)
+	pdb := buildPDB(pg, ReplicasPDBName(pg.Name), instance.RoleReplica, max(minAvailable, 0))
+	// a replica that is not ready serves nobody
+	pdb.Spec.UnhealthyPodEvictionPolicy = ptr.To(policyv1.AlwaysAllow)
+	return pdb
+}
+
+func buildPDB(pg *dbv1alpha1.PostgresCluster, name, role string, minAvailable int32) *policyv1.PodDisruptionBudget {
+	selector := Labels(pg.Name)
+	selector[RoleLabel] = role
+
+	return &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: pg.Namespace,
+			Labels:    Labels(pg.Name),
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			MinAvailable: ptr.To(intstr.FromInt32(minAvailable)),
+			Selector:     &metav1.LabelSelector{MatchLabels: selector},
+		},
+	}
+}
+
+// ReconcilePodDisruptionBudgets keeps the budgets of the primary and of the
+// replicas in line with spec.instances. A single instance has no replica to
+// switch over to and gets none: draining its node evicts it like any pod.
+func ReconcilePodDisruptionBudgets(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+) error {
+	for _, desired := range []*policyv1.PodDisruptionBudget{BuildPrimaryPDB(pg), BuildReplicasPDB(pg)} {
+		if err := reconcilePDB(ctx, c, scheme, pg, desired, pg.Spec.Instances > 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func reconcilePDB(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+	desired *policyv1.PodDisruptionBudget,
+	wanted bool,
+) error {
+	var existing policyv1.PodDisruptionBudget
+	err := c.Get(ctx, client.ObjectKeyFromObject(desired), &existing)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	found := err == nil
+
+	if !wanted {
+		if !found {
+			return nil
+		}
+		return client.IgnoreNotFound(c.Delete(ctx, &existing))
+	}
+
+	if err := ctrl.SetControllerReference(pg, desired, scheme); err != nil {
+		return err
+	}
+	if !found {
+		return c.Create(ctx, desired)
+	}
+	if equality.Semantic.DeepEqual(existing.Spec, desired.Spec) {
+		return nil
+	}
+	existing.Spec = desired.Spec
+	existing.Labels = desired.Labels
+	return c.Update(ctx, &existing)
+}
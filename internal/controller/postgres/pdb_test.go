@@ -0,0 +1,129 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+func TestReplicasPDBKeepsQuorum(t *testing.T) {
+	for instances, want := range map[int32]int{2: 0, 3: 1, 4: 2, 5: 2, 7: 3} {
+		pg := &dbv1alpha1.PostgresCluster{
+			ObjectMeta: metav1.ObjectMeta{Name: "pg"},
+			Spec:       dbv1alpha1.PostgresClusterSpec{Instances: instances},
+		}
+		pdb := BuildReplicasPDB(pg)
+		if got := pdb.Spec.MinAvailable.IntValue(); got != want {
+			t.Errorf("%d instances: minAvailable = %d, want %d", instances, got, want)
+		}
+		if role := pdb.Spec.Selector.MatchLabels[RoleLabel]; role != instance.RoleReplica {
+			t.Errorf("selected role = %s, want replicas", role)
+		}
+	}
+}
+
+func TestReconcilePodDisruptionBudgets(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = dbv1alpha1.AddToScheme(scheme)
+
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg", Namespace: "db", UID: "uid"},
+		Spec:       dbv1alpha1.PostgresClusterSpec{Instances: 3},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	ctx := context.Background()
+
+	if err := ReconcilePodDisruptionBudgets(ctx, c, scheme, pg); err != nil {
+		t.Fatal(err)
+	}
+	primary := &policyv1.PodDisruptionBudget{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "db", Name: "pg-primary"}, primary); err != nil {
+		t.Fatal(err)
+	}
+	if primary.Spec.MinAvailable.IntValue() != 1 {
+		t.Errorf("primary minAvailable = %s, want 1", primary.Spec.MinAvailable)
+	}
+
+	pg.Spec.Instances = 5
+	if err := ReconcilePodDisruptionBudgets(ctx, c, scheme, pg); err != nil {
+		t.Fatal(err)
+	}
+	replicas := &policyv1.PodDisruptionBudget{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "db", Name: "pg-replicas"}, replicas); err != nil {
+		t.Fatal(err)
+	}
+	if replicas.Spec.MinAvailable.IntValue() != 2 {
+		t.Errorf("replicas minAvailable = %s after scaling to 5, want 2", replicas.Spec.MinAvailable)
+	}
+
+	pg.Spec.Instances = 1
+	if err := ReconcilePodDisruptionBudgets(ctx, c, scheme, pg); err != nil {
+		t.Fatal(err)
+	}
+	var pdbs policyv1.PodDisruptionBudgetList
+	if err := c.List(ctx, &pdbs); err != nil || len(pdbs.Items) != 0 {
+		t.Errorf("%d budgets left for a single instance, err %v", len(pdbs.Items), err)
+	}
+}
+
+func TestReconcileDrainedPrimary(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	node := func(name string, cordoned bool) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: corev1.NodeSpec{Unschedulable: cordoned}}
+	}
+	pod := func(name, node string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: corev1.PodSpec{NodeName: node}}
+	}
+	replica := func(name string, lag int64) dbv1alpha1.InstanceStatus {
+		return dbv1alpha1.InstanceStatus{Name: name, Role: instance.RoleReplica, Ready: true, ReplicationLagBytes: ptr.To(lag)}
+	}
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg"},
+		Status: dbv1alpha1.PostgresClusterStatus{
+			CurrentPrimary: "pg-0",
+			Instances: []dbv1alpha1.InstanceStatus{
+				{Name: "pg-0", Role: instance.RolePrimary, Ready: true},
+				replica("pg-1", 0),
+				replica("pg-2", 100),
+			},
+		},
+	}
+	instances := []Instance{{Pod: pod("pg-0", "a")}, {Pod: pod("pg-1", "b")}, {Pod: pod("pg-2", "c")}}
+	ctx := context.Background()
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(node("a", false), node("b", true), node("c", false)).Build()
+	if err := ReconcileDrainedPrimary(ctx, c, pg, instances); err != nil || pg.Status.TargetPrimary != "" {
+		t.Fatalf("target = %q, err %v, want no switchover off a schedulable node", pg.Status.TargetPrimary, err)
+	}
+
+	c = fake.NewClientBuilder().WithScheme(scheme).WithObjects(node("a", true), node("b", true), node("c", true)).Build()
+	if err := ReconcileDrainedPrimary(ctx, c, pg, instances); err != nil || pg.Status.TargetPrimary != "" {
+		t.Fatalf("target = %q, err %v, want no replica on a schedulable node", pg.Status.TargetPrimary, err)
+	}
+	if !meta.IsStatusConditionTrue(pg.Status.Conditions, ConditionDrainBlocked) {
+		t.Error("a drain without a replica to switch over to is not reported")
+	}
+
+	c = fake.NewClientBuilder().WithScheme(scheme).WithObjects(node("a", true), node("b", true), node("c", false)).Build()
+	if err := ReconcileDrainedPrimary(ctx, c, pg, instances); err != nil || pg.Status.TargetPrimary != "pg-2" {
+		t.Errorf("target = %q, err %v, want the replica on the schedulable node", pg.Status.TargetPrimary, err)
+	}
+	if meta.FindStatusCondition(pg.Status.Conditions, ConditionDrainBlocked) != nil {
+		t.Error("the drain is still reported blocked once a switchover started")
+	}
+}
@@ -0,0 +1,66 @@
+package postgres
+
+import (
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+// DefaultStartupTimeoutSeconds is how long an instance may take to start
+// when spec.probes.startupTimeoutSeconds is not set.
+const DefaultStartupTimeoutSeconds = 3600
+
+const probePeriodSeconds = 10
+
+// StartupProbe gives an instance spec.probes.startupTimeoutSeconds to
+// accept connections, the liveness probe only starts afterwards.
+func StartupProbe(cluster *dbv1alpha1.PostgresCluster) *corev1.Probe {
+	timeout := int32(DefaultStartupTimeoutSeconds)
+	if cluster.Spec.Probes != nil && cluster.Spec.Probes.StartupTimeoutSeconds != nil {
+		timeout = *cluster.Spec.Probes.StartupTimeoutSeconds
+	}
+
+	probe := instanceProbe(instance.StartupPath)
+	probe.FailureThreshold = (timeout + probePeriodSeconds - 1) / probePeriodSeconds
+	return probe
+}
+
+// LivenessProbe restarts an instance whose PostgreSQL stops responding.
+func LivenessProbe() *corev1.Probe {
+	return instanceProbe(instance.HealthPath)
+}
+
+// ReadinessProbe takes an instance out of the Services while it can not
+// serve clients, see spec.probes.maxReplicationLag.
+func ReadinessProbe() *corev1.Probe {
+	return instanceProbe(instance.ReadyPath)
+}
+
+// probesEnv configures the probes served by the instance manager.
+func probesEnv(cluster *dbv1alpha1.PostgresCluster) []corev1.EnvVar {
+	if cluster.Spec.Probes == nil || cluster.Spec.Probes.MaxReplicationLag == nil {
+		return nil
+	}
+	return []corev1.EnvVar{{
+		Name:  instance.EnvMaxReplicationLag,
+		Value: strconv.FormatInt(cluster.Spec.Probes.MaxReplicationLag.Value(), 10),
+	}}
+}
+
+func instanceProbe(path string) *corev1.Probe {
+	return &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path: path,
+				Port: intstr.FromString(apiPortName),
+			},
+		},
+		PeriodSeconds:    probePeriodSeconds,
+		TimeoutSeconds:   5,
+		FailureThreshold: 3,
+	}
+}
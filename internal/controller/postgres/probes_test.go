@@ -0,0 +1,30 @@
+package postgres
+
+import (
+	"testing"
+
+	"k8s.io/utils/ptr"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+func TestStartupProbe(t *testing.T) {
+	tests := []struct {
+		timeout *int32
+		want    int32
+	}{
+		{timeout: nil, want: 360},
+		{timeout: ptr.To[int32](7200), want: 720},
+		// rounded up, the instance gets at least the timeout
+		{timeout: ptr.To[int32](15), want: 2},
+	}
+	for _, tt := range tests {
+		pg := &dbv1alpha1.PostgresCluster{}
+		if tt.timeout != nil {
+			pg.Spec.Probes = &dbv1alpha1.ProbesSpec{StartupTimeoutSeconds: tt.timeout}
+		}
+		if got := StartupProbe(pg).FailureThreshold; got != tt.want {
+			t.Errorf("failureThreshold for %v = %d, want %d", tt.timeout, got, tt.want)
+		}
+	}
+}
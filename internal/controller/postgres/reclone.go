@@ -0,0 +1,167 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+// instanceOrdinal is the ordinal of the instance of pg whose pod is called
+// name, if it is one of spec.instances.
+func instanceOrdinal(pg *dbv1alpha1.PostgresCluster, name string) (int32, bool) {
+	ordinal, ok := strings.CutPrefix(name, pg.Name+"-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(ordinal, 10, 32)
+	if err != nil || n < 0 || int32(n) >= pg.Spec.Instances {
+		return 0, false
+	}
+	return int32(n), true
+}
+
+// recloneFromSnapshot reports whether the instance ordinal of pg is
+// re-cloned like a new replica, from the latest snapshot backup. The
+// StatefulSet can only be held below the last instance, the others are
+// cloned from the primary by their instance manager.
+func recloneFromSnapshot(pg *dbv1alpha1.PostgresCluster, ordinal int32) bool {
+	return ReplicaSnapshotsEnabled(pg) && ordinal > 0 && ordinal == pg.Spec.Instances-1
+}
+
+// RecloneInProgress returns the ordinal of the instance re-cloned from a
+// snapshot backup. The StatefulSet is kept below it until its new volume is
+// provisioned by ReconcileSnapshotVolumes.
+func RecloneInProgress(pg *dbv1alpha1.PostgresCluster) (int32, bool) {
+	s := pg.Status.Reclone
+	if s == nil || (s.Phase != dbv1alpha1.RecloneDeletingVolume && s.Phase != dbv1alpha1.RecloneCloning) {
+		return 0, false
+	}
+	ordinal, ok := instanceOrdinal(pg, s.Instance)
+	if !ok || !recloneFromSnapshot(pg, ordinal) {
+		return 0, false
+	}
+	return ordinal, true
+}
+
+// ReconcileReclone re-clones the instance named by
+// dbv1alpha1.RecloneInstanceAnnotation: its data volume and its pod are
+// deleted, the StatefulSet recreates both and the instance manager clones
+// the empty volume from the primary, unless it is restored from a snapshot
+// backup. It reports true once the re-clone succeeded or was refused, for
+// the annotation to be removed.
+func ReconcileReclone(ctx context.Context, c client.Client, pg *dbv1alpha1.PostgresCluster, instances []Instance) (bool, error) {
+	name, ok := pg.Annotations[dbv1alpha1.RecloneInstanceAnnotation]
+	if !ok {
+		return false, nil
+	}
+	name = strings.TrimSpace(name)
+	logger := log.FromContext(ctx)
+
+	s := pg.Status.Reclone
+	if s == nil || s.Instance != name || s.Phase == dbv1alpha1.RecloneSucceeded || s.Phase == dbv1alpha1.RecloneFailed {
+		s = &dbv1alpha1.RecloneStatus{
+			Instance:  name,
+			Phase:     dbv1alpha1.RecloneDeletingVolume,
+			StartTime: metav1.Now(),
+		}
+		pg.Status.Reclone = s
+
+		if _, ok := instanceOrdinal(pg, name); !ok {
+			finishReclone(s, dbv1alpha1.RecloneFailed, fmt.Sprintf("%s is not an instance of the cluster", name))
+			return true, nil
+		}
+		if name == CurrentPrimary(pg) {
+			finishReclone(s, dbv1alpha1.RecloneFailed, "The primary is not re-cloned, switch over to another instance first")
+			return true, nil
+		}
+		logger.Info("Re-cloning instance", "instance", name)
+	}
+
+	switch s.Phase {
+	case dbv1alpha1.RecloneDeletingVolume:
+		// the instance is cloned from the primary, whose switchover or
+		// upgrade is seen through first
+		if pg.Status.TargetPrimary != "" || MajorUpgradeInProgress(pg) || !primaryReady(pg) {
+			s.Message = "Waiting for the primary to be ready"
+			return false, nil
+		}
+		if name == CurrentPrimary(pg) {
+			finishReclone(s, dbv1alpha1.RecloneFailed, "The instance was promoted, it is not re-cloned")
+			return true, nil
+		}
+
+		ordinal, _ := instanceOrdinal(pg, name)
+		s.Source = CurrentPrimary(pg)
+		if recloneFromSnapshot(pg, ordinal) {
+			latest, err := LatestSnapshotBackup(ctx, c, pg)
+			if err != nil {
+				return false, err
+			}
+			if latest != nil {
+				s.Source = latest.Name
+			}
+		}
+
+		// the volume is only gone once the pod no longer uses it, the
+		// StatefulSet waits for it before creating a new one
+		pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: DataPVCName(pg.Name, ordinal), Namespace: pg.Namespace}}
+		if err := client.IgnoreNotFound(c.Delete(ctx, pvc)); err != nil {
+			return false, err
+		}
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: pg.Namespace}}
+		if err := client.IgnoreNotFound(c.Delete(ctx, pod)); err != nil {
+			return false, err
+		}
+		logger.Info("Deleted the data volume of the instance", "instance", name, "pvc", pvc.Name, "source", s.Source)
+		s.Phase = dbv1alpha1.RecloneCloning
+		s.Message = fmt.Sprintf("Cloning %s from %s", name, s.Source)
+		return false, nil
+
+	case dbv1alpha1.RecloneCloning:
+		if !recloneCaughtUp(pg, instances, name, s.StartTime) {
+			return false, nil
+		}
+		logger.Info("Re-cloned instance", "instance", name, "source", s.Source)
+		finishReclone(s, dbv1alpha1.RecloneSucceeded, fmt.Sprintf("%s is cloned from %s and streams from the primary", name, s.Source))
+		return true, nil
+	}
+	return false, nil
+}
+
+func finishReclone(s *dbv1alpha1.RecloneStatus, phase, message string) {
+	s.Phase = phase
+	s.Message = message
+	s.CompletionTime = ptr.To(metav1.Now())
+}
+
+// primaryReady reports whether the primary of pg is ready to be cloned.
+func primaryReady(pg *dbv1alpha1.PostgresCluster) bool {
+	for _, s := range pg.Status.Instances {
+		if s.Name == CurrentPrimary(pg) {
+			return s.Ready && s.Role == instance.RolePrimary
+		}
+	}
+	return false
+}
+
+// recloneCaughtUp reports whether the instance name runs in a pod created
+// since the re-clone started and is a ready replica caught up with the
+// primary.
+func recloneCaughtUp(pg *dbv1alpha1.PostgresCluster, instances []Instance, name string, since metav1.Time) bool {
+	for _, inst := range instances {
+		if inst.Pod.Name == name && !inst.Pod.CreationTimestamp.Before(&since) {
+			return CaughtUpReplica(pg, name)
+		}
+	}
+	return false
+}
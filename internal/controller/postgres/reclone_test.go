@@ -0,0 +1,175 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+func TestReconcileReclone(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = dbv1alpha1.AddToScheme(scheme)
+
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pg",
+			Namespace:   "db",
+			Annotations: map[string]string{dbv1alpha1.RecloneInstanceAnnotation: "pg-1"},
+		},
+		Spec: dbv1alpha1.PostgresClusterSpec{Instances: 3},
+		Status: dbv1alpha1.PostgresClusterStatus{
+			CurrentPrimary: "pg-0",
+			Instances: []dbv1alpha1.InstanceStatus{
+				{Name: "pg-0", Role: instance.RolePrimary, Ready: true},
+				{Name: "pg-1", Ready: false},
+			},
+		},
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:              "pg-1",
+		Namespace:         "db",
+		CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Hour)),
+	}}
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data-pg-1", Namespace: "db"}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pod, pvc).Build()
+	ctx := context.Background()
+
+	done, err := ReconcileReclone(ctx, c, pg, []Instance{{Pod: pod}})
+	if err != nil || done {
+		t.Fatalf("done = %v, err %v, want the re-clone started", done, err)
+	}
+	if s := pg.Status.Reclone; s.Phase != dbv1alpha1.RecloneCloning || s.Source != "pg-0" {
+		t.Errorf("reclone status = %+v, want cloning from the primary", s)
+	}
+	for _, obj := range []client.Object{&corev1.Pod{}, &corev1.PersistentVolumeClaim{}} {
+		name := "pg-1"
+		if _, ok := obj.(*corev1.PersistentVolumeClaim); ok {
+			name = "data-pg-1"
+		}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: "db", Name: name}, obj); !apierrors.IsNotFound(err) {
+			t.Errorf("%s not deleted: %v", name, err)
+		}
+	}
+
+	// the old pod is still reported until the StatefulSet recreates it
+	if done, _ := ReconcileReclone(ctx, c, pg, []Instance{{Pod: pod}}); done {
+		t.Fatal("re-clone done with the old pod")
+	}
+
+	recreated := pod.DeepCopy()
+	recreated.CreationTimestamp = metav1.Now()
+	pg.Status.Instances[1] = dbv1alpha1.InstanceStatus{
+		Name: "pg-1", Role: instance.RoleReplica, Ready: true, ReplicationLagBytes: ptr.To[int64](0),
+	}
+	done, err = ReconcileReclone(ctx, c, pg, []Instance{{Pod: recreated}})
+	if err != nil || !done || pg.Status.Reclone.Phase != dbv1alpha1.RecloneSucceeded {
+		t.Errorf("done = %v, err %v, status %+v, want the re-clone succeeded", done, err, pg.Status.Reclone)
+	}
+
+	for _, name := range []string{"pg-0", "pg-3", "other-1"} {
+		pg.Annotations[dbv1alpha1.RecloneInstanceAnnotation] = name
+		done, err := ReconcileReclone(ctx, c, pg, nil)
+		if err != nil || !done || pg.Status.Reclone.Phase != dbv1alpha1.RecloneFailed {
+			t.Errorf("re-clone of %s: done = %v, err %v, status %+v, want it refused", name, done, err, pg.Status.Reclone)
+		}
+	}
+}
+
+// The first instance is re-cloned from the primary after a switchover,
+// it is never initialized nor recovered again.
+func TestRecloneFirstInstance(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = dbv1alpha1.AddToScheme(scheme)
+
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pg",
+			Namespace:   "db",
+			Annotations: map[string]string{dbv1alpha1.RecloneInstanceAnnotation: "pg-0"},
+		},
+		Spec: dbv1alpha1.PostgresClusterSpec{
+			Instances: 2,
+			Bootstrap: &dbv1alpha1.BootstrapSpec{
+				Recovery: &dbv1alpha1.RecoverySpec{
+					Source: dbv1alpha1.ObjectStoreSpec{Endpoint: "http://minio:9000", Bucket: "b", Path: "db/orders"},
+				},
+			},
+		},
+		Status: dbv1alpha1.PostgresClusterStatus{
+			CurrentPrimary: "pg-1",
+			Instances: []dbv1alpha1.InstanceStatus{
+				{Name: "pg-0", Ready: false},
+				{Name: "pg-1", Role: instance.RolePrimary, Ready: true},
+			},
+		},
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:              "pg-0",
+		Namespace:         "db",
+		CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Hour)),
+	}}
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data-pg-0", Namespace: "db"}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pod, pvc).Build()
+	ctx := context.Background()
+
+	done, err := ReconcileReclone(ctx, c, pg, []Instance{{Pod: pod}})
+	if err != nil || done {
+		t.Fatalf("done = %v, err %v, want the re-clone started", done, err)
+	}
+	if s := pg.Status.Reclone; s.Phase != dbv1alpha1.RecloneCloning || s.Source != "pg-1" {
+		t.Errorf("reclone status = %+v, want cloning from the primary", s)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(pvc), &corev1.PersistentVolumeClaim{}); !apierrors.IsNotFound(err) {
+		t.Errorf("data-pg-0 not deleted: %v", err)
+	}
+
+	// the empty volume is cloned, not initialized nor recovered
+	if !Initialized(pg) {
+		t.Error("a cluster that ran a primary is not initialized")
+	}
+	if _, ok := BuildConfigMap(pg).Data[instance.BootstrapKey]; ok {
+		t.Errorf("%s kept in the configuration of an initialized cluster", instance.BootstrapKey)
+	}
+
+	pg.Status.Instances = nil
+	if _, ok := BuildConfigMap(pg).Data[instance.BootstrapKey]; !ok {
+		t.Errorf("%s missing from the configuration of a new cluster", instance.BootstrapKey)
+	}
+}
+
+func TestRecloneInProgress(t *testing.T) {
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg"},
+		Spec: dbv1alpha1.PostgresClusterSpec{
+			Instances: 3,
+			ReplicaBootstrap: &dbv1alpha1.ReplicaBootstrapSpec{
+				VolumeSnapshot: true,
+			},
+		},
+		Status: dbv1alpha1.PostgresClusterStatus{
+			Reclone: &dbv1alpha1.RecloneStatus{Instance: "pg-2", Phase: dbv1alpha1.RecloneCloning},
+		},
+	}
+	if ordinal, ok := RecloneInProgress(pg); !ok || ordinal != 2 {
+		t.Errorf("RecloneInProgress = %d, %v, want the last instance held", ordinal, ok)
+	}
+
+	pg.Status.Reclone.Instance = "pg-1"
+	if _, ok := RecloneInProgress(pg); ok {
+		t.Error("an instance other than the last one held")
+	}
+}
@@ -0,0 +1,155 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+	"github.com/nikitadada/atlasdb/internal/objectstore"
+)
+
+const (
+	ConditionRecovered = "Recovered"
+
+	restoreContainerName = "restore"
+)
+
+// RecoveryEnabled reports whether pg is bootstrapped from a backup.
+func RecoveryEnabled(pg *dbv1alpha1.PostgresCluster) bool {
+	return pg.Spec.Bootstrap != nil && pg.Spec.Bootstrap.Recovery != nil
+}
+
+// RecoveryEnv describes the recovery source and target to the instance
+// manager.
+func RecoveryEnv(pg *dbv1alpha1.PostgresCluster) []corev1.EnvVar {
+	recovery := pg.Spec.Bootstrap.Recovery
+	env := ObjectStoreEnv(objectstore.RecoveryEnvPrefix, &recovery.Source,
+		ObjectStorePrefix(pg, &recovery.Source))
+
+	add := func(name, value string) {
+		if value != "" {
+			env = append(env, corev1.EnvVar{Name: name, Value: value})
+		}
+	}
+
+	add(instance.EnvRecoveryBackupID, recovery.BackupID)
+	if target := recovery.Target; target != nil {
+		add(instance.EnvRecoveryTargetTime, target.Time)
+		add(instance.EnvRecoveryTargetLSN, target.LSN)
+		add(instance.EnvRecoveryTargetXID, target.XID)
+		add(instance.EnvRecoveryTargetName, target.Name)
+		if target.Exclusive {
+			add(instance.EnvRecoveryExclusive, "true")
+		}
+	}
+
+	return env
+}
+
+// ValidateRecovery catches mistakes that would otherwise only show up once
+// the restore is running.
+func ValidateRecovery(pg *dbv1alpha1.PostgresCluster) error {
+	recovery := pg.Spec.Bootstrap.Recovery
+
+	// the default path is the one of the new cluster, not of the source
+	if recovery.Source.Path == "" {
+		return fmt.Errorf("source.path is required, set it to the archive path of the source cluster")
+	}
+
+	if target := recovery.Target; target != nil {
+		set := 0
+		for _, v := range []string{target.Time, target.LSN, target.XID, target.Name} {
+			if v != "" {
+				set++
+			}
+		}
+		if set > 1 {
+			return fmt.Errorf("only one of time, lsn, xid and name can be set as recovery target")
+		}
+	}
+
+	if recovery.BackupID != "" && recovery.VolumeSnapshots != nil {
+		return fmt.Errorf("backupID and volumeSnapshots are mutually exclusive")
+	}
+
+	if ArchivingEnabled(pg) {
+		archive := pg.Spec.Backup.ObjectStore
+		if archive.Endpoint == recovery.Source.Endpoint &&
+			archive.Bucket == recovery.Source.Bucket &&
+			ObjectStorePrefix(pg, archive) == ObjectStorePrefix(pg, &recovery.Source) {
+			return fmt.Errorf("the cluster must not archive into the object store path it recovers from")
+		}
+	}
+
+	return nil
+}
+
+// UpdateRecoveryStatus tracks the progress of the recovery of the first
+// instance in the Recovered condition. Once recovery has completed the
+// condition stays true for the lifetime of the cluster.
+func UpdateRecoveryStatus(
+	ctx context.Context,
+	c client.Client,
+	pg *dbv1alpha1.PostgresCluster,
+) error {
+	if !RecoveryEnabled(pg) || meta.IsStatusConditionTrue(pg.Status.Conditions, ConditionRecovered) {
+		return nil
+	}
+
+	setCondition := func(status metav1.ConditionStatus, reason, message string) {
+		meta.SetStatusCondition(&pg.Status.Conditions, metav1.Condition{
+			Type:               ConditionRecovered,
+			Status:             status,
+			Reason:             reason,
+			Message:            message,
+			ObservedGeneration: pg.Generation,
+		})
+	}
+
+	if err := ValidateRecovery(pg); err != nil {
+		setCondition(metav1.ConditionFalse, "InvalidRecovery", err.Error())
+		return nil
+	}
+
+	pod := &corev1.Pod{}
+	err := c.Get(ctx, client.ObjectKey{Name: pg.Name + "-0", Namespace: pg.Namespace}, pod)
+	if apierrors.IsNotFound(err) {
+		setCondition(metav1.ConditionFalse, "Pending", "Waiting for the first instance to be created")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, status := range pod.Status.InitContainerStatuses {
+		if status.Name != restoreContainerName {
+			continue
+		}
+		if terminated := status.State.Terminated; terminated != nil && terminated.ExitCode != 0 {
+			setCondition(metav1.ConditionFalse, "RecoveryFailed",
+				fmt.Sprintf("Restoring the base backup failed: %s", terminated.Message))
+			return nil
+		}
+		if status.State.Terminated == nil {
+			setCondition(metav1.ConditionFalse, "RestoringBaseBackup", "Downloading the base backup")
+			return nil
+		}
+	}
+
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue {
+			setCondition(metav1.ConditionTrue, "TargetReached", "Recovery target reached, the instance was promoted")
+			return nil
+		}
+	}
+
+	setCondition(metav1.ConditionFalse, "ReplayingWAL", "Replaying archived WAL up to the recovery target")
+	return nil
+}
@@ -0,0 +1,37 @@
+package postgres
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+func TestValidateRecovery(t *testing.T) {
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "orders-restore", Namespace: "db"},
+		Spec: dbv1alpha1.PostgresClusterSpec{
+			Bootstrap: &dbv1alpha1.BootstrapSpec{
+				Recovery: &dbv1alpha1.RecoverySpec{
+					Source: dbv1alpha1.ObjectStoreSpec{Endpoint: "http://minio:9000", Bucket: "b"},
+				},
+			},
+		},
+	}
+	if err := ValidateRecovery(pg); err == nil {
+		t.Error("recovery without source.path accepted, it would look for the archive of orders-restore")
+	}
+
+	pg.Spec.Bootstrap.Recovery.Source.Path = "db/orders"
+	if err := ValidateRecovery(pg); err != nil {
+		t.Errorf("recovery from db/orders: %v", err)
+	}
+
+	pg.Spec.Backup = &dbv1alpha1.BackupSpec{
+		ObjectStore: &dbv1alpha1.ObjectStoreSpec{Endpoint: "http://minio:9000", Bucket: "b", Path: "db/orders"},
+	}
+	if err := ValidateRecovery(pg); err == nil {
+		t.Error("archiving into the path recovered from accepted")
+	}
+}
@@ -0,0 +1,234 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/objectstore"
+)
+
+// RetentionPolicy is the parsed form of spec.backup.retentionPolicy. Exactly
+// one of its fields is set.
+type RetentionPolicy struct {
+	// RecoveryWindow keeps every backup needed to recover to any point in
+	// the last RecoveryWindow.
+	RecoveryWindow time.Duration
+	// KeepLast keeps the KeepLast most recent backups.
+	KeepLast int
+}
+
+var retentionPolicyRe = regexp.MustCompile(`^(?:([1-9][0-9]*)([dw])|keep-last-([1-9][0-9]*))$`)
+
+// ParseRetentionPolicy accepts a recovery window such as 30d or 4w, or
+// keep-last-N.
+func ParseRetentionPolicy(s string) (RetentionPolicy, error) {
+	m := retentionPolicyRe.FindStringSubmatch(s)
+	if m == nil {
+		return RetentionPolicy{}, fmt.Errorf("invalid retention policy %q, expected e.g. 30d, 4w or keep-last-7", s)
+	}
+
+	if m[3] != "" {
+		n, _ := strconv.Atoi(m[3])
+		return RetentionPolicy{KeepLast: n}, nil
+	}
+
+	n, _ := strconv.Atoi(m[1])
+	day := 24 * time.Hour
+	if m[2] == "w" {
+		return RetentionPolicy{RecoveryWindow: time.Duration(n) * 7 * day}, nil
+	}
+	return RetentionPolicy{RecoveryWindow: time.Duration(n) * day}, nil
+}
+
+// Expired splits backups (sorted oldest first) into the ones to keep and
+// the ones that are no longer needed. The most recent backup is always kept.
+// For a recovery window, the newest backup that completed before the window
+// started is kept as well, since recovering to the start of the window has
+// to begin from it.
+func (p RetentionPolicy) Expired(backups []objectstore.BackupInfo, now time.Time) (keep, expired []objectstore.BackupInfo) {
+	if len(backups) == 0 {
+		return nil, nil
+	}
+
+	first := len(backups) - 1
+	switch {
+	case p.KeepLast > 0:
+		first = max(len(backups)-p.KeepLast, 0)
+	case p.RecoveryWindow > 0:
+		windowStart := now.Add(-p.RecoveryWindow)
+		for first > 0 && backups[first].StopTime.After(windowStart) {
+			first--
+		}
+	}
+
+	return backups[first:], backups[:first]
+}
+
+// ApplyRetention removes expired base backups, the VolumeSnapshots of expired
+// snapshot backups and the WAL no remaining backup needs, marks the matching
+// PostgresBackups as expired and records the recoverability window in the
+// cluster status.
+func ApplyRetention(
+	ctx context.Context,
+	c client.Client,
+	pg *dbv1alpha1.PostgresCluster,
+) error {
+	store := pg.Spec.Backup.ObjectStore
+	prefix := ObjectStorePrefix(pg, store)
+
+	storeClient, err := NewObjectStoreClient(ctx, c, pg.Namespace, store)
+	if err != nil {
+		return err
+	}
+
+	backups, err := storeClient.ListBackups(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	// snapshot backups need the archived WAL just as much
+	snapshotBackups, err := completedSnapshotBackups(ctx, c, pg)
+	if err != nil {
+		return err
+	}
+	snapshots := map[string]*dbv1alpha1.PostgresBackup{}
+	for i := range snapshotBackups {
+		backup := &snapshotBackups[i]
+		snapshots[backup.Status.BackupID] = backup
+		backups = append(backups, objectstore.BackupInfo{
+			ID:        backup.Status.BackupID,
+			Timeline:  backup.Status.Timeline,
+			BeginLSN:  backup.Status.BeginLSN,
+			EndLSN:    backup.Status.EndLSN,
+			BeginWAL:  backup.Status.BeginWAL,
+			EndWAL:    backup.Status.EndWAL,
+			StartTime: backup.Status.StartedAt.Time,
+			StopTime:  backup.Status.StoppedAt.Time,
+		})
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].StopTime.Before(backups[j].StopTime)
+	})
+
+	keep, expired := backups, []objectstore.BackupInfo(nil)
+	if pg.Spec.Backup.RetentionPolicy != "" {
+		policy, err := ParseRetentionPolicy(pg.Spec.Backup.RetentionPolicy)
+		if err != nil {
+			return err
+		}
+		keep, expired = policy.Expired(backups, time.Now())
+	}
+
+	for _, backup := range expired {
+		if snapshot, ok := snapshots[backup.ID]; ok {
+			err = DeleteSnapshots(ctx, c, snapshot)
+		} else {
+			err = deleteBackup(ctx, storeClient, prefix, backup.ID)
+		}
+		if err != nil {
+			return err
+		}
+		if err := markBackupExpired(ctx, c, pg, backup.ID); err != nil {
+			return err
+		}
+	}
+
+	if len(keep) == 0 {
+		pg.Status.FirstRecoverabilityPoint = nil
+		pg.Status.LastSuccessfulBackup = ""
+		return nil
+	}
+
+	if err := pruneWAL(ctx, storeClient, prefix, keep[0].BeginWAL); err != nil {
+		return err
+	}
+
+	oldest, newest := keep[0], keep[len(keep)-1]
+	pg.Status.FirstRecoverabilityPoint = &metav1.Time{Time: oldest.StopTime}
+	pg.Status.LastSuccessfulBackup = newest.ID
+
+	lastPoint := newest.StopTime
+	if pg.Status.LastArchivedWALTime != nil && pg.Status.LastArchivedWALTime.After(lastPoint) {
+		lastPoint = pg.Status.LastArchivedWALTime.Time
+	}
+	pg.Status.LastRecoverabilityPoint = &metav1.Time{Time: lastPoint}
+
+	return nil
+}
+
+func deleteBackup(ctx context.Context, store *objectstore.Client, prefix, id string) error {
+	objects, err := store.List(ctx, objectstore.BackupKey(prefix, id, ""))
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if err := store.Delete(ctx, obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneWAL deletes the WAL segments preceding oldestWAL. Timeline history
+// files are small and needed to follow timeline switches, they are kept.
+func pruneWAL(ctx context.Context, store *objectstore.Client, prefix, oldestWAL string) error {
+	if len(oldestWAL) != 24 {
+		return nil
+	}
+
+	objects, err := store.List(ctx, objectstore.WALPrefix(prefix))
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objects {
+		name := objectstore.WALName(obj.Key)
+		if len(name) != 24 || strings.Contains(name, ".") {
+			continue
+		}
+		// compare log and segment numbers, whatever the timeline
+		if name[8:] >= oldestWAL[8:] {
+			continue
+		}
+		if err := store.Delete(ctx, obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func markBackupExpired(
+	ctx context.Context,
+	c client.Client,
+	pg *dbv1alpha1.PostgresCluster,
+	backupID string,
+) error {
+	var backups dbv1alpha1.PostgresBackupList
+	if err := c.List(ctx, &backups, client.InNamespace(pg.Namespace)); err != nil {
+		return err
+	}
+
+	for i := range backups.Items {
+		backup := &backups.Items[i]
+		if backup.Spec.ClusterName != pg.Name ||
+			backup.Status.BackupID != backupID ||
+			backup.Status.Phase == dbv1alpha1.BackupPhaseExpired {
+			continue
+		}
+
+		backup.Status.Phase = dbv1alpha1.BackupPhaseExpired
+		if err := c.Status().Update(ctx, backup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package postgres
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nikitadada/atlasdb/internal/objectstore"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	for in, want := range map[string]RetentionPolicy{
+		"30d":         {RecoveryWindow: 30 * 24 * time.Hour},
+		"2w":          {RecoveryWindow: 14 * 24 * time.Hour},
+		"keep-last-5": {KeepLast: 5},
+	} {
+		got, err := ParseRetentionPolicy(in)
+		if err != nil || got != want {
+			t.Errorf("ParseRetentionPolicy(%q) = %+v, %v, want %+v", in, got, err, want)
+		}
+	}
+
+	for _, in := range []string{"", "0d", "30", "keep-last-0", "1y"} {
+		if _, err := ParseRetentionPolicy(in); err == nil {
+			t.Errorf("ParseRetentionPolicy(%q) should fail", in)
+		}
+	}
+}
+
+func TestRetentionPolicyExpired(t *testing.T) {
+	now := time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC)
+	day := func(d int) objectstore.BackupInfo {
+		return objectstore.BackupInfo{ID: now.AddDate(0, 0, -d).Format("0102"), StopTime: now.AddDate(0, 0, -d)}
+	}
+	backups := []objectstore.BackupInfo{day(20), day(10), day(5), day(1)}
+
+	ids := func(bs []objectstore.BackupInfo) (out []string) {
+		for _, b := range bs {
+			out = append(out, b.ID)
+		}
+		return out
+	}
+
+	keep, expired := RetentionPolicy{KeepLast: 2}.Expired(backups, now)
+	if len(keep) != 2 || len(expired) != 2 || keep[0].ID != day(5).ID {
+		t.Errorf("keep-last-2: keep %v, expired %v", ids(keep), ids(expired))
+	}
+
+	// the 10 days old backup is needed to recover to 7 days ago
+	keep, expired = RetentionPolicy{RecoveryWindow: 7 * 24 * time.Hour}.Expired(backups, now)
+	if len(keep) != 3 || len(expired) != 1 || expired[0].ID != day(20).ID {
+		t.Errorf("7d: keep %v, expired %v", ids(keep), ids(expired))
+	}
+
+	// the latest backup is never expired
+	keep, _ = RetentionPolicy{RecoveryWindow: time.Hour}.Expired(backups, now.AddDate(1, 0, 0))
+	if len(keep) != 1 || keep[0].ID != day(1).ID {
+		t.Errorf("expired window: keep %v", ids(keep))
+	}
+}
@@ -0,0 +1,204 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+	appsv1 "k8s.io/api/apps/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// rolloutMaxLag is how far behind the primary a replica may be for the
+// rollout to go on, one WAL segment.
+const rolloutMaxLag = 16 * 1024 * 1024
+
+// ReconcileRollout moves the instances of pg to the current revision of the
+// pod template of sts, which uses the OnDelete strategy. Outdated replicas
+// are restarted one at a time, each once every instance is ready and caught
+// up. The primary goes last: the most caught up replica is switched over to
+// first, then the former primary is restarted as a replica. A single
+// instance is simply restarted.
+//
+// It is called once every instance is ready and reports whether the rollout
+// is complete. Otherwise it sets the Progressing condition. A step deferred
+// to the maintenance window counts as complete.
+func ReconcileRollout(
+	ctx context.Context,
+	c client.Client,
+	pg *dbv1alpha1.PostgresCluster,
+	sts *appsv1.StatefulSet,
+	instances []Instance,
+) (bool, error) {
+	logger := log.FromContext(ctx)
+	primary := CurrentPrimary(pg)
+
+	var outdated []Instance
+	var primaryInstance *Instance
+	for i, inst := range instances {
+		if inst.Pod.Labels[appsv1.StatefulSetRevisionLabel] == sts.Status.UpdateRevision {
+			continue
+		}
+		if inst.Pod.Name == primary {
+			primaryInstance = &instances[i]
+		} else {
+			outdated = append(outdated, inst)
+		}
+	}
+	if len(outdated) == 0 && primaryInstance == nil {
+		for _, op := range []string{OperationRestart, OperationMinorUpgrade, OperationSwitchover} {
+			clearPendingOperation(pg, op)
+		}
+		return true, nil
+	}
+
+	// every step waits for the maintenance window, the cluster is ready in
+	// between
+	pending := outdated
+	if primaryInstance != nil {
+		pending = append(slices.Clone(outdated), *primaryInstance)
+	}
+	op, message := rolloutOperation(sts, pending)
+	target := ""
+	if len(outdated) == 0 {
+		if target = switchoverTarget(pg, instances, sts.Status.UpdateRevision); target != "" {
+			op, message = OperationSwitchover, fmt.Sprintf("Switchover from %s to %s to update the primary", primary, target)
+		}
+	}
+	if !allowDisruption(pg, op, message, time.Now()) {
+		return true, nil
+	}
+
+	if replica := laggingReplica(pg); replica != "" {
+		SetProgressing(pg, "RollingUpdate", fmt.Sprintf("Waiting for %s to catch up with the primary", replica))
+		return false, nil
+	}
+
+	if len(outdated) > 0 {
+		pod := outdated[len(outdated)-1].Pod
+		logger.Info("Restarting replica to update it", "instance", pod.Name)
+		SetProgressing(pg, "RollingUpdate", fmt.Sprintf("Restarting replica %s", pod.Name))
+		return false, client.IgnoreNotFound(c.Delete(ctx, pod))
+	}
+
+	if target != "" {
+		logger.Info("Switching over before updating the primary", "primary", primary, "target", target)
+		pg.Status.TargetPrimary = target
+		return false, switchover(ctx, pg, instances, target)
+	}
+
+	pod := primaryInstance.Pod
+	if err := checkpointInstance(ctx, *primaryInstance); err != nil {
+		logger.Error(err, "Failed to checkpoint before restart", "instance", pod.Name)
+	}
+	logger.Info("Restarting primary to update it", "instance", pod.Name)
+	SetProgressing(pg, "RollingUpdate", fmt.Sprintf("Restarting primary %s", pod.Name))
+	return false, client.IgnoreNotFound(c.Delete(ctx, pod))
+}
+
+// rolloutOperation describes the restart of the outdated instances: a minor
+// upgrade when the image of one differs from the one of the pod template.
+func rolloutOperation(sts *appsv1.StatefulSet, outdated []Instance) (string, string) {
+	image := ""
+	for _, container := range sts.Spec.Template.Spec.Containers {
+		if container.Name == "postgres" {
+			image = container.Image
+		}
+	}
+	for _, inst := range outdated {
+		for _, container := range inst.Pod.Spec.Containers {
+			if container.Name == "postgres" && container.Image != image {
+				return OperationMinorUpgrade, fmt.Sprintf("Update of %d instances to %s", len(outdated), image)
+			}
+		}
+	}
+	return OperationRestart, fmt.Sprintf("Restart of %d instances to apply the pod template", len(outdated))
+}
+
+// ReconcileSwitchover carries on the switchover to status.targetPrimary and
+// reports whether none is in progress anymore. It does not wait for the
+// instances to be ready: a demoted primary may not be until another
+// instance is promoted.
+func ReconcileSwitchover(ctx context.Context, pg *dbv1alpha1.PostgresCluster, instances []Instance) (bool, error) {
+	target := pg.Status.TargetPrimary
+	if target == "" {
+		return true, nil
+	}
+	if target != CurrentPrimary(pg) {
+		return false, switchover(ctx, pg, instances, target)
+	}
+
+	log.FromContext(ctx).Info("Switchover complete", "primary", target)
+	pg.Status.TargetPrimary = ""
+	return true, nil
+}
+
+// switchover makes target the primary: the current primary is demoted
+// first, its fast shutdown sends the WAL it wrote to the replicas, and
+// target is only promoted once the former primary runs as a replica, so
+// that there is never more than one primary.
+func switchover(ctx context.Context, pg *dbv1alpha1.PostgresCluster, instances []Instance, target string) error {
+	primary := CurrentPrimary(pg)
+	SetProgressing(pg, "Switchover", fmt.Sprintf("Switching over from %s to %s", primary, target))
+
+	var primaryInst, targetInst *Instance
+	for i := range instances {
+		switch instances[i].Pod.Name {
+		case primary:
+			primaryInst = &instances[i]
+		case target:
+			targetInst = &instances[i]
+		}
+	}
+	if primaryInst == nil || primaryInst.Reported == nil || targetInst == nil || targetInst.Reported == nil {
+		// wait until both can be reached
+		return nil
+	}
+
+	if primaryInst.Reported.Role == instance.RolePrimary {
+		if err := checkpointInstance(ctx, *primaryInst); err != nil {
+			log.FromContext(ctx).Error(err, "Failed to checkpoint before switchover", "instance", primary)
+		}
+		return callInstance(ctx, instanceClient, *primaryInst, instance.DemotePath)
+	}
+	return callInstance(ctx, instanceClient, *targetInst, instance.PromotePath)
+}
+
+// switchoverTarget is the updated replica with the least replication lag,
+// empty when there is none.
+func switchoverTarget(pg *dbv1alpha1.PostgresCluster, instances []Instance, revision string) string {
+	updated := map[string]bool{}
+	for _, inst := range instances {
+		updated[inst.Pod.Name] = inst.Pod.Labels[appsv1.StatefulSetRevisionLabel] == revision
+	}
+
+	target := ""
+	var targetLag int64
+	for _, s := range pg.Status.Instances {
+		if !updated[s.Name] || !s.Ready || s.Role != instance.RoleReplica || s.ReplicationLagBytes == nil {
+			continue
+		}
+		if target == "" || *s.ReplicationLagBytes < targetLag {
+			target, targetLag = s.Name, *s.ReplicationLagBytes
+		}
+	}
+	return target
+}
+
+// laggingReplica is a replica that has not caught up with the primary,
+// empty when all have.
+func laggingReplica(pg *dbv1alpha1.PostgresCluster) string {
+	for _, s := range pg.Status.Instances {
+		if s.Name == CurrentPrimary(pg) {
+			continue
+		}
+		if s.ReplicationLagBytes == nil || *s.ReplicationLagBytes > rolloutMaxLag {
+			return s.Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,103 @@
+package postgres
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+func TestSwitchoverTarget(t *testing.T) {
+	pod := func(name, revision string) Instance {
+		return Instance{Pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{appsv1.StatefulSetRevisionLabel: revision},
+		}}}
+	}
+	instances := []Instance{pod("pg-0", "old"), pod("pg-1", "new"), pod("pg-2", "new"), pod("pg-3", "new")}
+
+	pg := &dbv1alpha1.PostgresCluster{ObjectMeta: metav1.ObjectMeta{Name: "pg"}}
+	pg.Status.Instances = []dbv1alpha1.InstanceStatus{
+		{Name: "pg-0", Role: "primary", Ready: true},
+		{Name: "pg-1", Role: "replica", Ready: true, ReplicationLagBytes: ptr.To[int64](4096)},
+		{Name: "pg-2", Role: "replica", Ready: true, ReplicationLagBytes: ptr.To[int64](0)},
+		// the least lag, but not ready
+		{Name: "pg-3", Role: "replica", ReplicationLagBytes: ptr.To[int64](0)},
+	}
+
+	if got := switchoverTarget(pg, instances, "new"); got != "pg-2" {
+		t.Errorf("switchoverTarget() = %q, want pg-2", got)
+	}
+	if got := switchoverTarget(pg, instances, "newer"); got != "" {
+		t.Errorf("switchoverTarget() = %q without updated replicas", got)
+	}
+}
+
+func TestLaggingReplica(t *testing.T) {
+	pg := &dbv1alpha1.PostgresCluster{ObjectMeta: metav1.ObjectMeta{Name: "pg"}}
+	pg.Status.Instances = []dbv1alpha1.InstanceStatus{
+		{Name: "pg-0", Role: "primary"},
+		{Name: "pg-1", Role: "replica", ReplicationLagBytes: ptr.To[int64](1024)},
+	}
+	if got := laggingReplica(pg); got != "" {
+		t.Errorf("laggingReplica() = %q, want none", got)
+	}
+
+	pg.Status.Instances = append(pg.Status.Instances,
+		dbv1alpha1.InstanceStatus{Name: "pg-2", Error: "connection refused"})
+	if got := laggingReplica(pg); got != "pg-2" {
+		t.Errorf("laggingReplica() = %q, want pg-2", got)
+	}
+}
+
+func TestRestartAnnotation(t *testing.T) {
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg"},
+		Spec: dbv1alpha1.PostgresClusterSpec{
+			Instances: 1,
+			Storage:   dbv1alpha1.StorageSpec{Size: "1Gi"},
+		},
+	}
+	before, err := BuildStatefulSet(pg, "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pg.Annotations = map[string]string{dbv1alpha1.RestartAnnotation: "2024-01-01T00:00:00Z"}
+	after, err := BuildStatefulSet(pg, "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !StatefulSetNeedsUpdate(before, after) {
+		t.Error("the restart annotation does not change the pod template")
+	}
+	if after.Spec.UpdateStrategy.Type != appsv1.OnDeleteStatefulSetStrategyType {
+		t.Errorf("update strategy %s, want OnDelete", after.Spec.UpdateStrategy.Type)
+	}
+}
+
+func TestBuildStatefulSetUndefaulted(t *testing.T) {
+	// created while the webhooks were down
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg"},
+		Spec:       dbv1alpha1.PostgresClusterSpec{Instances: 1, Storage: dbv1alpha1.StorageSpec{Size: "lots"}},
+	}
+	if _, err := BuildStatefulSet(pg, "operator"); err == nil {
+		t.Error("an invalid storage size was accepted")
+	}
+
+	pg.Spec.Storage.Size = "1Gi"
+	sts, err := BuildStatefulSet(pg, "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := sts.Spec.Template.Spec.Containers[0].Env[0].ValueFrom.SecretKeyRef.Name
+	if secret != "pg-superuser" {
+		t.Errorf("superuser Secret %q, want the generated pg-superuser", secret)
+	}
+}
@@ -0,0 +1,467 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+const (
+	// SnapshotBackupAnnotation is set on volumes provisioned from a snapshot
+	// backup, PreparedAnnotation once the backup label was put back.
+	SnapshotBackupAnnotation = "databases.atlasdb.io/snapshot-backup"
+	PreparedAnnotation       = "databases.atlasdb.io/prepared"
+
+	dataVolumeName = "data"
+)
+
+// DataPVCName is the name the StatefulSet gives to the data volume of an
+// instance.
+func DataPVCName(cluster string, ordinal int32) string {
+	return fmt.Sprintf("%s-%s-%d", dataVolumeName, cluster, ordinal)
+}
+
+// PrimaryHost resolves to the primary instance through the -rw Service,
+// which follows the primary when another instance is promoted. Once the
+// clients are switched over to the target of a blue/green upgrade, the -rw
+// Service sends to the target and the pod of the primary is used instead.
+func PrimaryHost(pg *dbv1alpha1.PostgresCluster) string {
+	if SwitchedOver(pg) {
+		return CurrentPrimary(pg) + "." + pg.Name
+	}
+	return pg.Name + "-rw"
+}
+
+// SnapshotRecoveryEnabled reports whether pg is bootstrapped from the
+// VolumeSnapshots of a snapshot backup.
+func SnapshotRecoveryEnabled(pg *dbv1alpha1.PostgresCluster) bool {
+	return RecoveryEnabled(pg) && pg.Spec.Bootstrap.Recovery.VolumeSnapshots != nil
+}
+
+// ReplicaSnapshotsEnabled reports whether new replicas of pg are
+// provisioned from snapshot backups.
+func ReplicaSnapshotsEnabled(pg *dbv1alpha1.PostgresCluster) bool {
+	return pg.Spec.ReplicaBootstrap != nil && pg.Spec.ReplicaBootstrap.VolumeSnapshot
+}
+
+func SnapshotBackupJobName(backup *dbv1alpha1.PostgresBackup) string {
+	return backup.Name + "-snapshot"
+}
+
+// SnapshotServiceAccountName is the identity of the Jobs that create
+// VolumeSnapshots.
+func SnapshotServiceAccountName(cluster string) string {
+	return cluster + "-snapshot"
+}
+
+// BuildSnapshotBackupJob holds a backup session open on the primary while
+// it snapshots the volumes of the primary. The result is reported in the
+// termination message of the container.
+func BuildSnapshotBackupJob(
+	backup *dbv1alpha1.PostgresBackup,
+	cluster *dbv1alpha1.PostgresCluster,
+	operatorImage string,
+) *batchv1.Job {
+	env := []corev1.EnvVar{
+		{Name: "PGHOST", Value: PrimaryHost(cluster)},
+		{Name: "PGUSER", Value: PostgresCaption},
+		superuserPasswordEnv(cluster, "PGPASSWORD"),
+		{Name: instance.EnvBackupID, Value: backup.Name},
+		{Name: instance.EnvClusterName, Value: cluster.Name},
+		{Name: instance.EnvSnapshotPVCs, Value: dataVolumeName + "-" + CurrentPrimary(cluster)},
+		{
+			Name: instance.EnvNamespace,
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+			},
+		},
+	}
+	if backup.Spec.VolumeSnapshotClassName != "" {
+		env = append(env, corev1.EnvVar{Name: instance.EnvSnapshotClass, Value: backup.Spec.VolumeSnapshotClassName})
+	}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      SnapshotBackupJobName(backup),
+			Namespace: backup.Namespace,
+			Labels:    Labels(cluster.Name),
+		},
+		Spec: batchv1.JobSpec{
+			// a retry would start a new backup with snapshots of the same names
+			BackoffLimit: ptr.To[int32](0),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						"postgresbackup": backup.Name,
+					},
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy:      corev1.RestartPolicyNever,
+					ServiceAccountName: SnapshotServiceAccountName(cluster.Name),
+					InitContainers:     []corev1.Container{BootstrapControllerContainer(operatorImage)},
+					Containers: []corev1.Container{
+						{
+							Name:         "snapshot",
+							Image:        PostgresImage(cluster),
+							Command:      []string{InstanceManagerPath, "snapshot-backup"},
+							Env:          env,
+							VolumeMounts: []corev1.VolumeMount{controllerVolumeMount()},
+						},
+					},
+					Volumes: []corev1.Volume{controllerVolume()},
+				},
+			},
+		},
+	}
+}
+
+// ReconcileSnapshotRBAC lets the snapshot backup Jobs of pg manage
+// VolumeSnapshots in its namespace.
+func ReconcileSnapshotRBAC(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+) error {
+	name := SnapshotServiceAccountName(pg.Name)
+	meta := func() metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: name, Namespace: pg.Namespace, Labels: Labels(pg.Name)}
+	}
+
+	objects := []client.Object{
+		&corev1.ServiceAccount{ObjectMeta: meta()},
+		&rbacv1.Role{
+			ObjectMeta: meta(),
+			Rules: []rbacv1.PolicyRule{
+				{
+					APIGroups: []string{instance.VolumeSnapshotGVK.Group},
+					Resources: []string{"volumesnapshots"},
+					Verbs:     []string{"get", "create"},
+				},
+			},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: meta(),
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: rbacv1.GroupName,
+				Kind:     "Role",
+				Name:     name,
+			},
+			Subjects: []rbacv1.Subject{
+				{Kind: rbacv1.ServiceAccountKind, Name: name, Namespace: pg.Namespace},
+			},
+		},
+	}
+
+	for _, obj := range objects {
+		if err := ctrl.SetControllerReference(pg, obj, scheme); err != nil {
+			return err
+		}
+		if err := c.Create(ctx, obj); err != nil && !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// LatestSnapshotBackup returns the most recent completed volumeSnapshot
+// backup of pg, or nil.
+func LatestSnapshotBackup(
+	ctx context.Context,
+	c client.Client,
+	pg *dbv1alpha1.PostgresCluster,
+) (*dbv1alpha1.PostgresBackup, error) {
+	backups, err := completedSnapshotBackups(ctx, c, pg)
+	if err != nil || len(backups) == 0 {
+		return nil, err
+	}
+	return &backups[len(backups)-1], nil
+}
+
+// completedSnapshotBackups lists the volumeSnapshot backups of pg that can
+// be restored, oldest first.
+func completedSnapshotBackups(
+	ctx context.Context,
+	c client.Client,
+	pg *dbv1alpha1.PostgresCluster,
+) ([]dbv1alpha1.PostgresBackup, error) {
+	var list dbv1alpha1.PostgresBackupList
+	if err := c.List(ctx, &list, client.InNamespace(pg.Namespace)); err != nil {
+		return nil, err
+	}
+
+	var backups []dbv1alpha1.PostgresBackup
+	for _, backup := range list.Items {
+		if backup.Spec.ClusterName == pg.Name &&
+			backup.Spec.Method == dbv1alpha1.BackupMethodVolumeSnapshot &&
+			backup.Status.Phase == dbv1alpha1.BackupPhaseCompleted &&
+			backup.Status.StartedAt != nil && backup.Status.StoppedAt != nil {
+			backups = append(backups, backup)
+		}
+	}
+
+	for i := 1; i < len(backups); i++ {
+		for j := i; j > 0 && backups[j].Status.StoppedAt.Before(backups[j-1].Status.StoppedAt); j-- {
+			backups[j], backups[j-1] = backups[j-1], backups[j]
+		}
+	}
+	return backups, nil
+}
+
+// ReconcileSnapshotVolumes provisions the data volumes of instances
+// current..instances-1 from snapshot backups, when configured to, and
+// returns how many instances may run. Volumes are provisioned one at a time
+// and an instance is only started once its volume has been prepared.
+func ReconcileSnapshotVolumes(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+	operatorImage string,
+	current int32,
+) (int32, error) {
+	for ordinal := current; ordinal < pg.Spec.Instances; ordinal++ {
+		var (
+			backup *dbv1alpha1.PostgresBackup
+			mode   string
+		)
+
+		switch {
+		case ordinal == 0 && SnapshotRecoveryEnabled(pg) && !Initialized(pg):
+			backup = &dbv1alpha1.PostgresBackup{}
+			name := pg.Spec.Bootstrap.Recovery.VolumeSnapshots.BackupName
+			if err := c.Get(ctx, client.ObjectKey{Name: name, Namespace: pg.Namespace}, backup); err != nil {
+				return ordinal, fmt.Errorf("recovery backup %s: %w", name, err)
+			}
+			if backup.Spec.Method != dbv1alpha1.BackupMethodVolumeSnapshot ||
+				backup.Status.Phase != dbv1alpha1.BackupPhaseCompleted {
+				return ordinal, fmt.Errorf("recovery backup %s is not a completed volumeSnapshot backup", name)
+			}
+			mode = instance.PrepareRecovery
+
+		case ordinal > 0 && ReplicaSnapshotsEnabled(pg):
+			latest, err := LatestSnapshotBackup(ctx, c, pg)
+			if err != nil {
+				return ordinal, err
+			}
+			backup = latest
+			mode = instance.PrepareStandby
+		}
+
+		ready, err := reconcileSnapshotVolume(ctx, c, scheme, pg, operatorImage, ordinal, backup, mode)
+		if err != nil || !ready {
+			return ordinal, err
+		}
+	}
+
+	return pg.Spec.Instances, nil
+}
+
+func reconcileSnapshotVolume(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+	operatorImage string,
+	ordinal int32,
+	backup *dbv1alpha1.PostgresBackup,
+	mode string,
+) (bool, error) {
+	pvc := &corev1.PersistentVolumeClaim{}
+	err := c.Get(ctx, client.ObjectKey{Name: DataPVCName(pg.Name, ordinal), Namespace: pg.Namespace}, pvc)
+
+	// --- create ---
+	if apierrors.IsNotFound(err) {
+		if backup == nil {
+			// the StatefulSet creates an empty volume
+			return true, nil
+		}
+		pvc, err := BuildSnapshotPVC(pg, backup, ordinal)
+		if err != nil {
+			return false, err
+		}
+		return false, c.Create(ctx, pvc)
+	}
+	if err != nil {
+		return false, err
+	}
+	if !pvc.DeletionTimestamp.IsZero() {
+		// a re-cloned instance, wait for the volume to be gone
+		return false, nil
+	}
+
+	// existing data is never touched
+	backupName := pvc.Annotations[SnapshotBackupAnnotation]
+	if backupName == "" || pvc.Annotations[PreparedAnnotation] == "true" {
+		return true, nil
+	}
+	if backup == nil || backup.Name != backupName {
+		backup = &dbv1alpha1.PostgresBackup{}
+		if err := c.Get(ctx, client.ObjectKey{Name: backupName, Namespace: pg.Namespace}, backup); err != nil {
+			return false, err
+		}
+	}
+
+	// --- prepare ---
+	job := &batchv1.Job{}
+	err = c.Get(ctx, client.ObjectKey{Name: PrepareJobName(pvc.Name), Namespace: pg.Namespace}, job)
+	if apierrors.IsNotFound(err) {
+		desired := BuildPrepareJob(pg, backup, pvc.Name, mode, operatorImage)
+		if err := ctrl.SetControllerReference(pg, desired, scheme); err != nil {
+			return false, err
+		}
+		return false, c.Create(ctx, desired)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, cond := range job.Status.Conditions {
+		if cond.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch cond.Type {
+		case batchv1.JobFailed:
+			return false, fmt.Errorf("preparing volume %s from backup %s failed, see the logs of Job %s",
+				pvc.Name, backup.Name, job.Name)
+		case batchv1.JobComplete:
+			patch := client.MergeFrom(pvc.DeepCopy())
+			pvc.Annotations[PreparedAnnotation] = "true"
+			return true, c.Patch(ctx, pvc, patch)
+		}
+	}
+	return false, nil
+}
+
+// BuildSnapshotPVC is the data volume of instance ordinal restored from the
+// snapshot of backup. Like the volumes created by the StatefulSet it is not
+// owned by the cluster.
+func BuildSnapshotPVC(
+	pg *dbv1alpha1.PostgresCluster,
+	backup *dbv1alpha1.PostgresBackup,
+	ordinal int32,
+) (*corev1.PersistentVolumeClaim, error) {
+	size, err := StorageSize(pg)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := instance.SnapshotName(backup.Name, DataPVCName(backup.Spec.ClusterName, 0))
+
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      DataPVCName(pg.Name, ordinal),
+			Namespace: pg.Namespace,
+			Labels:    Labels(pg.Name),
+			Annotations: map[string]string{
+				SnapshotBackupAnnotation: backup.Name,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: size,
+				},
+			},
+			StorageClassName: storageClassName(pg),
+			DataSource: &corev1.TypedLocalObjectReference{
+				APIGroup: ptr.To(instance.VolumeSnapshotGVK.Group),
+				Kind:     instance.VolumeSnapshotGVK.Kind,
+				Name:     snapshot,
+			},
+		},
+	}, nil
+}
+
+func PrepareJobName(pvc string) string {
+	return pvc + "-prepare"
+}
+
+// BuildPrepareJob writes the backup label and the recovery configuration
+// into a volume restored from a snapshot before an instance starts on it.
+func BuildPrepareJob(
+	pg *dbv1alpha1.PostgresCluster,
+	backup *dbv1alpha1.PostgresBackup,
+	pvc string,
+	mode string,
+	operatorImage string,
+) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      PrepareJobName(pvc),
+			Namespace: pg.Namespace,
+			Labels:    Labels(pg.Name),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: ptr.To[int32](2),
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy:  corev1.RestartPolicyNever,
+					InitContainers: []corev1.Container{BootstrapControllerContainer(operatorImage)},
+					Containers: []corev1.Container{
+						{
+							Name:    "prepare",
+							Image:   PostgresImage(pg),
+							Command: []string{InstanceManagerPath, "prepare-snapshot", PGDataPath, mode},
+							Env: []corev1.EnvVar{
+								{Name: instance.EnvBackupLabel, Value: backup.Status.BackupLabel},
+								{Name: instance.EnvPrimaryHost, Value: PrimaryHost(pg)},
+							},
+							TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: dataVolumeName, MountPath: PGDataPath},
+								controllerVolumeMount(),
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						controllerVolume(),
+						{
+							Name: dataVolumeName,
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: pvc},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// DeleteSnapshots removes the VolumeSnapshots of an expired backup.
+func DeleteSnapshots(ctx context.Context, c client.Client, backup *dbv1alpha1.PostgresBackup) error {
+	for _, name := range backup.Status.Snapshots {
+		snapshot := &unstructured.Unstructured{}
+		snapshot.SetGroupVersionKind(instance.VolumeSnapshotGVK)
+		snapshot.SetName(name)
+		snapshot.SetNamespace(backup.Namespace)
+		if err := c.Delete(ctx, snapshot); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WALTimeline is the timeline a WAL file name belongs to.
+func WALTimeline(wal string) int {
+	var timeline int
+	if len(wal) == 24 {
+		_, _ = fmt.Sscanf(strings.ToUpper(wal[:8]), "%X", &timeline)
+	}
+	return timeline
+}
@@ -1,6 +1,11 @@
 package postgres
 
 import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -8,14 +13,157 @@ import (
 	"k8s.io/utils/ptr"
 
 	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+	"github.com/nikitadada/atlasdb/internal/objectstore"
 )
 
+const (
+	// ControllerVolumePath is where the instance manager is copied to
+	// inside PostgreSQL pods.
+	ControllerVolumePath = "/controller"
+	InstanceManagerPath  = ControllerVolumePath + "/instance-manager"
+
+	// PGDataPath is where the data volume is mounted, it is the PGDATA of
+	// the official postgres image.
+	PGDataPath = "/var/lib/postgresql/data"
+
+	TemplateHashAnnotation = "databases.atlasdb.io/template-hash"
+
+	// apiPortName is the port of the API of the instance manager.
+	apiPortName = "api"
+)
+
+// DefaultVersion is the PostgreSQL version of clusters that do not set one.
+const DefaultVersion = "15"
+
+// PostgresImage is the image of the PostgreSQL server for cluster. While a
+// major upgrade of their data is pending the instances keep the image they
+// run, a new major version can not start on the data of an older one.
+func PostgresImage(cluster *dbv1alpha1.PostgresCluster) string {
+	if MajorUpgradePending(cluster) && cluster.Status.Image != "" {
+		return cluster.Status.Image
+	}
+	return specImage(cluster)
+}
+
+// specImage is the image of the version set in the spec of cluster.
+func specImage(cluster *dbv1alpha1.PostgresCluster) string {
+	return "postgres:" + specVersion(cluster)
+}
+
+func specVersion(cluster *dbv1alpha1.PostgresCluster) string {
+	if cluster.Spec.Version == "" {
+		return DefaultVersion
+	}
+	return cluster.Spec.Version
+}
+
+// BootstrapControllerContainer copies the instance manager out of the
+// operator image into the shared controller volume.
+func BootstrapControllerContainer(operatorImage string) corev1.Container {
+	return corev1.Container{
+		Name:         "bootstrap-controller",
+		Image:        operatorImage,
+		Command:      []string{"/instance-manager", "bootstrap", InstanceManagerPath},
+		VolumeMounts: []corev1.VolumeMount{controllerVolumeMount()},
+	}
+}
+
+func superuserPasswordEnv(cluster *dbv1alpha1.PostgresCluster, name string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: SuperuserSecretName(cluster),
+				},
+				Key: "password",
+			},
+		},
+	}
+}
+
+func controllerVolumeMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      "controller",
+		MountPath: ControllerVolumePath,
+	}
+}
+
+func controllerVolume() corev1.Volume {
+	return corev1.Volume{
+		Name: "controller",
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	}
+}
+
+// BuildStatefulSet is the StatefulSet running the instances of cluster. It
+// fails on a spec.storage.size that is not a quantity, which only clusters
+// created while the webhooks were down can have.
 func BuildStatefulSet(
 	cluster *dbv1alpha1.PostgresCluster,
-) *appsv1.StatefulSet {
+	operatorImage string,
+) (*appsv1.StatefulSet, error) {
+	size, err := StorageSize(cluster)
+	if err != nil {
+		return nil, err
+	}
 	labels := Labels(cluster.Name)
 
-	return &appsv1.StatefulSet{
+	env := []corev1.EnvVar{
+		superuserPasswordEnv(cluster, instance.EnvSuperuserPassword),
+		// used by replicas to clone and stream from the primary
+		superuserPasswordEnv(cluster, "PGPASSWORD"),
+		{Name: instance.EnvPrimaryHost, Value: PrimaryHost(cluster)},
+		apiTokenEnv(cluster),
+		bootstrapEnv(cluster),
+	}
+	env = append(env, probesEnv(cluster)...)
+	if LogicalReplicationSource(cluster) {
+		env = append(env, corev1.EnvVar{Name: instance.EnvWALLevel, Value: "logical"})
+	}
+
+	args := ConfigArgs()
+	if ArchivingEnabled(cluster) {
+		store := cluster.Spec.Backup.ObjectStore
+		env = append(env, ObjectStoreEnv(objectstore.ArchiveEnvPrefix, store, ObjectStorePrefix(cluster, store))...)
+		args = append(args, ArchivingArgs()...)
+	}
+
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      dataVolumeName,
+			MountPath: PGDataPath,
+		},
+		controllerVolumeMount(),
+		{
+			Name:      "config",
+			MountPath: ConfigVolumePath,
+		},
+	}
+
+	initContainers := []corev1.Container{
+		BootstrapControllerContainer(operatorImage),
+	}
+	if RecoveryEnabled(cluster) {
+		recoveryEnv := RecoveryEnv(cluster)
+		// restore_command runs in the postgres container
+		env = append(env, recoveryEnv...)
+		recoveryEnv = append(recoveryEnv, bootstrapEnv(cluster))
+
+		initContainers = append(initContainers, corev1.Container{
+			Name:                     restoreContainerName,
+			Image:                    PostgresImage(cluster),
+			Command:                  []string{InstanceManagerPath, "restore", PGDataPath},
+			Env:                      recoveryEnv,
+			VolumeMounts:             volumeMounts[:2],
+			TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+		})
+	}
+
+	sts := &appsv1.StatefulSet{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cluster.Name,
 			Namespace: cluster.Namespace,
@@ -27,37 +175,44 @@ func BuildStatefulSet(
 				MatchLabels: labels,
 			},
 			ServiceName: cluster.Name,
+			// pods are restarted by ReconcileRollout, the primary last
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type: appsv1.OnDeleteStatefulSetStrategyType,
+			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Labels: labels,
 				},
 				Spec: corev1.PodSpec{
+					InitContainers: initContainers,
 					Containers: []corev1.Container{
 						{
-							Name:  "postgres",
-							Image: "postgres:15",
+							Name:    "postgres",
+							Image:   PostgresImage(cluster),
+							Command: []string{InstanceManagerPath, "run", PGDataPath},
+							Args:    args,
 							Ports: []corev1.ContainerPort{
 								{ContainerPort: 5432},
+								{Name: apiPortName, ContainerPort: instance.APIPort},
 							},
-							Env: []corev1.EnvVar{
-								{
-									Name: "POSTGRES_PASSWORD",
-									ValueFrom: &corev1.EnvVarSource{
-										SecretKeyRef: &corev1.SecretKeySelector{
-											LocalObjectReference: corev1.LocalObjectReference{
-												Name: cluster.Spec.SuperuserSecretName,
-											},
-											Key: "password",
-										},
+							Env:            env,
+							VolumeMounts:   volumeMounts,
+							StartupProbe:   StartupProbe(cluster),
+							LivenessProbe:  LivenessProbe(),
+							ReadinessProbe: ReadinessProbe(),
+						},
+					},
+					Volumes: []corev1.Volume{
+						controllerVolume(),
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{
+										Name: ConfigMapName(cluster.Name),
 									},
 								},
 							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "data",
-									MountPath: "/var/lib/postgresql/data",
-								},
-							},
 						},
 					},
 				},
@@ -65,7 +220,7 @@ func BuildStatefulSet(
 			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
 				{
 					ObjectMeta: metav1.ObjectMeta{
-						Name: "data",
+						Name: dataVolumeName,
 					},
 					Spec: corev1.PersistentVolumeClaimSpec{
 						AccessModes: []corev1.PersistentVolumeAccessMode{
@@ -73,14 +228,59 @@ func BuildStatefulSet(
 						},
 						Resources: corev1.VolumeResourceRequirements{
 							Requests: corev1.ResourceList{
-								corev1.ResourceStorage: resource.MustParse(
-									cluster.Spec.Storage.Size,
-								),
+								corev1.ResourceStorage: size,
 							},
 						},
+						StorageClassName: storageClassName(cluster),
 					},
 				},
 			},
 		},
 	}
+
+	annotations := map[string]string{}
+	if restart, ok := cluster.Annotations[dbv1alpha1.RestartAnnotation]; ok {
+		annotations[dbv1alpha1.RestartAnnotation] = restart
+	}
+	sts.Spec.Template.Annotations = annotations
+	annotations[TemplateHashAnnotation] = templateHash(&sts.Spec.Template)
+
+	return sts, nil
+}
+
+// StorageSize is the size of the data volumes of pg.
+func StorageSize(pg *dbv1alpha1.PostgresCluster) (resource.Quantity, error) {
+	size, err := resource.ParseQuantity(pg.Spec.Storage.Size)
+	if err != nil {
+		return resource.Quantity{}, fmt.Errorf("invalid storage size %q: %w", pg.Spec.Storage.Size, err)
+	}
+	return size, nil
+}
+
+// StatefulSetNeedsUpdate reports whether the replicas, the update strategy
+// or the pod template of existing differ from desired. Templates are
+// compared by hash because the API server defaults many of their fields.
+func StatefulSetNeedsUpdate(existing, desired *appsv1.StatefulSet) bool {
+	if ptr.Deref(existing.Spec.Replicas, 1) != ptr.Deref(desired.Spec.Replicas, 1) {
+		return true
+	}
+	if existing.Spec.UpdateStrategy.Type != desired.Spec.UpdateStrategy.Type {
+		return true
+	}
+	return existing.Spec.Template.Annotations[TemplateHashAnnotation] !=
+		desired.Spec.Template.Annotations[TemplateHashAnnotation]
+}
+
+func templateHash(template *corev1.PodTemplateSpec) string {
+	data, _ := json.Marshal(template)
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+func storageClassName(cluster *dbv1alpha1.PostgresCluster) *string {
+	if cluster.Spec.Storage.StorageClassName == "" {
+		return nil
+	}
+	return ptr.To(cluster.Spec.Storage.StorageClassName)
 }
@@ -0,0 +1,198 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Standard conditions of a PostgresCluster. Together with
+// status.observedGeneration, Ready follows the kstatus conventions so that
+// generic tooling can wait for a change to be rolled out.
+//
+//   - Ready: every instance runs the current spec and is ready;
+//   - Available: the primary accepts connections;
+//   - Progressing: the operator is working towards the spec;
+//   - Degraded: the cluster serves clients but something needs attention.
+const (
+	ConditionReady       = "Ready"
+	ConditionAvailable   = "Available"
+	ConditionProgressing = "Progressing"
+	ConditionDegraded    = "Degraded"
+)
+
+// SetCondition sets condition condType of pg for its current generation.
+func SetCondition(
+	pg *dbv1alpha1.PostgresCluster,
+	condType string,
+	status metav1.ConditionStatus,
+	reason, message string,
+) {
+	meta.SetStatusCondition(&pg.Status.Conditions, metav1.Condition{
+		Type:               condType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: pg.Generation,
+	})
+}
+
+// SetProgressing records that the current generation of pg is being
+// rolled out. phase doubles as the reason of the conditions.
+func SetProgressing(pg *dbv1alpha1.PostgresCluster, phase, message string) {
+	pg.Status.Phase = phase
+	pg.Status.ObservedGeneration = pg.Generation
+	SetCondition(pg, ConditionReady, metav1.ConditionFalse, phase, message)
+	SetCondition(pg, ConditionProgressing, metav1.ConditionTrue, phase, message)
+	updateDegradedCondition(pg)
+}
+
+// SetReady records that the current generation of pg is rolled out.
+func SetReady(pg *dbv1alpha1.PostgresCluster) {
+	pg.Status.Phase = "Ready"
+	pg.Status.ObservedGeneration = pg.Generation
+	SetCondition(pg, ConditionReady, metav1.ConditionTrue, "ClusterReady", "Postgres cluster is ready")
+	SetCondition(pg, ConditionProgressing, metav1.ConditionFalse, "ReconcileComplete",
+		"The spec is rolled out")
+	updateDegradedCondition(pg)
+}
+
+// CurrentPrimary is the pod of the primary instance, the first one until
+// the instances report otherwise.
+func CurrentPrimary(pg *dbv1alpha1.PostgresCluster) string {
+	if pg.Status.CurrentPrimary != "" {
+		return pg.Status.CurrentPrimary
+	}
+	return pg.Name + "-0"
+}
+
+// ScaleDownReplicas caps a scale down of the StatefulSet of pg to replicas
+// so that the pod of the primary, which need not be the first one, is
+// never removed. The StatefulSet always removes the highest ordinals: a
+// primary past spec.instances is first switched over to the caught up
+// replica with the least lag among the pods kept.
+func ScaleDownReplicas(pg *dbv1alpha1.PostgresCluster, replicas int32) int32 {
+	ordinal, err := strconv.ParseInt(strings.TrimPrefix(CurrentPrimary(pg), pg.Name+"-"), 10, 32)
+	if err != nil || int32(ordinal) < replicas {
+		return replicas
+	}
+	if int32(ordinal) >= pg.Spec.Instances && pg.Status.TargetPrimary == "" && !MajorUpgradeInProgress(pg) {
+		pg.Status.TargetPrimary = scaleDownTarget(pg, replicas)
+	}
+	return int32(ordinal) + 1
+}
+
+// scaleDownTarget is the caught up replica of pg with the least lag among
+// the first replicas pods, empty when there is none.
+func scaleDownTarget(pg *dbv1alpha1.PostgresCluster, replicas int32) string {
+	target := ""
+	var targetLag int64
+	for _, s := range pg.Status.Instances {
+		ordinal, ok := instanceOrdinal(pg, s.Name)
+		if !ok || ordinal >= replicas || !CaughtUpReplica(pg, s.Name) {
+			continue
+		}
+		if target == "" || *s.ReplicationLagBytes < targetLag {
+			target, targetLag = s.Name, *s.ReplicationLagBytes
+		}
+	}
+	return target
+}
+
+// UpdateInstancesStatus copies what sts reports about the instances into
+// pg.Status and sets the Available condition from the readiness of the
+// primary.
+func UpdateInstancesStatus(
+	ctx context.Context,
+	c client.Client,
+	pg *dbv1alpha1.PostgresCluster,
+	sts *appsv1.StatefulSet,
+) error {
+	pg.Status.ReadyInstances = sts.Status.ReadyReplicas
+	pg.Status.Selector = labels.SelectorFromSet(Labels(pg.Name)).String()
+	for _, container := range sts.Spec.Template.Spec.Containers {
+		if container.Name == "postgres" {
+			pg.Status.Image = container.Image
+		}
+	}
+
+	primary := CurrentPrimary(pg)
+	pg.Status.CurrentPrimary = primary
+
+	pod := &corev1.Pod{}
+	err := c.Get(ctx, types.NamespacedName{Namespace: pg.Namespace, Name: primary}, pod)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	if err == nil && podReady(pod) {
+		SetCondition(pg, ConditionAvailable, metav1.ConditionTrue, "PrimaryReady",
+			fmt.Sprintf("Primary %s accepts connections", primary))
+		return nil
+	}
+
+	SetCondition(pg, ConditionAvailable, metav1.ConditionFalse, "PrimaryNotReady",
+		fmt.Sprintf("Primary %s is not ready", primary))
+	return nil
+}
+
+// SetInstancesNotReady records that some instances of pg are not ready. It
+// is progress while sts rolls out the current generation, which has never
+// been ready yet, and degradation once the generation was ready before.
+func SetInstancesNotReady(pg *dbv1alpha1.PostgresCluster, sts *appsv1.StatefulSet) {
+	ready := meta.FindStatusCondition(pg.Status.Conditions, ConditionReady)
+	wasReady := ready != nil && ready.ObservedGeneration == pg.Generation &&
+		(ready.Status == metav1.ConditionTrue || ready.Reason == "InstancesNotReady")
+
+	if !wasReady || !statefulSetRolledOut(sts, pg.Spec.Instances) {
+		SetProgressing(pg, "Reconciling", "Waiting for pods to become ready")
+		return
+	}
+
+	message := fmt.Sprintf("%d of %d instances are ready", sts.Status.ReadyReplicas, pg.Spec.Instances)
+	pg.Status.Phase = "Degraded"
+	pg.Status.ObservedGeneration = pg.Generation
+	SetCondition(pg, ConditionReady, metav1.ConditionFalse, "InstancesNotReady", message)
+	SetCondition(pg, ConditionProgressing, metav1.ConditionFalse, "ReconcileComplete", "The spec is rolled out")
+	SetCondition(pg, ConditionDegraded, metav1.ConditionTrue, "InstancesNotReady", message)
+}
+
+// statefulSetRolledOut reports whether every one of the instances pods
+// of sts runs its current template.
+func statefulSetRolledOut(sts *appsv1.StatefulSet, instances int32) bool {
+	return sts.Status.ObservedGeneration >= sts.Generation &&
+		*sts.Spec.Replicas == instances &&
+		sts.Status.Replicas == instances &&
+		sts.Status.UpdatedReplicas == instances
+}
+
+// updateDegradedCondition sets Degraded from the archiving condition, the
+// one problem that does not stop the instances from being ready.
+func updateDegradedCondition(pg *dbv1alpha1.PostgresCluster) {
+	archiving := meta.FindStatusCondition(pg.Status.Conditions, ConditionContinuousArchiving)
+	if archiving != nil && archiving.Status == metav1.ConditionFalse {
+		SetCondition(pg, ConditionDegraded, metav1.ConditionTrue, "ArchivingFailing", archiving.Message)
+		return
+	}
+	SetCondition(pg, ConditionDegraded, metav1.ConditionFalse, "AsExpected", "")
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package postgres
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+func TestSetInstancesNotReady(t *testing.T) {
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg", Generation: 2},
+		Spec:       dbv1alpha1.PostgresClusterSpec{Instances: 3},
+	}
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Generation: 5},
+		Spec:       appsv1.StatefulSetSpec{Replicas: ptr.To(int32(3))},
+		Status: appsv1.StatefulSetStatus{
+			ObservedGeneration: 5, Replicas: 3, UpdatedReplicas: 3, ReadyReplicas: 2,
+		},
+	}
+	reason := func(condType string) string {
+		return meta.FindStatusCondition(pg.Status.Conditions, condType).Reason
+	}
+
+	// the generation has never been ready, it is still rolled out
+	SetInstancesNotReady(pg, sts)
+	if pg.Status.Phase != "Reconciling" || !meta.IsStatusConditionTrue(pg.Status.Conditions, ConditionProgressing) {
+		t.Errorf("phase %s, progressing %s, want Reconciling", pg.Status.Phase, reason(ConditionProgressing))
+	}
+
+	// an instance lost after the generation was ready degrades the cluster
+	SetReady(pg)
+	SetInstancesNotReady(pg, sts)
+	if pg.Status.Phase != "Degraded" || !meta.IsStatusConditionTrue(pg.Status.Conditions, ConditionDegraded) ||
+		meta.IsStatusConditionTrue(pg.Status.Conditions, ConditionProgressing) {
+		t.Errorf("phase %s, degraded %s, want Degraded", pg.Status.Phase, reason(ConditionDegraded))
+	}
+
+	// and stays degraded until the instances are back
+	SetInstancesNotReady(pg, sts)
+	if pg.Status.Phase != "Degraded" {
+		t.Errorf("phase %s, want Degraded", pg.Status.Phase)
+	}
+
+	// a new generation is progress again
+	pg.Generation = 3
+	SetInstancesNotReady(pg, sts)
+	if pg.Status.Phase != "Reconciling" || pg.Status.ObservedGeneration != 3 {
+		t.Errorf("phase %s, observed generation %d", pg.Status.Phase, pg.Status.ObservedGeneration)
+	}
+	if reason(ConditionDegraded) != "AsExpected" {
+		t.Errorf("degraded reason %s, want AsExpected", reason(ConditionDegraded))
+	}
+}
+
+func TestScaleDownReplicas(t *testing.T) {
+	pg := &dbv1alpha1.PostgresCluster{ObjectMeta: metav1.ObjectMeta{Name: "pg"}}
+
+	if got := ScaleDownReplicas(pg, 1); got != 1 {
+		t.Errorf("primary pg-0: got %d replicas, want 1", got)
+	}
+
+	pg.Status.CurrentPrimary = "pg-2"
+	if got := ScaleDownReplicas(pg, 1); got != 3 {
+		t.Errorf("primary pg-2: got %d replicas, want 3", got)
+	}
+	if got := ScaleDownReplicas(pg, 4); got != 4 {
+		t.Errorf("primary pg-2: got %d replicas, want 4", got)
+	}
+}
+
+func TestScaleDownPastThePrimary(t *testing.T) {
+	replica := func(name string, lag int64) dbv1alpha1.InstanceStatus {
+		return dbv1alpha1.InstanceStatus{Name: name, Role: "replica", Ready: true, ReplicationLagBytes: ptr.To(lag)}
+	}
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg"},
+		Spec:       dbv1alpha1.PostgresClusterSpec{Instances: 2},
+		Status: dbv1alpha1.PostgresClusterStatus{
+			CurrentPrimary: "pg-3",
+			Instances: []dbv1alpha1.InstanceStatus{
+				replica("pg-0", 4096),
+				replica("pg-1", 1024),
+				replica("pg-2", 0),
+				{Name: "pg-3", Role: "primary", Ready: true},
+			},
+		},
+	}
+
+	if got := ScaleDownReplicas(pg, 2); got != 4 {
+		t.Errorf("got %d replicas before the switchover, want 4", got)
+	}
+	if pg.Status.TargetPrimary != "pg-1" {
+		t.Errorf("target primary %q, want pg-1, the least lagging replica that is kept", pg.Status.TargetPrimary)
+	}
+
+	// ReconcileSwitchover completed
+	pg.Status.CurrentPrimary, pg.Status.TargetPrimary = "pg-1", ""
+	if got := ScaleDownReplicas(pg, 2); got != 2 {
+		t.Errorf("got %d replicas after the switchover, want 2", got)
+	}
+	if pg.Status.TargetPrimary != "" {
+		t.Errorf("target primary %q set once the primary is kept", pg.Status.TargetPrimary)
+	}
+}
+
+func TestSetReplicationLag(t *testing.T) {
+	statuses := []dbv1alpha1.InstanceStatus{
+		{Name: "pg-0", Role: "primary", LSN: "1/2000000"},
+		{Name: "pg-1", Role: "replica", LSN: "1/1000000"},
+		{Name: "pg-2", Role: "replica", LSN: "1/3000000"},
+		{Name: "pg-3", Error: "connection refused"},
+	}
+
+	setReplicationLag("pg-0", statuses)
+
+	if lag := statuses[1].ReplicationLagBytes; lag == nil || *lag != 0x1000000 {
+		t.Errorf("lag of pg-1 = %v, want %d", lag, 0x1000000)
+	}
+	// a replica reporting a position ahead of the primary is not behind
+	if lag := statuses[2].ReplicationLagBytes; lag == nil || *lag != 0 {
+		t.Errorf("lag of pg-2 = %v, want 0", lag)
+	}
+	if statuses[0].ReplicationLagBytes != nil || statuses[3].ReplicationLagBytes != nil {
+		t.Error("lag set for an instance that is not a replica")
+	}
+}
+
+func TestElectPrimary(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []dbv1alpha1.InstanceStatus
+		want     string
+	}{
+		{
+			name:     "no instance reports",
+			statuses: []dbv1alpha1.InstanceStatus{{Name: "pg-0", Error: "pod has no IP yet"}},
+			want:     "pg-0",
+		},
+		{
+			name: "promoted replica",
+			statuses: []dbv1alpha1.InstanceStatus{
+				{Name: "pg-0", Role: "primary", Timeline: 1},
+				{Name: "pg-1", Role: "primary", Timeline: 2},
+				{Name: "pg-2", Role: "replica", Timeline: 2},
+			},
+			want: "pg-1",
+		},
+		{
+			name: "tie keeps the current primary",
+			statuses: []dbv1alpha1.InstanceStatus{
+				{Name: "pg-0", Role: "primary", Timeline: 1},
+				{Name: "pg-1", Role: "primary", Timeline: 1},
+			},
+			want: "pg-0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := electPrimary("pg-0", tt.statuses); got != tt.want {
+				t.Errorf("electPrimary() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
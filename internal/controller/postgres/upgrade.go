@@ -0,0 +1,558 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+// ConditionMajorUpgrade tracks the upgrade of the data of the instances to
+// the major version of spec.version. Its reason is the step the upgrade is
+// at, it is true once the upgrade succeeded.
+const ConditionMajorUpgrade = "MajorUpgrade"
+
+// Steps of a major upgrade, in order, and how it can end.
+const (
+	upgradePending         = "Pending"
+	upgradeSwitchover      = "Switchover"
+	upgradeShutdown        = "ShuttingDown"
+	upgradeUpgrading       = "Upgrading"
+	upgradeRestarting      = "Restarting"
+	upgradeAnalyzing       = "Analyzing"
+	upgradeSucceeded       = "Succeeded"
+	upgradeFailed          = "Failed"
+	upgradePreflightFailed = "PreflightFailed"
+)
+
+// oldBinariesPath is where the upgrade Job copies the binaries of the old
+// major version to, their layout under it is the one of the image.
+const oldBinariesPath = "/old"
+
+var versionPattern = regexp.MustCompile(`^([0-9]+)(\.[0-9]+)?(-[a-z0-9.]+)?$`)
+
+// MajorVersion returns the PostgreSQL major version of a postgres image tag
+// such as 16, 16.4 or 16-alpine.
+func MajorVersion(version string) (int, error) {
+	m := versionPattern.FindStringSubmatch(version)
+	if m == nil {
+		return 0, fmt.Errorf("must be a postgres image tag like 16, 16.4 or 16-alpine")
+	}
+	return strconv.Atoi(m[1])
+}
+
+// MajorUpgradePending reports whether the data of the instances of pg was
+// written by an older major version than the one of its spec.
+func MajorUpgradePending(pg *dbv1alpha1.PostgresCluster) bool {
+	target, err := MajorVersion(specVersion(pg))
+	return err == nil && pg.Status.MajorVersion != 0 && int(pg.Status.MajorVersion) < target
+}
+
+// MajorUpgradeInProgress reports whether a major upgrade has steps left
+// that the instances do not trigger themselves.
+func MajorUpgradeInProgress(pg *dbv1alpha1.PostgresCluster) bool {
+	cond := meta.FindStatusCondition(pg.Status.Conditions, ConditionMajorUpgrade)
+	if cond == nil {
+		return false
+	}
+	switch cond.Reason {
+	case upgradeSucceeded, upgradeFailed, upgradePreflightFailed, upgradeSwitchedOver, upgradeRolledBack:
+		return false
+	}
+	return true
+}
+
+func UpgradeJobName(cluster string) string {
+	return cluster + "-upgrade"
+}
+
+func AnalyzeJobName(cluster string) string {
+	return cluster + "-analyze"
+}
+
+// ReconcileMajorUpgrade upgrades the data of the instances of pg when
+// spec.version moves to a new major version:
+//
+//   - preflight checks that the images can be upgraded between and that
+//     the primary is ready;
+//   - the first instance, the one the StatefulSet starts first, is switched
+//     over to, so that it is the primary replicas clone from later on;
+//   - every instance is shut down;
+//   - a Job runs pg_upgrade --link on the volume of the primary, see
+//     instance.Upgrade. When it fails, it rolls back and the instances are
+//     started again on the old major version;
+//   - the volumes of the replicas, still on the old major version, are
+//     deleted so that the replicas are cloned from the upgraded primary;
+//   - once the primary runs, a Job runs ANALYZE, pg_upgrade does not carry
+//     over the planner statistics.
+//
+// A failed upgrade is not retried until the spec changes. It reports
+// whether the instances have to be shut down. With the BlueGreen method
+// they never are, see reconcileBlueGreen.
+func ReconcileMajorUpgrade(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+	instances []Instance,
+	operatorImage string,
+) (bool, error) {
+	initMajorVersion(pg)
+
+	reason := ""
+	cond := meta.FindStatusCondition(pg.Status.Conditions, ConditionMajorUpgrade)
+	if cond != nil {
+		reason = cond.Reason
+	}
+
+	if !MajorUpgradePending(pg) {
+		clearPendingOperation(pg, OperationMajorUpgrade)
+		switch reason {
+		case upgradeRestarting:
+			return false, startAnalyze(ctx, c, scheme, pg)
+		case upgradeAnalyzing:
+			return false, reconcileAnalyze(ctx, c, scheme, pg)
+		}
+		return false, nil
+	}
+
+	switch reason {
+	case upgradeShutdown:
+		return shutDownForUpgrade(ctx, c, scheme, pg, operatorImage)
+	case upgradeUpgrading:
+		return reconcileUpgradeJob(ctx, c, scheme, pg, operatorImage)
+	}
+	if BlueGreenUpgrade(pg) || blueGreenStep(reason) {
+		return false, reconcileBlueGreen(ctx, c, scheme, pg, instances, operatorImage)
+	}
+	if (reason == upgradeFailed || reason == upgradePreflightFailed) && cond.ObservedGeneration == pg.Generation {
+		return false, nil
+	}
+	// once started, the upgrade is seen through
+	if reason != upgradeSwitchover && reason != upgradePending && !allowDisruption(pg, OperationMajorUpgrade,
+		fmt.Sprintf("Upgrade from PostgreSQL %d to %s, the instances are shut down", pg.Status.MajorVersion, specVersion(pg)),
+		time.Now()) {
+		return false, nil
+	}
+	return startMajorUpgrade(ctx, c, scheme, pg, instances, operatorImage)
+}
+
+// initMajorVersion records the major version of the data of a cluster that
+// has none yet: the one of the image its instances run, or are about to be
+// created with.
+func initMajorVersion(pg *dbv1alpha1.PostgresCluster) {
+	if pg.Status.MajorVersion != 0 {
+		return
+	}
+	version := specVersion(pg)
+	if pg.Status.Image != "" {
+		version = imageTag(pg.Status.Image)
+	}
+	if major, err := MajorVersion(version); err == nil {
+		pg.Status.MajorVersion = int32(major)
+	}
+}
+
+func startMajorUpgrade(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+	instances []Instance,
+	operatorImage string,
+) (bool, error) {
+	logger := log.FromContext(ctx)
+	target, _ := MajorVersion(specVersion(pg))
+
+	if err := upgradePreflight(pg); err != nil {
+		setUpgradeCondition(pg, metav1.ConditionFalse, upgradePreflightFailed, err.Error())
+		return false, nil
+	}
+
+	first := pg.Name + "-0"
+	if primary := CurrentPrimary(pg); primary != first {
+		if pg.Status.TargetPrimary == "" {
+			logger.Info("Switching over to the first instance before the major upgrade", "primary", primary)
+			pg.Status.TargetPrimary = first
+		}
+		setUpgradeCondition(pg, metav1.ConditionFalse, upgradeSwitchover,
+			fmt.Sprintf("Switching over to %s, the instance whose data is upgraded", first))
+		return false, nil
+	}
+
+	var primary *Instance
+	for i := range instances {
+		if instances[i].Pod.Name == first {
+			primary = &instances[i]
+		}
+	}
+	if primary == nil || !podReady(primary.Pod) {
+		setUpgradeCondition(pg, metav1.ConditionFalse, upgradePending,
+			fmt.Sprintf("Waiting for the primary %s to be ready", first))
+		return false, nil
+	}
+
+	// jobs of a previous upgrade
+	for _, name := range []string{UpgradeJobName(pg.Name), AnalyzeJobName(pg.Name)} {
+		job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: pg.Namespace}}
+		if err := c.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+			return false, err
+		}
+	}
+
+	if err := checkpointInstance(ctx, *primary); err != nil {
+		logger.Error(err, "Failed to checkpoint before the major upgrade", "instance", first)
+	}
+	logger.Info("Shutting down the instances for a major upgrade",
+		"from", pg.Status.MajorVersion, "to", target)
+	setUpgradeCondition(pg, metav1.ConditionFalse, upgradeShutdown,
+		fmt.Sprintf("Shutting down the instances to upgrade from PostgreSQL %d to %d", pg.Status.MajorVersion, target))
+	return shutDownForUpgrade(ctx, c, scheme, pg, operatorImage)
+}
+
+// upgradePreflight checks what would make the upgrade fail once the
+// instances are down. pg_upgrade runs the binaries of the old image in the
+// new one: both have to be built alike.
+func upgradePreflight(pg *dbv1alpha1.PostgresCluster) error {
+	if pg.Status.Image == "" {
+		return fmt.Errorf("the image the instances run is not known yet")
+	}
+	oldTag, newTag := imageTag(pg.Status.Image), specVersion(pg)
+	if strings.Contains(oldTag, "alpine") || strings.Contains(newTag, "alpine") {
+		return fmt.Errorf("major upgrades are only supported between Debian based images, not %s and %s",
+			oldTag, newTag)
+	}
+	if imageVariant(oldTag) != imageVariant(newTag) {
+		return fmt.Errorf("the images %s and %s are built on different distributions", oldTag, newTag)
+	}
+	if ReplicaSnapshotsEnabled(pg) {
+		return fmt.Errorf("replicas would be provisioned from snapshots of the old major version, " +
+			"disable spec.replicaBootstrap.volumeSnapshot for the upgrade")
+	}
+	return nil
+}
+
+func shutDownForUpgrade(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+	operatorImage string,
+) (bool, error) {
+	var pods corev1.PodList
+	if err := c.List(ctx, &pods, client.InNamespace(pg.Namespace), client.MatchingLabels(Labels(pg.Name))); err != nil {
+		return true, err
+	}
+	SetProgressing(pg, "MajorUpgrade", fmt.Sprintf("Waiting for %d instances to shut down", len(pods.Items)))
+	if len(pods.Items) > 0 {
+		return true, nil
+	}
+
+	job := BuildUpgradeJob(pg, operatorImage)
+	if err := ctrl.SetControllerReference(pg, job, scheme); err != nil {
+		return true, err
+	}
+	err := c.Create(ctx, job)
+	if apierrors.IsAlreadyExists(err) {
+		err = c.Get(ctx, client.ObjectKeyFromObject(job), job)
+		if err == nil && !job.DeletionTimestamp.IsZero() {
+			// the Job of a previous upgrade is still being deleted
+			return true, nil
+		}
+	}
+	if err != nil {
+		return true, err
+	}
+
+	message := fmt.Sprintf("Running pg_upgrade on the volume of %s", CurrentPrimary(pg))
+	setUpgradeCondition(pg, metav1.ConditionFalse, upgradeUpgrading, message)
+	SetProgressing(pg, "MajorUpgrade", message)
+	return true, nil
+}
+
+// reconcileUpgradeJob waits for the upgrade Job. The instances stay down
+// for the reconcile that records its outcome.
+func reconcileUpgradeJob(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+	operatorImage string,
+) (bool, error) {
+	logger := log.FromContext(ctx)
+	target, _ := MajorVersion(specVersion(pg))
+
+	job := &batchv1.Job{}
+	err := c.Get(ctx, client.ObjectKey{Name: UpgradeJobName(pg.Name), Namespace: pg.Namespace}, job)
+	if apierrors.IsNotFound(err) {
+		return shutDownForUpgrade(ctx, c, scheme, pg, operatorImage)
+	}
+	if err != nil {
+		return true, err
+	}
+
+	for _, cond := range job.Status.Conditions {
+		if cond.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch cond.Type {
+		case batchv1.JobFailed:
+			message, err := jobFailureMessage(ctx, c, job)
+			if err != nil {
+				return true, err
+			}
+			logger.Info("Major upgrade failed, starting the old version again", "message", message)
+			setUpgradeCondition(pg, metav1.ConditionFalse, upgradeFailed, fmt.Sprintf(
+				"pg_upgrade failed and was rolled back, the instances keep running PostgreSQL %d: %s",
+				pg.Status.MajorVersion, message))
+			return true, nil
+
+		case batchv1.JobComplete:
+			if err := deleteReplicaVolumes(ctx, c, pg); err != nil {
+				return true, err
+			}
+			logger.Info("Data upgraded, cloning the replicas", "version", target)
+			pg.Status.MajorVersion = int32(target)
+			setUpgradeCondition(pg, metav1.ConditionFalse, upgradeRestarting,
+				"Starting the upgraded primary and cloning the replicas from it")
+			return true, nil
+		}
+	}
+	return true, nil
+}
+
+// deleteReplicaVolumes deletes the data volumes of every instance but the
+// first one, the upgraded primary, including the volumes a scale down left
+// behind. The StatefulSet creates empty ones, which are cloned into.
+func deleteReplicaVolumes(ctx context.Context, c client.Client, pg *dbv1alpha1.PostgresCluster) error {
+	var pvcs corev1.PersistentVolumeClaimList
+	if err := c.List(ctx, &pvcs, client.InNamespace(pg.Namespace)); err != nil {
+		return err
+	}
+
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		if n, ok := dataVolumeOrdinal(pg, pvc.Name); !ok || n == 0 {
+			continue
+		}
+		if err := c.Delete(ctx, pvc); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startAnalyze starts the ANALYZE Job once the upgraded primary is ready.
+func startAnalyze(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+) error {
+	ready := false
+	for _, s := range pg.Status.Instances {
+		if major, _, _ := strings.Cut(s.Version, "."); s.Name == CurrentPrimary(pg) && s.Ready &&
+			major == strconv.Itoa(int(pg.Status.MajorVersion)) {
+			ready = true
+		}
+	}
+	if !ready {
+		return nil
+	}
+
+	job := BuildAnalyzeJob(pg)
+	if err := ctrl.SetControllerReference(pg, job, scheme); err != nil {
+		return err
+	}
+	if err := c.Create(ctx, job); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	setUpgradeCondition(pg, metav1.ConditionFalse, upgradeAnalyzing,
+		"Collecting the planner statistics pg_upgrade does not carry over")
+	return nil
+}
+
+func reconcileAnalyze(
+	ctx context.Context,
+	c client.Client,
+	scheme *runtime.Scheme,
+	pg *dbv1alpha1.PostgresCluster,
+) error {
+	job := &batchv1.Job{}
+	err := c.Get(ctx, client.ObjectKey{Name: AnalyzeJobName(pg.Name), Namespace: pg.Namespace}, job)
+	if apierrors.IsNotFound(err) {
+		return startAnalyze(ctx, c, scheme, pg)
+	}
+	if err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("Upgraded to PostgreSQL %d", pg.Status.MajorVersion)
+	for _, cond := range job.Status.Conditions {
+		if cond.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch cond.Type {
+		case batchv1.JobFailed:
+			// the upgrade itself succeeded, queries are only slower
+			setUpgradeCondition(pg, metav1.ConditionTrue, upgradeSucceeded, message+
+				fmt.Sprintf(", ANALYZE failed, see the logs of Job %s and run vacuumdb --all --analyze-in-stages",
+					job.Name))
+		case batchv1.JobComplete:
+			setUpgradeCondition(pg, metav1.ConditionTrue, upgradeSucceeded, message)
+		}
+	}
+	return nil
+}
+
+// BuildUpgradeJob runs instance.Upgrade on the data volume of the first
+// instance with the image of spec.version. An init container copies the
+// binaries of the major version the instances run out of their image.
+func BuildUpgradeJob(pg *dbv1alpha1.PostgresCluster, operatorImage string) *batchv1.Job {
+	from := pg.Status.MajorVersion
+	copyBinaries := fmt.Sprintf("mkdir -p %[1]s/usr/lib/postgresql %[1]s/usr/share/postgresql && "+
+		"cp -a /usr/lib/postgresql/%[2]d %[1]s/usr/lib/postgresql/ && "+
+		"cp -a /usr/share/postgresql/%[2]d %[1]s/usr/share/postgresql/", oldBinariesPath, from)
+	oldBindir := fmt.Sprintf("%s/usr/lib/postgresql/%d/bin", oldBinariesPath, from)
+	oldBinariesMount := corev1.VolumeMount{Name: "old-binaries", MountPath: oldBinariesPath}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      UpgradeJobName(pg.Name),
+			Namespace: pg.Namespace,
+			Labels:    Labels(pg.Name),
+		},
+		Spec: batchv1.JobSpec{
+			// a failed upgrade is rolled back, not retried
+			BackoffLimit: ptr.To[int32](0),
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					InitContainers: []corev1.Container{
+						BootstrapControllerContainer(operatorImage),
+						{
+							Name:         "old-binaries",
+							Image:        pg.Status.Image,
+							Command:      []string{"sh", "-c", copyBinaries},
+							VolumeMounts: []corev1.VolumeMount{oldBinariesMount},
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:                     "upgrade",
+							Image:                    specImage(pg),
+							Command:                  []string{InstanceManagerPath, "upgrade", PGDataPath, oldBindir},
+							TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: dataVolumeName, MountPath: PGDataPath},
+								controllerVolumeMount(),
+								oldBinariesMount,
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						controllerVolume(),
+						{
+							Name:         "old-binaries",
+							VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+						},
+						{
+							Name: dataVolumeName,
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: DataPVCName(pg.Name, 0),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// BuildAnalyzeJob collects the planner statistics of every database of the
+// primary, the most important ones first.
+func BuildAnalyzeJob(pg *dbv1alpha1.PostgresCluster) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      AnalyzeJobName(pg.Name),
+			Namespace: pg.Namespace,
+			Labels:    Labels(pg.Name),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: ptr.To[int32](2),
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:    "analyze",
+							Image:   PostgresImage(pg),
+							Command: []string{"vacuumdb", "--all", "--analyze-in-stages"},
+							Env: []corev1.EnvVar{
+								{Name: "PGHOST", Value: PrimaryHost(pg)},
+								{Name: "PGUSER", Value: "postgres"},
+								superuserPasswordEnv(pg, "PGPASSWORD"),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func setUpgradeCondition(pg *dbv1alpha1.PostgresCluster, status metav1.ConditionStatus, reason, message string) {
+	SetCondition(pg, ConditionMajorUpgrade, status, reason, message)
+}
+
+// jobFailureMessage is the termination message of the failed container of
+// job, the tail of its logs.
+func jobFailureMessage(ctx context.Context, c client.Client, job *batchv1.Job) (string, error) {
+	var pods corev1.PodList
+	if err := c.List(ctx, &pods,
+		client.InNamespace(job.Namespace),
+		client.MatchingLabels{batchv1.JobNameLabel: job.Name},
+	); err != nil {
+		return "", err
+	}
+	for _, pod := range pods.Items {
+		for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+			if terminated := status.State.Terminated; terminated != nil && terminated.ExitCode != 0 {
+				return strings.TrimSpace(terminated.Message), nil
+			}
+		}
+	}
+	return fmt.Sprintf("see the logs of Job %s", job.Name), nil
+}
+
+// imageTag is the tag of image, e.g. 16.4 for postgres:16.4.
+func imageTag(image string) string {
+	if i := strings.LastIndex(image, ":"); i >= 0 && !strings.Contains(image[i:], "/") {
+		return image[i+1:]
+	}
+	return "latest"
+}
+
+// imageVariant is the suffix of a postgres image tag naming the
+// distribution it is built on, e.g. bookworm for 16-bookworm.
+func imageVariant(tag string) string {
+	_, variant, _ := strings.Cut(tag, "-")
+	return variant
+}
@@ -0,0 +1,87 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+func TestPostgresImageDuringMajorUpgrade(t *testing.T) {
+	pg := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg"},
+		Spec:       dbv1alpha1.PostgresClusterSpec{Version: "16.4"},
+		Status:     dbv1alpha1.PostgresClusterStatus{Image: "postgres:15.8"},
+	}
+
+	initMajorVersion(pg)
+	if pg.Status.MajorVersion != 15 {
+		t.Fatalf("majorVersion = %d, want 15 from the image the instances run", pg.Status.MajorVersion)
+	}
+	if got := PostgresImage(pg); got != "postgres:15.8" {
+		t.Errorf("image while the upgrade is pending = %s, want postgres:15.8", got)
+	}
+
+	pg.Status.MajorVersion = 16
+	if got := PostgresImage(pg); got != "postgres:16.4" {
+		t.Errorf("image once upgraded = %s, want postgres:16.4", got)
+	}
+}
+
+func TestUpgradePreflight(t *testing.T) {
+	tests := []struct {
+		image, version string
+		ok             bool
+	}{
+		{"postgres:15", "16", true},
+		{"postgres:15.8-bookworm", "16-bookworm", true},
+		{"postgres:15-bullseye", "16-bookworm", false},
+		{"postgres:15-alpine", "16-alpine", false},
+		{"", "16", false},
+	}
+	for _, tt := range tests {
+		pg := &dbv1alpha1.PostgresCluster{
+			Spec:   dbv1alpha1.PostgresClusterSpec{Version: tt.version},
+			Status: dbv1alpha1.PostgresClusterStatus{Image: tt.image},
+		}
+		if err := upgradePreflight(pg); (err == nil) != tt.ok {
+			t.Errorf("%s to %s: err = %v, want ok=%v", tt.image, tt.version, err, tt.ok)
+		}
+	}
+}
+
+func TestDeleteReplicaVolumes(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	pvc := func(name string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "db"}}
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		pvc("data-pg-0"), pvc("data-pg-1"), pvc("data-pg-4"), pvc("data-pg-x-1"),
+	).Build()
+	pg := &dbv1alpha1.PostgresCluster{ObjectMeta: metav1.ObjectMeta{Name: "pg", Namespace: "db"}}
+
+	ctx := context.Background()
+	if err := deleteReplicaVolumes(ctx, c, pg); err != nil {
+		t.Fatal(err)
+	}
+
+	var left corev1.PersistentVolumeClaimList
+	if err := c.List(ctx, &left); err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, p := range left.Items {
+		names[p.Name] = true
+	}
+	if len(names) != 2 || !names["data-pg-0"] || !names["data-pg-x-1"] {
+		t.Errorf("remaining volumes = %v, want the primary's and the other cluster's", names)
+	}
+}
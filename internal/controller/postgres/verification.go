@@ -0,0 +1,192 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/instance"
+)
+
+// VerificationLabel marks the ephemeral clusters of restore drills.
+const VerificationLabel = "databases.atlasdb.io/backup-verification"
+
+// minDrillInterval keeps drills, each restoring a whole cluster, from
+// running back to back. The CRD refuses shorter intervals, objects created
+// before it are held to it here.
+const minDrillInterval = time.Hour
+
+func DrillClusterName(v *dbv1alpha1.BackupVerification) string {
+	return v.Name + "-drill"
+}
+
+func DrillCheckJobName(v *dbv1alpha1.BackupVerification) string {
+	return v.Name + "-drill-check"
+}
+
+// NextDrillTime is when the next restore drill of v is due.
+func NextDrillTime(v *dbv1alpha1.BackupVerification) time.Time {
+	if v.Status.LastDrillTime == nil {
+		return v.CreationTimestamp.Time
+	}
+	return v.Status.LastDrillTime.Add(max(v.Spec.Interval.Duration, minDrillInterval))
+}
+
+// LatestBackup returns the most recent completed backup of cluster, or nil.
+func LatestBackup(
+	ctx context.Context,
+	c client.Client,
+	cluster *dbv1alpha1.PostgresCluster,
+) (*dbv1alpha1.PostgresBackup, error) {
+	var list dbv1alpha1.PostgresBackupList
+	if err := c.List(ctx, &list, client.InNamespace(cluster.Namespace)); err != nil {
+		return nil, err
+	}
+
+	var latest *dbv1alpha1.PostgresBackup
+	for i := range list.Items {
+		backup := &list.Items[i]
+		if backup.Spec.ClusterName != cluster.Name ||
+			backup.Status.Phase != dbv1alpha1.BackupPhaseCompleted ||
+			backup.Status.StoppedAt == nil {
+			continue
+		}
+		if latest == nil || latest.Status.StoppedAt.Before(backup.Status.StoppedAt) {
+			latest = backup
+		}
+	}
+	return latest, nil
+}
+
+// BuildDrillCluster is a single instance cluster recovering backup of
+// source up to the end of the backup, which is all a drill needs to replay.
+func BuildDrillCluster(
+	v *dbv1alpha1.BackupVerification,
+	source *dbv1alpha1.PostgresCluster,
+	backup *dbv1alpha1.PostgresBackup,
+) *dbv1alpha1.PostgresCluster {
+	store := *source.Spec.Backup.ObjectStore
+	store.Path = backup.Status.DestinationPath
+
+	recovery := &dbv1alpha1.RecoverySpec{
+		Source: store,
+		Target: &dbv1alpha1.RecoveryTarget{LSN: backup.Status.EndLSN},
+	}
+	if backup.Spec.Method == dbv1alpha1.BackupMethodVolumeSnapshot {
+		recovery.VolumeSnapshots = &dbv1alpha1.VolumeSnapshotsSource{BackupName: backup.Name}
+	} else {
+		recovery.BackupID = backup.Status.BackupID
+	}
+
+	return &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      DrillClusterName(v),
+			Namespace: v.Namespace,
+			Labels: map[string]string{
+				VerificationLabel: v.Name,
+			},
+		},
+		Spec: dbv1alpha1.PostgresClusterSpec{
+			Instances: 1,
+			Version:   source.Spec.Version,
+			Storage:   source.Spec.Storage,
+			// the password comes with the backup
+			SuperuserSecretName: source.Spec.SuperuserSecretName,
+			Bootstrap: &dbv1alpha1.BootstrapSpec{
+				Recovery: recovery,
+			},
+		},
+	}
+}
+
+// BuildDrillCheckJob runs the checks of v against the drill cluster. The
+// results are reported in the termination message of the container.
+func BuildDrillCheckJob(
+	v *dbv1alpha1.BackupVerification,
+	drill *dbv1alpha1.PostgresCluster,
+	operatorImage string,
+) (*batchv1.Job, error) {
+	checks := make([]instance.SQLCheck, 0, len(v.Spec.Checks.SQL))
+	for _, check := range v.Spec.Checks.SQL {
+		checks = append(checks, instance.SQLCheck{
+			Name:     check.Name,
+			Database: check.Database,
+			Query:    check.Query,
+			Expected: check.Expected,
+		})
+	}
+	sql, err := json.Marshal(checks)
+	if err != nil {
+		return nil, err
+	}
+
+	env := []corev1.EnvVar{
+		{Name: "PGHOST", Value: PrimaryHost(drill)},
+		{Name: "PGUSER", Value: PostgresCaption},
+		superuserPasswordEnv(drill, "PGPASSWORD"),
+		{Name: instance.EnvVerifySQL, Value: string(sql)},
+	}
+	if ptr.Deref(v.Spec.Checks.Amcheck, true) {
+		env = append(env, corev1.EnvVar{Name: instance.EnvVerifyAmcheck, Value: "true"})
+	}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      DrillCheckJobName(v),
+			Namespace: v.Namespace,
+			Labels: map[string]string{
+				VerificationLabel: v.Name,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: ptr.To[int32](1),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						VerificationLabel: v.Name,
+					},
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy:  corev1.RestartPolicyNever,
+					InitContainers: []corev1.Container{BootstrapControllerContainer(operatorImage)},
+					Containers: []corev1.Container{
+						{
+							Name:         "verify",
+							Image:        PostgresImage(drill),
+							Command:      []string{InstanceManagerPath, "verify"},
+							Env:          env,
+							VolumeMounts: []corev1.VolumeMount{controllerVolumeMount()},
+						},
+					},
+					Volumes: []corev1.Volume{controllerVolume()},
+				},
+			},
+		},
+	}, nil
+}
+
+// DeleteDrillVolumes removes the volumes left behind by the StatefulSet of a
+// deleted drill cluster.
+func DeleteDrillVolumes(ctx context.Context, c client.Client, drill client.ObjectKey) error {
+	var pvcs corev1.PersistentVolumeClaimList
+	if err := c.List(ctx, &pvcs,
+		client.InNamespace(drill.Namespace),
+		client.MatchingLabels{"postgrescluster": drill.Name},
+	); err != nil {
+		return err
+	}
+
+	for i := range pvcs.Items {
+		if err := c.Delete(ctx, &pvcs.Items[i]); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
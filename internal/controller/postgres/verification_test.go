@@ -0,0 +1,70 @@
+package postgres
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+func TestBuildDrillCluster(t *testing.T) {
+	v := &dbv1alpha1.BackupVerification{ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: "db"}}
+	source := &dbv1alpha1.PostgresCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg", Namespace: "db"},
+		Spec: dbv1alpha1.PostgresClusterSpec{
+			Instances:           3,
+			Storage:             dbv1alpha1.StorageSpec{Size: "10Gi"},
+			SuperuserSecretName: "pg-superuser",
+			Backup: &dbv1alpha1.BackupSpec{
+				ObjectStore: &dbv1alpha1.ObjectStoreSpec{Endpoint: "http://minio:9000", Bucket: "b"},
+			},
+		},
+	}
+	backup := &dbv1alpha1.PostgresBackup{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg-1"},
+		Status: dbv1alpha1.PostgresBackupStatus{
+			BackupID:        "pg-1",
+			DestinationPath: "pg",
+			EndLSN:          "0/3000100",
+		},
+	}
+
+	drill := BuildDrillCluster(v, source, backup)
+	recovery := drill.Spec.Bootstrap.Recovery
+	if drill.Name != "nightly-drill" || drill.Spec.Instances != 1 {
+		t.Errorf("unexpected drill cluster %s with %d instances", drill.Name, drill.Spec.Instances)
+	}
+	if recovery.Source.Path != "pg" || recovery.BackupID != "pg-1" || recovery.VolumeSnapshots != nil {
+		t.Errorf("unexpected recovery %+v", recovery)
+	}
+	if recovery.Target.LSN != "0/3000100" {
+		t.Errorf("recovery target = %+v, want the end of the backup", recovery.Target)
+	}
+	if ArchivingEnabled(drill) {
+		t.Error("the drill cluster must not archive")
+	}
+
+	backup.Spec.Method = dbv1alpha1.BackupMethodVolumeSnapshot
+	recovery = BuildDrillCluster(v, source, backup).Spec.Bootstrap.Recovery
+	if recovery.BackupID != "" || recovery.VolumeSnapshots == nil || recovery.VolumeSnapshots.BackupName != "pg-1" {
+		t.Errorf("unexpected snapshot recovery %+v", recovery)
+	}
+}
+
+func TestNextDrillTime(t *testing.T) {
+	last := metav1.NewTime(time.Date(2026, 10, 19, 3, 0, 0, 0, time.UTC))
+	v := &dbv1alpha1.BackupVerification{
+		Spec:   dbv1alpha1.BackupVerificationSpec{Interval: metav1.Duration{Duration: 24 * time.Hour}},
+		Status: dbv1alpha1.BackupVerificationStatus{LastDrillTime: &last},
+	}
+	if next := NextDrillTime(v); !next.Equal(last.Add(24 * time.Hour)) {
+		t.Errorf("next drill at %s, want a day after the last one", next)
+	}
+
+	v.Spec.Interval.Duration = 0
+	if next := NextDrillTime(v); !next.Equal(last.Add(time.Hour)) {
+		t.Errorf("next drill at %s with a zero interval, want an hour after the last one", next)
+	}
+}
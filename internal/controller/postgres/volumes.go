@@ -0,0 +1,75 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	dbv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+// dataVolumeOrdinal is the ordinal of the instance the data volume called
+// name belongs to, if it is one of pg.
+func dataVolumeOrdinal(pg *dbv1alpha1.PostgresCluster, name string) (int, bool) {
+	ordinal, ok := strings.CutPrefix(name, dataVolumeName+"-"+pg.Name+"-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(ordinal)
+	return n, err == nil
+}
+
+// ReconcileVolumeSizes grows the data volumes of pg to spec.storage.size:
+// the StatefulSet only sizes the volumes it creates. All of them are
+// resized at once, in the maintenance window. Whether the file system
+// grows online or when the instance restarts depends on the CSI driver,
+// the StorageClass has to allow volume expansion.
+func ReconcileVolumeSizes(ctx context.Context, c client.Client, pg *dbv1alpha1.PostgresCluster) error {
+	size, err := resource.ParseQuantity(pg.Spec.Storage.Size)
+	if err != nil {
+		return nil
+	}
+
+	var pvcs corev1.PersistentVolumeClaimList
+	if err := c.List(ctx, &pvcs, client.InNamespace(pg.Namespace)); err != nil {
+		return err
+	}
+	var small []*corev1.PersistentVolumeClaim
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		if _, ok := dataVolumeOrdinal(pg, pvc.Name); !ok {
+			continue
+		}
+		if current := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; current.Cmp(size) < 0 {
+			small = append(small, pvc)
+		}
+	}
+	if len(small) == 0 {
+		clearPendingOperation(pg, OperationVolumeResize)
+		return nil
+	}
+	if !allowDisruption(pg, OperationVolumeResize,
+		fmt.Sprintf("Resize of %d data volumes to %s", len(small), pg.Spec.Storage.Size), time.Now()) {
+		return nil
+	}
+
+	for _, pvc := range small {
+		log.FromContext(ctx).Info("Resizing data volume", "volume", pvc.Name, "size", pg.Spec.Storage.Size)
+		patch := client.MergeFrom(pvc.DeepCopy())
+		if pvc.Spec.Resources.Requests == nil {
+			pvc.Spec.Resources.Requests = corev1.ResourceList{}
+		}
+		pvc.Spec.Resources.Requests[corev1.ResourceStorage] = size
+		if err := c.Patch(ctx, pvc, patch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
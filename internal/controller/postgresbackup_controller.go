@@ -0,0 +1,200 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	databasesv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/controller/postgres"
+	"github.com/nikitadada/atlasdb/internal/instance"
+	"github.com/nikitadada/atlasdb/internal/objectstore"
+	batchv1 "k8s.io/api/batch/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+type PostgresBackupReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	OperatorImage string
+}
+
+// +kubebuilder:rbac:groups=databases.atlasdb.io,resources=postgresbackups,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=databases.atlasdb.io,resources=postgresbackups/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;create
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles;rolebindings,verbs=get;list;watch;create
+// +kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create;delete
+
+func (r *PostgresBackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	backup := &databasesv1alpha1.PostgresBackup{}
+	if err := r.Get(ctx, req.NamespacedName, backup); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	switch backup.Status.Phase {
+	case databasesv1alpha1.BackupPhaseCompleted,
+		databasesv1alpha1.BackupPhaseFailed,
+		databasesv1alpha1.BackupPhaseExpired:
+		return ctrl.Result{}, nil
+	}
+
+	pg := &databasesv1alpha1.PostgresCluster{}
+	err := r.Get(ctx, client.ObjectKey{Name: backup.Spec.ClusterName, Namespace: backup.Namespace}, pg)
+	if apierrors.IsNotFound(err) {
+		return ctrl.Result{}, r.fail(ctx, backup, fmt.Sprintf("PostgresCluster %s not found", backup.Spec.ClusterName))
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+	if clusterPaused(ctx, pg) {
+		return ctrl.Result{RequeueAfter: pausedRequeue}, nil
+	}
+
+	if !postgres.ArchivingEnabled(pg) {
+		return ctrl.Result{}, r.fail(ctx, backup, "spec.backup.objectStore is not configured on the cluster")
+	}
+
+	snapshot := backup.Spec.Method == databasesv1alpha1.BackupMethodVolumeSnapshot
+
+	// ---------------- JOB ENSURE ----------------
+
+	jobName := postgres.BackupJobName(backup)
+	if snapshot {
+		jobName = postgres.SnapshotBackupJobName(backup)
+	}
+
+	job := &batchv1.Job{}
+	err = r.Get(ctx, client.ObjectKey{Name: jobName, Namespace: backup.Namespace}, job)
+
+	if apierrors.IsNotFound(err) {
+		desired := postgres.BuildBackupJob(backup, pg, r.OperatorImage)
+		if snapshot {
+			if err := postgres.ReconcileSnapshotRBAC(ctx, r.Client, r.Scheme, pg); err != nil {
+				return ctrl.Result{}, err
+			}
+			desired = postgres.BuildSnapshotBackupJob(backup, pg, r.OperatorImage)
+		}
+
+		if err := ctrl.SetControllerReference(backup, desired, r.Scheme); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		logger.Info("Creating backup Job", "job", desired.Name)
+		if err := r.Create(ctx, desired); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		store := pg.Spec.Backup.ObjectStore
+		backup.Status.Phase = databasesv1alpha1.BackupPhaseRunning
+		backup.Status.BackupID = backup.Name
+		backup.Status.DestinationPath = postgres.ObjectStorePrefix(pg, store)
+		backup.Status.StartedAt = ptrNow()
+
+		return ctrl.Result{}, r.Status().Update(ctx, backup)
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// ---------------- JOB RESULT ----------------
+
+	switch {
+	case jobFinished(job, batchv1.JobFailed):
+		return ctrl.Result{}, r.fail(ctx, backup, "backup Job failed, see its pod logs for details")
+
+	case jobFinished(job, batchv1.JobComplete) && snapshot:
+		return ctrl.Result{}, r.completeSnapshotBackup(ctx, backup)
+
+	case jobFinished(job, batchv1.JobComplete):
+		storeClient, err := postgres.NewObjectStoreClient(ctx, r.Client, pg.Namespace, pg.Spec.Backup.ObjectStore)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		info, err := storeClient.GetBackupInfo(ctx, backup.Status.DestinationPath, backup.Status.BackupID)
+		if errors.Is(err, objectstore.ErrNotFound) {
+			return ctrl.Result{}, r.fail(ctx, backup, "backup Job completed but the backup is missing from the object store")
+		} else if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		logger.Info("Backup completed", "backupID", info.ID, "endLSN", info.EndLSN)
+
+		backup.Status.Phase = databasesv1alpha1.BackupPhaseCompleted
+		backup.Status.Timeline = info.Timeline
+		backup.Status.BeginLSN = info.BeginLSN
+		backup.Status.EndLSN = info.EndLSN
+		backup.Status.BeginWAL = info.BeginWAL
+		backup.Status.EndWAL = info.EndWAL
+		backup.Status.StartedAt = &metav1.Time{Time: info.StartTime}
+		backup.Status.StoppedAt = &metav1.Time{Time: info.StopTime}
+
+		return ctrl.Result{}, r.Status().Update(ctx, backup)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// completeSnapshotBackup records the result the snapshot Job reported in
+// its termination message.
+func (r *PostgresBackupReconciler) completeSnapshotBackup(ctx context.Context, backup *databasesv1alpha1.PostgresBackup) error {
+	job := &batchv1.Job{}
+	if err := r.Get(ctx, client.ObjectKey{Name: postgres.SnapshotBackupJobName(backup), Namespace: backup.Namespace}, job); err != nil {
+		return err
+	}
+
+	message, err := jobTerminationMessage(ctx, r.Client, job, true)
+	if err != nil {
+		return err
+	}
+	if message == "" {
+		return r.fail(ctx, backup, "snapshot Job completed without reporting its result")
+	}
+
+	result := &instance.SnapshotResult{}
+	if err := json.Unmarshal([]byte(message), result); err != nil {
+		return r.fail(ctx, backup, fmt.Sprintf("invalid snapshot Job result: %v", err))
+	}
+
+	log.FromContext(ctx).Info("Snapshot backup completed", "snapshots", result.Snapshots, "endLSN", result.EndLSN)
+
+	backup.Status.Phase = databasesv1alpha1.BackupPhaseCompleted
+	backup.Status.Timeline = postgres.WALTimeline(result.BeginWAL)
+	backup.Status.BeginLSN = result.BeginLSN
+	backup.Status.EndLSN = result.EndLSN
+	backup.Status.BeginWAL = result.BeginWAL
+	backup.Status.EndWAL = result.EndWAL
+	backup.Status.Snapshots = result.Snapshots
+	backup.Status.BackupLabel = result.BackupLabel
+	backup.Status.StartedAt = &metav1.Time{Time: result.StartTime}
+	backup.Status.StoppedAt = &metav1.Time{Time: result.StopTime}
+
+	return r.Status().Update(ctx, backup)
+}
+
+func (r *PostgresBackupReconciler) fail(ctx context.Context, backup *databasesv1alpha1.PostgresBackup, msg string) error {
+	log.FromContext(ctx).Info("Backup failed", "reason", msg)
+
+	backup.Status.Phase = databasesv1alpha1.BackupPhaseFailed
+	backup.Status.Error = msg
+	backup.Status.StoppedAt = ptrNow()
+
+	return r.Status().Update(ctx, backup)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PostgresBackupReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&databasesv1alpha1.PostgresBackup{}).
+		Owns(&batchv1.Job{}).
+		Named("postgresbackup").
+		Complete(r)
+}
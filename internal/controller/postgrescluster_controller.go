@@ -3,34 +3,67 @@ package controller
 import (
 	"context"
 	"fmt"
+	"maps"
+	"sync"
 	"time"
 
 	databasesv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
 	"github.com/nikitadada/atlasdb/internal/controller/postgres"
+	"github.com/nikitadada/atlasdb/internal/instance"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 type PostgresClusterReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// OperatorImage is the image the instance manager is copied from
+	// into PostgreSQL pods.
+	OperatorImage string
+
+	// OperatorNamespace is where the operator runs, the only namespace
+	// allowed to reach the API of the instance managers. Empty, e.g. when
+	// the operator runs outside of the cluster, no NetworkPolicy restricts
+	// it and only the API token protects it.
+	OperatorNamespace string
+
+	// lastRetention throttles object store pruning per cluster.
+	lastRetention sync.Map
 }
 
+// retentionInterval is how often the retention policy is applied. Listing a
+// large WAL archive is expensive, there is no point doing it every reconcile.
+const retentionInterval = time.Hour
+
 const FinalizerName = "databases.atlasdb.io/finalizer"
 
 // +kubebuilder:rbac:groups=databases.atlasdb.io,resources=postgresclusters,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=databases.atlasdb.io,resources=postgresclusters/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=databases.atlasdb.io,resources=postgresclusters/finalizers,verbs=update
 // +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;patch;delete
+// +kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch;create;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;delete
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;delete
+// +kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
 
 func (r *PostgresClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
@@ -41,16 +74,110 @@ func (r *PostgresClusterReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	// ---------------- PAUSE ----------------
+
+	if postgres.ReconciliationPaused(pg) {
+		return r.reconcilePaused(ctx, pg)
+	}
+
 	// ---------------- FINALIZER ----------------
 
+	if !pg.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, pg)
+	}
+
 	if err := postgres.EnsureFinalizer(ctx, r.Client, pg); err != nil {
 		return ctrl.Result{}, err
 	}
 
+	// a confirmation is only good for one change of deletionProtection
+	if _, ok := pg.Annotations[databasesv1alpha1.ConfirmDeletionProtectionChangeAnnotation]; ok {
+		patch := client.MergeFrom(pg.DeepCopy())
+		delete(pg.Annotations, databasesv1alpha1.ConfirmDeletionProtectionChangeAnnotation)
+		if err := r.Patch(ctx, pg, patch); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// a rollback only applies to clients switched over, it is done or moot
+	if _, ok := pg.Annotations[databasesv1alpha1.RollbackUpgradeAnnotation]; ok && !postgres.SwitchedOver(pg) {
+		patch := client.MergeFrom(pg.DeepCopy())
+		delete(pg.Annotations, databasesv1alpha1.RollbackUpgradeAnnotation)
+		if err := r.Patch(ctx, pg, patch); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
 	creds, err := postgres.ReconcileCredentials(ctx, r.Client, r.Scheme, pg)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
+	if err := postgres.ReconcileAPIToken(ctx, r.Client, r.Scheme, pg); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := postgres.ReconcileConfigMap(ctx, r.Client, r.Scheme, pg); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// ---------------- INSTANCES ----------------
+
+	instances, err := postgres.UpdateInstanceStatuses(ctx, r.Client, pg)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	postgres.ReconcileFencing(ctx, pg, instances)
+	settled, err := postgres.ReconcileInstances(ctx, r.Client, pg, instances)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// ---------------- HIBERNATION ----------------
+
+	hibernate, untilHibernation := postgres.HibernationRequested(pg, time.Now())
+	hibernate = hibernate && postgres.ReadyToHibernate(ctx, pg)
+	if !hibernate {
+		postgres.Resume(pg)
+	}
+
+	// ---------------- MAJOR UPGRADE ----------------
+
+	stopped := false
+	if !hibernate {
+		stopped, err = postgres.ReconcileMajorUpgrade(ctx, r.Client, r.Scheme, pg, instances, r.OperatorImage)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// ---------------- RECLONE ----------------
+
+	if !stopped && !hibernate {
+		var phase string
+		if pg.Status.Reclone != nil {
+			phase = pg.Status.Reclone.Phase
+		}
+		recloned, err := postgres.ReconcileReclone(ctx, r.Client, pg, instances)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		// the phase is persisted before anything else: once the volume is
+		// deleted, a retry must not delete the one recreated for the clone
+		if recloned || (pg.Status.Reclone != nil && pg.Status.Reclone.Phase != phase) {
+			if err := r.Status().Update(ctx, pg); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		// the result is kept in the status, a request is good for one
+		// re-clone
+		if recloned {
+			patch := client.MergeFrom(pg.DeepCopy())
+			delete(pg.Annotations, databasesv1alpha1.RecloneInstanceAnnotation)
+			if err := r.Patch(ctx, pg, patch); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
 
 	// ---------------- STATEFULSET ENSURE ----------------
 
@@ -60,22 +187,96 @@ func (r *PostgresClusterReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 		Namespace: pg.Namespace,
 	}, sts)
 
+	if err != nil && !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+
+	desiredSts, buildErr := postgres.BuildStatefulSet(pg, r.OperatorImage)
+	if buildErr != nil {
+		// only a change of the spec can fix it, which is reconciled
+		logger.Error(buildErr, "Invalid cluster spec")
+		postgres.SetProgressing(pg, "InvalidSpec", buildErr.Error())
+		if err := r.Status().Update(ctx, pg); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// volumes restored from snapshots have to be prepared before their
+	// instance starts
+	current := int32(0)
+	if err == nil {
+		current = min(*sts.Spec.Replicas, pg.Spec.Instances)
+	}
+	if ordinal, ok := postgres.RecloneInProgress(pg); ok {
+		current = min(current, ordinal)
+	}
+	runnable, snapErr := postgres.ReconcileSnapshotVolumes(ctx, r.Client, r.Scheme, pg, r.OperatorImage, current)
+	if snapErr != nil {
+		logger.Error(snapErr, "Failed to provision volumes from snapshot backup")
+	}
+	desiredSts.Spec.Replicas = &runnable
+	if err == nil && runnable < *sts.Spec.Replicas {
+		desired := postgres.ScaleDownReplicas(pg, runnable)
+		if desired != runnable {
+			logger.Info("Switching over before scaling down past the primary",
+				"primary", pg.Status.CurrentPrimary, "target", pg.Status.TargetPrimary)
+		}
+		desiredSts.Spec.Replicas = &desired
+	}
+	if stopped || hibernate {
+		desiredSts.Spec.Replicas = ptr.To[int32](0)
+	}
+
 	if apierrors.IsNotFound(err) {
-		desired := postgres.BuildStatefulSet(pg)
+		if runnable == 0 {
+			logger.Info("Waiting for the data volume to be restored from snapshots")
+			return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+		}
 
-		if err := ctrl.SetControllerReference(pg, desired, r.Scheme); err != nil {
+		if err := ctrl.SetControllerReference(pg, desiredSts, r.Scheme); err != nil {
 			return ctrl.Result{}, err
 		}
 
 		logger.Info("Creating StatefulSet")
-		if err := r.Create(ctx, desired); err != nil {
+		if err := r.Create(ctx, desiredSts); err != nil {
 			return ctrl.Result{}, err
 		}
 
 		// ждём следующий reconcile
 		return ctrl.Result{RequeueAfter: 3 * time.Second}, nil
-	} else if err != nil {
-		return ctrl.Result{}, err
+	}
+
+	if hibernate {
+		postgres.Hibernate(ctx, pg, instances, sts)
+	}
+
+	if postgres.StatefulSetNeedsUpdate(sts, desiredSts) {
+		sts.Spec.Replicas = desiredSts.Spec.Replicas
+		sts.Spec.UpdateStrategy = desiredSts.Spec.UpdateStrategy
+		sts.Spec.Template = desiredSts.Spec.Template
+
+		logger.Info("Updating StatefulSet")
+		if err := r.Update(ctx, sts); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if hibernate {
+		if err := r.Status().Update(ctx, pg); err != nil {
+			return ctrl.Result{}, err
+		}
+		if len(instances) > 0 {
+			return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+		}
+		return ctrl.Result{RequeueAfter: untilHibernation}, nil
+	}
+
+	if stopped {
+		if err := r.Status().Update(ctx, pg); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
 	}
 
 	// ---------------- SERVICE ENSURE ----------------
@@ -137,6 +338,28 @@ func (r *PostgresClusterReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 		return ctrl.Result{}, err
 	}
 
+	// clusters created before the role label selected every instance
+	if desired := postgres.BuildClientService(pg); !maps.Equal(clientSvc.Spec.Selector, desired.Spec.Selector) {
+		clientSvc.Spec.Selector = desired.Spec.Selector
+
+		logger.Info("Updating client service selector")
+		if err := r.Update(ctx, clientSvc); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// ---------------- DISRUPTION BUDGETS ----------------
+
+	if err := postgres.ReconcilePodDisruptionBudgets(ctx, r.Client, r.Scheme, pg); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// ---------------- NETWORK POLICY ----------------
+
+	if err := postgres.ReconcileNetworkPolicy(ctx, r.Client, r.Scheme, pg, r.OperatorNamespace); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	// =========================
 	// CREATE CONNECTION SECRET
 	// =========================
@@ -145,7 +368,7 @@ func (r *PostgresClusterReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 		ctx,
 		r.Client,
 		pg.Namespace,
-		pg.Spec.SuperuserSecretName,
+		postgres.SuperuserSecretName(pg),
 	)
 	if err != nil {
 		return ctrl.Result{}, err
@@ -194,22 +417,63 @@ func (r *PostgresClusterReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 		}
 	}
 
+	// ---------------- CONTINUOUS ARCHIVING ----------------
+
+	postgres.UpdateArchivingStatus(ctx, r.Client, pg)
+
+	// ---------------- RECOVERY ----------------
+
+	if err := postgres.UpdateRecoveryStatus(ctx, r.Client, pg); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := postgres.UpdateInstancesStatus(ctx, r.Client, pg, sts); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if postgres.RecoveryEnabled(pg) &&
+		!meta.IsStatusConditionTrue(pg.Status.Conditions, postgres.ConditionRecovered) {
+		logger.Info("Waiting for recovery to reach its target")
+
+		postgres.SetProgressing(pg, "Recovering", "Waiting for point-in-time recovery to complete")
+
+		if err := r.Status().Update(ctx, pg); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	// ---------------- VOLUME RESIZE ----------------
+
+	if err := postgres.ReconcileVolumeSizes(ctx, r.Client, pg); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// ---------------- SWITCHOVER ----------------
+
+	if err := postgres.ReconcileDrainedPrimary(ctx, r.Client, pg, instances); err != nil {
+		return ctrl.Result{}, err
+	}
+	switchedOver, err := postgres.ReconcileSwitchover(ctx, pg, instances)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !switchedOver {
+		if err := r.Status().Update(ctx, pg); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+	}
+
 	// ---------------- READINESS CHECK ----------------
 
-	if sts.Status.ReadyReplicas != *sts.Spec.Replicas {
+	if sts.Status.ReadyReplicas != *sts.Spec.Replicas || *sts.Spec.Replicas != pg.Spec.Instances {
 		logger.Info("Waiting for StatefulSet to be ready",
 			"ready", sts.Status.ReadyReplicas,
 			"desired", *sts.Spec.Replicas)
 
-		meta.SetStatusCondition(&pg.Status.Conditions, metav1.Condition{
-			Type:               "Ready",
-			Status:             metav1.ConditionFalse,
-			Reason:             "Reconciling",
-			Message:            "Waiting for pods to become ready",
-			LastTransitionTime: metav1.Now(),
-		})
-
-		pg.Status.Phase = "Reconciling"
+		postgres.SetInstancesNotReady(pg, sts)
 
 		if err := r.Status().Update(ctx, pg); err != nil {
 			return ctrl.Result{}, err
@@ -218,36 +482,178 @@ func (r *PostgresClusterReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 		return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
 	}
 
+	// ---------------- ROLLING UPDATE ----------------
+
+	rolledOut, err := postgres.ReconcileRollout(ctx, r.Client, pg, sts, instances)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !rolledOut {
+		if err := r.Status().Update(ctx, pg); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+	}
+
 	// ---------------- READY ----------------
 
 	logger.Info("Postgres cluster is ready")
 
-	meta.SetStatusCondition(&pg.Status.Conditions, metav1.Condition{
-		Type:               "Ready",
-		Status:             metav1.ConditionTrue,
-		Reason:             "ClusterReady",
-		Message:            "Postgres cluster is ready",
-		LastTransitionTime: metav1.Now(),
-	})
-
-	pg.Status.Phase = "Ready"
+	postgres.SetReady(pg)
 	pg.Status.Endpoint = fmt.Sprintf(
 		"%s.%s.svc.cluster.local:5432",
 		clientSvcName,
 		pg.Namespace,
 	)
 
+	// ---------------- RETENTION ----------------
+
+	if postgres.ArchivingEnabled(pg) {
+		last, ok := r.lastRetention.Load(req.NamespacedName)
+		if !ok || time.Since(last.(time.Time)) > retentionInterval {
+			if err := postgres.ApplyRetention(ctx, r.Client, pg); err != nil {
+				logger.Error(err, "Failed to apply backup retention policy")
+			} else {
+				r.lastRetention.Store(req.NamespacedName, time.Now())
+			}
+		}
+	}
+
+	untilWindow := postgres.UpdateNextMaintenanceWindow(pg, time.Now())
+
 	if err := r.Status().Update(ctx, pg); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	return ctrl.Result{}, nil
+	// an override is good for the operations pending when it is set
+	if postgres.MaintenanceOverrideDone(pg) {
+		patch := client.MergeFrom(pg.DeepCopy())
+		delete(pg.Annotations, databasesv1alpha1.MaintenanceOverrideAnnotation)
+		if err := r.Patch(ctx, pg, patch); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	_, recloning := pg.Annotations[databasesv1alpha1.RecloneInstanceAnnotation]
+	if !settled || postgres.MajorUpgradeInProgress(pg) || recloning {
+		// reloads, demotions, re-clones and the steps of an upgrade are
+		// asynchronous
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	requeue := untilWindow
+	if untilHibernation > 0 && (requeue == 0 || untilHibernation < requeue) {
+		requeue = untilHibernation
+	}
+	if postgres.ArchivingEnabled(pg) && (requeue == 0 || requeue > time.Minute) {
+		// archiver status lives in the object store, poll it
+		requeue = time.Minute
+	}
+	return ctrl.Result{RequeueAfter: requeue}, nil
+}
+
+// reconcilePaused only updates the status of a cluster while its
+// reconciliation is paused, and fences its instances: that is what an
+// intervention may need the operator for. A deleted cluster waits too.
+func (r *PostgresClusterReconciler) reconcilePaused(ctx context.Context, pg *databasesv1alpha1.PostgresCluster) (ctrl.Result, error) {
+	log.FromContext(ctx).Info("Reconciliation is paused")
+
+	instances, err := postgres.UpdateInstanceStatuses(ctx, r.Client, pg)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	postgres.ReconcileFencing(ctx, pg, instances)
+
+	sts := &appsv1.StatefulSet{}
+	err = r.Get(ctx, client.ObjectKeyFromObject(pg), sts)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+	if err == nil {
+		if err := postgres.UpdateInstancesStatus(ctx, r.Client, pg, sts); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	postgres.UpdateArchivingStatus(ctx, r.Client, pg)
+
+	if err := r.Status().Update(ctx, pg); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+}
+
+// finalize applies the deletion policy of a deleted cluster and removes the
+// finalizer once it is done.
+func (r *PostgresClusterReconciler) finalize(ctx context.Context, pg *databasesv1alpha1.PostgresCluster) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	if !controllerutil.ContainsFinalizer(pg, postgres.PostgresFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	done, err := postgres.Finalize(ctx, r.Client, pg)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	pg.Status.Phase = "Deleting"
+	if err := r.Status().Update(ctx, pg); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if !done {
+		cond := meta.FindStatusCondition(pg.Status.Conditions, postgres.ConditionDeletionPolicyApplied)
+		logger.Info("Applying deletion policy", "policy", pg.Spec.DeletionPolicy, "step", cond.Reason)
+		return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+	}
+
+	logger.Info("Deletion policy applied, removing finalizer")
+	r.lastRetention.Delete(client.ObjectKeyFromObject(pg))
+
+	controllerutil.RemoveFinalizer(pg, postgres.PostgresFinalizer)
+	return ctrl.Result{}, r.Update(ctx, pg)
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *PostgresClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&databasesv1alpha1.PostgresCluster{}).
+		Watches(&corev1.Node{}, handler.EnqueueRequestsFromMapFunc(r.primariesOnNode),
+			builder.WithPredicates(cordonChanged)).
 		Named("postgrescluster").
 		Complete(r)
 }
+
+// cordonChanged passes the updates of a Node that cordon or uncordon it.
+var cordonChanged = predicate.Funcs{
+	CreateFunc:  func(event.CreateEvent) bool { return false },
+	DeleteFunc:  func(event.DeleteEvent) bool { return false },
+	GenericFunc: func(event.GenericEvent) bool { return false },
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldNode, ok := e.ObjectOld.(*corev1.Node)
+		newNode, ok2 := e.ObjectNew.(*corev1.Node)
+		return ok && ok2 && oldNode.Spec.Unschedulable != newNode.Spec.Unschedulable
+	},
+}
+
+// primariesOnNode maps a Node to the clusters whose primary runs on it, so
+// that a drain is noticed as soon as the node is cordoned.
+func (r *PostgresClusterReconciler) primariesOnNode(ctx context.Context, node client.Object) []reconcile.Request {
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.MatchingLabels{postgres.RoleLabel: instance.RolePrimary}); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list the primaries on a node", "node", node.GetName())
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, pod := range pods.Items {
+		cluster := pod.Labels["postgrescluster"]
+		if pod.Spec.NodeName != node.GetName() || cluster == "" {
+			continue
+		}
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Namespace: pod.Namespace, Name: cluster},
+		})
+	}
+	return requests
+}
@@ -78,8 +78,9 @@ var _ = Describe("PostgresCluster Controller", func() {
 		It("should successfully reconcile the resource", func() {
 			By("Reconciling the created resource")
 			controllerReconciler := &PostgresClusterReconciler{
-				Client: k8sClient,
-				Scheme: k8sClient.Scheme(),
+				Client:        k8sClient,
+				Scheme:        k8sClient.Scheme(),
+				OperatorImage: "controller:latest",
 			}
 
 			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
@@ -0,0 +1,181 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	databasesv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/controller/postgres"
+	"github.com/nikitadada/atlasdb/internal/instance"
+	batchv1 "k8s.io/api/batch/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// PostgresDumpReconciler dumps the databases of a PostgresDump one after the
+// other, with a Job per database.
+type PostgresDumpReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	OperatorImage string
+}
+
+// +kubebuilder:rbac:groups=databases.atlasdb.io,resources=postgresdumps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=databases.atlasdb.io,resources=postgresdumps/status,verbs=get;update;patch
+
+func (r *PostgresDumpReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	dump := &databasesv1alpha1.PostgresDump{}
+	if err := r.Get(ctx, req.NamespacedName, dump); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	switch dump.Status.Phase {
+	case databasesv1alpha1.DumpPhaseCompleted, databasesv1alpha1.DumpPhaseFailed:
+		return ctrl.Result{}, nil
+	}
+
+	pg := &databasesv1alpha1.PostgresCluster{}
+	err := r.Get(ctx, client.ObjectKey{Name: dump.Spec.ClusterName, Namespace: dump.Namespace}, pg)
+	if apierrors.IsNotFound(err) {
+		return ctrl.Result{}, r.fail(ctx, dump, fmt.Sprintf("PostgresCluster %s not found", dump.Spec.ClusterName))
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+	if clusterPaused(ctx, pg) {
+		return ctrl.Result{RequeueAfter: pausedRequeue}, nil
+	}
+
+	if err := postgres.ValidateDumpDestination(dump.Spec.Destination); err != nil {
+		return ctrl.Result{}, r.fail(ctx, dump, err.Error())
+	}
+
+	// ---------------- START ----------------
+
+	if dump.Status.Phase == "" {
+		for _, db := range postgres.DumpDatabases(dump, pg) {
+			dump.Status.Databases = append(dump.Status.Databases, databasesv1alpha1.DatabaseDump{
+				Name:  db,
+				Phase: databasesv1alpha1.DumpPhasePending,
+			})
+		}
+		dump.Status.Phase = databasesv1alpha1.DumpPhaseRunning
+		dump.Status.Progress = dumpProgress(dump.Status.Databases)
+		dump.Status.StartedAt = ptrNow()
+
+		return ctrl.Result{}, r.Status().Update(ctx, dump)
+	}
+
+	// ---------------- NEXT DATABASE ----------------
+
+	index := nextDatabase(dump.Status.Databases)
+	if index < 0 {
+		logger.Info("Dump completed")
+
+		dump.Status.Phase = databasesv1alpha1.DumpPhaseCompleted
+		dump.Status.CompletedAt = ptrNow()
+		return ctrl.Result{}, r.Status().Update(ctx, dump)
+	}
+	db := &dump.Status.Databases[index]
+
+	job := &batchv1.Job{}
+	err = r.Get(ctx, client.ObjectKey{Name: postgres.DumpJobName(dump, index), Namespace: dump.Namespace}, job)
+
+	if apierrors.IsNotFound(err) {
+		desired := postgres.BuildDumpJob(dump, pg, index, db.Name, r.OperatorImage)
+		if err := ctrl.SetControllerReference(dump, desired, r.Scheme); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		logger.Info("Dumping database", "database", db.Name, "job", desired.Name)
+		if err := r.Create(ctx, desired); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		db.Phase = databasesv1alpha1.DumpPhaseRunning
+		return ctrl.Result{}, r.Status().Update(ctx, dump)
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// ---------------- JOB RESULT ----------------
+
+	switch {
+	case jobFinished(job, batchv1.JobFailed):
+		message, err := jobTerminationMessage(ctx, r.Client, job, false)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		db.Phase = databasesv1alpha1.DumpPhaseFailed
+		db.Error = message
+		return ctrl.Result{}, r.fail(ctx, dump, fmt.Sprintf("dumping database %s failed", db.Name))
+
+	case jobFinished(job, batchv1.JobComplete):
+		message, err := jobTerminationMessage(ctx, r.Client, job, true)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		var result instance.DumpResult
+		if err := json.Unmarshal([]byte(message), &result); err != nil {
+			db.Phase = databasesv1alpha1.DumpPhaseFailed
+			return ctrl.Result{}, r.fail(ctx, dump, fmt.Sprintf("invalid result of the dump of database %s: %v", db.Name, err))
+		}
+
+		db.Phase = databasesv1alpha1.DumpPhaseCompleted
+		db.Location = result.Location
+		db.Size = result.Size
+		dump.Status.Progress = dumpProgress(dump.Status.Databases)
+
+		return ctrl.Result{}, r.Status().Update(ctx, dump)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+func (r *PostgresDumpReconciler) fail(ctx context.Context, dump *databasesv1alpha1.PostgresDump, msg string) error {
+	log.FromContext(ctx).Info("Dump failed", "reason", msg)
+
+	dump.Status.Phase = databasesv1alpha1.DumpPhaseFailed
+	dump.Status.Error = msg
+	dump.Status.CompletedAt = ptrNow()
+
+	return r.Status().Update(ctx, dump)
+}
+
+// nextDatabase is the index of the first database not dumped or restored
+// yet, or -1.
+func nextDatabase(dbs []databasesv1alpha1.DatabaseDump) int {
+	for i, db := range dbs {
+		if db.Phase != databasesv1alpha1.DumpPhaseCompleted {
+			return i
+		}
+	}
+	return -1
+}
+
+func dumpProgress(dbs []databasesv1alpha1.DatabaseDump) string {
+	done := 0
+	for _, db := range dbs {
+		if db.Phase == databasesv1alpha1.DumpPhaseCompleted {
+			done++
+		}
+	}
+	return fmt.Sprintf("%d/%d", done, len(dbs))
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PostgresDumpReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&databasesv1alpha1.PostgresDump{}).
+		Owns(&batchv1.Job{}).
+		Named("postgresdump").
+		Complete(r)
+}
@@ -0,0 +1,454 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	databasesv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/controller/postgres"
+	batchv1 "k8s.io/api/batch/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// operationPollInterval is how often the operations carried on by the
+// cluster, or waiting for it, are checked.
+const operationPollInterval = 5 * time.Second
+
+// PostgresOperationReconciler runs a PostgresOperation once against its
+// cluster and keeps the result in its status. Operations are never run
+// again nor deleted, they are the record of what was done to the cluster:
+// an operation is running in its status before it acts on the cluster, and
+// a retry of a running operation only follows it through.
+type PostgresOperationReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+// +kubebuilder:rbac:groups=databases.atlasdb.io,resources=postgresoperations,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=databases.atlasdb.io,resources=postgresoperations/status,verbs=get;update;patch
+
+func (r *PostgresOperationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	op := &databasesv1alpha1.PostgresOperation{}
+	if err := r.Get(ctx, req.NamespacedName, op); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	switch op.Status.Phase {
+	case databasesv1alpha1.OperationPhaseSucceeded, databasesv1alpha1.OperationPhaseFailed:
+		return ctrl.Result{}, nil
+	}
+
+	pg := &databasesv1alpha1.PostgresCluster{}
+	err := r.Get(ctx, client.ObjectKey{Name: op.Spec.ClusterName, Namespace: op.Namespace}, pg)
+	if apierrors.IsNotFound(err) {
+		return ctrl.Result{}, r.fail(ctx, op, fmt.Sprintf("PostgresCluster %s not found", op.Spec.ClusterName))
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if postgres.ReconciliationPaused(pg) {
+		return r.wait(ctx, op, "Reconciliation of the cluster is paused")
+	}
+	if meta.IsStatusConditionTrue(pg.Status.Conditions, postgres.ConditionHibernated) {
+		return ctrl.Result{}, r.fail(ctx, op, "the cluster is hibernated")
+	}
+	if op.Spec.Instance != "" && !slices.ContainsFunc(pg.Status.Instances, func(s databasesv1alpha1.InstanceStatus) bool {
+		return s.Name == op.Spec.Instance
+	}) {
+		return ctrl.Result{}, r.fail(ctx, op, fmt.Sprintf("%s is not an instance of the cluster", op.Spec.Instance))
+	}
+
+	// the roles as the instances report them now, the status of the
+	// cluster itself is only changed to start a switchover
+	live := pg.DeepCopy()
+	instances, err := postgres.UpdateInstanceStatuses(ctx, r.Client, live)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if op.Status.Phase == databasesv1alpha1.OperationPhaseRunning {
+		return r.progress(ctx, op, pg, live, instances)
+	}
+
+	// pending, the operation is started and recorded as running
+	switch op.Spec.Type {
+	case databasesv1alpha1.OperationTypeReload, databasesv1alpha1.OperationTypeCheckpoint:
+		return ctrl.Result{}, r.callInstances(ctx, op, live, instances)
+
+	case databasesv1alpha1.OperationTypeSwitchover:
+		return r.startSwitchover(ctx, op, pg, live)
+
+	case databasesv1alpha1.OperationTypePromote:
+		return r.startPromote(ctx, op, live, instances)
+
+	case databasesv1alpha1.OperationTypeRestart:
+		return r.startRestart(ctx, op, live)
+
+	case databasesv1alpha1.OperationTypeVacuum, databasesv1alpha1.OperationTypeReindex:
+		return r.startJob(ctx, op, live)
+	}
+
+	return ctrl.Result{}, r.fail(ctx, op, fmt.Sprintf("unknown operation type %q", op.Spec.Type))
+}
+
+// callInstances reloads or checkpoints the instances, which is done right
+// away.
+func (r *PostgresOperationReconciler) callInstances(
+	ctx context.Context,
+	op *databasesv1alpha1.PostgresOperation,
+	live *databasesv1alpha1.PostgresCluster,
+	instances []postgres.Instance,
+) error {
+	var names []string
+	switch {
+	case op.Spec.Instance != "":
+		names = []string{op.Spec.Instance}
+	case op.Spec.Type == databasesv1alpha1.OperationTypeCheckpoint:
+		names = []string{postgres.CurrentPrimary(live)}
+	default:
+		for _, inst := range instances {
+			names = append(names, inst.Pod.Name)
+		}
+	}
+
+	if err := r.running(ctx, op, names, fmt.Sprintf("Running %s on %d instances", op.Spec.Type, len(names))); err != nil {
+		return err
+	}
+	path := postgres.OperationPath(op.Spec.Type)
+
+	var errs []error
+	for _, name := range names {
+		if err := postgres.CallInstanceOperation(ctx, instances, name, path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return r.fail(ctx, op, err.Error())
+	}
+	return r.succeed(ctx, op, fmt.Sprintf("Ran %s on %d instances", op.Spec.Type, len(names)))
+}
+
+// startSwitchover hands the switchover over to the cluster through
+// status.targetPrimary, like a rolling update does.
+func (r *PostgresOperationReconciler) startSwitchover(
+	ctx context.Context,
+	op *databasesv1alpha1.PostgresOperation,
+	pg, live *databasesv1alpha1.PostgresCluster,
+) (ctrl.Result, error) {
+	primary := postgres.CurrentPrimary(live)
+	if op.Spec.Instance == primary {
+		return ctrl.Result{}, r.fail(ctx, op, fmt.Sprintf("%s already is the primary", primary))
+	}
+	if pg.Status.TargetPrimary != "" || postgres.MajorUpgradeInProgress(pg) {
+		return r.wait(ctx, op, "Waiting for the switchover or the upgrade in progress")
+	}
+
+	target := op.Spec.Instance
+	if target == "" {
+		target = postgres.MostCaughtUpReplica(live)
+	}
+	if target == "" {
+		return r.wait(ctx, op, "Waiting for a replica to catch up with the primary")
+	}
+	if !postgres.CaughtUpReplica(live, target) {
+		return r.wait(ctx, op, fmt.Sprintf("Waiting for %s to catch up with the primary", target))
+	}
+
+	if err := r.running(ctx, op, []string{target}, fmt.Sprintf("Switching over from %s to %s", primary, target)); err != nil {
+		return ctrl.Result{}, err
+	}
+	log.FromContext(ctx).Info("Switching over", "primary", primary, "target", target)
+	// the cluster changes all the time, the switchover is handed over on a
+	// fresh copy unless another one started meanwhile
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := r.Get(ctx, client.ObjectKeyFromObject(pg), pg); err != nil {
+			return err
+		}
+		if pg.Status.TargetPrimary != "" {
+			return nil
+		}
+		pg.Status.TargetPrimary = target
+		return r.Status().Update(ctx, pg)
+	})
+	return ctrl.Result{RequeueAfter: operationPollInterval}, err
+}
+
+// startPromote promotes a replica while no primary runs. A running primary
+// would be left on the same timeline as the promoted replica and not be
+// demoted, a switchover is done instead.
+func (r *PostgresOperationReconciler) startPromote(
+	ctx context.Context,
+	op *databasesv1alpha1.PostgresOperation,
+	live *databasesv1alpha1.PostgresCluster,
+	instances []postgres.Instance,
+) (ctrl.Result, error) {
+	target := op.Spec.Instance
+	if !postgres.PrimaryDown(live) {
+		return ctrl.Result{}, r.fail(ctx, op, fmt.Sprintf(
+			"the primary %s is running, switch over to %s instead", postgres.CurrentPrimary(live), target))
+	}
+	if !slices.ContainsFunc(instances, func(inst postgres.Instance) bool {
+		return inst.Pod.Name == target && inst.Reported != nil
+	}) {
+		return r.wait(ctx, op, fmt.Sprintf("Waiting for %s to be reachable", target))
+	}
+
+	if err := r.running(ctx, op, []string{target}, fmt.Sprintf("Promoting %s", target)); err != nil {
+		return ctrl.Result{}, err
+	}
+	log.FromContext(ctx).Info("Promoting instance", "instance", target, "primary", postgres.CurrentPrimary(live))
+	if err := postgres.CallInstanceOperation(ctx, instances, target, postgres.OperationPath(op.Spec.Type)); err != nil {
+		return ctrl.Result{}, r.fail(ctx, op, err.Error())
+	}
+	return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+}
+
+// startRestart records the instances to restart: one instance, or every
+// instance through the RestartAnnotation, the replicas first, then the
+// primary after a switchover, in the maintenance window. The restart
+// itself is left to restart.
+func (r *PostgresOperationReconciler) startRestart(
+	ctx context.Context,
+	op *databasesv1alpha1.PostgresOperation,
+	live *databasesv1alpha1.PostgresCluster,
+) (ctrl.Result, error) {
+	if name := op.Spec.Instance; name != "" {
+		return ctrl.Result{RequeueAfter: operationPollInterval},
+			r.running(ctx, op, []string{name}, fmt.Sprintf("Restarting %s", name))
+	}
+
+	var names []string
+	for _, s := range live.Status.Instances {
+		names = append(names, s.Name)
+	}
+	return ctrl.Result{RequeueAfter: operationPollInterval},
+		r.running(ctx, op, names, "Restarting every instance")
+}
+
+// restart deletes the pod of the instance of op, or sets the
+// RestartAnnotation, unless that was done since op started: pods created
+// since are restarted.
+func (r *PostgresOperationReconciler) restart(
+	ctx context.Context,
+	op *databasesv1alpha1.PostgresOperation,
+	pg, live *databasesv1alpha1.PostgresCluster,
+	instances []postgres.Instance,
+) error {
+	logger := log.FromContext(ctx)
+
+	if name := op.Spec.Instance; name != "" {
+		i := slices.IndexFunc(instances, func(inst postgres.Instance) bool { return inst.Pod.Name == name })
+		if i < 0 {
+			return nil
+		}
+		pod := instances[i].Pod
+		if !pod.CreationTimestamp.Before(op.Status.StartedAt) || !pod.DeletionTimestamp.IsZero() {
+			return nil
+		}
+		if name == postgres.CurrentPrimary(live) {
+			if err := postgres.CallInstanceOperation(ctx, instances, name, postgres.OperationPath(databasesv1alpha1.OperationTypeCheckpoint)); err != nil {
+				logger.Error(err, "Failed to checkpoint before restart", "instance", name)
+			}
+		}
+		logger.Info("Restarting instance", "instance", name)
+		return client.IgnoreNotFound(r.Delete(ctx, pod, client.Preconditions{UID: &pod.UID}))
+	}
+
+	// a later restart is not taken back
+	last, err := time.Parse(time.RFC3339, pg.Annotations[databasesv1alpha1.RestartAnnotation])
+	if err == nil && !last.Before(op.Status.StartedAt.Time) {
+		return nil
+	}
+	logger.Info("Restarting every instance")
+	patch := client.MergeFrom(pg.DeepCopy())
+	if pg.Annotations == nil {
+		pg.Annotations = map[string]string{}
+	}
+	pg.Annotations[databasesv1alpha1.RestartAnnotation] = op.Status.StartedAt.UTC().Format(time.RFC3339)
+	return r.Patch(ctx, pg, patch)
+}
+
+// startJob records the operation run by a vacuumdb or a reindexdb Job,
+// which jobResult creates.
+func (r *PostgresOperationReconciler) startJob(
+	ctx context.Context,
+	op *databasesv1alpha1.PostgresOperation,
+	live *databasesv1alpha1.PostgresCluster,
+) (ctrl.Result, error) {
+	return ctrl.Result{RequeueAfter: operationPollInterval},
+		r.running(ctx, op, []string{postgres.CurrentPrimary(live)},
+			fmt.Sprintf("Running %s, see the logs of Job %s", op.Spec.Type, postgres.OperationJobName(op)))
+}
+
+// progress follows a running operation until it succeeds or fails.
+func (r *PostgresOperationReconciler) progress(
+	ctx context.Context,
+	op *databasesv1alpha1.PostgresOperation,
+	pg, live *databasesv1alpha1.PostgresCluster,
+	instances []postgres.Instance,
+) (ctrl.Result, error) {
+	switch op.Spec.Type {
+	case databasesv1alpha1.OperationTypeReload, databasesv1alpha1.OperationTypeCheckpoint:
+		// the instances were called by the pass that started the operation
+		return ctrl.Result{}, r.fail(ctx, op, fmt.Sprintf(
+			"the result of the %s was not recorded, it is not run again", op.Spec.Type))
+
+	case databasesv1alpha1.OperationTypeSwitchover:
+		target := op.Status.Instances[0]
+		if pg.Status.TargetPrimary == target {
+			break
+		}
+		if pg.Status.CurrentPrimary != target {
+			return ctrl.Result{}, r.fail(ctx, op, fmt.Sprintf(
+				"the switchover was given up, %s is the primary", pg.Status.CurrentPrimary))
+		}
+		return ctrl.Result{}, r.succeed(ctx, op, fmt.Sprintf("%s is the primary", target))
+
+	case databasesv1alpha1.OperationTypePromote:
+		target := op.Status.Instances[0]
+		if postgres.CurrentPrimary(live) == target {
+			return ctrl.Result{}, r.succeed(ctx, op, fmt.Sprintf("%s is the primary", target))
+		}
+
+	case databasesv1alpha1.OperationTypeRestart:
+		if err := r.restart(ctx, op, pg, live, instances); err != nil {
+			return ctrl.Result{}, err
+		}
+		if slices.ContainsFunc(pg.Status.PendingOperations, func(p databasesv1alpha1.PendingOperation) bool {
+			return p.Type == postgres.OperationRestart
+		}) {
+			return r.wait(ctx, op, "Restart deferred to the maintenance window")
+		}
+		if restarted(op, live, instances) {
+			return ctrl.Result{}, r.succeed(ctx, op, fmt.Sprintf("Restarted %d instances", len(op.Status.Instances)))
+		}
+
+	case databasesv1alpha1.OperationTypeVacuum, databasesv1alpha1.OperationTypeReindex:
+		return ctrl.Result{}, r.jobResult(ctx, op, pg)
+	}
+
+	return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+}
+
+// restarted reports whether the instances of op run in pods created since
+// it started and are ready.
+func restarted(op *databasesv1alpha1.PostgresOperation, live *databasesv1alpha1.PostgresCluster, instances []postgres.Instance) bool {
+	for _, name := range op.Status.Instances {
+		recreated := slices.ContainsFunc(instances, func(inst postgres.Instance) bool {
+			return inst.Pod.Name == name && !inst.Pod.CreationTimestamp.Before(op.Status.StartedAt)
+		})
+		ready := slices.ContainsFunc(live.Status.Instances, func(s databasesv1alpha1.InstanceStatus) bool {
+			return s.Name == name && s.Ready
+		})
+		if !recreated || !ready {
+			return false
+		}
+	}
+	return true
+}
+
+// jobResult creates the Job of op, or records its result once it is
+// finished.
+func (r *PostgresOperationReconciler) jobResult(
+	ctx context.Context,
+	op *databasesv1alpha1.PostgresOperation,
+	pg *databasesv1alpha1.PostgresCluster,
+) error {
+	job := &batchv1.Job{}
+	err := r.Get(ctx, client.ObjectKey{Name: postgres.OperationJobName(op), Namespace: op.Namespace}, job)
+	if apierrors.IsNotFound(err) {
+		desired := postgres.BuildOperationJob(op, pg)
+		if err := ctrl.SetControllerReference(op, desired, r.Scheme); err != nil {
+			return err
+		}
+		log.FromContext(ctx).Info("Creating operation Job", "job", desired.Name)
+		if err := r.Create(ctx, desired); err != nil && !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	switch {
+	case jobFinished(job, batchv1.JobFailed):
+		message, err := jobTerminationMessage(ctx, r.Client, job, false)
+		if err != nil {
+			return err
+		}
+		if message == "" {
+			message = fmt.Sprintf("Job %s failed, see its pod logs for details", job.Name)
+		}
+		return r.fail(ctx, op, message)
+
+	case jobFinished(job, batchv1.JobComplete):
+		return r.succeed(ctx, op, fmt.Sprintf("%s completed", op.Spec.Type))
+	}
+	return nil
+}
+
+// wait keeps the operation pending, or running, and says what for.
+func (r *PostgresOperationReconciler) wait(ctx context.Context, op *databasesv1alpha1.PostgresOperation, msg string) (ctrl.Result, error) {
+	if op.Status.Phase == "" {
+		op.Status.Phase = databasesv1alpha1.OperationPhasePending
+	} else if op.Status.Message == msg {
+		return ctrl.Result{RequeueAfter: operationPollInterval}, nil
+	}
+	op.Status.Message = msg
+	return ctrl.Result{RequeueAfter: operationPollInterval}, r.Status().Update(ctx, op)
+}
+
+func (r *PostgresOperationReconciler) running(
+	ctx context.Context,
+	op *databasesv1alpha1.PostgresOperation,
+	instances []string,
+	msg string,
+) error {
+	op.Status.Phase = databasesv1alpha1.OperationPhaseRunning
+	op.Status.Instances = instances
+	op.Status.Message = msg
+	if op.Status.StartedAt == nil {
+		op.Status.StartedAt = ptrNow()
+	}
+
+	return r.Status().Update(ctx, op)
+}
+
+func (r *PostgresOperationReconciler) succeed(ctx context.Context, op *databasesv1alpha1.PostgresOperation, msg string) error {
+	log.FromContext(ctx).Info("Operation succeeded", "type", op.Spec.Type, "result", msg)
+
+	op.Status.Phase = databasesv1alpha1.OperationPhaseSucceeded
+	op.Status.Message = msg
+	op.Status.CompletedAt = ptrNow()
+
+	return r.Status().Update(ctx, op)
+}
+
+func (r *PostgresOperationReconciler) fail(ctx context.Context, op *databasesv1alpha1.PostgresOperation, msg string) error {
+	log.FromContext(ctx).Info("Operation failed", "type", op.Spec.Type, "reason", msg)
+
+	op.Status.Phase = databasesv1alpha1.OperationPhaseFailed
+	op.Status.Error = msg
+	op.Status.Message = ""
+	op.Status.CompletedAt = ptrNow()
+
+	return r.Status().Update(ctx, op)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PostgresOperationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&databasesv1alpha1.PostgresOperation{}).
+		Owns(&batchv1.Job{}).
+		Named("postgresoperation").
+		Complete(r)
+}
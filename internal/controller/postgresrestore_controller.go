@@ -0,0 +1,179 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	databasesv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/controller/postgres"
+	batchv1 "k8s.io/api/batch/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// PostgresRestoreReconciler loads the databases of a PostgresDump into a
+// cluster one after the other, with a Job per database.
+type PostgresRestoreReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	OperatorImage string
+}
+
+// +kubebuilder:rbac:groups=databases.atlasdb.io,resources=postgresrestores,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=databases.atlasdb.io,resources=postgresrestores/status,verbs=get;update;patch
+
+func (r *PostgresRestoreReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	restore := &databasesv1alpha1.PostgresRestore{}
+	if err := r.Get(ctx, req.NamespacedName, restore); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	switch restore.Status.Phase {
+	case databasesv1alpha1.DumpPhaseCompleted, databasesv1alpha1.DumpPhaseFailed:
+		return ctrl.Result{}, nil
+	}
+
+	pg := &databasesv1alpha1.PostgresCluster{}
+	err := r.Get(ctx, client.ObjectKey{Name: restore.Spec.ClusterName, Namespace: restore.Namespace}, pg)
+	if apierrors.IsNotFound(err) {
+		return ctrl.Result{}, r.fail(ctx, restore, fmt.Sprintf("PostgresCluster %s not found", restore.Spec.ClusterName))
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+	if clusterPaused(ctx, pg) {
+		return ctrl.Result{RequeueAfter: pausedRequeue}, nil
+	}
+
+	dump := &databasesv1alpha1.PostgresDump{}
+	err = r.Get(ctx, client.ObjectKey{Name: restore.Spec.DumpName, Namespace: restore.Namespace}, dump)
+	if apierrors.IsNotFound(err) {
+		return ctrl.Result{}, r.fail(ctx, restore, fmt.Sprintf("PostgresDump %s not found", restore.Spec.DumpName))
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// ---------------- START ----------------
+
+	if restore.Status.Phase == "" || restore.Status.Phase == databasesv1alpha1.DumpPhasePending {
+		switch dump.Status.Phase {
+		case databasesv1alpha1.DumpPhaseFailed:
+			return ctrl.Result{}, r.fail(ctx, restore, fmt.Sprintf("PostgresDump %s failed", dump.Name))
+
+		case databasesv1alpha1.DumpPhaseCompleted:
+			for _, db := range dump.Status.Databases {
+				if len(restore.Spec.Databases) > 0 && !slices.Contains(restore.Spec.Databases, db.Name) {
+					continue
+				}
+				restore.Status.Databases = append(restore.Status.Databases, databasesv1alpha1.DatabaseDump{
+					Name:     db.Name,
+					Phase:    databasesv1alpha1.DumpPhasePending,
+					Location: db.Location,
+				})
+			}
+			if len(restore.Status.Databases) == 0 {
+				return ctrl.Result{}, r.fail(ctx, restore, "none of the requested databases is in the dump")
+			}
+
+			restore.Status.Phase = databasesv1alpha1.DumpPhaseRunning
+			restore.Status.Progress = dumpProgress(restore.Status.Databases)
+			restore.Status.StartedAt = ptrNow()
+
+			return ctrl.Result{}, r.Status().Update(ctx, restore)
+
+		default:
+			logger.Info("Waiting for the dump to complete", "dump", dump.Name)
+			if restore.Status.Phase == "" {
+				restore.Status.Phase = databasesv1alpha1.DumpPhasePending
+				if err := r.Status().Update(ctx, restore); err != nil {
+					return ctrl.Result{}, err
+				}
+			}
+			// the PostgresDump is not watched, poll it
+			return ctrl.Result{RequeueAfter: dumpPollInterval}, nil
+		}
+	}
+
+	// ---------------- NEXT DATABASE ----------------
+
+	index := nextDatabase(restore.Status.Databases)
+	if index < 0 {
+		logger.Info("Restore completed")
+
+		restore.Status.Phase = databasesv1alpha1.DumpPhaseCompleted
+		restore.Status.CompletedAt = ptrNow()
+		return ctrl.Result{}, r.Status().Update(ctx, restore)
+	}
+	db := &restore.Status.Databases[index]
+
+	job := &batchv1.Job{}
+	err = r.Get(ctx, client.ObjectKey{Name: postgres.RestoreJobName(restore, index), Namespace: restore.Namespace}, job)
+
+	if apierrors.IsNotFound(err) {
+		desired := postgres.BuildRestoreJob(restore, pg, dump, index, *db, r.OperatorImage)
+		if err := ctrl.SetControllerReference(restore, desired, r.Scheme); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		logger.Info("Restoring database", "database", db.Name, "job", desired.Name)
+		if err := r.Create(ctx, desired); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		db.Phase = databasesv1alpha1.DumpPhaseRunning
+		return ctrl.Result{}, r.Status().Update(ctx, restore)
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// ---------------- JOB RESULT ----------------
+
+	switch {
+	case jobFinished(job, batchv1.JobFailed):
+		message, err := jobTerminationMessage(ctx, r.Client, job, false)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		db.Phase = databasesv1alpha1.DumpPhaseFailed
+		db.Error = message
+		return ctrl.Result{}, r.fail(ctx, restore, fmt.Sprintf("restoring database %s failed", db.Name))
+
+	case jobFinished(job, batchv1.JobComplete):
+		db.Phase = databasesv1alpha1.DumpPhaseCompleted
+		restore.Status.Progress = dumpProgress(restore.Status.Databases)
+
+		return ctrl.Result{}, r.Status().Update(ctx, restore)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// dumpPollInterval is how often a restore waiting for its dump checks on it.
+const dumpPollInterval = 15 * time.Second
+
+func (r *PostgresRestoreReconciler) fail(ctx context.Context, restore *databasesv1alpha1.PostgresRestore, msg string) error {
+	log.FromContext(ctx).Info("Restore failed", "reason", msg)
+
+	restore.Status.Phase = databasesv1alpha1.DumpPhaseFailed
+	restore.Status.Error = msg
+	restore.Status.CompletedAt = ptrNow()
+
+	return r.Status().Update(ctx, restore)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PostgresRestoreReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&databasesv1alpha1.PostgresRestore{}).
+		Owns(&batchv1.Job{}).
+		Named("postgresrestore").
+		Complete(r)
+}
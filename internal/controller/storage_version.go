@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;list;watch
+// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions/status,verbs=update;patch
+
+// StorageVersionMigrator moves the objects of a CRD to its storage version
+// once the storage version has changed. Every object still stored in an
+// older version is rewritten with an unmodified update, then the older
+// versions are dropped from status.storedVersions so that they can later be
+// removed from the CRD. It needs the conversion webhook to be served.
+type StorageVersionMigrator struct {
+	Client  client.Client
+	CRDName string
+	// Interval between attempts while the migration fails.
+	Interval time.Duration
+}
+
+// Start implements manager.Runnable. It returns once the migration is done.
+func (m *StorageVersionMigrator) Start(ctx context.Context) error {
+	logger := logf.FromContext(ctx).WithValues("crd", m.CRDName)
+
+	interval := m.Interval
+	if interval == 0 {
+		interval = time.Minute
+	}
+
+	err := wait.PollUntilContextCancel(ctx, interval, true, func(ctx context.Context) (bool, error) {
+		if err := m.migrate(ctx); err != nil {
+			logger.Error(err, "Storage version migration failed, retrying")
+			return false, nil
+		}
+		return true, nil
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable.
+func (m *StorageVersionMigrator) NeedLeaderElection() bool {
+	return true
+}
+
+func (m *StorageVersionMigrator) migrate(ctx context.Context) error {
+	logger := logf.FromContext(ctx).WithValues("crd", m.CRDName)
+
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	if err := m.Client.Get(ctx, types.NamespacedName{Name: m.CRDName}, crd); err != nil {
+		return err
+	}
+
+	storageVersion := ""
+	for _, v := range crd.Spec.Versions {
+		if v.Storage {
+			storageVersion = v.Name
+		}
+	}
+	if storageVersion == "" {
+		return fmt.Errorf("CRD %s has no storage version", m.CRDName)
+	}
+	if slices.Equal(crd.Status.StoredVersions, []string{storageVersion}) {
+		return nil
+	}
+
+	logger.Info("Migrating stored objects", "from", crd.Status.StoredVersions, "to", storageVersion)
+
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(schema.GroupVersionKind{
+		Group:   crd.Spec.Group,
+		Version: storageVersion,
+		Kind:    crd.Spec.Names.ListKind,
+	})
+	if err := m.Client.List(ctx, list); err != nil {
+		return err
+	}
+
+	for i := range list.Items {
+		obj := &list.Items[i]
+		// a conflict means that the object was written since it was
+		// listed, so it is stored in the storage version already
+		err := m.Client.Update(ctx, obj)
+		if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("rewrite %s/%s: %w", obj.GetNamespace(), obj.GetName(), err)
+		}
+	}
+
+	crd.Status.StoredVersions = []string{storageVersion}
+	if err := m.Client.Status().Update(ctx, crd); err != nil {
+		return err
+	}
+
+	logger.Info("Stored objects migrated", "version", storageVersion, "objects", len(list.Items))
+	return nil
+}
@@ -0,0 +1,136 @@
+package instance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/nikitadada/atlasdb/internal/objectstore"
+)
+
+// EnvBackupID names the base backup taken by TakeBackup.
+const EnvBackupID = "ATLASDB_BACKUP_ID"
+
+// TakeBackup runs pg_basebackup against the server described by the libpq
+// environment (PGHOST, PGUSER, PGPASSWORD) into workDir and uploads the
+// result to the archive object store. The backup is self-contained: the WAL
+// needed to make it consistent is fetched into the tarball.
+func TakeBackup(ctx context.Context, workDir string) error {
+	cfg, prefix, err := objectstore.ConfigFromEnv(objectstore.ArchiveEnvPrefix)
+	if err != nil {
+		return err
+	}
+	id := os.Getenv(EnvBackupID)
+	if id == "" {
+		return fmt.Errorf("%s must be set", EnvBackupID)
+	}
+
+	store, err := objectstore.New(cfg)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp(workDir, "basebackup-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	startTime := time.Now().UTC()
+	cmd := exec.CommandContext(ctx, "pg_basebackup",
+		"--pgdata", dir,
+		"--format", "tar",
+		"--gzip",
+		"--wal-method", "fetch",
+		"--checkpoint", "fast",
+		"--label", id,
+		"--no-password",
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_basebackup: %w", err)
+	}
+	stopTime := time.Now().UTC()
+
+	info, err := readBackupManifest(filepath.Join(dir, objectstore.BackupManifestFile))
+	if err != nil {
+		return err
+	}
+	info.ID = id
+	info.StartTime = startTime
+	info.StopTime = stopTime
+
+	for _, file := range []string{objectstore.BackupDataFile, objectstore.BackupManifestFile} {
+		if err := uploadFile(ctx, store, filepath.Join(dir, file), objectstore.BackupKey(prefix, id, file)); err != nil {
+			return err
+		}
+	}
+
+	return store.PutBackupInfo(ctx, prefix, info)
+}
+
+// readBackupManifest extracts the WAL range of a backup from the manifest
+// written by pg_basebackup.
+func readBackupManifest(path string) (*objectstore.BackupInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest struct {
+		WALRanges []struct {
+			Timeline int    `json:"Timeline"`
+			StartLSN string `json:"Start-LSN"`
+			EndLSN   string `json:"End-LSN"`
+		} `json:"WAL-Ranges"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("decode backup manifest: %w", err)
+	}
+	if len(manifest.WALRanges) == 0 {
+		return nil, fmt.Errorf("backup manifest has no WAL ranges")
+	}
+
+	first := manifest.WALRanges[0]
+	last := manifest.WALRanges[len(manifest.WALRanges)-1]
+
+	begin, err := ParseLSN(first.StartLSN)
+	if err != nil {
+		return nil, err
+	}
+	end, err := ParseLSN(last.EndLSN)
+	if err != nil {
+		return nil, err
+	}
+
+	return &objectstore.BackupInfo{
+		Timeline: last.Timeline,
+		BeginLSN: first.StartLSN,
+		EndLSN:   last.EndLSN,
+		BeginWAL: walFileName(first.Timeline, begin),
+		EndWAL:   walFileName(last.Timeline, end),
+	}, nil
+}
+
+func uploadFile(ctx context.Context, store *objectstore.Client, path, key string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := store.Put(ctx, key, f, st.Size()); err != nil {
+		return fmt.Errorf("upload %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+// Package instance implements the commands of the in-pod instance manager.
+package instance
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Bootstrap copies the running executable to dest. It is used by the init
+// container that ships the instance manager from the operator image into a
+// volume shared with the PostgreSQL container.
+func Bootstrap(dest string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(self)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	tmp := dest + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o755)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		return fmt.Errorf("copy %s: %w", self, err)
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, dest)
+}
@@ -0,0 +1,260 @@
+package instance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/nikitadada/atlasdb/internal/objectstore"
+)
+
+// Environment of the logical dump and restore Jobs.
+const (
+	EnvDumpName     = "ATLASDB_DUMP_NAME"
+	EnvDumpDatabase = "ATLASDB_DUMP_DATABASE"
+	EnvDumpFormat   = "ATLASDB_DUMP_FORMAT"
+	EnvDumpSchemas  = "ATLASDB_DUMP_SCHEMAS"
+	// EnvDumpDir is where dumps are written to or read from. It is on the
+	// destination volume, or a scratch volume when the dump goes to an
+	// object store.
+	EnvDumpDir      = "ATLASDB_DUMP_DIR"
+	EnvDumpLocation = "ATLASDB_DUMP_LOCATION"
+
+	EnvRestoreClean   = "ATLASDB_RESTORE_CLEAN"
+	EnvRestoreNoOwner = "ATLASDB_RESTORE_NO_OWNER"
+	EnvRestoreJobs    = "ATLASDB_RESTORE_JOBS"
+)
+
+const (
+	DumpFormatCustom    = "custom"
+	DumpFormatDirectory = "directory"
+)
+
+// DumpResult is written as the termination message of the dump container.
+type DumpResult struct {
+	// Location is the path of the dump on the volume or its key in the
+	// object store.
+	Location string `json:"location"`
+	Size     int64  `json:"size"`
+}
+
+// Dump runs pg_dump for one database and, when an object store is
+// configured, uploads the result.
+func Dump(ctx context.Context, terminationLog string) error {
+	name := os.Getenv(EnvDumpName)
+	db := os.Getenv(EnvDumpDatabase)
+	format := os.Getenv(EnvDumpFormat)
+	dir := os.Getenv(EnvDumpDir)
+	if name == "" || db == "" || dir == "" {
+		return fmt.Errorf("%s, %s and %s must be set", EnvDumpName, EnvDumpDatabase, EnvDumpDir)
+	}
+
+	file := dumpFile(db, format)
+	dest := filepath.Join(dir, name, file)
+
+	// a retried Job starts over
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+
+	args := []string{"-d", db, "-f", dest, "--verbose"}
+	if format == DumpFormatDirectory {
+		args = append(args, "-Fd")
+	} else {
+		args = append(args, "-Fc")
+	}
+	for _, schema := range dumpSchemas() {
+		args = append(args, "-n", schema)
+	}
+
+	fmt.Printf("dumping database %s to %s\n", db, dest)
+	if err := run(ctx, "pg_dump", args...); err != nil {
+		return err
+	}
+
+	result := DumpResult{Location: dest}
+
+	err := filepath.WalkDir(dest, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		result.Size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if os.Getenv(objectstore.DumpEnvPrefix+objectstore.EnvEndpoint) != "" {
+		cfg, prefix, err := objectstore.ConfigFromEnv(objectstore.DumpEnvPrefix)
+		if err != nil {
+			return err
+		}
+		store, err := objectstore.New(cfg)
+		if err != nil {
+			return err
+		}
+
+		if err := uploadTree(ctx, store, filepath.Join(dir, name), objectstore.DumpKey(prefix, name, "")); err != nil {
+			return err
+		}
+		result.Location = objectstore.DumpKey(prefix, name, file)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(terminationLog, data, 0o644)
+}
+
+// RestoreDump loads a dump made by Dump into a database, creating the
+// database if needed.
+func RestoreDump(ctx context.Context) error {
+	location := os.Getenv(EnvDumpLocation)
+	db := os.Getenv(EnvDumpDatabase)
+	dir := os.Getenv(EnvDumpDir)
+	if location == "" || db == "" || dir == "" {
+		return fmt.Errorf("%s, %s and %s must be set", EnvDumpLocation, EnvDumpDatabase, EnvDumpDir)
+	}
+
+	src := location
+	if os.Getenv(objectstore.DumpEnvPrefix+objectstore.EnvEndpoint) != "" {
+		cfg, _, err := objectstore.ConfigFromEnv(objectstore.DumpEnvPrefix)
+		if err != nil {
+			return err
+		}
+		store, err := objectstore.New(cfg)
+		if err != nil {
+			return err
+		}
+
+		src = filepath.Join(dir, filepath.Base(location))
+		if err := downloadTree(ctx, store, location, src, os.Getenv(EnvDumpFormat) == DumpFormatDirectory); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("creating database %s if needed\n", db)
+	create := exec.CommandContext(ctx, "psql", "-X", "-q", "-v", "ON_ERROR_STOP=1", "-v", "db="+db, "-d", "postgres")
+	create.Stdin = strings.NewReader("SELECT format('CREATE DATABASE %I', :'db') " +
+		"WHERE NOT EXISTS (SELECT FROM pg_database WHERE datname = :'db')\\gexec\n")
+	create.Stdout, create.Stderr = os.Stdout, os.Stderr
+	if err := create.Run(); err != nil {
+		return fmt.Errorf("create database: %w", err)
+	}
+
+	args := []string{"-d", db, "--exit-on-error", "--verbose"}
+	if os.Getenv(EnvRestoreClean) == "true" {
+		args = append(args, "--clean", "--if-exists")
+	}
+	if os.Getenv(EnvRestoreNoOwner) == "true" {
+		args = append(args, "--no-owner", "--no-privileges")
+	}
+	if jobs, _ := strconv.Atoi(os.Getenv(EnvRestoreJobs)); jobs > 1 {
+		args = append(args, "-j", strconv.Itoa(jobs))
+	}
+	for _, schema := range dumpSchemas() {
+		args = append(args, "-n", schema)
+	}
+	args = append(args, src)
+
+	fmt.Printf("restoring %s into database %s\n", location, db)
+	return run(ctx, "pg_restore", args...)
+}
+
+func dumpFile(db, format string) string {
+	if format == DumpFormatDirectory {
+		return db
+	}
+	return db + ".dump"
+}
+
+func dumpSchemas() []string {
+	if s := os.Getenv(EnvDumpSchemas); s != "" {
+		return strings.Split(s, ",")
+	}
+	return nil
+}
+
+func run(ctx context.Context, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// uploadTree uploads every file under root to keyPrefix, keeping their
+// relative paths.
+func uploadTree(ctx context.Context, store *objectstore.Client, root, keyPrefix string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		return uploadFile(ctx, store, path, keyPrefix+"/"+filepath.ToSlash(rel))
+	})
+}
+
+// downloadTree fetches key into dest, or every key under it when dir is set.
+func downloadTree(ctx context.Context, store *objectstore.Client, key, dest string, dir bool) error {
+	if !dir {
+		return downloadFile(ctx, store, key, dest)
+	}
+
+	objects, err := store.List(ctx, key+"/")
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("dump %s not found in the object store", key)
+	}
+	for _, obj := range objects {
+		rel := strings.TrimPrefix(obj.Key, key+"/")
+		if err := downloadFile(ctx, store, obj.Key, filepath.Join(dest, filepath.FromSlash(rel))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func downloadFile(ctx context.Context, store *objectstore.Client, key, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+
+	body, err := store.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("download %s: %w", key, err)
+	}
+	defer func() { _ = body.Close() }()
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
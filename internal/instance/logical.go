@@ -0,0 +1,298 @@
+package instance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Environment of the Jobs of a blue/green major upgrade.
+const (
+	// EnvLogicalSource is the host of the primary of the cluster being
+	// upgraded.
+	EnvLogicalSource = "ATLASDB_LOGICAL_SOURCE"
+	// EnvLogicalTarget is the host of the primary of the cluster on the
+	// new major version.
+	EnvLogicalTarget = "ATLASDB_LOGICAL_TARGET"
+)
+
+const (
+	// LogicalSlotPrefix starts the names of the subscriptions of a
+	// blue/green upgrade, and so of their replication slots on the source.
+	LogicalSlotPrefix = "atlasdb_upgrade_"
+	publicationName   = "atlasdb_upgrade"
+
+	logicalPollInterval = 5 * time.Second
+	// cutOverTimeout bounds how long the source is read-only while the
+	// target catches up.
+	cutOverTimeout = 5 * time.Minute
+)
+
+// slotPattern matches the replication slots of the subscriptions in LIKE.
+const slotPattern = `'atlasdb\_upgrade\_%'`
+
+// SetupLogicalReplication copies the roles and the schema of every database
+// of the source to the target and subscribes the target to all the tables
+// of the source, which copies their data first. The source must run with
+// wal_level = logical, which is waited for while its instances restart.
+// The subscriptions connect as the postgres user with the PGPASSWORD of the
+// target instances, both clusters share the password.
+func SetupLogicalReplication(ctx context.Context) error {
+	source, target, err := logicalHosts()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("waiting for wal_level = logical on %s\n", source)
+	for {
+		level, err := queryHost(ctx, source, "postgres", "SHOW wal_level")
+		if err == nil && level == "logical" {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(logicalPollInterval):
+		}
+	}
+
+	fmt.Println("copying the roles")
+	globals, err := output(ctx, "pg_dumpall", "-h", source, "-U", "postgres", "--globals-only")
+	if err != nil {
+		return err
+	}
+	// roles the target already has, like postgres, fail to be created and
+	// are altered by the next statement
+	if err := psqlScript(ctx, target, "postgres", globals, false); err != nil {
+		return fmt.Errorf("copy roles: %w", err)
+	}
+
+	databases, err := queryRows(ctx, source, "postgres",
+		"SELECT oid, datname FROM pg_database WHERE datallowconn AND NOT datistemplate ORDER BY datname")
+	if err != nil {
+		return err
+	}
+	for _, db := range databases {
+		oid, name := db[0], db[1]
+
+		fmt.Printf("copying the schema of database %s\n", name)
+		args := []string{"-h", source, "-U", "postgres", "--schema-only", "-d", name}
+		if name != "postgres" {
+			args = append(args, "--create")
+		}
+		schema, err := output(ctx, "pg_dump", args...)
+		if err != nil {
+			return err
+		}
+		if err := psqlScript(ctx, target, "postgres", schema, true); err != nil {
+			return fmt.Errorf("copy the schema of %s: %w", name, err)
+		}
+
+		fmt.Printf("subscribing to database %s\n", name)
+		if _, err := queryHost(ctx, source, name, "CREATE PUBLICATION "+publicationName+" FOR ALL TABLES"); err != nil {
+			return fmt.Errorf("create publication in %s: %w", name, err)
+		}
+		conninfo := fmt.Sprintf("host=%s port=5432 user=postgres dbname=%s", source, conninfoValue(name))
+		subscribe := fmt.Sprintf("CREATE SUBSCRIPTION %s%s CONNECTION %s PUBLICATION %s;\n",
+			LogicalSlotPrefix, oid, quoteLiteral(conninfo), publicationName)
+		if err := psqlScript(ctx, target, name, subscribe, true); err != nil {
+			return fmt.Errorf("create subscription in %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// CutOverLogicalReplication makes the source read-only once the initial
+// copy of every table completed, disconnects its clients, waits for the
+// target to receive everything written before, copies the values of the
+// sequences, which logical replication does not, and drops the
+// subscriptions. The source is made writable again when any of it fails.
+func CutOverLogicalReplication(ctx context.Context) (err error) {
+	source, target, err := logicalHosts()
+	if err != nil {
+		return err
+	}
+
+	subscriptions, err := queryRows(ctx, target, "postgres",
+		"SELECT s.subname, d.datname FROM pg_subscription s JOIN pg_database d ON d.oid = s.subdbid "+
+			"WHERE s.subname LIKE "+slotPattern)
+	if err != nil {
+		return err
+	}
+	if len(subscriptions) == 0 {
+		return fmt.Errorf("%s has no subscriptions to %s", target, source)
+	}
+
+	fmt.Println("waiting for the initial copy of every table")
+	for _, sub := range subscriptions {
+		err := waitFor(ctx, target, sub[1],
+			"SELECT count(*) = 0 FROM pg_subscription_rel WHERE srsubstate <> 'r'")
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("making %s read-only\n", source)
+	if err := setReadOnly(ctx, source, true); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			fmt.Printf("making %s writable again\n", source)
+			err = errors.Join(err, setReadOnly(context.Background(), source, false))
+		}
+	}()
+	_, err = queryHost(ctx, source, "postgres", "SELECT count(pg_terminate_backend(pid)) FROM pg_stat_activity "+
+		"WHERE backend_type = 'client backend' AND pid <> pg_backend_pid()")
+	if err != nil {
+		return fmt.Errorf("disconnect clients: %w", err)
+	}
+
+	lsn, err := queryHost(ctx, source, "postgres", "SELECT pg_current_wal_lsn()")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("waiting for %s to confirm %s\n", target, lsn)
+	waitCtx, cancel := context.WithTimeout(ctx, cutOverTimeout)
+	defer cancel()
+	err = waitFor(waitCtx, source, "postgres", fmt.Sprintf(
+		"SELECT count(*) = 0 FROM pg_replication_slots WHERE slot_name LIKE %s "+
+			"AND (confirmed_flush_lsn IS NULL OR confirmed_flush_lsn < '%s')", slotPattern, lsn))
+	if err != nil {
+		return fmt.Errorf("wait for the target to catch up: %w", err)
+	}
+
+	for _, sub := range subscriptions {
+		db := sub[1]
+		fmt.Printf("copying the sequences of database %s\n", db)
+		setvals, err := queryHost(ctx, source, db, "SELECT format('SELECT setval(%L, %s, true);', "+
+			"format('%I.%I', schemaname, sequencename), last_value) FROM pg_sequences WHERE last_value IS NOT NULL")
+		if err != nil {
+			return err
+		}
+		if err := psqlScript(ctx, target, db, setvals, true); err != nil {
+			return fmt.Errorf("copy sequences of %s: %w", db, err)
+		}
+	}
+
+	for _, sub := range subscriptions {
+		name, db := sub[0], sub[1]
+		fmt.Printf("dropping subscription %s\n", name)
+		drop := fmt.Sprintf("ALTER SUBSCRIPTION %[1]s DISABLE;\n"+
+			"ALTER SUBSCRIPTION %[1]s SET (slot_name = NONE);\n"+
+			"DROP SUBSCRIPTION %[1]s;\n", name)
+		if err := psqlScript(ctx, target, db, drop, true); err != nil {
+			return fmt.Errorf("drop subscription %s: %w", name, err)
+		}
+	}
+
+	// the target no longer replicates, failing to clean up the source only
+	// leaves objects behind on a read-only cluster
+	cleanup := "SET default_transaction_read_only = off;\n" +
+		"SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name LIKE " + slotPattern + ";\n"
+	if err := psqlScript(ctx, source, "postgres", cleanup, true); err != nil {
+		fmt.Printf("dropping the replication slots: %v\n", err)
+	}
+	for _, sub := range subscriptions {
+		drop := "SET default_transaction_read_only = off;\nDROP PUBLICATION IF EXISTS " + publicationName + ";\n"
+		if err := psqlScript(ctx, source, sub[1], drop, true); err != nil {
+			fmt.Printf("dropping the publication of %s: %v\n", sub[1], err)
+		}
+	}
+	return nil
+}
+
+func logicalHosts() (string, string, error) {
+	source, target := os.Getenv(EnvLogicalSource), os.Getenv(EnvLogicalTarget)
+	if source == "" || target == "" {
+		return "", "", fmt.Errorf("%s and %s must be set", EnvLogicalSource, EnvLogicalTarget)
+	}
+	return source, target, nil
+}
+
+// setReadOnly makes the transactions of the server on host read-only by
+// default. ALTER SYSTEM can not run in a transaction with the reload.
+func setReadOnly(ctx context.Context, host string, readOnly bool) error {
+	statement := "ALTER SYSTEM RESET default_transaction_read_only"
+	if readOnly {
+		statement = "ALTER SYSTEM SET default_transaction_read_only = on"
+	}
+	for _, query := range []string{statement, "SELECT pg_reload_conf()"} {
+		if _, err := queryHost(ctx, host, "postgres", query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitFor polls a query returning a boolean until it is true.
+func waitFor(ctx context.Context, host, db, query string) error {
+	for {
+		out, err := queryHost(ctx, host, db, query)
+		if err != nil {
+			return err
+		}
+		if out == "t" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(logicalPollInterval):
+		}
+	}
+}
+
+// queryRows runs query like queryHost and splits its output into rows of
+// columns.
+func queryRows(ctx context.Context, host, db, query string) ([][]string, error) {
+	out, err := queryHost(ctx, host, db, query)
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	for _, line := range strings.Split(out, "\n") {
+		if line != "" {
+			rows = append(rows, strings.Split(line, "|"))
+		}
+	}
+	return rows, nil
+}
+
+// psqlScript runs script as the superuser in database db of the server on
+// host, stopping at the first error when stopOnError is set.
+func psqlScript(ctx context.Context, host, db, script string, stopOnError bool) error {
+	args := []string{"-X", "-q", "-h", host, "-U", "postgres", "-d", db}
+	if stopOnError {
+		args = append(args, "-v", "ON_ERROR_STOP=1")
+	}
+	cmd := exec.CommandContext(ctx, "psql", args...)
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// output runs a program and returns what it writes to stdout.
+func output(ctx context.Context, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return string(out), nil
+}
+
+// quoteLiteral quotes s as an SQL string literal.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// conninfoValue quotes s as a value of a libpq connection string.
+func conninfoValue(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
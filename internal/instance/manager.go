@@ -0,0 +1,697 @@
+package instance
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ConfigDir is where the configuration files rendered by the operator are
+// mounted in the postgres container.
+const ConfigDir = "/etc/atlasdb"
+
+// EnvSuperuserPassword is the password initdb gives to the postgres user.
+const EnvSuperuserPassword = "POSTGRES_PASSWORD"
+
+// EnvWALLevel overrides the wal_level of the instance, replica by default.
+const EnvWALLevel = "ATLASDB_WAL_LEVEL"
+
+// EnvBootstrap is "true" while the cluster was never initialized, from the
+// BootstrapKey of the configuration the operator renders until a primary
+// ran. Only then may the first instance initialize or recover the cluster.
+const (
+	EnvBootstrap = "ATLASDB_BOOTSTRAP"
+	BootstrapKey = "bootstrap"
+)
+
+const (
+	// configFileName is the configuration owned by the instance manager. It
+	// is rendered into PGDATA on every start and included from
+	// postgresql.conf.
+	configFileName = "atlasdb.conf"
+	includeConfig  = "include_if_exists = '" + configFileName + "'"
+
+	// shutdownTimeout bounds a fast shutdown, after which PostgreSQL is
+	// stopped with an immediate one.
+	shutdownTimeout = 20 * time.Second
+	// primaryRetryInterval is how often a new replica checks whether the
+	// primary it has to be cloned from is up.
+	primaryRetryInterval = 5 * time.Second
+	// fencedFileName marks a fenced instance in pgdata, so that it stays
+	// fenced when its container restarts.
+	fencedFileName = "atlasdb.fenced"
+)
+
+type manager struct {
+	pgdata      string
+	args        []string
+	primaryHost string
+	// apiToken authorizes the actions of the API, see EnvAPIToken.
+	apiToken string
+	// postgresUser runs PostgreSQL and its tools when the instance manager
+	// runs as root, like the entrypoint of the postgres image does.
+	postgresUser *syscall.Credential
+
+	// maxLag is the replication lag in bytes above which a replica is not
+	// ready, negative for no limit.
+	maxLag int64
+
+	postgres *exec.Cmd
+	exited   chan error
+	demote   chan struct{}
+	fence    chan struct{}
+	unfence  chan struct{}
+
+	mu         sync.Mutex
+	configHash string
+	// running is set while PostgreSQL is supposed to run, it is not during
+	// the initialization and demotion of the instance.
+	running bool
+	// fenced is set while PostgreSQL must not run, see FencePath.
+	fenced bool
+}
+
+// Run is the entrypoint of the postgres container. It initializes an empty
+// pgdata, with initdb on the first instance of a new cluster and as a clone
+// of the primary everywhere else, renders the configuration it owns, then
+// runs PostgreSQL with args and serves the API of the instance until ctx is
+// done, when it shuts PostgreSQL down.
+func Run(ctx context.Context, pgdata string, args []string) error {
+	cred, err := postgresCredential()
+	if err != nil {
+		return err
+	}
+
+	maxLag := int64(-1)
+	if raw := os.Getenv(EnvMaxReplicationLag); raw != "" {
+		if maxLag, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return fmt.Errorf("%s: %w", EnvMaxReplicationLag, err)
+		}
+	}
+
+	m := &manager{
+		pgdata:       pgdata,
+		args:         args,
+		primaryHost:  os.Getenv(EnvPrimaryHost),
+		apiToken:     os.Getenv(EnvAPIToken),
+		postgresUser: cred,
+		maxLag:       maxLag,
+		demote:       make(chan struct{}, 1),
+		fence:        make(chan struct{}, 1),
+		unfence:      make(chan struct{}, 1),
+	}
+	if _, err := os.Stat(filepath.Join(pgdata, fencedFileName)); err == nil {
+		m.fenced = true
+	}
+
+	apiCtx, stopAPI := context.WithCancel(context.Background())
+	defer stopAPI()
+	apiErr := make(chan error, 1)
+	go func() { apiErr <- m.serveAPI(apiCtx) }()
+
+	if err := m.prepareDataDir(); err != nil {
+		return err
+	}
+	// a major upgrade killed midway leaves the old cluster half moved
+	if err := rollbackUpgrade(pgdata); err != nil {
+		return fmt.Errorf("roll back the upgrade: %w", err)
+	}
+	if err := m.initialize(ctx); err != nil {
+		return err
+	}
+	if err := m.renderConfig(); err != nil {
+		return err
+	}
+
+	for {
+		if m.isFenced() {
+			fmt.Println("the instance is fenced, waiting to be unfenced")
+			select {
+			case <-ctx.Done():
+				return nil
+			case err := <-apiErr:
+				return fmt.Errorf("serve API: %w", err)
+			case <-m.fence:
+			case <-m.unfence:
+			}
+			continue
+		}
+
+		if err := m.start(); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			m.shutdown()
+			return nil
+
+		case err := <-m.exited:
+			return fmt.Errorf("postgres exited: %v", err)
+
+		case err := <-apiErr:
+			m.shutdown()
+			return fmt.Errorf("serve API: %w", err)
+
+		case <-m.demote:
+			if err := m.demoteInstance(ctx); err != nil {
+				return err
+			}
+
+		case <-m.fence:
+			fmt.Println("fencing the instance")
+			m.setRunning(false)
+			m.shutdown()
+		}
+	}
+}
+
+// postgresCredential is the postgres user of the image when running as
+// root, nil otherwise.
+func postgresCredential() (*syscall.Credential, error) {
+	if os.Geteuid() != 0 {
+		return nil, nil
+	}
+
+	u, err := user.Lookup("postgres")
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// command runs name as the postgres user.
+func (m *manager) command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if m.postgresUser != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: m.postgresUser}
+	}
+	return cmd
+}
+
+// prepareDataDir gives pgdata, including what init containers and Jobs
+// wrote into it as root, to the postgres user.
+func (m *manager) prepareDataDir() error {
+	if err := os.MkdirAll(m.pgdata, 0o700); err != nil {
+		return err
+	}
+	if m.postgresUser == nil {
+		return nil
+	}
+
+	uid, gid := int(m.postgresUser.Uid), int(m.postgresUser.Gid)
+	err := filepath.WalkDir(m.pgdata, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) == uid {
+			return nil
+		}
+		return os.Lchown(path, uid, gid)
+	})
+	if err != nil {
+		return err
+	}
+	return os.Chmod(m.pgdata, 0o700)
+}
+
+// initialize creates the database cluster in an empty pgdata. Every
+// instance but the first one of a new cluster is cloned from the primary,
+// and so is the first one when a primary is already running elsewhere,
+// e.g. after its volume was lost. Once the cluster was initialized an empty
+// volume waits for the primary however long it is down: a new database
+// cluster would be a second primary.
+func (m *manager) initialize(ctx context.Context) error {
+	if _, err := os.Stat(filepath.Join(m.pgdata, "PG_VERSION")); err == nil {
+		return nil
+	}
+
+	for {
+		if m.primaryReachable(ctx) {
+			return m.cloneReplica(ctx)
+		}
+		if bootstrapInstance() {
+			return m.initdb(ctx)
+		}
+
+		fmt.Printf("waiting for the primary %s to clone a replica from\n", m.primaryHost)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(primaryRetryInterval):
+		}
+	}
+}
+
+func (m *manager) primaryReachable(ctx context.Context) bool {
+	return exec.CommandContext(ctx, "pg_isready", "-q", "-h", m.primaryHost, "-t", "3").Run() == nil
+}
+
+func (m *manager) initdb(ctx context.Context) error {
+	fmt.Println("initializing a new database cluster")
+
+	pwfile, err := os.CreateTemp("", "pwfile")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(pwfile.Name()) }()
+
+	_, err = pwfile.WriteString(os.Getenv(EnvSuperuserPassword))
+	if closeErr := pwfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := m.chown(pwfile.Name()); err != nil {
+		return err
+	}
+
+	cmd := m.command(ctx, "initdb", "-D", m.pgdata, "-U", "postgres", "--pwfile="+pwfile.Name(),
+		"--auth-local=trust", "--auth-host=scram-sha-256")
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("initdb: %w", err)
+	}
+	return nil
+}
+
+// cloneReplica takes a base backup of the primary into pgdata and makes it
+// a standby. A partial clone is removed so that it is retried from scratch.
+func (m *manager) cloneReplica(ctx context.Context) error {
+	fmt.Printf("cloning a replica from %s\n", m.primaryHost)
+
+	cmd := m.command(ctx, "pg_basebackup", "-h", m.primaryHost, "-U", "postgres", "-D", m.pgdata,
+		"-X", "stream", "--checkpoint=fast", "--no-password")
+	if err := cmd.Run(); err != nil {
+		if cleanErr := removeContents(m.pgdata); cleanErr != nil {
+			return errors.Join(fmt.Errorf("pg_basebackup: %w", err), cleanErr)
+		}
+		return fmt.Errorf("pg_basebackup: %w", err)
+	}
+	return m.configureStandby()
+}
+
+// configureStandby makes the instance start as a standby. The recovery
+// target a cluster may have been recovered with is dropped: a standby
+// reaching it would promote itself.
+func (m *manager) configureStandby() error {
+	if err := m.writeFile("standby.signal", nil); err != nil {
+		return err
+	}
+
+	autoConf := filepath.Join(m.pgdata, "postgresql.auto.conf")
+	data, err := os.ReadFile(autoConf)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var kept []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "recovery_target") {
+			kept = append(kept, line)
+		}
+	}
+	return m.writeFile("postgresql.auto.conf", []byte(strings.Join(kept, "\n")))
+}
+
+// renderConfig writes the settings the instance manager owns and includes
+// them from postgresql.conf. primary_conninfo only applies to standbys, so
+// it is set on every instance.
+func (m *manager) renderConfig() error {
+	hostname, _ := os.Hostname()
+	walLevel := os.Getenv(EnvWALLevel)
+	if walLevel == "" {
+		walLevel = "replica"
+	}
+	settings := []string{
+		"# rendered by the atlasdb instance manager on every start, do not edit",
+		"listen_addresses = '*'",
+		"wal_level = " + walLevel,
+		"hot_standby = on",
+		"max_wal_senders = 10",
+		// required by pg_rewind when a former primary is demoted
+		"wal_log_hints = on",
+		fmt.Sprintf("primary_conninfo = 'host=%s user=postgres application_name=%s'", m.primaryHost, hostname),
+	}
+	if err := m.writeFile(configFileName, []byte(strings.Join(settings, "\n")+"\n")); err != nil {
+		return err
+	}
+
+	conf := filepath.Join(m.pgdata, "postgresql.conf")
+	data, err := os.ReadFile(conf)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == includeConfig {
+			return nil
+		}
+	}
+	return m.writeFile("postgresql.conf", []byte(string(data)+"\n"+includeConfig+"\n"))
+}
+
+// start runs PostgreSQL in the background.
+func (m *manager) start() error {
+	hash, err := loadedConfigHash()
+	if err != nil {
+		return err
+	}
+
+	cmd := m.command(context.Background(), "postgres", append([]string{"-D", m.pgdata}, m.args...)...)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start postgres: %w", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	m.postgres, m.exited = cmd, exited
+	m.setConfigHash(hash)
+	m.setRunning(true)
+	return nil
+}
+
+// stop shuts PostgreSQL down with a fast shutdown, which disconnects the
+// clients and writes a shutdown checkpoint, and falls back to an immediate
+// one when that takes longer than shutdownTimeout.
+func (m *manager) stop() {
+	_ = m.postgres.Process.Signal(syscall.SIGINT)
+	select {
+	case <-m.exited:
+		return
+	case <-time.After(shutdownTimeout):
+	}
+
+	fmt.Println("fast shutdown timed out, shutting down immediately")
+	_ = m.postgres.Process.Signal(syscall.SIGQUIT)
+	<-m.exited
+}
+
+// shutdown stops PostgreSQL when the pod is deleted. The checkpoint taken
+// beforehand, while clients are still served, shortens the shutdown
+// checkpoint and so the time the instance is unavailable.
+func (m *manager) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout/2)
+	defer cancel()
+	if _, err := queryLocal(ctx, "CHECKPOINT"); err != nil {
+		fmt.Printf("checkpoint before shutdown: %v\n", err)
+	}
+	m.stop()
+}
+
+// demoteInstance turns the instance into a standby. A former primary is
+// rewound when another primary already runs, to undo the changes it made
+// after that one was promoted. In a switchover no other primary runs yet:
+// the replicas received everything the instance wrote before its shutdown
+// and it follows the timeline of the one promoted next. The instance is
+// configured as a standby even when the rewind fails: it must not come back
+// as a second primary.
+func (m *manager) demoteInstance(ctx context.Context) error {
+	fmt.Printf("demoting the instance to a replica of %s\n", m.primaryHost)
+	m.setRunning(false)
+	m.stop()
+
+	var rewindErr error
+	if m.primaryReachable(ctx) {
+		// pg_rewind copies the configuration of the source, render ours after
+		cmd := m.command(ctx, "pg_rewind", "-D", m.pgdata, "--progress",
+			"--source-server=host="+m.primaryHost+" user=postgres dbname=postgres")
+		rewindErr = cmd.Run()
+	}
+
+	if err := m.configureStandby(); err != nil {
+		return err
+	}
+	if err := m.renderConfig(); err != nil {
+		return err
+	}
+	if rewindErr != nil {
+		return fmt.Errorf("pg_rewind: %w", rewindErr)
+	}
+	return nil
+}
+
+// serveAPI serves the API of the instance until ctx is done.
+func (m *manager) serveAPI(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              net.JoinHostPort("", strconv.Itoa(APIPort)),
+		Handler:           m.apiHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("serving the instance API on %s\n", server.Addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// apiHandler routes the endpoints of the API, the actions require the API
+// token.
+func (m *manager) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+StatusPath, func(w http.ResponseWriter, r *http.Request) {
+		if m.isFenced() {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(Status{Fenced: true})
+			return
+		}
+		status, err := GetStatus(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		status.ConfigHash = m.getConfigHash()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status)
+	})
+	mux.HandleFunc("GET "+HealthPath, func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, m.checkLive(r.Context()))
+	})
+	mux.HandleFunc("GET "+StartupPath, func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, m.checkStarted(r.Context()))
+	})
+	mux.HandleFunc("GET "+ReadyPath, func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, m.checkReady(r.Context()))
+	})
+	mux.HandleFunc("POST "+CheckpointPath, requireToken(m.apiToken, func(w http.ResponseWriter, r *http.Request) {
+		_, err := queryLocal(r.Context(), "CHECKPOINT")
+		writeResult(w, err)
+	}))
+	mux.HandleFunc("POST "+ReloadPath, requireToken(m.apiToken, func(w http.ResponseWriter, r *http.Request) {
+		hash, err := loadedConfigHash()
+		if err == nil {
+			_, err = queryLocal(r.Context(), "SELECT pg_reload_conf()")
+		}
+		if err == nil {
+			m.setConfigHash(hash)
+		}
+		writeResult(w, err)
+	}))
+	mux.HandleFunc("POST "+PromotePath, requireToken(m.apiToken, func(w http.ResponseWriter, r *http.Request) {
+		status, err := GetStatus(r.Context())
+		if err == nil && status.Role == RoleReplica {
+			_, err = queryLocal(r.Context(), "SELECT pg_promote()")
+		}
+		writeResult(w, err)
+	}))
+	mux.HandleFunc("POST "+DemotePath, requireToken(m.apiToken, func(w http.ResponseWriter, r *http.Request) {
+		status, err := GetStatus(r.Context())
+		if err != nil || status.Role == RoleReplica {
+			writeResult(w, err)
+			return
+		}
+		// the demotion restarts PostgreSQL, it is done asynchronously
+		select {
+		case m.demote <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	mux.HandleFunc("POST "+FencePath, requireToken(m.apiToken, func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, m.setFenced(true))
+	}))
+	mux.HandleFunc("POST "+UnfencePath, requireToken(m.apiToken, func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, m.setFenced(false))
+	}))
+	return mux
+}
+
+// requireToken only lets the requests bearing token through to next.
+// Without a token every request is refused, the actions stop, promote or
+// demote PostgreSQL.
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *manager) getConfigHash() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.configHash
+}
+
+func (m *manager) setConfigHash(hash string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.configHash = hash
+}
+
+func (m *manager) isRunning() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.running
+}
+
+func (m *manager) setRunning(running bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.running = running
+}
+
+func (m *manager) isFenced() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fenced
+}
+
+// setFenced records whether the instance is fenced in pgdata and has
+// PostgreSQL shut down or started accordingly. The shutdown is
+// asynchronous, like a demotion.
+func (m *manager) setFenced(fenced bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fenced == fenced {
+		return nil
+	}
+
+	signal := m.unfence
+	if fenced {
+		// initdb and pg_basebackup need an empty pgdata
+		if _, err := os.Stat(filepath.Join(m.pgdata, "PG_VERSION")); err != nil {
+			return errors.New("the instance is not initialized yet")
+		}
+		if err := m.writeFile(fencedFileName, nil); err != nil {
+			return err
+		}
+		signal = m.fence
+	} else if err := os.Remove(filepath.Join(m.pgdata, fencedFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	m.fenced = fenced
+
+	select {
+	case signal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// loadedConfigHash is the ConfigHash of the files currently in ConfigDir.
+// The entries starting with ".." are the internals of a ConfigMap volume.
+func loadedConfigHash() (string, error) {
+	entries, err := os.ReadDir(ConfigDir)
+	if err != nil {
+		return "", err
+	}
+
+	files := map[string]string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "..") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(ConfigDir, entry.Name()))
+		if err != nil {
+			return "", err
+		}
+		files[entry.Name()] = string(data)
+	}
+	return ConfigHash(files), nil
+}
+
+// writeFile writes a file of pgdata owned by the postgres user.
+func (m *manager) writeFile(name string, data []byte) error {
+	path := filepath.Join(m.pgdata, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return err
+	}
+	return m.chown(path)
+}
+
+func (m *manager) chown(path string) error {
+	if m.postgresUser == nil {
+		return nil
+	}
+	return os.Chown(path, int(m.postgresUser.Uid), int(m.postgresUser.Gid))
+}
+
+// bootstrapInstance reports whether this pod is the first instance of a
+// cluster that was never initialized, the one it is initialized or
+// recovered on.
+func bootstrapInstance() bool {
+	hostname, _ := os.Hostname()
+	return strings.HasSuffix(hostname, "-0") && os.Getenv(EnvBootstrap) == "true"
+}
+
+func removeContents(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
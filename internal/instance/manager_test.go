@@ -0,0 +1,157 @@
+package instance
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigureStandby(t *testing.T) {
+	pgdata := t.TempDir()
+	autoConf := "restore_command = 'wal-restore %f %p'\n" +
+		"recovery_target_time = '2024-01-01 00:00:00+00'\n" +
+		"recovery_target_action = 'promote'\n" +
+		"work_mem = '8MB'\n"
+	if err := os.WriteFile(filepath.Join(pgdata, "postgresql.auto.conf"), []byte(autoConf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &manager{pgdata: pgdata}
+	if err := m.configureStandby(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(pgdata, "standby.signal")); err != nil {
+		t.Errorf("standby.signal: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(pgdata, "postgresql.auto.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(got), "recovery_target") {
+		t.Errorf("recovery target kept:\n%s", got)
+	}
+	if !strings.Contains(string(got), "restore_command") || !strings.Contains(string(got), "work_mem") {
+		t.Errorf("other settings dropped:\n%s", got)
+	}
+}
+
+func TestRenderConfig(t *testing.T) {
+	pgdata := t.TempDir()
+	if err := os.WriteFile(filepath.Join(pgdata, "postgresql.conf"), []byte("max_connections = 100\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &manager{pgdata: pgdata, primaryHost: "pg-rw"}
+	// the configuration is rendered on every start
+	for range 2 {
+		if err := m.renderConfig(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf, err := os.ReadFile(filepath.Join(pgdata, "postgresql.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(conf), includeConfig); n != 1 {
+		t.Errorf("postgresql.conf includes %s %d times:\n%s", configFileName, n, conf)
+	}
+
+	rendered, err := os.ReadFile(filepath.Join(pgdata, configFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(rendered), "primary_conninfo = 'host=pg-rw user=postgres") {
+		t.Errorf("%s has no primary_conninfo:\n%s", configFileName, rendered)
+	}
+}
+
+func TestSetFenced(t *testing.T) {
+	pgdata := t.TempDir()
+	m := &manager{pgdata: pgdata, fence: make(chan struct{}, 1), unfence: make(chan struct{}, 1)}
+	marker := filepath.Join(pgdata, fencedFileName)
+
+	if err := m.setFenced(true); err == nil {
+		t.Error("fenced an instance that is not initialized")
+	}
+	if err := os.WriteFile(filepath.Join(pgdata, "PG_VERSION"), []byte("17\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		if err := m.setFenced(true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(marker); err != nil || !m.isFenced() {
+		t.Errorf("fenced = %v, marker: %v", m.isFenced(), err)
+	}
+	if len(m.fence) != 1 {
+		t.Error("the shutdown was not signaled")
+	}
+
+	if err := m.setFenced(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) || m.isFenced() {
+		t.Errorf("still fenced = %v, marker: %v", m.isFenced(), err)
+	}
+	if len(m.unfence) != 1 {
+		t.Error("the start was not signaled")
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	ok := func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	call := func(token, authorization string) int {
+		req := httptest.NewRequest(http.MethodPost, PromotePath, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		requireToken(token, ok)(rec, req)
+		return rec.Code
+	}
+
+	if code := call("secret", "Bearer secret"); code != http.StatusNoContent {
+		t.Errorf("valid token: status %d", code)
+	}
+	for _, authorization := range []string{"", "Bearer other", "secret", "Basic secret"} {
+		if code := call("secret", authorization); code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status %d, want 401", authorization, code)
+		}
+	}
+	if code := call("", "Bearer "); code != http.StatusUnauthorized {
+		t.Errorf("no token configured: status %d, want 401", code)
+	}
+}
+
+func TestFencingRequiresToken(t *testing.T) {
+	pgdata := t.TempDir()
+	if err := os.WriteFile(filepath.Join(pgdata, "PG_VERSION"), []byte("16\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m := &manager{pgdata: pgdata, apiToken: "secret", fence: make(chan struct{}, 1), unfence: make(chan struct{}, 1)}
+	handler := m.apiHandler()
+	call := func(path, authorization string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("Authorization", authorization)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := call(FencePath, "Bearer other"); code != http.StatusUnauthorized || m.isFenced() {
+		t.Fatalf("fence without the token: status %d, fenced %v", code, m.isFenced())
+	}
+	if code := call(FencePath, "Bearer secret"); code != http.StatusNoContent || !m.isFenced() {
+		t.Fatalf("fence with the token: status %d, fenced %v", code, m.isFenced())
+	}
+	if code := call(UnfencePath, ""); code != http.StatusUnauthorized || !m.isFenced() {
+		t.Errorf("unfence without the token: status %d, fenced %v", code, m.isFenced())
+	}
+}
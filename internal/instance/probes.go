@@ -0,0 +1,104 @@
+package instance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// EnvMaxReplicationLag is the replication lag in bytes above which a
+// replica is not ready. There is no limit when it is unset.
+const EnvMaxReplicationLag = "ATLASDB_MAX_REPLICATION_LAG"
+
+// Exit codes of pg_isready.
+const (
+	pgAccepting = 0
+	pgRejecting = 1
+)
+
+// lagQuery returns whether the instance is a replica and how many bytes
+// of the WAL the primary last reported it has are not replayed yet, empty
+// when the replica does not stream from the primary.
+const lagQuery = `SELECT pg_is_in_recovery(),
+  COALESCE(pg_wal_lsn_diff(r.latest_end_lsn, pg_last_wal_replay_lsn())::bigint::text, '')
+FROM (SELECT 1) AS one LEFT JOIN pg_stat_wal_receiver AS r ON true`
+
+// pgIsReady is the exit code of pg_isready against the local server.
+func pgIsReady(ctx context.Context) int {
+	err := exec.CommandContext(ctx, "pg_isready", "-q", "-h", "127.0.0.1").Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		return -1
+	}
+	return pgAccepting
+}
+
+// checkLive fails when PostgreSQL should run but does not respond at all.
+// A server that is starting up, recovering or shutting down rejects
+// connections and is alive, and so is the instance while the instance
+// manager initializes or demotes it.
+func (m *manager) checkLive(ctx context.Context) error {
+	if !m.isRunning() {
+		return nil
+	}
+	if code := pgIsReady(ctx); code != pgAccepting && code != pgRejecting {
+		return errors.New("postgres does not respond")
+	}
+	return nil
+}
+
+// checkStarted fails until PostgreSQL accepts connections for the first
+// time, the liveness probe only applies afterwards. A fenced instance has
+// started, it is not ready.
+func (m *manager) checkStarted(ctx context.Context) error {
+	if m.isFenced() {
+		return nil
+	}
+	if pgIsReady(ctx) != pgAccepting {
+		return errors.New("postgres does not accept connections yet")
+	}
+	return nil
+}
+
+// checkReady fails while the instance should not receive clients: it does
+// not accept connections, has not reached the target of a point-in-time
+// recovery yet or, as a replica, lags more than maxLag behind the primary.
+func (m *manager) checkReady(ctx context.Context) error {
+	if pgIsReady(ctx) != pgAccepting {
+		return errors.New("postgres does not accept connections")
+	}
+	if _, err := os.Stat(filepath.Join(m.pgdata, "recovery.signal")); err == nil {
+		return errors.New("point-in-time recovery is in progress")
+	}
+	if m.maxLag < 0 {
+		return nil
+	}
+
+	out, err := queryLocal(ctx, lagQuery)
+	if err != nil {
+		return fmt.Errorf("query replication lag: %w", err)
+	}
+	replica, lag, _ := strings.Cut(out, "|")
+	if replica != "t" {
+		return nil
+	}
+	if lag == "" {
+		return errors.New("not streaming from the primary")
+	}
+	bytes, err := strconv.ParseInt(lag, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid replication lag %q: %w", lag, err)
+	}
+	if bytes > m.maxLag {
+		return fmt.Errorf("replication lag of %d bytes exceeds %d", bytes, m.maxLag)
+	}
+	return nil
+}
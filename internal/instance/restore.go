@@ -0,0 +1,245 @@
+package instance
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nikitadada/atlasdb/internal/objectstore"
+)
+
+// Environment describing the recovery target, set by the operator from
+// spec.bootstrap.recovery.
+const (
+	EnvRecoveryBackupID   = "ATLASDB_RECOVERY_BACKUP_ID"
+	EnvRecoveryTargetTime = "ATLASDB_RECOVERY_TARGET_TIME"
+	EnvRecoveryTargetLSN  = "ATLASDB_RECOVERY_TARGET_LSN"
+	EnvRecoveryTargetXID  = "ATLASDB_RECOVERY_TARGET_XID"
+	EnvRecoveryTargetName = "ATLASDB_RECOVERY_TARGET_NAME"
+	EnvRecoveryExclusive  = "ATLASDB_RECOVERY_TARGET_EXCLUSIVE"
+)
+
+// RestoreBackup prepares pgdata for point-in-time recovery: it downloads the
+// base backup preceding the target, then configures restore_command and the
+// recovery target so that PostgreSQL replays archived WAL and promotes once
+// the target is reached. It does nothing if pgdata is already initialized,
+// nor once the cluster was: an empty volume is then cloned from the
+// primary.
+func RestoreBackup(ctx context.Context, pgdata string, instanceManager string) error {
+	if _, err := os.Stat(filepath.Join(pgdata, "PG_VERSION")); err == nil {
+		fmt.Println("PGDATA already initialized, skipping restore")
+		return nil
+	}
+
+	// only the first instance of a new cluster is recovered, the others
+	// are cloned from it
+	if !bootstrapInstance() {
+		fmt.Println("not the first instance of a new cluster, skipping restore")
+		return nil
+	}
+
+	cfg, prefix, err := objectstore.ConfigFromEnv(objectstore.RecoveryEnvPrefix)
+	if err != nil {
+		return err
+	}
+	store, err := objectstore.New(cfg)
+	if err != nil {
+		return err
+	}
+
+	backup, err := chooseBackup(ctx, store, prefix)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restoring base backup %s (end LSN %s)\n", backup.ID, backup.EndLSN)
+
+	body, err := store.Get(ctx, objectstore.BackupKey(prefix, backup.ID, objectstore.BackupDataFile))
+	if err != nil {
+		return fmt.Errorf("download base backup %s: %w", backup.ID, err)
+	}
+	defer func() { _ = body.Close() }()
+
+	if err := extractTarGz(body, pgdata); err != nil {
+		return fmt.Errorf("extract base backup %s: %w", backup.ID, err)
+	}
+	if err := os.Chmod(pgdata, 0o700); err != nil {
+		return err
+	}
+
+	if err := writeRecoveryConfig(pgdata, instanceManager); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(pgdata, "recovery.signal"), nil, 0o600)
+}
+
+// RestoreWAL implements restore_command: it fetches WAL file name into dest.
+// WAL comes from the recovery object store while a new cluster recovers, and
+// from the archive of the cluster for standbys.
+func RestoreWAL(ctx context.Context, name, dest string) error {
+	envPrefix := objectstore.RecoveryEnvPrefix
+	if os.Getenv(envPrefix+objectstore.EnvEndpoint) == "" {
+		envPrefix = objectstore.ArchiveEnvPrefix
+	}
+
+	cfg, prefix, err := objectstore.ConfigFromEnv(envPrefix)
+	if err != nil {
+		return err
+	}
+	store, err := objectstore.New(cfg)
+	if err != nil {
+		return err
+	}
+
+	body, err := store.Get(ctx, objectstore.WALKey(prefix, name))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = body.Close() }()
+
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return err
+	}
+
+	tmp := dest + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, zr); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// chooseBackup returns the requested backup or, by default, the latest one
+// that finished before the target time.
+func chooseBackup(ctx context.Context, store *objectstore.Client, prefix string) (*objectstore.BackupInfo, error) {
+	if id := os.Getenv(EnvRecoveryBackupID); id != "" {
+		backup, err := store.GetBackupInfo(ctx, prefix, id)
+		if errors.Is(err, objectstore.ErrNotFound) {
+			return nil, fmt.Errorf("base backup %s not found in %s", id, prefix)
+		}
+		return backup, err
+	}
+
+	backups, err := store.ListBackups(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var target time.Time
+	if v := os.Getenv(EnvRecoveryTargetTime); v != "" {
+		target, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recovery target time: %w", err)
+		}
+	}
+
+	for i := len(backups) - 1; i >= 0; i-- {
+		if target.IsZero() || backups[i].StopTime.Before(target) {
+			return &backups[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no base backup in %s precedes the recovery target", prefix)
+}
+
+func writeRecoveryConfig(pgdata, instanceManager string) error {
+	settings := []string{
+		fmt.Sprintf("restore_command = '%s wal-restore %%f %%p'", instanceManager),
+	}
+
+	// the API allows a single target, the first one set wins
+	targets := []struct{ setting, env string }{
+		{"recovery_target_time", EnvRecoveryTargetTime},
+		{"recovery_target_lsn", EnvRecoveryTargetLSN},
+		{"recovery_target_xid", EnvRecoveryTargetXID},
+		{"recovery_target_name", EnvRecoveryTargetName},
+	}
+	for _, target := range targets {
+		v := os.Getenv(target.env)
+		if v == "" {
+			continue
+		}
+		settings = append(settings,
+			fmt.Sprintf("%s = '%s'", target.setting, strings.ReplaceAll(v, "'", "''")),
+			"recovery_target_action = 'promote'",
+		)
+		if os.Getenv(EnvRecoveryExclusive) == "true" {
+			settings = append(settings, "recovery_target_inclusive = off")
+		}
+		break
+	}
+
+	return appendAutoConf(pgdata, "point-in-time recovery", settings)
+}
+
+// appendAutoConf adds settings at the end of postgresql.auto.conf, where
+// they take precedence over anything set before.
+func appendAutoConf(pgdata, reason string, settings []string) error {
+	f, err := os.OpenFile(filepath.Join(pgdata, "postgresql.auto.conf"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString("\n# added by atlasdb for " + reason + "\n" + strings.Join(settings, "\n") + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func extractTarGz(r io.Reader, dest string) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dest, filepath.Clean("/"+hdr.Name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o700); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode)&0o700)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				_ = f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
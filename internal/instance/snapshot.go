@@ -0,0 +1,272 @@
+package instance
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// Environment of the snapshot backup Job.
+const (
+	EnvNamespace     = "POD_NAMESPACE"
+	EnvClusterName   = "ATLASDB_CLUSTER_NAME"
+	EnvSnapshotPVCs  = "ATLASDB_SNAPSHOT_PVCS"
+	EnvSnapshotClass = "ATLASDB_SNAPSHOT_CLASS"
+)
+
+// VolumeSnapshotGVK is the CSI snapshot API, which has no Go types in the
+// dependencies of this module.
+var VolumeSnapshotGVK = schema.GroupVersionKind{
+	Group:   "snapshot.storage.k8s.io",
+	Version: "v1",
+	Kind:    "VolumeSnapshot",
+}
+
+// SnapshotResult is written as the termination message of the snapshot
+// backup container for the operator to pick up.
+type SnapshotResult struct {
+	BeginLSN    string    `json:"beginLSN"`
+	BeginWAL    string    `json:"beginWAL"`
+	EndLSN      string    `json:"endLSN"`
+	EndWAL      string    `json:"endWAL"`
+	BackupLabel string    `json:"backupLabel"`
+	Snapshots   []string  `json:"snapshots"`
+	StartTime   time.Time `json:"startTime"`
+	StopTime    time.Time `json:"stopTime"`
+}
+
+// SnapshotName is the VolumeSnapshot taken of pvc for backup id.
+func SnapshotName(backupID, pvc string) string {
+	return backupID + "-" + strings.SplitN(pvc, "-", 2)[0]
+}
+
+// TakeSnapshotBackup takes a consistent online backup of the PVCs of the
+// primary: it calls pg_backup_start, creates a VolumeSnapshot per PVC, waits
+// for them to be ready and calls pg_backup_stop in the same session. The
+// backup label returned by pg_backup_stop has to be put back into PGDATA
+// when a volume is restored from these snapshots.
+func TakeSnapshotBackup(ctx context.Context, terminationLog string) error {
+	id := os.Getenv(EnvBackupID)
+	namespace := os.Getenv(EnvNamespace)
+	pvcs := strings.Split(os.Getenv(EnvSnapshotPVCs), ",")
+	if id == "" || namespace == "" || len(pvcs) == 0 || pvcs[0] == "" {
+		return fmt.Errorf("%s, %s and %s must be set", EnvBackupID, EnvNamespace, EnvSnapshotPVCs)
+	}
+
+	cfg, err := config.GetConfig()
+	if err != nil {
+		return err
+	}
+	k8s, err := client.New(cfg, client.Options{})
+	if err != nil {
+		return err
+	}
+
+	session, err := startPsql(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	result := SnapshotResult{StartTime: time.Now().UTC()}
+
+	row, err := session.QueryRow(fmt.Sprintf(
+		"SELECT l, pg_walfile_name(l) FROM pg_backup_start('%s', true) AS l", id))
+	if err != nil {
+		return fmt.Errorf("pg_backup_start: %w", err)
+	}
+	result.BeginLSN, result.BeginWAL = row[0], row[1]
+
+	for _, pvc := range pvcs {
+		name := SnapshotName(id, pvc)
+		if err := createSnapshot(ctx, k8s, namespace, name, pvc); err != nil {
+			return err
+		}
+		result.Snapshots = append(result.Snapshots, name)
+	}
+
+	for _, name := range result.Snapshots {
+		if err := waitSnapshotReady(ctx, k8s, namespace, name); err != nil {
+			return err
+		}
+	}
+
+	row, err = session.QueryRow("SELECT s.lsn, pg_walfile_name(s.lsn), " +
+		"translate(encode(convert_to(s.labelfile, 'UTF8'), 'base64'), E'\\n', '') " +
+		"FROM pg_backup_stop(true) AS s")
+	if err != nil {
+		return fmt.Errorf("pg_backup_stop: %w", err)
+	}
+	result.EndLSN, result.EndWAL = row[0], row[1]
+
+	label, err := base64.StdEncoding.DecodeString(row[2])
+	if err != nil {
+		return fmt.Errorf("decode backup label: %w", err)
+	}
+	result.BackupLabel = string(label)
+	result.StopTime = time.Now().UTC()
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(terminationLog, data, 0o644)
+}
+
+func createSnapshot(ctx context.Context, k8s client.Client, namespace, name, pvc string) error {
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetGroupVersionKind(VolumeSnapshotGVK)
+	snapshot.SetName(name)
+	snapshot.SetNamespace(namespace)
+	snapshot.SetLabels(map[string]string{
+		"postgresbackup":  os.Getenv(EnvBackupID),
+		"postgrescluster": os.Getenv(EnvClusterName),
+	})
+
+	spec := map[string]any{
+		"source": map[string]any{"persistentVolumeClaimName": pvc},
+	}
+	if class := os.Getenv(EnvSnapshotClass); class != "" {
+		spec["volumeSnapshotClassName"] = class
+	}
+	snapshot.Object["spec"] = spec
+
+	fmt.Printf("creating VolumeSnapshot %s of %s\n", name, pvc)
+	return client.IgnoreAlreadyExists(k8s.Create(ctx, snapshot))
+}
+
+func waitSnapshotReady(ctx context.Context, k8s client.Client, namespace, name string) error {
+	for {
+		snapshot := &unstructured.Unstructured{}
+		snapshot.SetGroupVersionKind(VolumeSnapshotGVK)
+		if err := k8s.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, snapshot); err != nil {
+			return err
+		}
+
+		if msg, found, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message"); found {
+			return fmt.Errorf("VolumeSnapshot %s failed: %s", name, msg)
+		}
+		if ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse"); ready {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// psqlSession keeps a single psql process, and therefore a single database
+// session, open across several queries.
+type psqlSession struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func startPsql(ctx context.Context) (*psqlSession, error) {
+	cmd := exec.CommandContext(ctx, "psql", "-X", "-q", "-A", "-t", "-v", "ON_ERROR_STOP=1", "-d", "postgres")
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start psql: %w", err)
+	}
+
+	return &psqlSession{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+// QueryRow runs a query returning exactly one row and returns its columns.
+func (s *psqlSession) QueryRow(query string) ([]string, error) {
+	if _, err := io.WriteString(s.stdin, query+";\n"); err != nil {
+		return nil, err
+	}
+	line, err := s.stdout.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("psql exited, see its output above: %w", err)
+	}
+	return strings.Split(strings.TrimSuffix(line, "\n"), "|"), nil
+}
+
+func (s *psqlSession) Close() {
+	_ = s.stdin.Close()
+	_ = s.cmd.Wait()
+}
+
+// Modes of PrepareSnapshot.
+const (
+	// PrepareRecovery turns the volume into the first instance of a new
+	// cluster recovering from the recovery object store.
+	PrepareRecovery = "recovery"
+	// PrepareStandby turns the volume into a streaming replica of the
+	// cluster primary.
+	PrepareStandby = "standby"
+)
+
+// Environment of the prepare Job.
+const (
+	EnvBackupLabel = "ATLASDB_BACKUP_LABEL"
+	EnvPrimaryHost = "ATLASDB_PRIMARY_HOST"
+)
+
+// PrepareSnapshot makes a volume restored from a snapshot backup startable:
+// it puts back the backup label and configures the instance to recover, as
+// a new primary or as a standby, before PostgreSQL first starts on it.
+func PrepareSnapshot(pgdata, mode, instanceManager string) error {
+	label := os.Getenv(EnvBackupLabel)
+	if label == "" {
+		return fmt.Errorf("%s must be set", EnvBackupLabel)
+	}
+
+	if err := os.WriteFile(filepath.Join(pgdata, "backup_label"), []byte(label), 0o600); err != nil {
+		return err
+	}
+	// the snapshot was taken from a running server
+	for _, stale := range []string{"postmaster.pid", "standby.signal", "recovery.signal"} {
+		if err := os.Remove(filepath.Join(pgdata, stale)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	switch mode {
+	case PrepareRecovery:
+		if err := writeRecoveryConfig(pgdata, instanceManager); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(pgdata, "recovery.signal"), nil, 0o600)
+
+	case PrepareStandby:
+		settings := []string{
+			fmt.Sprintf("restore_command = '%s wal-restore %%f %%p'", instanceManager),
+			fmt.Sprintf("primary_conninfo = 'host=%s user=postgres'", os.Getenv(EnvPrimaryHost)),
+		}
+		if err := appendAutoConf(pgdata, "standby restored from a volume snapshot", settings); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(pgdata, "standby.signal"), nil, 0o600)
+	}
+
+	return fmt.Errorf("unknown mode %q", mode)
+}
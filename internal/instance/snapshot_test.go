@@ -0,0 +1,47 @@
+package instance
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrepareSnapshotStandby(t *testing.T) {
+	pgdata := t.TempDir()
+	for _, name := range []string{"postmaster.pid", "recovery.signal"} {
+		if err := os.WriteFile(filepath.Join(pgdata, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	label := "START WAL LOCATION: 0/2000028 (file 000000010000000000000002)\n"
+	t.Setenv(EnvBackupLabel, label)
+	t.Setenv(EnvPrimaryHost, "pg-0.pg")
+
+	if err := PrepareSnapshot(pgdata, PrepareStandby, "/controller/instance-manager"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(pgdata, "backup_label"))
+	if err != nil || string(got) != label {
+		t.Errorf("backup_label = %q, %v", got, err)
+	}
+	for _, name := range []string{"postmaster.pid", "recovery.signal"} {
+		if _, err := os.Stat(filepath.Join(pgdata, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(pgdata, "standby.signal")); err != nil {
+		t.Error("standby.signal is missing")
+	}
+
+	conf, _ := os.ReadFile(filepath.Join(pgdata, "postgresql.auto.conf"))
+	if !strings.Contains(string(conf), "primary_conninfo = 'host=pg-0.pg user=postgres'") {
+		t.Errorf("primary_conninfo missing from:\n%s", conf)
+	}
+
+	if err := PrepareSnapshot(pgdata, "bogus", ""); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,164 @@
+package instance
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// APIPort is where the instance manager serves its API.
+const APIPort = 8000
+
+// EnvAPIToken is the token the actions of the API require, sent by the
+// operator as a bearer token. The probes and StatusPath only read and need
+// none.
+const EnvAPIToken = "ATLASDB_API_TOKEN"
+
+// APITokenKey is the key of the token in the Secret of the cluster.
+const APITokenKey = "token"
+
+// Endpoints of the API of the instance manager.
+const (
+	// StatusPath returns the Status of the instance.
+	StatusPath = "/status"
+	// CheckpointPath runs a CHECKPOINT.
+	CheckpointPath = "/checkpoint"
+	// ReloadPath reloads the configuration of PostgreSQL.
+	ReloadPath = "/reload"
+	// PromotePath promotes a replica.
+	PromotePath = "/promote"
+	// DemotePath turns a primary into a replica of the current primary.
+	DemotePath = "/demote"
+	// FencePath stops PostgreSQL and keeps it stopped, across restarts of
+	// the container too, until UnfencePath is called.
+	FencePath = "/fence"
+	// UnfencePath starts PostgreSQL again on a fenced instance.
+	UnfencePath = "/unfence"
+
+	// HealthPath is the liveness probe of the instance.
+	HealthPath = "/healthz"
+	// StartupPath is the startup probe of the instance.
+	StartupPath = "/startupz"
+	// ReadyPath is the readiness probe of the instance.
+	ReadyPath = "/readyz"
+)
+
+// Roles of an instance.
+const (
+	RolePrimary = "primary"
+	RoleReplica = "replica"
+)
+
+// Status is what an instance reports about itself on StatusPath.
+type Status struct {
+	Role    string `json:"role"`
+	Version string `json:"version"`
+	// Timeline is the timeline the instance writes, or receives WAL on.
+	Timeline int64 `json:"timeline"`
+	// LSN is the current WAL position of a primary and the last replayed
+	// position of a replica.
+	LSN string `json:"lsn"`
+	// ConfigHash is the ConfigHash of the files in ConfigDir PostgreSQL
+	// last loaded.
+	ConfigHash string `json:"configHash,omitempty"`
+	// LogicalSlotLag is how far, in bytes of WAL, the consumer of every
+	// logical replication slot of a primary is behind it.
+	LogicalSlotLag map[string]int64 `json:"logicalSlotLag,omitempty"`
+	// Fenced is set, and nothing else, while the instance is fenced and
+	// PostgreSQL does not run.
+	Fenced bool `json:"fenced,omitempty"`
+}
+
+const statusQuery = `SELECT
+  CASE WHEN pg_is_in_recovery() THEN 'replica' ELSE 'primary' END,
+  split_part(current_setting('server_version'), ' ', 1),
+  COALESCE((SELECT received_tli FROM pg_stat_wal_receiver), (SELECT timeline_id FROM pg_control_checkpoint())),
+  CASE WHEN pg_is_in_recovery() THEN pg_last_wal_replay_lsn() ELSE pg_current_wal_lsn() END`
+
+const logicalSlotsQuery = `SELECT slot_name, pg_wal_lsn_diff(pg_current_wal_lsn(), confirmed_flush_lsn)::bigint
+  FROM pg_replication_slots WHERE slot_type = 'logical' AND confirmed_flush_lsn IS NOT NULL`
+
+// GetStatus queries the local PostgreSQL server.
+func GetStatus(ctx context.Context) (*Status, error) {
+	out, err := queryLocal(ctx, statusQuery)
+	if err != nil {
+		return nil, fmt.Errorf("query status: %w", err)
+	}
+
+	fields := strings.Split(out, "|")
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("unexpected status row %q", out)
+	}
+	timeline, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeline %q: %w", fields[2], err)
+	}
+
+	status := &Status{Role: fields[0], Version: fields[1], Timeline: timeline, LSN: fields[3]}
+	if status.Role != RolePrimary {
+		return status, nil
+	}
+
+	out, err = queryLocal(ctx, logicalSlotsQuery)
+	if err != nil {
+		return nil, fmt.Errorf("query logical replication slots: %w", err)
+	}
+	for _, row := range strings.Split(out, "\n") {
+		name, raw, ok := strings.Cut(row, "|")
+		if !ok {
+			continue
+		}
+		lag, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lag of slot %s %q: %w", name, raw, err)
+		}
+		if status.LogicalSlotLag == nil {
+			status.LogicalSlotLag = map[string]int64{}
+		}
+		status.LogicalSlotLag[name] = lag
+	}
+	return status, nil
+}
+
+// ConfigHash identifies the content of the configuration files rendered by
+// the operator, by file name.
+func ConfigHash(files map[string]string) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		_, _ = h.Write([]byte(name + "\x00" + files[name] + "\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// queryLocal runs query as the superuser on the local server over TCP, the
+// socket directory is not shared between containers, and returns its
+// unaligned output.
+func queryLocal(ctx context.Context, query string) (string, error) {
+	return queryHost(ctx, "127.0.0.1", "postgres", query)
+}
+
+// queryHost runs query as the superuser in database db of the server on
+// host and returns its unaligned output.
+func queryHost(ctx context.Context, host, db, query string) (string, error) {
+	cmd := exec.CommandContext(ctx, "psql", "-X", "-q", "-A", "-t", "-v", "ON_ERROR_STOP=1",
+		"-h", host, "-U", "postgres", "-d", db, "-c", query)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
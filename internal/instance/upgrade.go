@@ -0,0 +1,277 @@
+package instance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// upgradeDirName is where a major upgrade works, inside pgdata: the
+	// data volume is mounted there and pg_upgrade --link needs the new
+	// cluster on the same file system as the old one.
+	upgradeDirName = ".atlasdb-upgrade"
+
+	// lostAndFound is created by mkfs at the root of the volume.
+	lostAndFound = "lost+found"
+
+	// swappingMarker is created in the working directory once the old
+	// cluster is moved out of pgdata, before the new one is moved in, and
+	// upgradedMarker once the new one is in: they tell what pgdata holds
+	// when the upgrade was killed midway.
+	swappingMarker = "swapping"
+	upgradedMarker = "upgraded"
+)
+
+// Upgrade upgrades the database cluster in pgdata, which must have been
+// shut down cleanly, to the major version of the PostgreSQL binaries on the
+// PATH with pg_upgrade --link. oldBindir holds the binaries of the version
+// pgdata was written by.
+//
+// The new cluster is created next to the old one and only moved into pgdata
+// once pg_upgrade succeeded. Until then the old cluster is not modified but
+// for the pg_control file pg_upgrade renames, and every failure restores it
+// so that the old version can be started again. An upgrade killed before it
+// could restore it is rolled back by the next one, or by the instance
+// manager before it starts PostgreSQL. A pgdata that was already upgraded
+// is left as is.
+func Upgrade(ctx context.Context, pgdata, oldBindir string) (err error) {
+	cred, err := postgresCredential()
+	if err != nil {
+		return err
+	}
+	m := &manager{pgdata: pgdata, postgresUser: cred}
+	work := filepath.Join(pgdata, upgradeDirName)
+
+	// an attempt killed midway
+	if err := rollbackUpgrade(pgdata); err != nil {
+		return err
+	}
+
+	pgUpgrade, err := exec.LookPath("pg_upgrade")
+	if err != nil {
+		return err
+	}
+	newBindir := filepath.Dir(pgUpgrade)
+
+	oldMajor, err := os.ReadFile(filepath.Join(pgdata, "PG_VERSION"))
+	if err != nil {
+		return err
+	}
+	newMajor, err := binariesMajorVersion(ctx, pgUpgrade)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(oldMajor)) == newMajor {
+		fmt.Printf("the data directory already is at PostgreSQL %s\n", newMajor)
+		return os.RemoveAll(work)
+	}
+	fmt.Printf("upgrading the data directory from PostgreSQL %s to %s\n", strings.TrimSpace(string(oldMajor)), newMajor)
+
+	newData := filepath.Join(work, "new")
+	for _, dir := range []string{work, newData} {
+		if err := os.Mkdir(dir, 0o700); err != nil {
+			return err
+		}
+		if err := m.chown(dir); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, rollbackUpgrade(pgdata))
+		}
+	}()
+
+	checksums, err := m.dataChecksums(ctx, oldBindir)
+	if err != nil {
+		return err
+	}
+	initdbArgs := []string{"-D", newData, "-U", "postgres", "--auth=trust"}
+	if checksums {
+		initdbArgs = append(initdbArgs, "--data-checksums")
+	} else if major, _ := strconv.Atoi(newMajor); major >= 18 {
+		// checksums are enabled by default since 18, pg_upgrade
+		// requires the setting of the old cluster
+		initdbArgs = append(initdbArgs, "--no-data-checksums")
+	}
+	if err := m.command(ctx, filepath.Join(newBindir, "initdb"), initdbArgs...).Run(); err != nil {
+		return fmt.Errorf("initdb: %w", err)
+	}
+
+	upgradeArgs := []string{
+		"--old-bindir", oldBindir, "--new-bindir", newBindir,
+		"--old-datadir", pgdata, "--new-datadir", newData,
+		"--username", "postgres", "--link",
+	}
+	for _, args := range [][]string{append(slices.Clone(upgradeArgs), "--check"), upgradeArgs} {
+		cmd := m.command(ctx, pgUpgrade, args...)
+		// pg_upgrade writes its logs and sockets into the working directory
+		cmd.Dir = work
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("pg_upgrade: %w", err)
+		}
+	}
+
+	// postgresql.conf comes from initdb, renderConfig includes the
+	// configuration of the instance manager again
+	upgraded := &manager{pgdata: newData, postgresUser: cred}
+	for _, name := range []string{"postgresql.auto.conf", "pg_hba.conf"} {
+		data, err := os.ReadFile(filepath.Join(pgdata, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := upgraded.writeFile(name, data); err != nil {
+			return err
+		}
+	}
+
+	if err := swapDataDirs(pgdata, filepath.Join(work, "old"), newData); err != nil {
+		return err
+	}
+
+	// the old files are links to the new ones, removing them frees nothing
+	// but they must not be cloned along with pgdata
+	if err := os.RemoveAll(work); err != nil {
+		fmt.Printf("removing the old data directory: %v\n", err)
+	}
+	fmt.Printf("upgraded the data directory to PostgreSQL %s\n", newMajor)
+	return nil
+}
+
+// binariesMajorVersion is the major version of a PostgreSQL program, which
+// prints e.g. "pg_upgrade (PostgreSQL) 16.4 (Debian 16.4-1.pgdg120+1)".
+func binariesMajorVersion(ctx context.Context, program string) (string, error) {
+	out, err := exec.CommandContext(ctx, program, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s --version: %w", program, err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 3 {
+		return "", fmt.Errorf("unexpected version %q", strings.TrimSpace(string(out)))
+	}
+	major, _, _ := strings.Cut(fields[2], ".")
+	return major, nil
+}
+
+// dataChecksums reports whether the cluster in pgdata has data checksums
+// enabled, which pg_upgrade requires of the new cluster as well.
+func (m *manager) dataChecksums(ctx context.Context, bindir string) (bool, error) {
+	cmd := m.command(ctx, filepath.Join(bindir, "pg_controldata"), "-D", m.pgdata)
+	cmd.Stdout = nil
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	out, err := cmd.Output()
+	if err != nil {
+		return false, fmt.Errorf("pg_controldata: %w", err)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if value, ok := strings.CutPrefix(line, "Data page checksum version:"); ok {
+			return strings.TrimSpace(value) != "0", nil
+		}
+	}
+	return false, fmt.Errorf("pg_controldata reported no data page checksum version")
+}
+
+// swapDataDirs moves the content of pgdata into oldData and the content of
+// newData into pgdata. Either both moves complete or pgdata is restored,
+// now by undoSwap or, if the process is killed, by the next rollbackUpgrade.
+func swapDataDirs(pgdata, oldData, newData string) (err error) {
+	work := filepath.Join(pgdata, upgradeDirName)
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, undoSwap(pgdata, oldData, newData))
+		}
+	}()
+
+	if err := os.Mkdir(oldData, 0o700); err != nil {
+		return err
+	}
+	if err := moveAll(pgdata, oldData, upgradeDirName, lostAndFound); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(work, swappingMarker), nil, 0o600); err != nil {
+		return err
+	}
+	if err := moveAll(newData, pgdata); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(work, upgradedMarker), nil, 0o600)
+}
+
+// undoSwap moves the old cluster back into pgdata wherever swapDataDirs
+// stopped. It can itself be interrupted and run again.
+func undoSwap(pgdata, oldData, newData string) error {
+	work := filepath.Join(pgdata, upgradeDirName)
+	if _, err := os.Stat(oldData); os.IsNotExist(err) {
+		return nil
+	}
+
+	// once the old cluster is out, whatever pgdata holds is the new one
+	marker := filepath.Join(work, swappingMarker)
+	if _, err := os.Stat(marker); err == nil {
+		if err := os.MkdirAll(newData, 0o700); err != nil {
+			return err
+		}
+		if err := moveAll(pgdata, newData, upgradeDirName, lostAndFound); err != nil {
+			return err
+		}
+		if err := os.Remove(marker); err != nil {
+			return err
+		}
+	}
+	return moveAll(oldData, pgdata)
+}
+
+// moveAll renames the entries of from but skip into to.
+func moveAll(from, to string, skip ...string) error {
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if slices.Contains(skip, entry.Name()) {
+			continue
+		}
+		if err := os.Rename(filepath.Join(from, entry.Name()), filepath.Join(to, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackUpgrade makes the old cluster in pgdata startable again after
+// pg_upgrade --link failed or the upgrade was killed, before the new
+// cluster was ever started: the data files are untouched, pg_control was
+// renamed and pgdata may be halfway swapped. An upgrade that completed only
+// has its working directory removed.
+func rollbackUpgrade(pgdata string) error {
+	work := filepath.Join(pgdata, upgradeDirName)
+	if _, err := os.Stat(work); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(work, upgradedMarker)); err == nil {
+		return os.RemoveAll(work)
+	}
+	fmt.Println("rolling back the upgrade")
+
+	if err := undoSwap(pgdata, filepath.Join(work, "old"), filepath.Join(work, "new")); err != nil {
+		return err
+	}
+	control := filepath.Join(pgdata, "global", "pg_control")
+	if _, err := os.Stat(control); os.IsNotExist(err) {
+		if err := os.Rename(control+".old", control); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.RemoveAll(work)
+}
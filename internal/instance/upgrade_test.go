@@ -0,0 +1,160 @@
+package instance
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSwapDataDirs(t *testing.T) {
+	pgdata := t.TempDir()
+	work := filepath.Join(pgdata, upgradeDirName)
+	writeTree(t, pgdata, map[string]string{
+		"PG_VERSION":                        "15",
+		"base/1/1259":                       "old",
+		lostAndFound + "/keep":              "",
+		upgradeDirName + "/new/PG_VERSION":  "16",
+		upgradeDirName + "/new/base/1/1259": "new",
+	})
+
+	if err := swapDataDirs(pgdata, filepath.Join(work, "old"), filepath.Join(work, "new")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, filepath.Join(pgdata, "PG_VERSION")); got != "16" {
+		t.Errorf("PG_VERSION = %q, want 16", got)
+	}
+	if got := readFile(t, filepath.Join(pgdata, "base/1/1259")); got != "new" {
+		t.Errorf("base/1/1259 = %q, want the new cluster's", got)
+	}
+	if got := readFile(t, filepath.Join(work, "old", "PG_VERSION")); got != "15" {
+		t.Errorf("old PG_VERSION = %q, want 15", got)
+	}
+	if _, err := os.Stat(filepath.Join(pgdata, lostAndFound, "keep")); err != nil {
+		t.Errorf("%s moved: %v", lostAndFound, err)
+	}
+}
+
+func TestSwapDataDirsRestoresPGDataOnFailure(t *testing.T) {
+	pgdata := t.TempDir()
+	work := filepath.Join(pgdata, upgradeDirName)
+	writeTree(t, pgdata, map[string]string{
+		"PG_VERSION":                       "15",
+		"base/1/1259":                      "old",
+		upgradeDirName + "/new/PG_VERSION": "16",
+	})
+
+	// the new data directory is missing, the old one was already moved away
+	if err := swapDataDirs(pgdata, filepath.Join(work, "old"), filepath.Join(work, "missing")); err == nil {
+		t.Fatal("swap succeeded without a new data directory")
+	}
+
+	if got := readFile(t, filepath.Join(pgdata, "PG_VERSION")); got != "15" {
+		t.Errorf("PG_VERSION = %q, want the old cluster restored", got)
+	}
+	if got := readFile(t, filepath.Join(pgdata, "base/1/1259")); got != "old" {
+		t.Errorf("base/1/1259 = %q, want the old cluster restored", got)
+	}
+}
+
+func TestRollbackUpgrade(t *testing.T) {
+	pgdata := t.TempDir()
+	writeTree(t, pgdata, map[string]string{
+		"PG_VERSION":                       "15",
+		"global/pg_control.old":            "control",
+		upgradeDirName + "/new/PG_VERSION": "16",
+	})
+
+	if err := rollbackUpgrade(pgdata); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, filepath.Join(pgdata, "global", "pg_control")); got != "control" {
+		t.Errorf("pg_control = %q, want it renamed back", got)
+	}
+	if _, err := os.Stat(filepath.Join(pgdata, upgradeDirName)); !os.IsNotExist(err) {
+		t.Errorf("%s not removed: %v", upgradeDirName, err)
+	}
+}
+
+func TestRollbackInterruptedUpgrade(t *testing.T) {
+	old := func(name string) string { return upgradeDirName + "/old/" + name }
+	for name, tree := range map[string]map[string]string{
+		"killed moving the old cluster out": {
+			"base/1/1259":                      "old",
+			old("PG_VERSION"):                  "15",
+			old("global/pg_control.old"):       "control",
+			upgradeDirName + "/new/PG_VERSION": "16",
+		},
+		"killed moving the new cluster in": {
+			"PG_VERSION":                          "16",
+			old("PG_VERSION"):                     "15",
+			old("base/1/1259"):                    "old",
+			old("global/pg_control.old"):          "control",
+			upgradeDirName + "/new/base/1/1259":   "new",
+			upgradeDirName + "/" + swappingMarker: "",
+		},
+	} {
+		pgdata := t.TempDir()
+		writeTree(t, pgdata, tree)
+		writeTree(t, pgdata, map[string]string{lostAndFound + "/keep": ""})
+
+		if err := rollbackUpgrade(pgdata); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for file, want := range map[string]string{
+			"PG_VERSION":        "15",
+			"base/1/1259":       "old",
+			"global/pg_control": "control",
+		} {
+			if got := readFile(t, filepath.Join(pgdata, file)); got != want {
+				t.Errorf("%s: %s = %q, want the old cluster's %q", name, file, got, want)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(pgdata, upgradeDirName)); !os.IsNotExist(err) {
+			t.Errorf("%s: %s not removed: %v", name, upgradeDirName, err)
+		}
+		if _, err := os.Stat(filepath.Join(pgdata, lostAndFound, "keep")); err != nil {
+			t.Errorf("%s: %s moved: %v", name, lostAndFound, err)
+		}
+	}
+
+	// killed after the swap, the upgrade is complete
+	pgdata := t.TempDir()
+	writeTree(t, pgdata, map[string]string{
+		"PG_VERSION":                          "16",
+		old("PG_VERSION"):                     "15",
+		upgradeDirName + "/" + upgradedMarker: "",
+	})
+	if err := rollbackUpgrade(pgdata); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(pgdata, "PG_VERSION")); got != "16" {
+		t.Errorf("PG_VERSION = %q, want the completed upgrade kept", got)
+	}
+	if _, err := os.Stat(filepath.Join(pgdata, upgradeDirName)); !os.IsNotExist(err) {
+		t.Errorf("%s not removed: %v", upgradeDirName, err)
+	}
+}
@@ -0,0 +1,104 @@
+package instance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Environment of the restore drill check Job.
+const (
+	EnvVerifyAmcheck = "ATLASDB_VERIFY_AMCHECK"
+	EnvVerifySQL     = "ATLASDB_VERIFY_SQL"
+)
+
+// AmcheckName is the name of the pg_amcheck check in the results.
+const AmcheckName = "amcheck"
+
+// SQLCheck is a query run against a restored backup.
+type SQLCheck struct {
+	Name     string  `json:"name"`
+	Database string  `json:"database,omitempty"`
+	Query    string  `json:"query"`
+	Expected *string `json:"expected,omitempty"`
+}
+
+type CheckResult struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+// the termination message of a pod is limited to 4KiB
+const maxCheckMessage = 256
+
+// VerifyBackup runs the checks of a restore drill against the instance
+// PGHOST points to and writes their results as JSON to terminationLog.
+// Failed checks are reported in the results, an error is only returned
+// when the checks could not be run at all.
+func VerifyBackup(ctx context.Context, terminationLog string) error {
+	var checks []SQLCheck
+	if raw := os.Getenv(EnvVerifySQL); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &checks); err != nil {
+			return fmt.Errorf("%s: %w", EnvVerifySQL, err)
+		}
+	}
+
+	var results []CheckResult
+
+	if os.Getenv(EnvVerifyAmcheck) == "true" {
+		fmt.Println("running pg_amcheck")
+		out, err := exec.CommandContext(ctx, "pg_amcheck", "--all", "--install-missing").CombinedOutput()
+		fmt.Print(string(out))
+		results = append(results, checkResult(AmcheckName, err == nil, string(out)))
+	}
+
+	for _, check := range checks {
+		fmt.Printf("running check %s\n", check.Name)
+		results = append(results, runSQLCheck(ctx, check))
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(terminationLog, data, 0o644)
+}
+
+func runSQLCheck(ctx context.Context, check SQLCheck) CheckResult {
+	db := check.Database
+	if db == "" {
+		db = "postgres"
+	}
+
+	cmd := exec.CommandContext(ctx, "psql", "-X", "-q", "-A", "-t", "-v", "ON_ERROR_STOP=1",
+		"-d", db, "-c", check.Query)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return checkResult(check.Name, false, stderr.String())
+	}
+	if check.Expected == nil {
+		return checkResult(check.Name, true, "")
+	}
+
+	got, _, _ := strings.Cut(string(out), "\n")
+	got, _, _ = strings.Cut(got, "|")
+	if got != *check.Expected {
+		return checkResult(check.Name, false, fmt.Sprintf("expected %q, got %q", *check.Expected, got))
+	}
+	return checkResult(check.Name, true, "")
+}
+
+func checkResult(name string, passed bool, message string) CheckResult {
+	message = strings.TrimSpace(message)
+	if len(message) > maxCheckMessage {
+		message = message[:maxCheckMessage] + "..."
+	}
+	return CheckResult{Name: name, Passed: passed, Message: message}
+}
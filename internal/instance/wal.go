@@ -0,0 +1,35 @@
+package instance
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// walSegmentSize is the default --wal-segsize of initdb.
+const walSegmentSize = 16 * 1024 * 1024
+
+// ParseLSN parses the textual X/Y form of a pg_lsn into a byte position.
+func ParseLSN(lsn string) (uint64, error) {
+	hi, lo, ok := strings.Cut(lsn, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid LSN %q", lsn)
+	}
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", lsn, err)
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", lsn, err)
+	}
+	return h<<32 | l, nil
+}
+
+// walFileName returns the name of the WAL segment containing lsn, like
+// pg_walfile_name() does.
+func walFileName(timeline int, lsn uint64) string {
+	const segmentsPerID = 0x100000000 / walSegmentSize
+	segment := lsn / walSegmentSize
+	return fmt.Sprintf("%08X%08X%08X", timeline, segment/segmentsPerID, segment%segmentsPerID)
+}
@@ -0,0 +1,27 @@
+package instance
+
+import "testing"
+
+func TestWALFileName(t *testing.T) {
+	for _, tc := range []struct {
+		timeline int
+		lsn      string
+		want     string
+	}{
+		{1, "0/2000028", "000000010000000000000002"},
+		{1, "0/FF000000", "0000000100000000000000FF"},
+		{3, "1/A0000060", "0000000300000001000000A0"},
+	} {
+		lsn, err := ParseLSN(tc.lsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := walFileName(tc.timeline, lsn); got != tc.want {
+			t.Errorf("walFileName(%d, %s) = %s, want %s", tc.timeline, tc.lsn, got, tc.want)
+		}
+	}
+
+	if _, err := ParseLSN("garbage"); err == nil {
+		t.Error("expected an error for an invalid LSN")
+	}
+}
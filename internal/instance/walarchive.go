@@ -0,0 +1,109 @@
+package instance
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nikitadada/atlasdb/internal/objectstore"
+)
+
+// ArchiveWAL implements archive_command: it compresses the WAL file at
+// walPath (relative to PGDATA, as passed via %p) and uploads it to the object
+// store. Whatever the outcome, the archiver status object is updated so the
+// operator can surface it on the PostgresCluster.
+func ArchiveWAL(ctx context.Context, walPath string) error {
+	cfg, prefix, err := objectstore.ConfigFromEnv(objectstore.ArchiveEnvPrefix)
+	if err != nil {
+		return err
+	}
+
+	store, err := objectstore.New(cfg)
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Base(walPath)
+	archiveErr := uploadWAL(ctx, store, prefix, walPath, name)
+
+	status, err := store.GetArchiverStatus(ctx, prefix)
+	if err != nil || status == nil {
+		status = &objectstore.ArchiverStatus{}
+	}
+
+	now := time.Now().UTC()
+	if archiveErr != nil {
+		status.LastFailedWAL = name
+		status.LastFailedTime = now
+		status.LastError = archiveErr.Error()
+	} else {
+		status.LastArchivedWAL = name
+		status.LastArchivedTime = now
+		status.LastError = ""
+	}
+
+	if err := store.PutArchiverStatus(ctx, prefix, status); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to update archiver status: %v\n", err)
+	}
+
+	return archiveErr
+}
+
+// uploadWAL uploads the segment unless it is archived already. Postgres
+// archives a segment again when it did not see the previous attempt
+// succeed, which is fine, but a different segment under the same key is
+// another cluster archiving to the same path: it is refused rather than
+// overwritten.
+func uploadWAL(ctx context.Context, store *objectstore.Client, prefix, walPath, name string) error {
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		return err
+	}
+
+	key := objectstore.WALKey(prefix, name)
+	archived, err := store.Get(ctx, key)
+	if err == nil {
+		defer func() { _ = archived.Close() }()
+		same, err := sameWAL(archived, data)
+		if err != nil {
+			return fmt.Errorf("read archived %s: %w", name, err)
+		}
+		if !same {
+			return fmt.Errorf("%s is already archived with a different content", key)
+		}
+		return nil
+	}
+	if !errors.Is(err, objectstore.ErrNotFound) {
+		return err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return fmt.Errorf("compress %s: %w", name, err)
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	return store.Put(ctx, key, &buf, int64(buf.Len()))
+}
+
+// sameWAL reports whether the compressed segment archived holds data.
+func sameWAL(archived io.Reader, data []byte) (bool, error) {
+	zr, err := gzip.NewReader(archived)
+	if err != nil {
+		return false, err
+	}
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(content, data), nil
+}
@@ -0,0 +1,83 @@
+package instance
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nikitadada/atlasdb/internal/objectstore"
+)
+
+// memStore is an in-memory bucket serving the gets and puts of the archiver.
+type memStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	puts    int
+}
+
+func (m *memStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch r.Method {
+	case http.MethodPut:
+		m.objects[key], _ = io.ReadAll(r.Body)
+		m.puts++
+	case http.MethodGet:
+		data, ok := m.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	}
+}
+
+func TestUploadWAL(t *testing.T) {
+	mem := &memStore{objects: map[string][]byte{}}
+	srv := httptest.NewServer(mem)
+	defer srv.Close()
+
+	store, err := objectstore.New(objectstore.Config{
+		Endpoint:        srv.URL,
+		Bucket:          "bucket",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const name = "000000010000000000000001"
+	walPath := filepath.Join(t.TempDir(), name)
+	writeWAL := func(content string) {
+		if err := os.WriteFile(walPath, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+
+	writeWAL("segment")
+	if err := uploadWAL(ctx, store, "db/pg", walPath, name); err != nil {
+		t.Fatalf("first upload: %v", err)
+	}
+	// postgres retries a segment it did not see archived
+	if err := uploadWAL(ctx, store, "db/pg", walPath, name); err != nil || mem.puts != 1 {
+		t.Errorf("upload of the same segment: err %v, %d puts, want it to succeed without a put", err, mem.puts)
+	}
+
+	writeWAL("another cluster")
+	if err := uploadWAL(ctx, store, "db/pg", walPath, name); err == nil {
+		t.Error("a different segment overwrote the archived one")
+	}
+	if mem.puts != 1 {
+		t.Errorf("%d puts, want the archived segment kept", mem.puts)
+	}
+}
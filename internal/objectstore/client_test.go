@@ -0,0 +1,109 @@
+package objectstore
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeStore is a tiny in-memory S3 serving path-style requests for one bucket.
+type fakeStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), signAlgorithm+" Credential=key/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/bucket":
+		type item struct{ Key string }
+		var result struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []item
+		}
+		for k := range f.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				result.Contents = append(result.Contents, item{Key: k})
+			}
+		}
+		sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+		_ = xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodPut:
+		f.objects[key], _ = io.ReadAll(r.Body)
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	srv := httptest.NewServer(&fakeStore{objects: map[string][]byte{}})
+	defer srv.Close()
+
+	c, err := New(Config{
+		Endpoint:        srv.URL,
+		Bucket:          "bucket",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, name := range []string{"000000010000000000000002", "000000010000000000000001"} {
+		if err := c.Put(ctx, WALKey("pg", name), strings.NewReader(name), int64(len(name))); err != nil {
+			t.Fatalf("put %s: %v", name, err)
+		}
+	}
+
+	objects, err := c.List(ctx, WALPrefix("pg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || WALName(objects[0].Key) != "000000010000000000000001" {
+		t.Fatalf("unexpected listing: %+v", objects)
+	}
+
+	if err := c.Delete(ctx, objects[0].Key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, objects[0].Key); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	status, err := c.GetArchiverStatus(ctx, "pg")
+	if err != nil || status != nil {
+		t.Fatalf("expected no archiver status, got %v, %v", status, err)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	if got := escape("a b/c+d", false); got != "a%20b/c%2Bd" {
+		t.Errorf("escape path: %s", got)
+	}
+	if got := escape("a/b", true); got != "a%2Fb" {
+		t.Errorf("escape query: %s", got)
+	}
+}
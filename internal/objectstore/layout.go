@@ -0,0 +1,195 @@
+package objectstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Prefixes of the environment variables used to hand an object store
+// configuration to helpers running inside PostgreSQL pods. A pod can need two
+// stores at once: its own archive and the one it recovers from.
+const (
+	ArchiveEnvPrefix  = "ATLASDB_OBJECT_STORE"
+	RecoveryEnvPrefix = "ATLASDB_RECOVERY_OBJECT_STORE"
+	DumpEnvPrefix     = "ATLASDB_DUMP_OBJECT_STORE"
+)
+
+// Suffixes appended to an env prefix.
+const (
+	EnvEndpoint        = "_ENDPOINT"
+	EnvBucket          = "_BUCKET"
+	EnvPath            = "_PATH"
+	EnvRegion          = "_REGION"
+	EnvAccessKeyID     = "_ACCESS_KEY_ID"
+	EnvSecretAccessKey = "_SECRET_ACCESS_KEY"
+)
+
+// Keys of the credentials Secret referenced by an object store spec.
+const (
+	AccessKeyIDKey     = "accessKeyId"
+	SecretAccessKeyKey = "secretAccessKey"
+)
+
+// ConfigFromEnv reads the configuration set by the operator on the pod and
+// returns it together with the key prefix of the cluster.
+func ConfigFromEnv(envPrefix string) (Config, string, error) {
+	cfg := Config{
+		Endpoint:        os.Getenv(envPrefix + EnvEndpoint),
+		Bucket:          os.Getenv(envPrefix + EnvBucket),
+		Region:          os.Getenv(envPrefix + EnvRegion),
+		AccessKeyID:     os.Getenv(envPrefix + EnvAccessKeyID),
+		SecretAccessKey: os.Getenv(envPrefix + EnvSecretAccessKey),
+	}
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return cfg, "", fmt.Errorf("%s and %s must be set", envPrefix+EnvEndpoint, envPrefix+EnvBucket)
+	}
+	return cfg, os.Getenv(envPrefix + EnvPath), nil
+}
+
+// WALKey is where a compressed WAL segment (or history file) is stored.
+func WALKey(prefix, name string) string {
+	return path.Join(prefix, "wals", name+".gz")
+}
+
+// WALPrefix is the key prefix shared by all archived WAL files.
+func WALPrefix(prefix string) string {
+	return path.Join(prefix, "wals") + "/"
+}
+
+// WALName is the inverse of WALKey.
+func WALName(key string) string {
+	return strings.TrimSuffix(path.Base(key), ".gz")
+}
+
+// BackupKey is where file of base backup id is stored.
+func BackupKey(prefix, id, file string) string {
+	return path.Join(prefix, "base", id, file)
+}
+
+// DumpKey is where file of logical dump name is stored.
+func DumpKey(prefix, name, file string) string {
+	return path.Join(prefix, "dumps", name, file)
+}
+
+// Files making up a base backup.
+const (
+	BackupDataFile     = "base.tar.gz"
+	BackupManifestFile = "backup_manifest"
+	backupInfoFile     = "backup.json"
+)
+
+func archiverStatusKey(prefix string) string {
+	return path.Join(prefix, "status", "archiver.json")
+}
+
+// ArchiverStatus is written by the archive helper after every attempt so that
+// the operator can report archiving health without connecting to PostgreSQL.
+type ArchiverStatus struct {
+	LastArchivedWAL  string    `json:"lastArchivedWAL,omitempty"`
+	LastArchivedTime time.Time `json:"lastArchivedTime,omitzero"`
+	LastFailedWAL    string    `json:"lastFailedWAL,omitempty"`
+	LastFailedTime   time.Time `json:"lastFailedTime,omitzero"`
+	LastError        string    `json:"lastError,omitempty"`
+}
+
+// Failing reports whether the most recent archiving attempt failed.
+func (s *ArchiverStatus) Failing() bool {
+	return s.LastFailedTime.After(s.LastArchivedTime)
+}
+
+// GetArchiverStatus returns nil without error if nothing was archived yet.
+func (c *Client) GetArchiverStatus(ctx context.Context, prefix string) (*ArchiverStatus, error) {
+	status := &ArchiverStatus{}
+	err := c.getJSON(ctx, archiverStatusKey(prefix), status)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (c *Client) PutArchiverStatus(ctx context.Context, prefix string, status *ArchiverStatus) error {
+	return c.putJSON(ctx, archiverStatusKey(prefix), status)
+}
+
+// BackupInfo describes a completed base backup. It is uploaded last, so a
+// backup without it is incomplete and must not be restored.
+type BackupInfo struct {
+	ID        string    `json:"id"`
+	Timeline  int       `json:"timeline"`
+	BeginLSN  string    `json:"beginLSN"`
+	EndLSN    string    `json:"endLSN"`
+	BeginWAL  string    `json:"beginWAL"`
+	EndWAL    string    `json:"endWAL"`
+	StartTime time.Time `json:"startTime"`
+	StopTime  time.Time `json:"stopTime"`
+}
+
+// GetBackupInfo returns ErrNotFound if backup id does not exist or is
+// incomplete.
+func (c *Client) GetBackupInfo(ctx context.Context, prefix, id string) (*BackupInfo, error) {
+	info := &BackupInfo{}
+	if err := c.getJSON(ctx, BackupKey(prefix, id, backupInfoFile), info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (c *Client) PutBackupInfo(ctx context.Context, prefix string, info *BackupInfo) error {
+	return c.putJSON(ctx, BackupKey(prefix, info.ID, backupInfoFile), info)
+}
+
+// ListBackups returns the completed base backups under prefix, oldest first.
+func (c *Client) ListBackups(ctx context.Context, prefix string) ([]BackupInfo, error) {
+	objects, err := c.List(ctx, path.Join(prefix, "base")+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []BackupInfo
+	for _, obj := range objects {
+		if path.Base(obj.Key) != backupInfoFile {
+			continue
+		}
+		info := BackupInfo{}
+		if err := c.getJSON(ctx, obj.Key, &info); err != nil {
+			return nil, err
+		}
+		backups = append(backups, info)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].StopTime.Before(backups[j].StopTime)
+	})
+	return backups, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, key string, v any) error {
+	body, err := c.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = body.Close() }()
+
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		return fmt.Errorf("decode %s: %w", key, err)
+	}
+	return nil
+}
+
+func (c *Client) putJSON(ctx context.Context, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Put(ctx, key, strings.NewReader(string(data)), int64(len(data)))
+}
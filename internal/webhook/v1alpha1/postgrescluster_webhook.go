@@ -0,0 +1,289 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	databasesv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+	"github.com/nikitadada/atlasdb/internal/controller/postgres"
+)
+
+// log is for logging in this package.
+var postgresclusterlog = logf.Log.WithName("postgrescluster-resource")
+
+// Defaults of the spec fields.
+const (
+	defaultInstances   = 1
+	defaultStorageSize = "1Gi"
+)
+
+// SetupPostgresClusterWebhookWithManager registers the webhook for PostgresCluster in the manager.
+func SetupPostgresClusterWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr, &databasesv1alpha1.PostgresCluster{}).
+		WithDefaulter(&PostgresClusterCustomDefaulter{}).
+		WithValidator(&PostgresClusterCustomValidator{Client: mgr.GetClient()}).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-databases-atlasdb-io-v1alpha1-postgrescluster,mutating=true,failurePolicy=fail,sideEffects=None,groups=databases.atlasdb.io,resources=postgresclusters,verbs=create;update,versions=v1alpha1,name=mpostgrescluster-v1alpha1.kb.io,admissionReviewVersions=v1
+
+// PostgresClusterCustomDefaulter fills in the spec fields left empty.
+type PostgresClusterCustomDefaulter struct{}
+
+// Default implements admission.Defaulter.
+func (d *PostgresClusterCustomDefaulter) Default(_ context.Context, pg *databasesv1alpha1.PostgresCluster) error {
+	postgresclusterlog.Info("Defaulting for PostgresCluster", "name", pg.GetName())
+
+	if pg.Spec.Instances == 0 {
+		pg.Spec.Instances = defaultInstances
+	}
+	if pg.Spec.Storage.Size == "" {
+		pg.Spec.Storage.Size = defaultStorageSize
+	}
+	if pg.Spec.Version == "" {
+		pg.Spec.Version = postgres.DefaultVersion
+	}
+	if pg.Spec.SuperuserSecretName == "" {
+		pg.Spec.SuperuserSecretName = postgres.DefaultSuperuserSecretName(pg)
+	}
+
+	return nil
+}
+
+// +kubebuilder:webhook:path=/validate-databases-atlasdb-io-v1alpha1-postgrescluster,mutating=false,failurePolicy=fail,sideEffects=None,groups=databases.atlasdb.io,resources=postgresclusters,verbs=create;update;delete,versions=v1alpha1,name=vpostgrescluster-v1alpha1.kb.io,admissionReviewVersions=v1
+// +kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses,verbs=get;list;watch
+
+// PostgresClusterCustomValidator validates PostgresClusters on create,
+// update and delete.
+type PostgresClusterCustomValidator struct {
+	// Client looks up the Secrets and StorageClasses a cluster refers to.
+	Client client.Reader
+}
+
+// ValidateCreate implements admission.Validator.
+func (v *PostgresClusterCustomValidator) ValidateCreate(
+	ctx context.Context,
+	pg *databasesv1alpha1.PostgresCluster,
+) (admission.Warnings, error) {
+	postgresclusterlog.Info("Validation for PostgresCluster upon creation", "name", pg.GetName())
+
+	allErrs := validateSpec(pg)
+
+	refErrs, err := v.validateReferences(ctx, nil, pg)
+	if err != nil {
+		return nil, err
+	}
+	allErrs = append(allErrs, refErrs...)
+
+	return nil, invalid(pg, allErrs)
+}
+
+// ValidateUpdate implements admission.Validator.
+func (v *PostgresClusterCustomValidator) ValidateUpdate(
+	ctx context.Context,
+	oldPG, pg *databasesv1alpha1.PostgresCluster,
+) (admission.Warnings, error) {
+	postgresclusterlog.Info("Validation for PostgresCluster upon update", "name", pg.GetName())
+
+	// a cluster being torn down only needs to be able to change its
+	// deletion settings
+	if !pg.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+
+	allErrs := validateSpec(pg)
+	allErrs = append(allErrs, validateSpecUpdate(oldPG, pg)...)
+
+	refErrs, err := v.validateReferences(ctx, oldPG, pg)
+	if err != nil {
+		return nil, err
+	}
+	allErrs = append(allErrs, refErrs...)
+
+	return nil, invalid(pg, allErrs)
+}
+
+// ValidateDelete implements admission.Validator.
+func (v *PostgresClusterCustomValidator) ValidateDelete(
+	_ context.Context,
+	pg *databasesv1alpha1.PostgresCluster,
+) (admission.Warnings, error) {
+	postgresclusterlog.Info("Validation for PostgresCluster upon deletion", "name", pg.GetName())
+
+	if pg.Spec.DeletionProtection {
+		return nil, fmt.Errorf("PostgresCluster %s has spec.deletionProtection set, disable it first", pg.Name)
+	}
+
+	return nil, nil
+}
+
+// validateSpec checks the fields the controller can not work without.
+func validateSpec(pg *databasesv1alpha1.PostgresCluster) field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if pg.Spec.Instances < 1 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("instances"), pg.Spec.Instances,
+			"must be at least 1"))
+	}
+
+	if _, err := resource.ParseQuantity(pg.Spec.Storage.Size); err != nil {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("storage", "size"), pg.Spec.Storage.Size,
+			err.Error()))
+	}
+
+	if _, err := postgres.MajorVersion(pg.Spec.Version); err != nil {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("version"), pg.Spec.Version, err.Error()))
+	}
+
+	if probes := pg.Spec.Probes; probes != nil && probes.MaxReplicationLag != nil &&
+		probes.MaxReplicationLag.Sign() < 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("probes", "maxReplicationLag"),
+			probes.MaxReplicationLag.String(), "must not be negative"))
+	}
+
+	if upgrade := pg.Spec.MajorUpgrade; upgrade != nil && upgrade.MaxSwitchoverLag != nil &&
+		upgrade.MaxSwitchoverLag.Sign() < 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("majorUpgrade", "maxSwitchoverLag"),
+			upgrade.MaxSwitchoverLag.String(), "must not be negative"))
+	}
+
+	if window := pg.Spec.MaintenanceWindow; window != nil {
+		allErrs = append(allErrs, validateMaintenanceWindow(window, specPath.Child("maintenanceWindow"))...)
+	}
+	if schedule := pg.Spec.HibernationSchedule; schedule != nil {
+		allErrs = append(allErrs, validateMaintenanceWindow(schedule, specPath.Child("hibernationSchedule"))...)
+	}
+
+	return allErrs
+}
+
+func validateMaintenanceWindow(window *databasesv1alpha1.MaintenanceWindowSpec, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if _, err := time.LoadLocation(window.TimeZone); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("timeZone"), window.TimeZone, err.Error()))
+	}
+	if len(window.Windows) == 0 {
+		allErrs = append(allErrs, field.Required(path.Child("windows"), "at least one window is required"))
+	}
+	for i, w := range window.Windows {
+		windowPath := path.Child("windows").Index(i)
+		if _, err := postgres.ParseWeekdays(w.Days); err != nil {
+			allErrs = append(allErrs, field.Invalid(windowPath.Child("days"), w.Days, err.Error()))
+		}
+		if _, err := time.Parse("15:04", w.Start); err != nil {
+			allErrs = append(allErrs, field.Invalid(windowPath.Child("start"), w.Start, "must be a time of day like 02:30"))
+		}
+		if w.Duration.Duration <= 0 {
+			allErrs = append(allErrs, field.Invalid(windowPath.Child("duration"), w.Duration.String(), "must be positive"))
+		}
+	}
+	return allErrs
+}
+
+// validateSpecUpdate checks the changes that would break existing data or
+// volumes.
+func validateSpecUpdate(oldPG, pg *databasesv1alpha1.PostgresCluster) field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if oldPG.Spec.DeletionProtection != pg.Spec.DeletionProtection &&
+		pg.Annotations[databasesv1alpha1.ConfirmDeletionProtectionChangeAnnotation] != "true" {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("deletionProtection"),
+			fmt.Sprintf("changing it requires the %s: \"true\" annotation",
+				databasesv1alpha1.ConfirmDeletionProtectionChangeAnnotation)))
+	}
+
+	oldMajor, oldErr := postgres.MajorVersion(oldPG.Spec.Version)
+	newMajor, newErr := postgres.MajorVersion(pg.Spec.Version)
+	if oldErr == nil && newErr == nil && newMajor < oldMajor {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("version"),
+			fmt.Sprintf("downgrade from PostgreSQL %d to %d is not supported", oldMajor, newMajor)))
+	}
+
+	oldSize, oldErr := resource.ParseQuantity(oldPG.Spec.Storage.Size)
+	newSize, newErr := resource.ParseQuantity(pg.Spec.Storage.Size)
+	if oldErr == nil && newErr == nil && newSize.Cmp(oldSize) < 0 {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("storage", "size"),
+			fmt.Sprintf("volumes can not shrink from %s to %s", oldPG.Spec.Storage.Size, pg.Spec.Storage.Size)))
+	}
+
+	if oldPG.Spec.Storage.StorageClassName != pg.Spec.Storage.StorageClassName {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("storage", "storageClassName"),
+			"can not be changed"))
+	}
+
+	return allErrs
+}
+
+// validateReferences checks that the Secret and StorageClass pg refers to
+// exist. On update only the references that changed are checked, so that
+// a cluster is not locked when one of them is removed later.
+func (v *PostgresClusterCustomValidator) validateReferences(
+	ctx context.Context,
+	oldPG, pg *databasesv1alpha1.PostgresCluster,
+) (field.ErrorList, error) {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	secretName := pg.Spec.SuperuserSecretName
+	if secretName != postgres.DefaultSuperuserSecretName(pg) &&
+		(oldPG == nil || oldPG.Spec.SuperuserSecretName != secretName) {
+		err := v.Client.Get(ctx, types.NamespacedName{Namespace: pg.Namespace, Name: secretName}, &corev1.Secret{})
+		if apierrors.IsNotFound(err) {
+			allErrs = append(allErrs, field.NotFound(specPath.Child("superuserSecretName"), secretName))
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	className := pg.Spec.Storage.StorageClassName
+	if className != "" && (oldPG == nil || oldPG.Spec.Storage.StorageClassName != className) {
+		err := v.Client.Get(ctx, types.NamespacedName{Name: className}, &storagev1.StorageClass{})
+		if apierrors.IsNotFound(err) {
+			allErrs = append(allErrs, field.NotFound(specPath.Child("storage", "storageClassName"), className))
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return allErrs, nil
+}
+
+func invalid(pg *databasesv1alpha1.PostgresCluster, allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(
+		schema.GroupKind{Group: databasesv1alpha1.GroupVersion.Group, Kind: "PostgresCluster"},
+		pg.Name, allErrs)
+}
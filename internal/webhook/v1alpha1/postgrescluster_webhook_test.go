@@ -0,0 +1,244 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	databasesv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+var _ = Describe("PostgresCluster Webhook", func() {
+	var (
+		ctx       context.Context
+		obj       *databasesv1alpha1.PostgresCluster
+		oldObj    *databasesv1alpha1.PostgresCluster
+		validator PostgresClusterCustomValidator
+		defaulter PostgresClusterCustomDefaulter
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		obj = &databasesv1alpha1.PostgresCluster{
+			ObjectMeta: metav1.ObjectMeta{Name: "pg", Namespace: "default"},
+			Spec: databasesv1alpha1.PostgresClusterSpec{
+				Instances:           1,
+				Version:             "15",
+				Storage:             databasesv1alpha1.StorageSpec{Size: "1Gi"},
+				SuperuserSecretName: "pg-superuser",
+			},
+		}
+		oldObj = obj.DeepCopy()
+
+		scheme := runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+		validator = PostgresClusterCustomValidator{
+			Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+				&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "custom-secret", Namespace: "default"}},
+				&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "fast"}},
+			).Build(),
+		}
+		defaulter = PostgresClusterCustomDefaulter{}
+	})
+
+	Context("When creating PostgresCluster under Defaulting Webhook", func() {
+		It("Should fill in the empty fields", func() {
+			obj.Spec = databasesv1alpha1.PostgresClusterSpec{}
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Spec.Instances).To(Equal(int32(1)))
+			Expect(obj.Spec.Storage.Size).To(Equal("1Gi"))
+			Expect(obj.Spec.Version).To(Equal("15"))
+			Expect(obj.Spec.SuperuserSecretName).To(Equal("pg-superuser"))
+		})
+
+		It("Should keep the fields that are set", func() {
+			obj.Spec.Instances = 3
+			obj.Spec.SuperuserSecretName = "custom-secret"
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Spec.Instances).To(Equal(int32(3)))
+			Expect(obj.Spec.SuperuserSecretName).To(Equal("custom-secret"))
+		})
+	})
+
+	Context("When creating PostgresCluster under Validating Webhook", func() {
+		It("Should admit a valid cluster", func() {
+			Expect(validator.ValidateCreate(ctx, obj)).Error().NotTo(HaveOccurred())
+		})
+
+		It("Should deny a malformed storage size", func() {
+			obj.Spec.Storage.Size = "1 gigabyte"
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("spec.storage.size")))
+		})
+
+		It("Should deny a malformed version", func() {
+			obj.Spec.Version = "latest"
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("spec.version")))
+		})
+
+		It("Should deny a missing superuser Secret", func() {
+			obj.Spec.SuperuserSecretName = "missing"
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("spec.superuserSecretName")))
+
+			obj.Spec.SuperuserSecretName = "custom-secret"
+			Expect(validator.ValidateCreate(ctx, obj)).Error().NotTo(HaveOccurred())
+		})
+
+		It("Should deny a missing StorageClass", func() {
+			obj.Spec.Storage.StorageClassName = "missing"
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("spec.storage.storageClassName")))
+
+			obj.Spec.Storage.StorageClassName = "fast"
+			Expect(validator.ValidateCreate(ctx, obj)).Error().NotTo(HaveOccurred())
+		})
+
+		It("Should deny a negative replication lag", func() {
+			obj.Spec.Probes = &databasesv1alpha1.ProbesSpec{MaxReplicationLag: ptr.To(resource.MustParse("-1Mi"))}
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("spec.probes.maxReplicationLag")))
+		})
+
+		It("Should deny a negative switchover lag", func() {
+			obj.Spec.MajorUpgrade = &databasesv1alpha1.MajorUpgradeSpec{
+				Method:           databasesv1alpha1.MajorUpgradeBlueGreen,
+				MaxSwitchoverLag: ptr.To(resource.MustParse("-1Mi")),
+			}
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("spec.majorUpgrade.maxSwitchoverLag")))
+		})
+
+		It("Should admit a maintenance window", func() {
+			obj.Spec.MaintenanceWindow = &databasesv1alpha1.MaintenanceWindowSpec{
+				TimeZone: "Europe/Berlin",
+				Windows: []databasesv1alpha1.MaintenanceWindow{
+					{Days: "Sat,Sun", Start: "02:00", Duration: metav1.Duration{Duration: 3 * time.Hour}},
+				},
+			}
+			Expect(validator.ValidateCreate(ctx, obj)).Error().NotTo(HaveOccurred())
+		})
+
+		It("Should deny an invalid maintenance window", func() {
+			obj.Spec.MaintenanceWindow = &databasesv1alpha1.MaintenanceWindowSpec{
+				TimeZone: "Mars/Olympus",
+				Windows:  []databasesv1alpha1.MaintenanceWindow{{Days: "Mon-Funday", Start: "02:00"}},
+			}
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("spec.maintenanceWindow.timeZone")))
+			Expect(err).To(MatchError(ContainSubstring("spec.maintenanceWindow.windows[0].days")))
+			Expect(err).To(MatchError(ContainSubstring("spec.maintenanceWindow.windows[0].duration")))
+		})
+
+		It("Should deny an invalid hibernation schedule", func() {
+			obj.Spec.HibernationSchedule = &databasesv1alpha1.MaintenanceWindowSpec{
+				Windows: []databasesv1alpha1.MaintenanceWindow{
+					{Days: "Mon-Fri", Start: "20:00", Duration: metav1.Duration{Duration: 12 * time.Hour}},
+					{Days: "Sat-Sun", Start: "24:00", Duration: metav1.Duration{Duration: 24 * time.Hour}},
+				},
+			}
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("spec.hibernationSchedule.windows[1].start")))
+		})
+	})
+
+	Context("When updating PostgresCluster under Validating Webhook", func() {
+		It("Should deny a major version downgrade", func() {
+			oldObj.Spec.Version = "16.4"
+			obj.Spec.Version = "15.8"
+			_, err := validator.ValidateUpdate(ctx, oldObj, obj)
+			Expect(err).To(MatchError(ContainSubstring("downgrade")))
+		})
+
+		It("Should allow minor version changes and upgrades", func() {
+			oldObj.Spec.Version = "15.8"
+			obj.Spec.Version = "15.2-alpine"
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).Error().NotTo(HaveOccurred())
+
+			obj.Spec.Version = "16"
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).Error().NotTo(HaveOccurred())
+		})
+
+		It("Should deny shrinking the storage", func() {
+			oldObj.Spec.Storage.Size = "2Gi"
+			obj.Spec.Storage.Size = "1500Mi"
+			_, err := validator.ValidateUpdate(ctx, oldObj, obj)
+			Expect(err).To(MatchError(ContainSubstring("shrink")))
+
+			obj.Spec.Storage.Size = "4Gi"
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).Error().NotTo(HaveOccurred())
+		})
+
+		It("Should deny changing the StorageClass", func() {
+			obj.Spec.Storage.StorageClassName = "fast"
+			_, err := validator.ValidateUpdate(ctx, oldObj, obj)
+			Expect(err).To(MatchError(ContainSubstring("spec.storage.storageClassName")))
+		})
+	})
+
+	Context("When deletion protection is enabled", func() {
+		BeforeEach(func() {
+			obj.Spec.DeletionProtection = true
+		})
+
+		It("Should deny deletion", func() {
+			_, err := validator.ValidateDelete(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("deletionProtection")))
+		})
+
+		It("Should allow deletion once it is disabled", func() {
+			obj.Spec.DeletionProtection = false
+			Expect(validator.ValidateDelete(ctx, obj)).Error().NotTo(HaveOccurred())
+		})
+	})
+
+	Context("When changing deletion protection", func() {
+		It("Should deny the change without the confirmation annotation", func() {
+			obj.Spec.DeletionProtection = true
+			_, err := validator.ValidateUpdate(ctx, oldObj, obj)
+			Expect(err).To(MatchError(ContainSubstring(databasesv1alpha1.ConfirmDeletionProtectionChangeAnnotation)))
+		})
+
+		It("Should allow the change with the confirmation annotation", func() {
+			oldObj.Spec.DeletionProtection = true
+			obj.Annotations = map[string]string{
+				databasesv1alpha1.ConfirmDeletionProtectionChangeAnnotation: "true",
+			}
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).Error().NotTo(HaveOccurred())
+		})
+
+		It("Should allow other updates without the annotation", func() {
+			obj.Spec.DeletionProtection = true
+			oldObj.Spec.DeletionProtection = true
+			obj.Spec.Instances = 3
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).Error().NotTo(HaveOccurred())
+		})
+	})
+})
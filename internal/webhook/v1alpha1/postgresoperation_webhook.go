@@ -0,0 +1,99 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	databasesv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+var postgresoperationlog = logf.Log.WithName("postgresoperation-resource")
+
+// SetupPostgresOperationWebhookWithManager registers the webhook for PostgresOperation in the manager.
+func SetupPostgresOperationWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr, &databasesv1alpha1.PostgresOperation{}).
+		WithDefaulter(&PostgresOperationCustomDefaulter{}).
+		WithValidator(&PostgresOperationCustomValidator{}).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-databases-atlasdb-io-v1alpha1-postgresoperation,mutating=true,failurePolicy=fail,sideEffects=None,groups=databases.atlasdb.io,resources=postgresoperations,verbs=create,versions=v1alpha1,name=mpostgresoperation-v1alpha1.kb.io,admissionReviewVersions=v1
+
+// PostgresOperationCustomDefaulter records who created an operation. The
+// spec is immutable afterwards, so spec.requestedBy can be trusted.
+type PostgresOperationCustomDefaulter struct{}
+
+// Default implements admission.Defaulter.
+func (d *PostgresOperationCustomDefaulter) Default(ctx context.Context, op *databasesv1alpha1.PostgresOperation) error {
+	postgresoperationlog.Info("Defaulting for PostgresOperation", "name", op.GetName())
+
+	// a value set by the creator is left for the validator to refuse
+	if op.Spec.RequestedBy != "" {
+		return nil
+	}
+	if req, err := admission.RequestFromContext(ctx); err == nil {
+		op.Spec.RequestedBy = req.UserInfo.Username
+	}
+
+	return nil
+}
+
+// +kubebuilder:webhook:path=/validate-databases-atlasdb-io-v1alpha1-postgresoperation,mutating=false,failurePolicy=fail,sideEffects=None,groups=databases.atlasdb.io,resources=postgresoperations,verbs=create,versions=v1alpha1,name=vpostgresoperation-v1alpha1.kb.io,admissionReviewVersions=v1
+
+// PostgresOperationCustomValidator refuses operations whose spec.requestedBy
+// is not the user creating them. The other rules of the spec are CEL rules
+// of the CRD.
+type PostgresOperationCustomValidator struct{}
+
+// ValidateCreate implements admission.Validator.
+func (v *PostgresOperationCustomValidator) ValidateCreate(
+	ctx context.Context,
+	op *databasesv1alpha1.PostgresOperation,
+) (admission.Warnings, error) {
+	postgresoperationlog.Info("Validation for PostgresOperation upon creation", "name", op.GetName())
+
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if op.Spec.RequestedBy != req.UserInfo.Username {
+		return nil, fmt.Errorf("spec.requestedBy is recorded by the operator, it can not be set to %q", op.Spec.RequestedBy)
+	}
+	return nil, nil
+}
+
+// ValidateUpdate implements admission.Validator. The spec is immutable.
+func (v *PostgresOperationCustomValidator) ValidateUpdate(
+	_ context.Context,
+	_, _ *databasesv1alpha1.PostgresOperation,
+) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// ValidateDelete implements admission.Validator.
+func (v *PostgresOperationCustomValidator) ValidateDelete(
+	_ context.Context,
+	_ *databasesv1alpha1.PostgresOperation,
+) (admission.Warnings, error) {
+	return nil, nil
+}
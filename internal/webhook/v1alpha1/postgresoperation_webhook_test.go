@@ -0,0 +1,78 @@
+/*
+Copyright 2026.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	databasesv1alpha1 "github.com/nikitadada/atlasdb/api/v1alpha1"
+)
+
+var _ = Describe("PostgresOperation Webhook", func() {
+	var (
+		obj       *databasesv1alpha1.PostgresOperation
+		defaulter PostgresOperationCustomDefaulter
+		validator PostgresOperationCustomValidator
+		ctx       context.Context
+	)
+
+	BeforeEach(func() {
+		obj = &databasesv1alpha1.PostgresOperation{
+			ObjectMeta: metav1.ObjectMeta{Name: "switchover", Namespace: "default"},
+			Spec: databasesv1alpha1.PostgresOperationSpec{
+				ClusterName: "pg",
+				Type:        databasesv1alpha1.OperationTypeSwitchover,
+			},
+		}
+		defaulter = PostgresOperationCustomDefaulter{}
+		validator = PostgresOperationCustomValidator{}
+		ctx = admission.NewContextWithRequest(context.Background(), admission.Request{
+			AdmissionRequest: admissionv1.AdmissionRequest{
+				UserInfo: authenticationv1.UserInfo{Username: "alice@example.com"},
+			},
+		})
+	})
+
+	Context("When creating PostgresOperation under Defaulting Webhook", func() {
+		It("Should record the user who created it", func() {
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Spec.RequestedBy).To(Equal("alice@example.com"))
+		})
+	})
+
+	Context("When creating PostgresOperation under Validating Webhook", func() {
+		It("Should admit the operation recorded as requested by its creator", func() {
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(validator.ValidateCreate(ctx, obj)).Error().NotTo(HaveOccurred())
+		})
+
+		It("Should deny a requestedBy set to another user", func() {
+			obj.Spec.RequestedBy = "someone-else"
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Spec.RequestedBy).To(Equal("someone-else"))
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("spec.requestedBy")))
+		})
+	})
+})